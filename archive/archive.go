@@ -0,0 +1,281 @@
+package archive
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/meteorhacks/kdb"
+	"github.com/meteorhacks/kdb/dbucket"
+	"github.com/meteorhacks/kdb/mindex"
+	"github.com/meteorhacks/kdb/pslice"
+	"github.com/meteorhacks/kdb/rblock"
+	"github.com/meteorhacks/kdb/sindex"
+)
+
+var (
+	ErrArchiveNotFound   = errors.New("archive is not found")
+	ErrArchiveMissingIdx = errors.New("archive does not have an index file")
+	ErrMountSparse       = errors.New("buckets with sparse records can't be mounted")
+)
+
+// Archiver stores bucket files somewhere else before they get removed.
+// Each bucket is stored as a single file with all bucket files (index,
+// metadata and segments) so it can be used without restoring it.
+type Archiver interface {
+	// Archive stores all files in bucket directory `dir` with given name
+	Archive(name, dir string) (err error)
+
+	// Open returns an archive stored with given name
+	// returns ErrArchiveNotFound if it's not available
+	Open(name string) (file File, err error)
+}
+
+// File is an archive file which can be read from any position
+type File interface {
+	io.ReaderAt
+	io.Closer
+
+	// Size returns the size of the archive in bytes
+	Size() (size int64)
+}
+
+// Bucket is an archived bucket mounted for read only queries
+// the archive file is closed when the bucket is closed
+type Bucket struct {
+	*dbucket.DBucket
+	file File
+}
+
+func (bkt *Bucket) Close() (err error) {
+	if err := bkt.DBucket.Close(); err != nil {
+		return err
+	}
+
+	return bkt.file.Close()
+}
+
+// Write writes all files in bucket directory `dir` to `w` as a tar archive
+// file paths are stored relative to `dir` (ex: "index", "block_1")
+func Write(w io.Writer, dir string) (err error) {
+	tw := tar.NewWriter(w)
+
+	err = filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, fpath)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		file, err := os.Open(fpath)
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+
+		_, err = io.CopyN(tw, file, info.Size())
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// Mount opens an archived bucket for read only queries without restoring
+// bucket files. `BaseTime`, `IndexDepth`, `PayloadSize` and `SegmentSize`
+// options are required. Bucket duration and resolution are loaded from the
+// archive if available. Only buckets with fixed size records can be mounted.
+func Mount(a Archiver, name string, opts dbucket.Options) (bkt *Bucket, err error) {
+	file, err := a.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	bkt, err = mount(file, opts)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return bkt, nil
+}
+
+func mount(file File, opts dbucket.Options) (bkt *Bucket, err error) {
+	files, err := readFiles(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if r, ok := files["options"]; ok {
+		stored, err := pslice.Load(r, dbucket.OptionsCount)
+		if err != nil {
+			return nil, err
+		}
+
+		opts = dbucket.StoredOptions(opts, stored)
+	}
+
+	if opts.SparseRecords {
+		return nil, ErrMountSparse
+	}
+
+	r, ok := files["index"]
+	if !ok {
+		return nil, ErrArchiveMissingIdx
+	}
+
+	index, err := mountIndex(files, r, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// segment files are named as block_1, block_2, ...
+	// and presence files as presence_1, presence_2, ...
+	segments := numbered(files, "block_")
+	presence := numbered(files, "presence_")
+
+	block := rblock.NewWithFiles(rblock.Options{
+		PayloadSize:  opts.PayloadSize,
+		PayloadCount: dbucket.PayloadCount(opts),
+		SegmentSize:  opts.SegmentSize,
+	}, segments, presence)
+
+	opts.ReadOnly = true
+	bkt = &Bucket{
+		DBucket: dbucket.NewWithData(opts, index, block),
+		file:    file,
+	}
+
+	return bkt, nil
+}
+
+// mountIndex creates the index using the sealed index if it's available
+// and created with the archived index file (see dbucket.Seal)
+func mountIndex(files map[string]*io.SectionReader, r *io.SectionReader, opts dbucket.Options) (index kdb.Index, err error) {
+	if sr, ok := files["index_sealed"]; ok {
+		data, err := readAll(sr)
+		if err != nil {
+			return nil, err
+		}
+
+		sealed, err := sindex.NewFromData(sindex.Options{
+			IndexSize: r.Size(),
+			Labels:    opts.Labels,
+		}, data)
+
+		if err == nil {
+			return sealed, nil
+		}
+	}
+
+	data, err := readAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return mindex.NewMIndexFromData(mindex.MIndexOpts{
+		IndexDepth: opts.IndexDepth,
+		Labels:     opts.Labels,
+	}, data)
+}
+
+func readAll(r *io.SectionReader) (data []byte, err error) {
+	data = make([]byte, r.Size())
+	if _, err := r.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// numbered returns files named with a prefix and a number by the number
+func numbered(files map[string]*io.SectionReader, prefix string) (res map[int64]io.ReaderAt) {
+	res = make(map[int64]io.ReaderAt)
+	for fname, r := range files {
+		if !strings.HasPrefix(fname, prefix) {
+			continue
+		}
+
+		n, err := strconv.ParseInt(fname[len(prefix):], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		res[n] = r
+	}
+
+	return res
+}
+
+// readFiles finds the position of each file in the archive
+// files are stored uncompressed so they can be read directly
+func readFiles(file File) (files map[string]*io.SectionReader, err error) {
+	files = make(map[string]*io.SectionReader)
+	pr := &posReader{r: io.NewSectionReader(file, 0, file.Size())}
+	tr := tar.NewReader(pr)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// the tar reader has read the header but not the file content
+		files[hdr.Name] = io.NewSectionReader(file, pr.pos, hdr.Size)
+	}
+
+	return files, nil
+}
+
+// posReader keeps track of the current read position
+// it can seek so file content can be skipped without reading it
+type posReader struct {
+	r   *io.SectionReader
+	pos int64
+}
+
+func (pr *posReader) Read(p []byte) (n int, err error) {
+	n, err = pr.r.Read(p)
+	pr.pos += int64(n)
+	return n, err
+}
+
+func (pr *posReader) Seek(offset int64, whence int) (pos int64, err error) {
+	pos, err = pr.r.Seek(offset, whence)
+	if err == nil {
+		pr.pos = pos
+	}
+
+	return pos, err
+}
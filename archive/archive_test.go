@@ -0,0 +1,168 @@
+package archive
+
+import (
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+
+	"github.com/meteorhacks/kdb/dbucket"
+	"github.com/meteorhacks/kdb/sindex"
+)
+
+func TestArchiveAndMount(t *testing.T) {
+	defer cleanTestFiles()
+	cleanTestFiles()
+
+	opts := testOptions()
+	bkt, err := dbucket.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vals := []string{"a", "b", "c", "d"}
+	pld := []byte{1, 2, 3, 4}
+
+	// write enough records to use more than one segment
+	for i := 0; i < 15; i++ {
+		vals[3] = string('a' + rune(i))
+		if err := bkt.Put(int64(i*10), vals, pld); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := bkt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &LocalArchiver{Path: "/tmp/test-archive/archives"}
+	if err := a.Archive("test_0", dbucket.Path(opts)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Mount(a, "test_1000", opts); err != ErrArchiveNotFound {
+		t.Fatal("should return correct error")
+	}
+
+	// bucket files should not be needed after archiving
+	if err := os.RemoveAll(dbucket.Path(opts)); err != nil {
+		t.Fatal(err)
+	}
+
+	mounted, err := Mount(a, "test_0", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mounted.Close()
+
+	vals[3] = string('a' + rune(12))
+	res, err := mounted.Get(100, 130, vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := [][]byte{{0, 0, 0, 0}, {0, 0, 0, 0}, pld}
+	if !reflect.DeepEqual(res, exp) {
+		t.Fatal("incorrect results")
+	}
+
+	found, err := mounted.Find(0, 150, []string{"a", "b", "c", ""})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(found) != 15 {
+		t.Fatal("incorrect number of results")
+	}
+
+	if err := mounted.Put(0, vals, pld); err != dbucket.ErrWriteOnReadOnly {
+		t.Fatal("should return correct error")
+	}
+}
+
+func TestMountSealed(t *testing.T) {
+	defer cleanTestFiles()
+	cleanTestFiles()
+
+	opts := testOptions()
+	bkt, err := dbucket.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vals := []string{"a", "b", "c", "d"}
+	pld := []byte{1, 2, 3, 4}
+
+	if err := bkt.Put(10, vals, pld); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bkt.Seal(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bkt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &LocalArchiver{Path: "/tmp/test-archive/archives"}
+	if err := a.Archive("test_0", dbucket.Path(opts)); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := a.Open("test_0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	files, err := readFiles(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := mountIndex(files, files["index"], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer index.Close()
+
+	if _, ok := index.(*sindex.SIndex); !ok {
+		t.Fatal("should use the sealed index")
+	}
+
+	mounted, err := Mount(a, "test_0", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer mounted.Close()
+
+	res, err := mounted.Get(0, 20, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{{0, 0, 0, 0}, pld}) {
+		t.Fatal("incorrect results")
+	}
+}
+
+// ---------- //
+
+func testOptions() (opts dbucket.Options) {
+	return dbucket.Options{
+		DatabaseName:   "test",
+		DataPath:       "/tmp/test-archive",
+		IndexDepth:     4,
+		PayloadSize:    4,
+		BucketDuration: 1000,
+		Resolution:     10,
+		SegmentSize:    10,
+		BaseTime:       0,
+	}
+}
+
+func cleanTestFiles() {
+	cmd := exec.Command("rm", "-rf", "/tmp/test-archive")
+	cmd.Run()
+}
@@ -0,0 +1,83 @@
+package archive
+
+import (
+	"os"
+	"path"
+)
+
+const (
+	// default permissions used when creating archive files
+	FilePermissions = 0744
+)
+
+// LocalArchiver stores archives as files in a local directory
+// * archive file path: ARCHIVE_PATH/NAME.tar
+type LocalArchiver struct {
+	// place to store archive files
+	Path string
+}
+
+// Archive writes the archive to a temporary file and renames it when
+// completed so an incomplete archive is never available with `Open`
+func (a *LocalArchiver) Archive(name, dir string) (err error) {
+	fpath := path.Join(a.Path, name+".tar")
+	tmp := path.Join(path.Dir(fpath), "."+path.Base(fpath)+".tmp")
+
+	if err := os.MkdirAll(path.Dir(fpath), FilePermissions); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, FilePermissions)
+	if err != nil {
+		return err
+	}
+
+	if err := Write(file, dir); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, fpath)
+}
+
+func (a *LocalArchiver) Open(name string) (file File, err error) {
+	fpath := path.Join(a.Path, name+".tar")
+
+	f, err := os.Open(fpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = ErrArchiveNotFound
+		}
+
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &localFile{f, info.Size()}, nil
+}
+
+type localFile struct {
+	*os.File
+	size int64
+}
+
+func (f *localFile) Size() (size int64) {
+	return f.size
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meteorhacks/kdb/dbase"
+	"github.com/meteorhacks/kdb/ingest"
+	"github.com/meteorhacks/kdb/metrics"
+	"github.com/meteorhacks/kdb/payload"
+	"github.com/meteorhacks/kdb/prom"
+	"github.com/meteorhacks/kdb/query"
+	"github.com/meteorhacks/kdb/replica"
+)
+
+var commands = map[string]func(args []string) (err error){
+	"leader":     runLeader,
+	"follower":   runFollower,
+	"prometheus": runPrometheus,
+	"ingest":     runIngest,
+	"query":      runQuery,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+
+	if err := cmd(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: kdb <command> [options]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  leader      accept data points from stdin and replicate to followers")
+	fmt.Fprintln(os.Stderr, "  follower    replicate data points from a leader")
+	fmt.Fprintln(os.Stderr, "  prometheus  serve prometheus remote_write and remote_read requests")
+	fmt.Fprintln(os.Stderr, "  ingest      accept influx line protocol or graphite plaintext")
+	fmt.Fprintln(os.Stderr, "  query       run queries from stdin (ex: {level0=\"app\"}[1h] | avg(1m))")
+	os.Exit(2)
+}
+
+// error handling used with flag sets of commands
+// commands exit on errors and when help is requested
+var flagErrors = flag.ExitOnError
+
+// newFlagSet creates the flag set of a command
+func newFlagSet(name string) (fs *flag.FlagSet) {
+	return flag.NewFlagSet(name, flagErrors)
+}
+
+// dbFlags adds flags required to open a database to the flag set
+func dbFlags(fs *flag.FlagSet) (opts *dbase.Options) {
+	opts = &dbase.Options{}
+	fs.StringVar(&opts.DatabaseName, "name", "kdb", "database name")
+	fs.StringVar(&opts.DataPath, "path", "/tmp/kdb", "data path")
+	fs.Int64Var(&opts.IndexDepth, "depth", 4, "index depth")
+	fs.BoolVar(&opts.Labels, "label-index", false, "index series by name=value labels (depth is not used)")
+	fs.Int64Var(&opts.PayloadSize, "payload", 4, "payload size in bytes")
+	fs.Int64Var(&opts.BucketDuration, "duration", int64(time.Hour), "bucket duration in nano seconds")
+	fs.Int64Var(&opts.Resolution, "resolution", int64(time.Minute), "resolution in nano seconds")
+	fs.Int64Var(&opts.SegmentSize, "segment", 10000, "number of records per segment")
+	fs.StringVar(&metricsAddr, "metrics", "", "address to serve metrics (/metrics and /debug/vars)")
+	return opts
+}
+
+// address to serve metrics, metrics are not served if empty
+var metricsAddr string
+
+// serveMetrics serves metrics in prometheus text format and with expvar
+func serveMetrics() {
+	if metricsAddr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	go func() {
+		if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+			fmt.Fprintln(os.Stderr, "metrics:", err)
+		}
+	}()
+}
+
+// runLeader reads data points from stdin and streams them to followers
+// each line should be in format: TIMESTAMP VAL1,VAL2,... HEX_PAYLOAD
+func runLeader(args []string) (err error) {
+	fs := newFlagSet("leader")
+	opts := dbFlags(fs)
+	addr := fs.String("addr", "localhost:7000", "address to listen for followers")
+	maxLog := fs.Int64("max-log-size", replica.DefaultMaxLogSize, "maximum size of the replication log in bytes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	serveMetrics()
+
+	db, err := dbase.New(*opts)
+	if err != nil {
+		return err
+	}
+
+	l, err := replica.NewLeader(db, replica.LeaderOptions{Address: *addr, MaxLogSize: *maxLog})
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	defer l.Close()
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) != 3 {
+			fmt.Fprintln(os.Stderr, "invalid line:", scanner.Text())
+			continue
+		}
+
+		ts, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid timestamp:", parts[0])
+			continue
+		}
+
+		pld, err := hex.DecodeString(parts[2])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid payload:", parts[2])
+			continue
+		}
+
+		vals := strings.Split(parts[1], ",")
+		if err := l.Put(ts, vals, pld); err != nil {
+			fmt.Fprintln(os.Stderr, "put failed:", err)
+			continue
+		}
+
+		fmt.Println("position:", l.Position())
+	}
+
+	return scanner.Err()
+}
+
+// runFollower replicates data from the leader until interrupted
+func runFollower(args []string) (err error) {
+	fs := newFlagSet("follower")
+	opts := dbFlags(fs)
+	addr := fs.String("leader", "localhost:7000", "address of the leader")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	serveMetrics()
+
+	db, err := dbase.New(*opts)
+	if err != nil {
+		return err
+	}
+
+	f, err := replica.NewFollower(db, replica.FollowerOptions{Address: *addr})
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	defer f.Close()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var last int64 = -1
+
+	for {
+		select {
+		case <-sigs:
+			return nil
+		case <-ticker.C:
+			if pos := f.Position(); pos != last {
+				fmt.Println("position:", pos)
+				last = pos
+			}
+		}
+	}
+}
+
+// runPrometheus serves remote storage endpoints for prometheus
+// (remote_write url: http://ADDR/write, remote_read url: http://ADDR/read)
+func runPrometheus(args []string) (err error) {
+	fs := newFlagSet("prometheus")
+	opts := dbFlags(fs)
+	addr := fs.String("addr", "localhost:9201", "address to listen for prometheus")
+	labels := fs.String("labels", "__name__,job,instance", "labels stored in each index level")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	serveMetrics()
+
+	// samples are always stored with the same payload size
+	// index depth is decided by the number of labels
+	opts.PayloadSize = prom.PayloadSize
+	opts.IndexDepth = int64(len(strings.Split(*labels, ",")))
+
+	db, err := dbase.New(*opts)
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	a, err := prom.New(db, prom.Options{Labels: strings.Split(*labels, ",")})
+	if err != nil {
+		return err
+	}
+
+	return http.ListenAndServe(*addr, a.Handler())
+}
+
+// runIngest accepts data points in influx or graphite format until interrupted
+// counters are printed when they change
+func runIngest(args []string) (err error) {
+	fs := newFlagSet("ingest")
+	opts := dbFlags(fs)
+	format := fs.String("format", "influx", "line format (influx or graphite)")
+	network := fs.String("network", "tcp", "network to listen (tcp or udp)")
+	addr := fs.String("addr", "localhost:8089", "address to listen")
+	levels := fs.String("levels", "measurement,host,field", "names of values stored in each index level")
+	template := fs.String("template", "", "names of graphite path parts (ex: host.measurement.field)")
+	strict := fs.Bool("strict", false, "reject lines which does not fit index levels")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	serveMetrics()
+
+	lopts := ingest.Options{
+		Network:  *network,
+		Address:  *addr,
+		Levels:   strings.Split(*levels, ","),
+		Template: *template,
+		Strict:   *strict,
+	}
+
+	switch *format {
+	case "influx":
+		lopts.Format = ingest.FormatInflux
+	case "graphite":
+		lopts.Format = ingest.FormatGraphite
+	default:
+		return ingest.ErrInvalidFormat
+	}
+
+	opts.PayloadSize = payload.FloatSize
+	opts.IndexDepth = int64(len(lopts.Levels))
+
+	db, err := dbase.New(*opts)
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	l, err := ingest.New(db, lopts)
+	if err != nil {
+		return err
+	}
+
+	defer l.Close()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var last ingest.Stats
+
+	for {
+		select {
+		case <-sigs:
+			return nil
+		case <-ticker.C:
+			if stats := l.Stats(); stats != last {
+				fmt.Printf("%+v\n", stats)
+				last = stats
+			}
+		}
+	}
+}
+
+// runQuery reads queries from stdin and prints matching series until the
+// input ends. The database is opened read only so it can be used while
+// another process is writing to it.
+func runQuery(args []string) (err error) {
+	fs := newFlagSet("query")
+	opts := dbFlags(fs)
+	levels := fs.String("levels", "", "names of index levels used with matchers (default: level0,level1,...)")
+	format := fs.String("format", "float", "payload format (float or int)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	qopts := query.Options{}
+
+	switch *format {
+	case "float":
+		qopts.Decode = payload.DecodeFloat
+	case "int":
+		qopts.Decode = func(pld []byte) (float64, bool) {
+			v, ok := payload.DecodeInt(pld)
+			return float64(v), ok
+		}
+	default:
+		return errors.New("invalid format " + strconv.Quote(*format))
+	}
+
+	if *levels != "" {
+		qopts.Levels = strings.Split(*levels, ",")
+		opts.IndexDepth = int64(len(qopts.Levels))
+	}
+
+	opts.PayloadSize = payload.FloatSize
+	opts.ReadOnly = true
+
+	db, err := dbase.New(*opts)
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	qopts.IndexDepth = opts.IndexDepth
+	qopts.Resolution = opts.Resolution
+	qopts.Labels = opts.Labels
+
+	names := qopts.Levels
+	if names == nil {
+		for i := 0; i < int(opts.IndexDepth); i++ {
+			names = append(names, "level"+strconv.Itoa(i))
+		}
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for fmt.Print("> "); scanner.Scan(); fmt.Print("> ") {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		q, err := query.Parse(line)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+
+		res, err := q.Exec(db, qopts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "query failed:", err)
+			continue
+		}
+
+		for _, s := range res {
+			if opts.Labels {
+				fmt.Println(labelsName(s.Values))
+			} else {
+				fmt.Println(seriesName(names, s.Values))
+			}
+
+			for _, p := range s.Points {
+				t := time.Unix(0, p.Timestamp).UTC().Format(time.RFC3339)
+				fmt.Printf("  %s  %g\n", t, p.Value)
+			}
+		}
+
+		fmt.Printf("(%d series)\n", len(res))
+	}
+
+	fmt.Println()
+	return scanner.Err()
+}
+
+// seriesName formats index values of a series as a selector
+// values left empty by aggregations are not included
+func seriesName(names, vals []string) (name string) {
+	var parts []string
+	for i, v := range vals {
+		if v != "" && i < len(names) {
+			parts = append(parts, names[i]+"="+strconv.Quote(v))
+		}
+	}
+
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// labelsName formats labels of a series as a selector
+func labelsName(labels []string) (name string) {
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		eq := strings.IndexByte(l, '=')
+		parts[i] = l[:eq+1] + strconv.Quote(l[eq+1:])
+	}
+
+	return "{" + strings.Join(parts, ", ") + "}"
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+)
+
+// flag sets of all commands should be created without conflicting flags
+func TestCommandFlags(t *testing.T) {
+	flagErrors = flag.ContinueOnError
+	defer func() { flagErrors = flag.ExitOnError }()
+
+	// help messages are not needed
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() { os.Stderr = stderr }()
+
+	for name, cmd := range commands {
+		if err := cmd([]string{"-h"}); err != flag.ErrHelp {
+			t.Fatal("flags of", name, "should be parsed", err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package dbase
+
+import (
+	"errors"
+	"path"
+	"strconv"
+
+	"github.com/meteorhacks/kdb"
+	"github.com/meteorhacks/kdb/archive"
+	"github.com/meteorhacks/kdb/dbucket"
+)
+
+var (
+	ErrNoArchiver   = errors.New("archiver is not set")
+	ErrMountSharded = errors.New("can't mount buckets sharded by series")
+)
+
+// archiveBucket stores bucket files with the archiver before it's removed
+// buckets are sealed (and trimmed) when they are removed from hot buckets
+// so files are archived as they are. The sealed index is written if it's
+// missing so mounted buckets don't load all index elements.
+// * archive name: DATABASE_NAME_BASE_TIME
+func (db *DBase) archiveBucket(dataPath string, baseTS int64) (err error) {
+	bkt, err := dbucket.New(dbucket.Options{
+		DatabaseName:   db.DatabaseName,
+		DataPath:       dataPath,
+		IndexDepth:     db.IndexDepth,
+		Labels:         db.Labels,
+		PayloadSize:    db.PayloadSize,
+		BucketDuration: db.BucketDuration,
+		Resolution:     db.Resolution,
+		BaseTime:       baseTS,
+		SegmentSize:    db.SegmentSize,
+		ReadOnly:       true,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if err := bkt.SealIndex(); err != nil {
+		bkt.Close()
+		return err
+	}
+
+	if err := bkt.Close(); err != nil {
+		return err
+	}
+
+	name := db.DatabaseName + "_" + strconv.FormatInt(baseTS, 10)
+	return db.Archiver.Archive(name, path.Join(dataPath, name))
+}
+
+// Mount opens a bucket archived when it was removed with `RemoveBefore`
+// for read only queries. Bucket files are read directly from the archive.
+func (db *DBase) Mount(baseTS int64) (bkt kdb.Bucket, err error) {
+	if db.Archiver == nil {
+		return nil, ErrNoArchiver
+	}
+
+	if db.shards != nil {
+		return nil, ErrMountSharded
+	}
+
+	name := db.DatabaseName + "_" + strconv.FormatInt(baseTS, 10)
+	return archive.Mount(db.Archiver, name, dbucket.Options{
+		DatabaseName:   db.DatabaseName,
+		IndexDepth:     db.IndexDepth,
+		Labels:         db.Labels,
+		PayloadSize:    db.PayloadSize,
+		BucketDuration: db.BucketDuration,
+		Resolution:     db.Resolution,
+		BaseTime:       baseTS,
+		SegmentSize:    db.SegmentSize,
+	})
+}
+
+// shardArchiver stores archives of a shard separately as
+// buckets of all shards have the same name when sharding by series
+// * shard archive name: SHARD_INDEX/DATABASE_NAME_BASE_TIME
+type shardArchiver struct {
+	archive.Archiver
+	prefix string
+}
+
+func (a shardArchiver) Archive(name, dir string) (err error) {
+	return a.Archiver.Archive(path.Join(a.prefix, name), dir)
+}
+
+func (a shardArchiver) Open(name string) (file archive.File, err error) {
+	return a.Archiver.Open(path.Join(a.prefix, name))
+}
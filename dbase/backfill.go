@@ -0,0 +1,171 @@
+package dbase
+
+import (
+	"github.com/meteorhacks/kdb/clock"
+	"github.com/meteorhacks/kdb/dbucket"
+)
+
+// Backfill writes data points to buckets which are not hot anymore. These
+// buckets are opened read only by the database so `Put` can't write to them.
+// A bucket is kept open for writing until a data point of another bucket is
+// written or the backfill is closed, then it's sealed again. Data points
+// should be ordered by time so buckets are not opened many times.
+// A backfill should be used by one goroutine at a time.
+type Backfill struct {
+	db      *DBase
+	buckets map[*DBase]*backfillBucket // bucket open for writing by shard
+}
+
+// backfillBucket is a bucket opened for writing by a backfill
+type backfillBucket struct {
+	layout layout
+	bkt    *dbucket.DBucket
+}
+
+// NewBackfill creates a backfill for the database
+// it should be closed before closing the database
+func (db *DBase) NewBackfill() (b *Backfill) {
+	return &Backfill{
+		db:      db,
+		buckets: make(map[*DBase]*backfillBucket),
+	}
+}
+
+// Put writes a data point to the bucket which has the timestamp.
+// Data points of hot buckets are written with the database.
+func (b *Backfill) Put(ts int64, vals []string, pld []byte) (err error) {
+	db := b.db
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+
+	vals, err = db.indexValues(vals)
+	if err != nil {
+		return err
+	}
+
+	if db.shards != nil {
+		db = db.shardFor(vals)
+	}
+
+	// floor tiemstamps by resolution
+	ts -= ts % db.Resolution
+
+	if ts > clock.Now() {
+		return ErrInvalidTimestamp
+	}
+
+	if len(pld) != int(db.PayloadSize) {
+		return ErrInvalidPayload
+	}
+
+	if open, ok := b.buckets[db]; ok {
+		if ts >= open.layout.BaseTime && ts < open.layout.end() {
+			return b.put(open, ts, vals, pld)
+		}
+
+		if err := b.close(db); err != nil {
+			return err
+		}
+	}
+
+	// old buckets are opened read only or not at all by the database
+	err = db.write(ts, 0, vals, pld, nil)
+	if err != dbucket.ErrWriteOnReadOnly && err != dbucket.ErrBucketNotInDisk {
+		return err
+	}
+
+	open, err := b.open(db, ts)
+	if err != nil {
+		return err
+	}
+
+	return b.put(open, ts, vals, pld)
+}
+
+func (b *Backfill) put(open *backfillBucket, ts int64, vals []string, pld []byte) (err error) {
+	if err := open.bkt.Put(ts, vals, pld); err != nil {
+		return err
+	}
+
+	metricPoints.Inc()
+
+	return nil
+}
+
+// open opens the bucket which has `ts` for writing. The bucket is removed
+// from memory first so only this bucket writes to its files. Buckets being
+// moved to a tier are not opened.
+func (b *Backfill) open(db *DBase, ts int64) (open *backfillBucket, err error) {
+	l, known := db.findLayout(ts)
+	if !known {
+		l = db.newLayout(ts)
+	}
+
+	if !db.claimBucket(l.BaseTime) {
+		return nil, ErrBucketBusy
+	}
+
+	bkt, err := db.openWritable(l)
+	if err != nil {
+		db.releaseBucket(l.BaseTime)
+		return nil, err
+	}
+
+	if !known {
+		l.BucketDuration = bkt.BucketDuration
+		l.Resolution = bkt.Resolution
+		db.addLayout(l)
+	}
+
+	open = &backfillBucket{layout: l, bkt: bkt}
+	b.buckets[db] = open
+
+	return open, nil
+}
+
+// openWritable removes the bucket with layout `l` from memory after
+// sealing it if it's hot and opens the bucket files for writing
+func (db *DBase) openWritable(l layout) (bkt *dbucket.DBucket, err error) {
+	if err := db.sealHot(l.BaseTime); err != nil {
+		return nil, err
+	}
+
+	if err := db.dropBucket(l.BaseTime); err != nil {
+		return nil, err
+	}
+
+	return dbucket.New(db.bucketOptions(l, false))
+}
+
+// close seals and closes the bucket opened for the shard `db`
+// the bucket is opened read only again when it's used by requests
+func (b *Backfill) close(db *DBase) (err error) {
+	open := b.buckets[db]
+	delete(b.buckets, db)
+
+	err = seal(open.bkt)
+	if cerr := open.bkt.Close(); err == nil {
+		err = cerr
+	}
+
+	// requests may have opened it read only while writing
+	if derr := db.dropBucket(open.layout.BaseTime); err == nil {
+		err = derr
+	}
+
+	db.releaseBucket(open.layout.BaseTime)
+
+	return err
+}
+
+// Close seals and closes buckets opened for writing
+func (b *Backfill) Close() (err error) {
+	for db := range b.buckets {
+		if cerr := b.close(db); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
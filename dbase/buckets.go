@@ -0,0 +1,455 @@
+package dbase
+
+import (
+	"sync"
+
+	"github.com/meteorhacks/kdb"
+	"github.com/meteorhacks/kdb/clock"
+	"github.com/meteorhacks/kdb/dbucket"
+)
+
+// buckets which preallocate disk space can remove
+// unused space when they will not receive more writes
+type trimmer interface {
+	Trim() (err error)
+}
+
+// buckets which can write a compact read only index
+// when they will not receive more writes (also trims)
+type sealer interface {
+	Seal() (err error)
+}
+
+// buckets which can merge new payloads with stored payloads
+type merger interface {
+	PutMerge(ts int64, vals []string, pld []byte, fn kdb.MergeFunc) (err error)
+}
+
+// buckets which keep record positions by series ID
+type idPutter interface {
+	PutByID(ts int64, id uint64, vals []string, pld []byte) (err error)
+}
+
+// buckets which report which payloads were written
+type presenter interface {
+	GetPresence(start, end int64, vals []string) (res [][]byte, present []bool, err error)
+	FindPresence(start, end int64, vals []string) (res map[*kdb.IndexElement][][]byte, present map[*kdb.IndexElement][]bool, err error)
+}
+
+// buckets which find the last written payload of series
+type latester interface {
+	Latest(vals []string) (res *kdb.Point, err error)
+	LatestFind(vals []string) (res map[*kdb.IndexElement]*kdb.Point, err error)
+}
+
+// bucketRef is a bucket kept in memory with the number of requests using
+// it. Buckets removed from memory are closed when these requests complete.
+type bucketRef struct {
+	kdb.Bucket
+	db *DBase
+
+	refs    int  // number of requests using the bucket
+	evicted bool // removed from memory, close when not used
+	trim    bool // remove preallocated space and seal before closing
+	mutex   *sync.Mutex
+
+	baseTS int64         // base time of the bucket
+	closed chan struct{} // closed after the bucket is closed
+	err    error         // error returned when closing the bucket
+}
+
+// bucketCall is used to wait until a bucket is opened
+// by another request when many requests need the same bucket
+type bucketCall struct {
+	done chan struct{}
+	err  error
+}
+
+// getBucket returns the bucket which has `ts` and marks it as used.
+// If the bucket is not in memory, it's opened and added to hot buckets or
+// cold buckets. A bucket is opened only once even with concurrent requests.
+// `release` should be called with the bucket when the request completes.
+func (db *DBase) getBucket(ts int64) (bkt *bucketRef, err error) {
+	select {
+	case <-db.closed:
+		return nil, ErrClosed
+	default:
+	}
+
+	for {
+		l, ok := db.findLayout(ts)
+		if !ok {
+			l = db.newLayout(ts)
+		}
+
+		baseTS := l.BaseTime
+
+		db.bucketMutex.Lock()
+
+		// if a "hot" bucket is available, return the bucket
+		if val, err := db.HBuckets.Get(baseTS); err == nil {
+			bkt := val.(*bucketRef)
+			bkt.acquire()
+			db.bucketMutex.Unlock()
+			return bkt, nil
+		}
+
+		// if a "cold" bucket is available, return the bucket
+		if val, err := db.CBuckets.Get(baseTS); err == nil {
+			bkt := val.(*bucketRef)
+			bkt.acquire()
+			db.bucketMutex.Unlock()
+			return bkt, nil
+		}
+
+		// wait if another request is opening the bucket and try again
+		// the bucket may get removed from memory before it's used
+		if call, ok := db.opening[baseTS]; ok {
+			db.bucketMutex.Unlock()
+			<-call.done
+
+			if call.err != nil {
+				return nil, call.err
+			}
+
+			continue
+		}
+
+		// wait if the bucket was removed from hot buckets and is still
+		// being sealed, its files can't be opened until it's closed
+		if bkt, ok := db.sealing[baseTS]; ok {
+			db.bucketMutex.Unlock()
+			<-bkt.closed
+			continue
+		}
+
+		call := &bucketCall{done: make(chan struct{})}
+		db.opening[baseTS] = call
+		db.bucketMutex.Unlock()
+
+		bkt, hot, err := db.openBucket(l, ok)
+
+		// the bucket may be moved to a tier while opening it
+		retry := false
+		if err == dbucket.ErrBucketNotInDisk {
+			if moved, found := db.findLayout(ts); found && moved.DataPath != l.DataPath {
+				err, retry = nil, true
+			}
+		}
+
+		db.bucketMutex.Lock()
+		delete(db.opening, baseTS)
+
+		if retry {
+			close(call.done)
+			db.bucketMutex.Unlock()
+			continue
+		}
+
+		if err == nil {
+			bkts := db.CBuckets
+			if hot {
+				bkts = db.HBuckets
+			}
+
+			// buckets can't be added after closing the database
+			if err = bkts.Add(baseTS, bkt); err != nil {
+				bkt.Close()
+				bkt, err = nil, ErrClosed
+			} else {
+				bkt.acquire()
+			}
+		}
+
+		call.err = err
+		close(call.done)
+		db.bucketMutex.Unlock()
+
+		return bkt, err
+	}
+}
+
+// openBucket opens the bucket with layout `l` from disk. Hot buckets are
+// opened for writing, read only databases always open cold buckets.
+// The layout is stored if it's not a known layout.
+func (db *DBase) openBucket(l layout, known bool) (bkt *bucketRef, hot bool, err error) {
+	nowTS := clock.Now()
+	nowTS -= (nowTS % db.BucketDuration)
+	minTS := nowTS - db.BucketDuration*(MaxHotBuckets-1)
+	hot = l.end() > minTS && !db.ReadOnly
+
+	b, err := dbucket.New(db.bucketOptions(l, !hot))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if hot {
+		metricBktsOpened.With("hot").Inc()
+	} else {
+		metricBktsOpened.With("cold").Inc()
+	}
+
+	if !known {
+		l.BucketDuration = b.BucketDuration
+		l.Resolution = b.Resolution
+		db.addLayout(l)
+	}
+
+	bkt = &bucketRef{
+		Bucket: b,
+		db:     db,
+		mutex:  &sync.Mutex{},
+		baseTS: l.BaseTime,
+		closed: make(chan struct{}),
+	}
+
+	return bkt, hot, nil
+}
+
+// bucketOptions returns options used to open the bucket with layout `l`
+func (db *DBase) bucketOptions(l layout, readOnly bool) (opts dbucket.Options) {
+	return dbucket.Options{
+		DatabaseName:   db.DatabaseName,
+		DataPath:       l.DataPath,
+		IndexDepth:     db.IndexDepth,
+		Labels:         db.Labels,
+		PayloadSize:    db.PayloadSize,
+		BucketDuration: l.BucketDuration,
+		Resolution:     l.Resolution,
+		BaseTime:       l.BaseTime,
+		SegmentSize:    db.SegmentSize,
+
+		SparseRecords:   db.SparseRecords,
+		SparseThreshold: db.SparseThreshold,
+		ReadOnly:        readOnly,
+	}
+}
+
+// dropBucket removes a cold bucket from memory if it's available
+// the bucket is closed when all requests using it complete
+func (db *DBase) dropBucket(baseTS int64) (err error) {
+	db.bucketMutex.Lock()
+	val, err := db.CBuckets.Del(baseTS)
+	db.bucketMutex.Unlock()
+
+	if err != nil {
+		return nil
+	}
+
+	return val.(*bucketRef).evict(false)
+}
+
+func (b *bucketRef) acquire() {
+	b.mutex.Lock()
+	b.refs++
+	b.mutex.Unlock()
+}
+
+// release marks that a request has completed using the bucket
+// errors when closing a removed bucket are reported with `OnError`
+func (b *bucketRef) release() {
+	b.mutex.Lock()
+	b.refs--
+	unused := b.evicted && b.refs == 0
+	b.mutex.Unlock()
+
+	if unused {
+		if err := b.close(); err != nil {
+			b.db.onError(err)
+		}
+	}
+}
+
+// evict marks the bucket as removed from memory and closes it if it's not
+// used. Otherwise, it's closed when the last request using it completes.
+func (b *bucketRef) evict(trim bool) (err error) {
+	b.mutex.Lock()
+	b.evicted = true
+	b.trim = trim
+	unused := b.refs == 0
+	b.mutex.Unlock()
+
+	if unused {
+		return b.close()
+	}
+
+	return nil
+}
+
+func (b *bucketRef) close() (err error) {
+	if b.trim {
+		err = seal(b.Bucket)
+		if cerr := b.Bucket.Close(); err == nil {
+			err = cerr
+		}
+
+		b.db.bucketMutex.Lock()
+		if b.db.sealing[b.baseTS] == b {
+			delete(b.db.sealing, b.baseTS)
+		}
+		b.db.bucketMutex.Unlock()
+	} else {
+		err = b.Bucket.Close()
+	}
+
+	b.err = err
+	close(b.closed)
+
+	return err
+}
+
+// sealHot removes the bucket with `baseTS` from hot buckets and waits until
+// it's sealed and closed. Hot buckets evicted by other requests are also
+// waited for. It should be used before writing to the bucket files with
+// another bucket, the bucket should be out of the hot time range so it's
+// not opened as a hot bucket again.
+func (db *DBase) sealHot(baseTS int64) (err error) {
+	db.bucketMutex.Lock()
+	bkt := db.sealing[baseTS]
+	val, err := db.HBuckets.Del(baseTS)
+	if err == nil {
+		bkt = val.(*bucketRef)
+		db.sealing[baseTS] = bkt
+		metricBktsEvicted.With("hot").Inc()
+	}
+	db.bucketMutex.Unlock()
+
+	if bkt == nil {
+		return nil
+	}
+
+	if val != nil {
+		// errors are returned by the bucket below
+		bkt.evict(true)
+	}
+
+	<-bkt.closed
+	return bkt.err
+}
+
+// claimBucket marks the bucket with `baseTS` as used by a backfill or a
+// move so these don't write bucket files at the same time. Returns false
+// if it's already used, `releaseBucket` should be called when completed.
+func (db *DBase) claimBucket(baseTS int64) (ok bool) {
+	db.bucketMutex.Lock()
+	defer db.bucketMutex.Unlock()
+
+	if db.busy[baseTS] {
+		return false
+	}
+
+	db.busy[baseTS] = true
+	return true
+}
+
+// releaseBucket marks the bucket as not used by a backfill or a move
+func (db *DBase) releaseBucket(baseTS int64) {
+	db.bucketMutex.Lock()
+	delete(db.busy, baseTS)
+	db.bucketMutex.Unlock()
+}
+
+// seal seals the bucket if it's supported, otherwise it's only trimmed
+func seal(bkt kdb.Bucket) (err error) {
+	if s, ok := bkt.(sealer); ok {
+		return s.Seal()
+	}
+
+	if t, ok := bkt.(trimmer); ok {
+		return t.Trim()
+	}
+
+	return nil
+}
+
+// bucketGet reads payloads of a series from a bucket and which of them were
+// written. Payloads with non zero bytes are considered written if the bucket
+// doesn't report written payloads.
+func bucketGet(bkt kdb.Bucket, start, end int64, vals []string) (res [][]byte, present []bool, err error) {
+	if p, ok := bkt.(presenter); ok {
+		return p.GetPresence(start, end, vals)
+	}
+
+	res, err = bkt.Get(start, end, vals)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return res, nonEmpty(res), nil
+}
+
+// bucketFind works like `bucketGet` with all series matching `vals`
+func bucketFind(bkt kdb.Bucket, start, end int64, vals []string) (res map[*kdb.IndexElement][][]byte, present map[*kdb.IndexElement][]bool, err error) {
+	if p, ok := bkt.(presenter); ok {
+		return p.FindPresence(start, end, vals)
+	}
+
+	res, err = bkt.Find(start, end, vals)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	present = make(map[*kdb.IndexElement][]bool, len(res))
+	for el, plds := range res {
+		present[el] = nonEmpty(plds)
+	}
+
+	return res, present, nil
+}
+
+// bucketLatest finds the last written payload of a series in a bucket
+// all payloads of the series are read if the bucket can't find it
+func bucketLatest(bkt kdb.Bucket, l layout, vals []string) (res *kdb.Point, err error) {
+	if b, ok := bkt.(latester); ok {
+		return b.Latest(vals)
+	}
+
+	plds, present, err := bucketGet(bkt, l.BaseTime, l.end(), vals)
+	if err != nil {
+		return nil, err
+	}
+
+	return lastPresent(l, plds, present), nil
+}
+
+// bucketLatestFind works like `bucketLatest` with all series matching `vals`
+func bucketLatestFind(bkt kdb.Bucket, l layout, vals []string) (res map[*kdb.IndexElement]*kdb.Point, err error) {
+	if b, ok := bkt.(latester); ok {
+		return b.LatestFind(vals)
+	}
+
+	out, marks, err := bucketFind(bkt, l.BaseTime, l.end(), vals)
+	if err != nil {
+		return nil, err
+	}
+
+	res = make(map[*kdb.IndexElement]*kdb.Point)
+	for el, plds := range out {
+		if pt := lastPresent(l, plds, marks[el]); pt != nil {
+			res[el] = pt
+		}
+	}
+
+	return res, nil
+}
+
+// lastPresent returns the last present payload read from a bucket
+func lastPresent(l layout, plds [][]byte, present []bool) (res *kdb.Point) {
+	for i := len(plds) - 1; i >= 0; i-- {
+		if present[i] {
+			return &kdb.Point{Timestamp: l.BaseTime + int64(i)*l.Resolution, Payload: plds[i]}
+		}
+	}
+
+	return nil
+}
+
+// nonEmpty marks payloads which have non zero bytes
+func nonEmpty(plds [][]byte) (present []bool) {
+	present = make([]bool, len(plds))
+	for i, pld := range plds {
+		present[i] = !isEmpty(pld)
+	}
+
+	return present
+}
@@ -3,20 +3,33 @@ package dbase
 import (
 	"errors"
 	"io/ioutil"
+	"log"
+	"math"
+	"os"
 	"os/exec"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/meteorhacks/kdb"
+	"github.com/meteorhacks/kdb/archive"
 	"github.com/meteorhacks/kdb/clock"
 	"github.com/meteorhacks/kdb/dbucket"
+	"github.com/meteorhacks/kdb/metrics"
+	"github.com/meteorhacks/kdb/mindex"
 	"github.com/meteorhacks/kdb/queue"
 )
 
 const (
 	MaxHotBuckets  = 2
 	MaxColdBuckets = 4
+
+	// default time between checks for buckets changed by
+	// another process when the database is read only
+	DefaultRefreshInterval = time.Second
 )
 
 var (
@@ -25,6 +38,19 @@ var (
 	ErrInvalidIndexValues = errors.New("invalid index values")
 	ErrInvalidPayload     = errors.New("invalid payload size")
 	ErrRemoveHotBucket    = errors.New("can't remove hot bucket")
+	ErrClosed             = errors.New("database is closed")
+	ErrReadOnly           = errors.New("write operation on a read only database")
+	ErrUnknownSeries      = errors.New("series is not registered")
+	ErrBucketBusy         = errors.New("bucket is being moved or backfilled")
+	ErrReplicated         = errors.New("write operation is not replicated to followers")
+
+	// metrics reported to the default registry
+	metricPutTime     = metrics.NewHistogram("kdb_put_seconds", "time taken to write a data point", metrics.LatencyBuckets)
+	metricGetTime     = metrics.NewHistogram("kdb_get_seconds", "time taken to run a get request", metrics.LatencyBuckets)
+	metricFindTime    = metrics.NewHistogram("kdb_find_seconds", "time taken to run a find request", metrics.LatencyBuckets)
+	metricPoints      = metrics.NewCounter("kdb_points_written_total", "number of data points written")
+	metricBktsOpened  = metrics.NewCounterVec("kdb_buckets_opened_total", "number of buckets opened", "type")
+	metricBktsEvicted = metrics.NewCounterVec("kdb_buckets_evicted_total", "number of buckets evicted from memory", "type")
 )
 
 type Options struct {
@@ -35,21 +61,77 @@ type Options struct {
 	// place to store data files
 	DataPath string
 
+	// places to store data files when data is sharded across many disks
+	// the first path is used as `DataPath` if `DataPath` is not set
+	DataPaths []string
+
+	// strategy used to place data in `DataPaths`
+	// it should not be changed after creating the database
+	Sharding Sharding
+
 	// depth of the index tree
 	IndexDepth int64
 
+	// index series of new buckets by sets of labels in name=value format
+	// (ex: "host=h1") instead of `IndexDepth` values. Series can have any
+	// number of labels in any order and `Find` matches series which have
+	// all given labels. `IndexDepth` is not used with labels.
+	Labels bool
+
 	// maximum payload size in bytes
 	PayloadSize int64
 
 	// bucket duration in nano seconds
 	// this should be a multiple of `Resolution`
+	// changes only apply to newly created buckets
 	BucketDuration int64
 
 	// bucket resolution in nano seconds
+	// results are resampled to this resolution
 	Resolution int64
 
 	// number of records per segment
 	SegmentSize int64
+
+	// store records of new buckets as (position, payload) pairs
+	// until they have enough payloads to use fixed size records
+	// useful when most series only have a few points per bucket
+	SparseRecords bool
+
+	// ratio of filled payloads (0 - 1) in a sparse record
+	// after which the record is converted to a fixed size record
+	SparseThreshold float64
+
+	// maximum age of data points returned by `Latest` and `LatestFind`
+	// in nano seconds. Buckets which end before that are not opened.
+	// all buckets are read if it's not set
+	LatestMaxAge int64
+
+	// secondary places to move buckets when they get old
+	// buckets are moved in the background by a mover goroutine
+	Tiers []Tier
+
+	// time between checks for buckets which should be moved to tiers
+	TierInterval time.Duration
+
+	// stores buckets removed with `RemoveBefore` before deleting them
+	// archived buckets can be opened later with `Mount` for queries
+	Archiver archive.Archiver
+
+	// called with errors from background goroutines (ex: closing
+	// buckets evicted from memory or moving buckets to tiers)
+	// errors are logged with the standard logger if not set
+	OnError func(err error)
+
+	// open all buckets read only, files will not be created or modified
+	// useful to read a database while another process is writing to it
+	// buckets and data written by the other process are visible to requests
+	ReadOnly bool
+
+	// minimum time between checks for buckets created, moved or removed
+	// by another process when the database is read only. Requests use
+	// buckets found by the last check. defaults to DefaultRefreshInterval
+	RefreshInterval time.Duration
 }
 
 type DBase struct {
@@ -62,9 +144,67 @@ type DBase struct {
 	HBuckets queue.Queue
 	CBuckets queue.Queue
 
-	// empty slice with enough empty payloads to fill a bucket
-	// used to fill result when bucket doesn't have required data
-	emptyOut [][]byte
+	// buckets being opened by a request, other requests for the
+	// same bucket wait until it's opened. Hot and cold bucket queues
+	// and this map should be used only with `bucketMutex` locked.
+	opening     map[int64]*bucketCall
+	bucketMutex *sync.Mutex
+
+	// hot buckets removed from memory until they're sealed and closed
+	// used with `bucketMutex` locked same as bucket queues (see sealHot)
+	sealing map[int64]*bucketRef
+
+	// buckets written outside hot buckets by a backfill or being moved
+	// to a tier, used with `bucketMutex` locked (see claimBucket)
+	busy map[int64]bool
+
+	// buckets removed from memory are closed in the background
+	// used to wait until they are closed when closing the database
+	evictions *sync.WaitGroup
+
+	// time ranges and resolutions of all buckets available on disk
+	// sorted by bucket base time. Buckets may have different layouts
+	// if `BucketDuration` or `Resolution` was changed over time.
+	layouts     []layout
+	layoutMutex *sync.RWMutex
+
+	// databases for each data path when sharding by series
+	// all requests are forwarded to these databases if available
+	shards []*DBase
+
+	// assigns IDs to series, opened when IDs are used for the first time
+	registry      *registry
+	registryMutex *sync.Mutex
+
+	// lock files of data paths held by writable databases
+	// only one process can write to a data path at a time
+	locks []*os.File
+
+	// closed when the database is closed
+	// used to stop background goroutines
+	closed chan struct{}
+
+	// written by a replication leader (see SetReplicated)
+	replicated bool
+
+	// time when layouts were last refreshed by a read only database
+	// used with `refreshMutex` locked (see refreshLayouts)
+	refreshed    int64
+	refreshMutex *sync.Mutex
+}
+
+// layout describes the time range covered by a bucket, the resolution
+// used when creating the bucket and the data path it's stored in
+type layout struct {
+	BaseTime       int64
+	BucketDuration int64
+	Resolution     int64
+	DataPath       string
+}
+
+// end returns the timestamp right after the last payload of the bucket
+func (l layout) end() (ts int64) {
+	return l.BaseTime + l.BucketDuration
 }
 
 func New(opts Options) (db *DBase, err error) {
@@ -72,17 +212,68 @@ func New(opts Options) (db *DBase, err error) {
 		return nil, ErrInvalidParams
 	}
 
-	// pre compute empty result slices to use with Get/Find requests
-	outSize := int(opts.BucketDuration / opts.Resolution)
-	emptyOut := make([][]byte, outSize, outSize)
-	emptyPld := make([]byte, opts.PayloadSize, opts.PayloadSize)
-	for i := 0; i < outSize; i++ {
-		emptyOut[i] = emptyPld
+	if opts.DataPath == "" && len(opts.DataPaths) > 0 {
+		opts.DataPath = opts.DataPaths[0]
+	}
+
+	if opts.TierInterval == 0 {
+		opts.TierInterval = DefaultTierInterval
 	}
 
-	hbkts := queue.NewQueue(MaxHotBuckets)
-	cbkts := queue.NewQueue(MaxColdBuckets)
-	db = &DBase{opts, hbkts, cbkts, emptyOut}
+	if opts.RefreshInterval == 0 {
+		opts.RefreshInterval = DefaultRefreshInterval
+	}
+
+	db = &DBase{
+		Options:     opts,
+		opening:     make(map[int64]*bucketCall),
+		bucketMutex: &sync.Mutex{},
+		sealing:     make(map[int64]*bucketRef),
+		busy:        make(map[int64]bool),
+		evictions:   &sync.WaitGroup{},
+		layouts:     make([]layout, 0),
+		layoutMutex: &sync.RWMutex{},
+		closed:      make(chan struct{}),
+
+		registryMutex: &sync.Mutex{},
+		refreshMutex:  &sync.Mutex{},
+	}
+
+	db.HBuckets = queue.NewQueueWithCallback(MaxHotBuckets, db.evictHot)
+	db.CBuckets = queue.NewQueueWithCallback(MaxColdBuckets, db.evictCold)
+
+	// make sure data is placed the same way it was placed before
+	if err = db.checkShards(); err != nil {
+		return nil, err
+	}
+
+	if len(opts.DataPaths) > 1 && opts.Sharding == ShardBySeries {
+		if err = db.openShards(); err != nil {
+			return nil, err
+		}
+
+		return db, nil
+	}
+
+	// other processes can read the database but can't write to it
+	if !opts.ReadOnly {
+		if err = db.lock(); err != nil {
+			return nil, err
+		}
+
+		defer func() {
+			if err != nil {
+				db.unlock()
+			}
+		}()
+	}
+
+	// find layouts of buckets already available on disk
+	if err = db.loadLayouts(); err != nil {
+		return nil, err
+	}
+
+	db.refreshed = clock.Now()
 
 	now := clock.Now()
 	now -= now % db.BucketDuration
@@ -97,9 +288,14 @@ func New(opts Options) (db *DBase, err error) {
 	// only these will perform writes
 	for i = 0; i < MaxHotBuckets; i++ {
 		ts := minHot + i*opts.BucketDuration
-		if _, err = db.getBucket(ts); err != nil {
+		bkt, err := db.getBucket(ts)
+		if err == dbucket.ErrBucketNotInDisk && opts.ReadOnly {
+			continue
+		} else if err != nil {
 			return nil, err
 		}
+
+		bkt.release()
 	}
 
 	// assuming buckets immediately before earliest hot bucket
@@ -107,15 +303,21 @@ func New(opts Options) (db *DBase, err error) {
 	// this will load only if buckets already exist on the server
 	for i = 0; i < MaxColdBuckets; i++ {
 		ts := minCold + i*opts.BucketDuration
-		if _, err = db.getBucket(ts); err != nil &&
-			err != dbucket.ErrBucketNotInDisk {
+		bkt, err := db.getBucket(ts)
+		if err == dbucket.ErrBucketNotInDisk {
+			continue
+		} else if err != nil {
 			return nil, err
 		}
+
+		bkt.release()
 	}
 
-	// start a goroutine to close
-	// all overflowing buckets
-	go db.checkBucketCounts()
+	// start a goroutine to move
+	// old buckets to tiers
+	if len(opts.Tiers) > 0 && !opts.ReadOnly {
+		go db.runMover()
+	}
 
 	return db, nil
 }
@@ -123,26 +325,122 @@ func New(opts Options) (db *DBase, err error) {
 // Put adds new data points to the correct bucket.
 // It also validates all incoming parameters before passing on to buckets
 func (db *DBase) Put(ts int64, vals []string, pld []byte) (err error) {
-	// floor tiemstamps by resolution
-	ts -= ts % db.Resolution
+	return db.put(ts, vals, pld, nil)
+}
 
-	now := clock.Now()
-	if ts > now {
-		return ErrInvalidTimestamp
+// PutMerge combines the data point with the payload already stored for the
+// series at the same time using `fn` (ex: payload.AddInt) and stores the
+// result. Payloads are merged atomically so concurrent writes are not lost.
+func (db *DBase) PutMerge(ts int64, vals []string, pld []byte, fn kdb.MergeFunc) (err error) {
+	if fn == nil {
+		return ErrInvalidParams
 	}
 
-	if len(vals) != int(db.IndexDepth) {
-		return ErrInvalidIndexValues
+	if db.replicated {
+		return ErrReplicated
 	}
 
-	for _, v := range vals {
-		if v == "" {
-			return ErrInvalidIndexValues
-		}
+	return db.put(ts, vals, pld, fn)
+}
+
+// put validates and writes the data point, payloads
+// are merged using `fn` if it's not nil
+func (db *DBase) put(ts int64, vals []string, pld []byte, fn kdb.MergeFunc) (err error) {
+	if db.ReadOnly {
+		return ErrReadOnly
 	}
 
-	if len(pld) != int(db.PayloadSize) {
-		return ErrInvalidPayload
+	vals, err = db.indexValues(vals)
+	if err != nil {
+		return err
+	}
+
+	if db.shards != nil {
+		return db.shardFor(vals).write(ts, 0, vals, pld, fn)
+	}
+
+	return db.write(ts, 0, vals, pld, fn)
+}
+
+// SeriesID returns the ID of the series which can be used with `PutByID`
+// and `GetByID`. Series are registered when an ID is requested for the
+// first time and keep the same ID even after reopening the database.
+// Read only databases only return IDs of series registered by the writer.
+func (db *DBase) SeriesID(vals []string) (id uint64, err error) {
+	vals, err = db.indexValues(vals)
+	if err != nil {
+		return 0, err
+	}
+
+	reg, err := db.openRegistry()
+	if err != nil {
+		return 0, err
+	}
+
+	return reg.id(vals)
+}
+
+// PutByID works like `Put` using the ID of a registered series (see
+// SeriesID). Buckets keep record positions by ID so the index is used
+// only when the series is written to a bucket for the first time.
+func (db *DBase) PutByID(ts int64, id uint64, pld []byte) (err error) {
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if db.replicated {
+		return ErrReplicated
+	}
+
+	reg, err := db.openRegistry()
+	if err != nil {
+		return err
+	}
+
+	vals, err := reg.values(id)
+	if err != nil {
+		return err
+	}
+
+	if db.shards != nil {
+		return db.shardFor(vals).write(ts, id, vals, pld, nil)
+	}
+
+	return db.write(ts, id, vals, pld, nil)
+}
+
+// SetReplicated marks the database as written by a replication leader.
+// The leader sends data points and removals made with it to followers,
+// writes it can't send (PutMerge and PutByID) are rejected with
+// ErrReplicated. It should be called before the database is used.
+func (db *DBase) SetReplicated() {
+	db.replicated = true
+}
+
+// GetByID works like `Get` using the ID of a registered series
+func (db *DBase) GetByID(start, end int64, id uint64) (res [][]byte, err error) {
+	reg, err := db.openRegistry()
+	if err != nil {
+		return nil, err
+	}
+
+	vals, err := reg.values(id)
+	if err != nil {
+		return nil, err
+	}
+
+	res, _, err = db.get(start, end, vals)
+	return res, err
+}
+
+// write writes a data point with validated index values to a bucket
+// `id` is the series ID if it's known (0 otherwise)
+func (db *DBase) write(ts int64, id uint64, vals []string, pld []byte, fn kdb.MergeFunc) (err error) {
+	defer metricPutTime.Since(time.Now())
+
+	ts, err = db.checkPoint(ts, pld)
+	if err != nil {
+		return err
 	}
 
 	bkt, err := db.getBucket(ts)
@@ -150,142 +448,277 @@ func (db *DBase) Put(ts int64, vals []string, pld []byte) (err error) {
 		return err
 	}
 
-	err = bkt.Put(ts, vals, pld)
+	if p, ok := bkt.Bucket.(idPutter); ok && fn == nil && id != 0 {
+		err = p.PutByID(ts, id, vals, pld)
+	} else if fn == nil {
+		err = bkt.Put(ts, vals, pld)
+	} else if m, ok := bkt.Bucket.(merger); ok {
+		err = m.PutMerge(ts, vals, pld, fn)
+	} else {
+		err = dbucket.ErrMergeNotAllowed
+	}
+
+	bkt.release()
 	if err != nil {
 		return err
 	}
 
+	metricPoints.Inc()
+
 	return nil
 }
 
-func (db *DBase) Get(start, end int64, vals []string) (res [][]byte, err error) {
+// checkPoint validates the timestamp and the payload of a data point
+// and returns the timestamp floored by resolution
+func (db *DBase) checkPoint(ts int64, pld []byte) (res int64, err error) {
 	// floor tiemstamps by resolution
-	start -= start % db.Resolution
-	end -= end % db.Resolution
+	ts -= ts % db.Resolution
 
 	now := clock.Now()
-	last := end - db.Resolution
-	if start > now || last > now || end < start {
-		return nil, ErrInvalidTimestamp
+	if ts > now {
+		return 0, ErrInvalidTimestamp
 	}
 
-	if len(vals) != int(db.IndexDepth) {
-		return nil, ErrInvalidIndexValues
+	if len(pld) != int(db.PayloadSize) {
+		return 0, ErrInvalidPayload
+	}
+
+	return ts, nil
+}
+
+// Point is a data point written with `PutBatch`
+type Point struct {
+	Timestamp int64
+	Values    []string
+	Payload   []byte
+}
+
+// batch is a group of validated data points written to the same bucket
+type batch struct {
+	db     *DBase // database or shard which has the bucket
+	baseTS int64
+	pts    []Point
+}
+
+// PutBatch adds many data points. Points are grouped by bucket and each
+// bucket is used once for all its points. Points which can't be written
+// are skipped and the number of failed points and the last error is
+// returned.
+func (db *DBase) PutBatch(pts []Point) (failed int, err error) {
+	if db.ReadOnly {
+		return len(pts), ErrReadOnly
 	}
 
-	// base time of starting bucket
-	bs := start - (start % db.BucketDuration)
+	batches, failed, err := db.batches(pts)
 
-	// base time of last bucket
-	be := end - (end % db.BucketDuration)
+	for _, b := range batches {
+		if n, e := b.db.writeBatch(b.pts); e != nil {
+			failed += n
+			err = e
+		}
+	}
 
-	// number of payoads in final result
-	rs := (end - start) / db.Resolution
-	res = make([][]byte, 0, rs)
+	return failed, err
+}
 
-	var bktStart, bktEnd int64
+// batches validates data points and groups them by bucket keeping
+// the order of points, invalid points are counted as failed
+func (db *DBase) batches(pts []Point) (res []*batch, failed int, err error) {
+	type key struct {
+		db     *DBase
+		baseTS int64
+	}
+
+	byBucket := make(map[key]*batch)
 
-	for t := bs; t <= be; t += db.BucketDuration {
-		if t == bs {
-			// if it's the first bucket
-			// skip payloads before `start` time
-			bktStart = start
-		} else {
-			// defaults to base time of the bucket
-			bktStart = t
+	for _, p := range pts {
+		vals, e := db.indexValues(p.Values)
+		if e != nil {
+			failed++
+			err = e
+			continue
 		}
 
-		// skip payloads after end time in end bucket
-		if t == be {
-			// if this is the last bucket
-			// skip payloads after `end` time
-			bktEnd = end
-		} else {
-			// defaults to end of the bucket
-			bktEnd = t + db.BucketDuration
+		bdb := db
+		if db.shards != nil {
+			bdb = db.shardFor(vals)
 		}
 
-		count := (bktEnd - bktStart) / db.Resolution
-		out := db.emptyOut[:count]
+		ts, e := bdb.checkPoint(p.Timestamp, p.Payload)
+		if e != nil {
+			failed++
+			err = e
+			continue
+		}
 
-		bkt, err := db.getBucket(t)
-		if err != nil && err != dbucket.ErrBucketNotInDisk {
-			return nil, err
+		l, ok := bdb.findLayout(ts)
+		if !ok {
+			l = bdb.newLayout(ts)
 		}
 
-		if err == nil {
-			out, err = bkt.Get(bktStart, bktEnd, vals)
-			if err != nil {
-				return nil, err
-			}
+		k := key{bdb, l.BaseTime}
+		b, ok := byBucket[k]
+		if !ok {
+			b = &batch{db: bdb, baseTS: l.BaseTime}
+			byBucket[k] = b
+			res = append(res, b)
+		}
+
+		b.pts = append(b.pts, Point{ts, vals, p.Payload})
+	}
+
+	return res, failed, err
+}
+
+// writeBatch writes validated data points of a bucket (see batches)
+// the bucket is used once for all points and released when completed
+func (db *DBase) writeBatch(pts []Point) (failed int, err error) {
+	defer metricPutTime.Since(time.Now())
+
+	bkt, err := db.getBucket(pts[0].Timestamp)
+	if err != nil {
+		return len(pts), err
+	}
+
+	defer bkt.release()
+
+	for _, p := range pts {
+		if e := bkt.Put(p.Timestamp, p.Values, p.Payload); e != nil {
+			failed++
+			err = e
+			continue
+		}
+
+		metricPoints.Inc()
+	}
+
+	return failed, err
+}
+
+func (db *DBase) Get(start, end int64, vals []string) (res [][]byte, err error) {
+	res, _, err = db.get(start, end, vals)
+	return res, err
+}
+
+// GetPresence works like `Get` and also reports which payloads hold data.
+// Missing payloads are filled with empty payloads same as with `Get` but
+// these are not present, payloads written with only zero bytes are present.
+func (db *DBase) GetPresence(start, end int64, vals []string) (res [][]byte, present []bool, err error) {
+	return db.get(start, end, vals)
+}
+
+func (db *DBase) get(start, end int64, vals []string) (res [][]byte, present []bool, err error) {
+	vals, err = db.indexValues(vals)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if db.shards != nil {
+		return db.shardFor(vals).get(start, end, vals)
+	}
+
+	defer metricGetTime.Since(time.Now())
+
+	// floor tiemstamps by resolution
+	start -= start % db.Resolution
+	end -= end % db.Resolution
+
+	now := clock.Now()
+	last := end - db.Resolution
+	if start > now || last > now || end < start {
+		return nil, nil, ErrInvalidTimestamp
+	}
 
-			if out == nil {
-				out = db.emptyOut[:count]
+	// buckets may be created, moved or removed by another process
+	if db.ReadOnly {
+		if err := db.refreshLayouts(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// number of payoads in final result
+	rs := (end - start) / db.Resolution
+	res = db.emptyPayloads(rs)
+	present = make([]bool, rs, rs)
+
+	for _, l := range db.layoutsBetween(start, end) {
+		bkt, err := db.getBucket(l.BaseTime)
+		if err != nil {
+			if err == dbucket.ErrBucketNotInDisk {
+				continue
 			}
+
+			return nil, nil, err
 		}
 
-		res = append(res, out...)
+		bktStart, bktEnd := l.clip(start, end)
+		out, marks, err := bucketGet(bkt.Bucket, bktStart, bktEnd, vals)
+		bkt.release()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		db.resample(res, present, start, out, marks, l.floor(bktStart), l.Resolution)
 	}
 
-	return res, nil
+	return res, present, nil
 }
 
 func (db *DBase) Find(start, end int64, vals []string) (res map[*kdb.IndexElement][][]byte, err error) {
+	res, _, err = db.find(start, end, vals)
+	return res, err
+}
+
+// FindPresence works like `Find` and also reports which payloads of
+// each series hold data (using the same index elements as keys)
+func (db *DBase) FindPresence(start, end int64, vals []string) (res map[*kdb.IndexElement][][]byte, present map[*kdb.IndexElement][]bool, err error) {
+	return db.find(start, end, vals)
+}
+
+func (db *DBase) find(start, end int64, vals []string) (res map[*kdb.IndexElement][][]byte, present map[*kdb.IndexElement][]bool, err error) {
+	if db.shards != nil {
+		return db.findShards(start, end, vals)
+	}
+
+	defer metricFindTime.Since(time.Now())
+
 	// floor tiemstamps by resolution
 	start -= start % db.Resolution
 	end -= end % db.Resolution
 
 	now := clock.Now()
 	if start > now || end > now || end < start {
-		return nil, ErrInvalidTimestamp
+		return nil, nil, ErrInvalidTimestamp
 	}
 
-	// base time of starting bucket
-	bs := start - (start % db.BucketDuration)
-
-	// base time of last bucket
-	be := end - (end % db.BucketDuration)
+	// buckets may be created, moved or removed by another process
+	if db.ReadOnly {
+		if err := db.refreshLayouts(); err != nil {
+			return nil, nil, err
+		}
+	}
 
 	// number of payoads in final result
 	rs := (end - start) / db.Resolution
 	tmpData := make(map[string][][]byte)
+	tmpMarks := make(map[string][]bool)
 	tmpVals := make(map[string][]string)
 
-	var bktStart, bktEnd int64
-
-	for t := bs; t <= be; t += db.BucketDuration {
-		bkt, err := db.getBucket(t)
-		notExist := err == dbucket.ErrBucketNotInDisk
+	for _, l := range db.layoutsBetween(start, end) {
+		bkt, err := db.getBucket(l.BaseTime)
 		if err != nil {
-			if notExist {
+			if err == dbucket.ErrBucketNotInDisk {
 				continue
 			}
 
-			return nil, err
-		}
-
-		if t == bs {
-			// if it's the first bucket
-			// skip payloads before `start` time
-			bktStart = start
-		} else {
-			// defaults to base time of the bucket
-			bktStart = t
-		}
-
-		// skip payloads after end time in end bucket
-		if t == be {
-			// if this is the last bucket
-			// skip payloads after `end` time
-			bktEnd = end
-		} else {
-			// defaults to end of the bucket
-			bktEnd = t + db.BucketDuration
+			return nil, nil, err
 		}
 
-		out, err := bkt.Find(bktStart, bktEnd, vals)
+		bktStart, bktEnd := l.clip(start, end)
+		out, marks, err := bucketFind(bkt.Bucket, bktStart, bktEnd, vals)
+		bkt.release()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		for el, plds := range out {
@@ -293,34 +726,236 @@ func (db *DBase) Find(start, end int64, vals []string) (res map[*kdb.IndexElemen
 
 			set, ok := tmpData[key]
 			if !ok {
-				set = make([][]byte, rs, rs)
-
-				var i int64
-				for i = 0; i < rs; i++ {
-					set[i] = make([]byte, db.PayloadSize)
-				}
-
+				set = db.emptyPayloads(rs)
 				tmpData[key] = set
+				tmpMarks[key] = make([]bool, rs, rs)
 				tmpVals[key] = el.Values
 			}
 
-			rStart := (bktStart - start) / db.Resolution
-			rEnd := (bktEnd - start) / db.Resolution
-			copy(set[rStart:rEnd], plds)
+			db.resample(set, tmpMarks[key], start, plds, marks[el], l.floor(bktStart), l.Resolution)
 		}
 	}
 
 	// move data from tmp to res
 	res = make(map[*kdb.IndexElement][][]byte)
+	present = make(map[*kdb.IndexElement][]bool)
 	for key, val := range tmpVals {
 		el := &kdb.IndexElement{Values: val}
 		res[el] = tmpData[key]
+		present[el] = tmpMarks[key]
+	}
+
+	return res, present, nil
+}
+
+// Latest returns the last written payload of a series with the start time of
+// its payload slot, nil is returned if the series has no data. Buckets are
+// read from the newest one until a bucket has data of the series or until
+// buckets are older than `LatestMaxAge`.
+func (db *DBase) Latest(vals []string) (res *kdb.Point, err error) {
+	vals, err = db.indexValues(vals)
+	if err != nil {
+		return nil, err
+	}
+
+	if db.shards != nil {
+		return db.shardFor(vals).latest(vals)
+	}
+
+	return db.latest(vals)
+}
+
+func (db *DBase) latest(vals []string) (res *kdb.Point, err error) {
+	ls, from, err := db.latestLayouts()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(ls) - 1; i >= 0; i-- {
+		bkt, err := db.getBucket(ls[i].BaseTime)
+		if err != nil {
+			if err == dbucket.ErrBucketNotInDisk {
+				continue
+			}
+
+			return nil, err
+		}
+
+		res, err = bucketLatest(bkt.Bucket, ls[i], vals)
+		bkt.release()
+		if err != nil {
+			return nil, err
+		}
+
+		if res != nil {
+			res.Timestamp -= res.Timestamp % db.Resolution
+			if res.Timestamp < from {
+				return nil, nil
+			}
+
+			return res, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// LatestFind works like `Latest` with all series matching `vals`. Series may
+// only have data in older buckets so all buckets within `LatestMaxAge` are
+// read, the payload from the newest bucket is used for each series. Reading
+// stops at the first bucket with data if `vals` has all values of a series.
+// Series without data are not included in the result.
+func (db *DBase) LatestFind(vals []string) (res map[*kdb.IndexElement]*kdb.Point, err error) {
+	if db.shards != nil {
+		return db.latestFindShards(vals)
+	}
+
+	return db.latestFind(vals)
+}
+
+func (db *DBase) latestFind(vals []string) (res map[*kdb.IndexElement]*kdb.Point, err error) {
+	// only one series can match, same as `Latest`
+	if db.isSeries(vals) {
+		res = make(map[*kdb.IndexElement]*kdb.Point)
+
+		pt, err := db.latest(vals)
+		if err != nil {
+			return nil, err
+		} else if pt != nil {
+			res[&kdb.IndexElement{Values: vals}] = pt
+		}
+
+		return res, nil
+	}
+
+	ls, from, err := db.latestLayouts()
+	if err != nil {
+		return nil, err
+	}
+
+	tmpData := make(map[string]*kdb.Point)
+	tmpVals := make(map[string][]string)
+
+	for i := len(ls) - 1; i >= 0; i-- {
+		bkt, err := db.getBucket(ls[i].BaseTime)
+		if err != nil {
+			if err == dbucket.ErrBucketNotInDisk {
+				continue
+			}
+
+			return nil, err
+		}
+
+		out, err := bucketLatestFind(bkt.Bucket, ls[i], vals)
+		bkt.release()
+		if err != nil {
+			return nil, err
+		}
+
+		for el, pt := range out {
+			key := strings.Join(el.Values, "-")
+			if _, ok := tmpData[key]; ok {
+				continue
+			}
+
+			pt.Timestamp -= pt.Timestamp % db.Resolution
+			if pt.Timestamp < from {
+				continue
+			}
+
+			tmpData[key] = pt
+			tmpVals[key] = el.Values
+		}
+	}
+
+	// move data from tmp to res
+	res = make(map[*kdb.IndexElement]*kdb.Point)
+	for key, val := range tmpVals {
+		res[&kdb.IndexElement{Values: val}] = tmpData[key]
 	}
 
 	return res, nil
 }
 
+// latestLayouts returns layouts of buckets used to find latest payloads
+// and the time of the oldest payload which can be returned
+func (db *DBase) latestLayouts() (ls []layout, from int64, err error) {
+	// buckets may be created, moved or removed by another process
+	if db.ReadOnly {
+		if err := db.refreshLayouts(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	now := clock.Now()
+	from = math.MinInt64
+	if db.LatestMaxAge > 0 {
+		from = now - db.LatestMaxAge
+	}
+
+	return db.layoutsBetween(from, now+1), from, nil
+}
+
+// isSeries checks whether `vals` has all index values of a series
+// queries with labels may match many series with more labels
+func (db *DBase) isSeries(vals []string) (ok bool) {
+	if db.Labels || len(vals) != int(db.IndexDepth) {
+		return false
+	}
+
+	for _, v := range vals {
+		if v == "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// indexValues validates index values of a series. Labels are sorted by name
+// so a series is always stored with the same values (see mindex.Labels).
+func (db *DBase) indexValues(vals []string) (res []string, err error) {
+	if db.Labels {
+		if len(vals) == 0 {
+			return nil, ErrInvalidIndexValues
+		}
+
+		res, err = mindex.Labels(vals)
+		if err != nil {
+			return nil, ErrInvalidIndexValues
+		}
+
+		return res, nil
+	}
+
+	if len(vals) != int(db.IndexDepth) {
+		return nil, ErrInvalidIndexValues
+	}
+
+	for _, v := range vals {
+		if v == "" {
+			return nil, ErrInvalidIndexValues
+		}
+	}
+
+	return vals, nil
+}
+
 func (db *DBase) RemoveBefore(ts int64) (err error) {
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if db.shards != nil {
+		for _, shard := range db.shards {
+			if err := shard.RemoveBefore(ts); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
 	now := clock.Now()
 	now -= now % db.BucketDuration
 	min := now - db.BucketDuration*(MaxHotBuckets-1)
@@ -330,122 +965,411 @@ func (db *DBase) RemoveBefore(ts int64) (err error) {
 		return ErrRemoveHotBucket
 	}
 
-	files, _ := ioutil.ReadDir(db.DataPath)
+	for _, dataPath := range db.allPaths() {
+		for _, tsInt := range db.listBuckets(dataPath) {
+			if tsInt >= ts {
+				continue
+			}
+
+			if err := db.dropBucket(tsInt); err != nil {
+				return err
+			}
+
+			if db.Archiver != nil {
+				if err := db.archiveBucket(dataPath, tsInt); err != nil {
+					return err
+				}
+			}
+
+			name := pfx + strconv.FormatInt(tsInt, 10)
+			bpath := path.Join(dataPath, name)
+			cmd := exec.Command("rm", "-rf", bpath)
+			if err := cmd.Run(); err != nil {
+				return err
+			}
+
+			db.removeLayout(tsInt)
+		}
+	}
+
+	return nil
+}
+
+func (db *DBase) Close() (err error) {
+	close(db.closed)
+
+	for _, shard := range db.shards {
+		if err := shard.Close(); err != nil {
+			return err
+		}
+	}
+
+	db.bucketMutex.Lock()
+	hot, _ := db.HBuckets.Close()
+	cold, _ := db.CBuckets.Close()
+	db.bucketMutex.Unlock()
+
+	db.evictions.Wait()
+
+	// buckets still used by requests are closed when they complete
+	for _, val := range hot {
+		if err := val.(*bucketRef).evict(false); err != nil {
+			return err
+		}
+	}
+
+	for _, val := range cold {
+		if err := val.(*bucketRef).evict(false); err != nil {
+			return err
+		}
+	}
+
+	db.registryMutex.Lock()
+	if db.registry != nil {
+		if err := db.registry.close(); err != nil {
+			db.registryMutex.Unlock()
+			return err
+		}
+	}
+	db.registryMutex.Unlock()
+
+	return db.unlock()
+}
+
+// listBuckets returns base times of all buckets available in a data path
+// * bucket path: DATA_PATH/DATABASE_NAME_BASE_TIME
+func (db *DBase) listBuckets(dataPath string) (bases []int64) {
+	pfx := db.DatabaseName + "_"
+	bases = make([]int64, 0)
+
+	files, _ := ioutil.ReadDir(dataPath)
 	for _, f := range files {
 		name := f.Name()
 
-		if !strings.HasPrefix(name, pfx) {
+		if !f.IsDir() || !strings.HasPrefix(name, pfx) {
 			continue
 		}
 
 		tsStr := strings.TrimPrefix(name, pfx)
 		tsInt, err := strconv.ParseInt(tsStr, 10, 64)
 		if err != nil {
-			return err
+			continue
+		}
+
+		bases = append(bases, tsInt)
+	}
+
+	return bases
+}
+
+// loadLayouts reads bucket duration and resolution
+// of all buckets available on disk
+func (db *DBase) loadLayouts() (err error) {
+	for _, dataPath := range db.allPaths() {
+		for _, baseTS := range db.listBuckets(dataPath) {
+			opts, err := dbucket.LoadOptions(dbucket.Options{
+				DatabaseName:   db.DatabaseName,
+				DataPath:       dataPath,
+				BucketDuration: db.BucketDuration,
+				Resolution:     db.Resolution,
+				BaseTime:       baseTS,
+			})
+
+			if err != nil {
+				return err
+			}
+
+			db.addLayout(layout{baseTS, opts.BucketDuration, opts.Resolution, dataPath})
+		}
+	}
+
+	return nil
+}
+
+// refreshLayouts updates layouts with buckets created, moved or removed by
+// another process since layouts were loaded. Used with read only databases.
+// Buckets moved or removed are dropped from memory if they are available.
+// Layouts are checked at most once per `RefreshInterval`.
+func (db *DBase) refreshLayouts() (err error) {
+	db.refreshMutex.Lock()
+	defer db.refreshMutex.Unlock()
+
+	// the clock may be moved back (see clock.Goto)
+	now := clock.Now()
+	if now >= db.refreshed && now-db.refreshed < int64(db.RefreshInterval) {
+		return nil
+	}
+
+	if err := db.loadChanges(); err != nil {
+		return err
+	}
+
+	db.refreshed = now
+	return nil
+}
+
+// loadChanges updates layouts with buckets found on disk (see refreshLayouts)
+func (db *DBase) loadChanges() (err error) {
+	found := make(map[int64][]string)
+	for _, dataPath := range db.allPaths() {
+		for _, baseTS := range db.listBuckets(dataPath) {
+			found[baseTS] = append(found[baseTS], dataPath)
 		}
+	}
 
-		if tsInt >= ts {
+	for _, l := range db.layoutsBetween(math.MinInt64, math.MaxInt64) {
+		if hasPath(found[l.BaseTime], l.DataPath) {
+			delete(found, l.BaseTime)
 			continue
 		}
 
-		_, err = db.CBuckets.Del(tsInt)
-		if err != nil && err != queue.ErrKeyMissing {
+		db.removeLayout(l.BaseTime)
+		if err := db.dropBucket(l.BaseTime); err != nil {
 			return err
 		}
+	}
 
-		bpath := path.Join(db.DataPath, name)
-		cmd := exec.Command("rm", "-rf", bpath)
-		if err := cmd.Run(); err != nil {
+	for baseTS, paths := range found {
+		opts, err := dbucket.LoadOptions(dbucket.Options{
+			DatabaseName:   db.DatabaseName,
+			DataPath:       paths[0],
+			BucketDuration: db.BucketDuration,
+			Resolution:     db.Resolution,
+			BaseTime:       baseTS,
+		})
+
+		// the bucket may be removed after listing
+		if err == dbucket.ErrBucketNotInDisk {
+			continue
+		} else if err != nil {
 			return err
 		}
+
+		db.addLayout(layout{baseTS, opts.BucketDuration, opts.Resolution, paths[0]})
 	}
 
 	return nil
 }
 
-func (db *DBase) Close() (err error) {
-	for _, val := range db.HBuckets.Flush() {
-		bkt := val.(kdb.Bucket)
-		err = bkt.Close()
-		if err != nil {
-			return err
+func hasPath(paths []string, dataPath string) (ok bool) {
+	for _, p := range paths {
+		if p == dataPath {
+			return true
 		}
 	}
 
-	for _, val := range db.CBuckets.Flush() {
-		bkt := val.(kdb.Bucket)
-		err = bkt.Close()
-		if err != nil {
-			return err
+	return false
+}
+
+// findLayout returns the layout of the bucket which contains `ts`
+func (db *DBase) findLayout(ts int64) (l layout, ok bool) {
+	db.layoutMutex.RLock()
+	defer db.layoutMutex.RUnlock()
+
+	i := sort.Search(len(db.layouts), func(i int) bool {
+		return db.layouts[i].end() > ts
+	})
+
+	if i < len(db.layouts) && db.layouts[i].BaseTime <= ts {
+		return db.layouts[i], true
+	}
+
+	return layout{}, false
+}
+
+// newLayout creates a layout for a new bucket which contains `ts` using
+// current database options. The bucket is shortened if it overlaps with
+// existing buckets created with a different `BucketDuration`.
+func (db *DBase) newLayout(ts int64) (l layout) {
+	db.layoutMutex.RLock()
+	defer db.layoutMutex.RUnlock()
+
+	start := ts - (ts % db.BucketDuration)
+	end := start + db.BucketDuration
+
+	i := sort.Search(len(db.layouts), func(i int) bool {
+		return db.layouts[i].end() > ts
+	})
+
+	if i > 0 {
+		if prev := db.layouts[i-1].end(); prev > start {
+			start = prev
 		}
 	}
 
-	return nil
+	if i < len(db.layouts) {
+		if next := db.layouts[i].BaseTime; next < end {
+			end = next
+		}
+	}
+
+	return layout{start, end - start, db.Resolution, db.pathFor(start)}
 }
 
-// getBucket fetches a `Bucket` from the base timestamp => Bucket map
-// If a bucket does not exist, it will be created and added to the map
-func (db *DBase) getBucket(ts int64) (bkt kdb.Bucket, err error) {
-	baseTS := ts - (ts % db.BucketDuration)
+// layoutsBetween returns layouts of all buckets
+// which has data within given time range
+func (db *DBase) layoutsBetween(start, end int64) (ls []layout) {
+	db.layoutMutex.RLock()
+	defer db.layoutMutex.RUnlock()
 
-	// if a "hot" bucket is available, return the bucket
-	if val, err := db.HBuckets.Get(baseTS); err == nil {
-		bkt := val.(kdb.Bucket)
-		return bkt, nil
+	ls = make([]layout, 0)
+	for _, l := range db.layouts {
+		if l.BaseTime < end && l.end() > start {
+			ls = append(ls, l)
+		}
 	}
 
-	// if a "cold" bucket is available, return the bucket
-	if val, err := db.CBuckets.Get(baseTS); err == nil {
-		bkt := val.(kdb.Bucket)
-		return bkt, nil
+	return ls
+}
+
+func (db *DBase) addLayout(l layout) {
+	db.layoutMutex.Lock()
+	defer db.layoutMutex.Unlock()
+
+	i := sort.Search(len(db.layouts), func(i int) bool {
+		return db.layouts[i].BaseTime >= l.BaseTime
+	})
+
+	if i < len(db.layouts) && db.layouts[i].BaseTime == l.BaseTime {
+		db.layouts[i] = l
+		return
 	}
 
-	nowTS := clock.Now()
-	nowTS -= (nowTS % db.BucketDuration)
-	minTS := nowTS - db.BucketDuration*MaxHotBuckets
-	isHot := baseTS > minTS
+	db.layouts = append(db.layouts, layout{})
+	copy(db.layouts[i+1:], db.layouts[i:])
+	db.layouts[i] = l
+}
+
+func (db *DBase) removeLayout(baseTS int64) {
+	db.layoutMutex.Lock()
+	defer db.layoutMutex.Unlock()
 
-	opts := dbucket.Options{
-		DatabaseName:   db.DatabaseName,
-		DataPath:       db.DataPath,
-		IndexDepth:     db.IndexDepth,
-		PayloadSize:    db.PayloadSize,
-		BucketDuration: db.BucketDuration,
-		Resolution:     db.Resolution,
-		BaseTime:       baseTS,
-		SegmentSize:    db.SegmentSize,
+	for i, l := range db.layouts {
+		if l.BaseTime == baseTS {
+			db.layouts = append(db.layouts[:i], db.layouts[i+1:]...)
+			return
+		}
 	}
+}
 
-	bkts := db.HBuckets
+// clip limits a time range to the time range of the bucket
+func (l layout) clip(start, end int64) (s, e int64) {
+	s, e = start, end
 
-	if !isHot {
-		opts.ReadOnly = true
-		bkts = db.CBuckets
+	if s < l.BaseTime {
+		s = l.BaseTime
 	}
 
-	bkt, err = dbucket.New(opts)
-	if err != nil {
-		return nil, err
+	if e > l.end() {
+		e = l.end()
 	}
 
-	bkts.Add(baseTS, bkt)
+	return s, e
+}
+
+// floor returns the start time of the bucket payload which contains `ts`
+func (l layout) floor(ts int64) (res int64) {
+	return ts - (ts-l.BaseTime)%l.Resolution
+}
+
+// resample places payloads read from a bucket in the result slice `dst`.
+// `src` payloads start at `srcStart` with `srcRes` resolution and `dst`
+// payloads start at `dstStart` with database resolution. Each present
+// payload is placed in the `dst` slot which contains its timestamp and the
+// slot is marked in `dstPresent`. When more than one payload falls in a
+// slot, the latest one is used.
+func (db *DBase) resample(dst [][]byte, dstPresent []bool, dstStart int64, src [][]byte, srcPresent []bool, srcStart, srcRes int64) {
+	count := int64(len(dst))
+
+	for i, pld := range src {
+		ts := srcStart + int64(i)*srcRes
+		if !srcPresent[i] {
+			continue
+		}
+
+		// a payload may start before `dstStart`
+		// if the bucket has a lower resolution
+		if ts < dstStart {
+			if ts+srcRes <= dstStart {
+				continue
+			}
+
+			ts = dstStart
+		}
 
-	return bkt, nil
+		j := (ts - dstStart) / db.Resolution
+		if j >= count {
+			break
+		}
+
+		dst[j] = pld
+		dstPresent[j] = true
+	}
 }
 
-func (db *DBase) checkBucketCounts() {
-	for {
-		var val interface{}
+// emptyPayloads creates `count` empty payloads used to fill results when
+// buckets don't have data. Payloads don't share bytes so a result can be
+// modified without changing other results.
+func (db *DBase) emptyPayloads(count int64) (plds [][]byte) {
+	data := make([]byte, count*db.PayloadSize)
+	plds = make([][]byte, count, count)
+	for i := range plds {
+		start := int64(i) * db.PayloadSize
+		end := start + db.PayloadSize
+		plds[i] = data[start:end:end]
+	}
+
+	return plds
+}
 
-		select {
-		case val = <-db.HBuckets.Out():
-		case val = <-db.CBuckets.Out():
+// isEmpty checks whether the payload only has zero bytes
+func isEmpty(pld []byte) (empty bool) {
+	for _, b := range pld {
+		if b != 0 {
+			return false
 		}
+	}
+
+	return true
+}
+
+// evictHot closes buckets removed from hot buckets when there are too
+// many buckets. These buckets will not receive any more writes so
+// preallocated space is removed and the index is sealed before closing.
+// it's called by `HBuckets` with `bucketMutex` locked
+func (db *DBase) evictHot(key int64, val interface{}) {
+	metricBktsEvicted.With("hot").Inc()
+	db.sealing[key] = val.(*bucketRef)
+	db.evict(val.(*bucketRef), true)
+}
 
-		bkt := val.(kdb.Bucket)
-		if err := bkt.Close(); err != nil {
-			// handle this error
-			panic(err)
+// evictCold closes buckets removed from cold buckets
+func (db *DBase) evictCold(key int64, val interface{}) {
+	metricBktsEvicted.With("cold").Inc()
+	db.evict(val.(*bucketRef), false)
+}
+
+// evict closes a bucket in the background so requests which
+// are adding buckets to hot or cold buckets are not blocked
+func (db *DBase) evict(bkt *bucketRef, trim bool) {
+	db.evictions.Add(1)
+
+	go func() {
+		defer db.evictions.Done()
+
+		if err := bkt.evict(trim); err != nil {
+			db.onError(err)
 		}
+	}()
+}
+
+// onError reports errors from background goroutines
+// using `OnError` if it's set or the standard logger
+func (db *DBase) onError(err error) {
+	if db.OnError != nil {
+		db.OnError(err)
+		return
 	}
+
+	log.Println("kdb:", err)
 }
@@ -2,11 +2,20 @@ package dbase
 
 import (
 	"errors"
+	"io/ioutil"
+	"os"
 	"os/exec"
 	"reflect"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/meteorhacks/kdb"
+	"github.com/meteorhacks/kdb/archive"
 	"github.com/meteorhacks/kdb/clock"
+	"github.com/meteorhacks/kdb/dbucket"
+	"github.com/meteorhacks/kdb/payload"
 )
 
 // A test clock is used to control the time
@@ -211,6 +220,79 @@ func TestPut(t *testing.T) {
 	}
 }
 
+func TestPutBatch(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	vals := []string{"a", "b", "c", "d"}
+	pts := []Point{
+		{10990, vals, []byte{1, 2, 3, 4}},
+		{12000, vals, []byte{1, 2, 3, 4}},
+		{11000, vals, []byte{5, 6, 7, 8}},
+	}
+
+	failed, err := db.PutBatch(pts)
+	if failed != 1 || err != ErrInvalidTimestamp {
+		t.Fatal("should return correct error")
+	}
+
+	res, err := db.Get(10990, 11010, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{{1, 2, 3, 4}, {5, 6, 7, 8}}) {
+		t.Fatal("other points should be written")
+	}
+
+	// points are written with one bucket reference per bucket
+	pts = []Point{
+		{10000, vals, []byte{1, 1, 1, 1}},
+		{11000, vals, []byte{2, 2, 2, 2}},
+		{10010, vals, []byte{3, 3, 3, 3}},
+		{11010, vals, []byte{4, 4, 4, 4}},
+	}
+
+	batches, failed, err := db.batches(pts)
+	if failed != 0 || err != nil {
+		t.Fatal(err)
+	} else if len(batches) != 2 {
+		t.Fatal("points should be grouped by bucket")
+	} else if batches[0].baseTS != 10000 || !reflect.DeepEqual(batches[0].pts, []Point{pts[0], pts[2]}) {
+		t.Fatal("invalid batch")
+	} else if batches[1].baseTS != 11000 || !reflect.DeepEqual(batches[1].pts, []Point{pts[1], pts[3]}) {
+		t.Fatal("invalid batch")
+	}
+
+	if failed, err := db.PutBatch(pts); failed != 0 || err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ts := range []int64{10000, 11000} {
+		bkt, err := db.getBucket(ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bkt.refs != 1 {
+			t.Fatal("batch should release bucket references")
+		}
+
+		bkt.release()
+	}
+
+	res, err = db.Get(10000, 10020, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{{1, 1, 1, 1}, {3, 3, 3, 3}}) {
+		t.Fatal("batch points should be written")
+	}
+}
+
 func TestGet(t *testing.T) {
 	defer cleanTestFiles()
 
@@ -270,9 +352,10 @@ func TestGet(t *testing.T) {
 		t.Fatal("should throw an error")
 	}
 
+	// the last payload starts before now
 	_, err = db.Get(ts-10, ts, vals)
-	if err == nil {
-		t.Fatal("should throw an error")
+	if err != nil {
+		t.Fatal(err)
 	}
 
 	_, err = db.Get(11000, 10990, vals)
@@ -291,6 +374,57 @@ func TestGet(t *testing.T) {
 	}
 }
 
+func TestEmptyPayloads(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	vals := []string{"a", "b", "c", "d"}
+	if err := db.Put(11000, vals, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := db.Get(11010, 11030, vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// results can be modified by the caller
+	res[0][0] = 1
+
+	res, err = db.Get(11010, 11030, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{{0, 0, 0, 0}, {0, 0, 0, 0}}) {
+		t.Fatal("empty payloads should not be shared")
+	}
+
+	found, err := db.Find(11000, 11020, []string{"a", "b", "c", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, plds := range found {
+		plds[1][0] = 1
+	}
+
+	found, err = db.Find(11000, 11020, []string{"a", "b", "c", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, plds := range found {
+		if !reflect.DeepEqual(plds, [][]byte{{1, 2, 3, 4}, {0, 0, 0, 0}}) {
+			t.Fatal("empty payloads should not be shared")
+		}
+	}
+}
+
 func TestFind(t *testing.T) {
 	defer cleanTestFiles()
 
@@ -340,51 +474,1604 @@ func TestFind(t *testing.T) {
 	}
 }
 
-func TestRemoveBefore(t *testing.T) {
+func TestChangedBucketLayout(t *testing.T) {
 	defer cleanTestFiles()
 
-	db, err := createTestDbase()
+	clock.UseTestClock()
+	clock.Goto(3999)
+	defer clock.Goto(11999)
+
+	cleanTestFiles()
+
+	opts := Options{
+		DatabaseName:   "test",
+		DataPath:       "/tmp/test-dbase/",
+		IndexDepth:     4,
+		PayloadSize:    4,
+		BucketDuration: 1000,
+		Resolution:     10,
+		SegmentSize:    10,
+	}
+
+	db, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vals := []string{"a", "b", "c", "d"}
+	pld0 := []byte{0, 0, 0, 0}
+	pld1 := []byte{1, 2, 3, 4}
+	pld2 := []byte{5, 6, 7, 8}
+	pld3 := []byte{9, 9, 9, 9}
+
+	if err := db.Put(3030, vals, pld1); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+
+	// use longer buckets with a lower resolution
+	opts.BucketDuration = 1500
+	opts.Resolution = 20
+
+	clock.Goto(5999)
+	db, err = New(opts)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	defer db.Close()
 
-	err = db.RemoveBefore(10001)
+	// new bucket is shortened to start where the old bucket ends
+	if err := db.Put(4010, vals, pld2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put(4520, vals, pld3); err != nil {
+		t.Fatal(err)
+	}
+
+	l, ok := db.findLayout(4010)
+	if !ok || l.BaseTime != 4000 || l.BucketDuration != 500 || l.Resolution != 20 {
+		t.Fatal("incorrect layout for the new bucket")
+	}
+
+	l, ok = db.findLayout(3030)
+	if !ok || l.BaseTime != 3000 || l.BucketDuration != 1000 || l.Resolution != 10 {
+		t.Fatal("incorrect layout for the old bucket")
+	}
+
+	res, err := db.Get(2000, 4600, vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res) != 130 {
+		t.Fatal("incorrect number of payloads")
+	}
+
+	for i, pld := range res {
+		exp := pld0
+
+		switch i {
+		case 51:
+			exp = pld1
+		case 100:
+			exp = pld2
+		case 126:
+			exp = pld3
+		}
+
+		if !reflect.DeepEqual(pld, exp) {
+			t.Fatal("invalid payload at", i)
+		}
+	}
+
+	out, err := db.Find(3000, 3100, []string{"a", "", "", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out) != 1 {
+		t.Fatal("incorrect number of results")
+	}
+
+	for _, plds := range out {
+		if len(plds) != 5 || !reflect.DeepEqual(plds[1], pld1) {
+			t.Fatal("invalid payload")
+		}
+	}
+}
+
+func TestShardByTime(t *testing.T) {
+	defer cleanTestFiles()
+
+	clock.UseTestClock()
+	clock.Goto(11999)
+	cleanTestFiles()
+
+	opts := Options{
+		DatabaseName:   "test",
+		DataPaths:      []string{"/tmp/test-dbase/p0", "/tmp/test-dbase/p1"},
+		IndexDepth:     4,
+		PayloadSize:    4,
+		BucketDuration: 1000,
+		Resolution:     10,
+		SegmentSize:    10,
+	}
+
+	db, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vals := []string{"a", "b", "c", "d"}
+	pld1 := []byte{1, 2, 3, 4}
+	pld2 := []byte{5, 6, 7, 8}
+
+	if err := db.Put(10990, vals, pld1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put(11000, vals, pld2); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+
+	if _, err := os.Stat("/tmp/test-dbase/p0/test_10000"); err != nil {
+		t.Fatal("bucket should be stored in the first path")
+	}
+
+	if _, err := os.Stat("/tmp/test-dbase/p1/test_11000"); err != nil {
+		t.Fatal("bucket should be stored in the second path")
+	}
+
+	db, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := db.Get(10990, 11010, vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(res, [][]byte{pld1, pld2}) {
+		t.Fatal("invalid data")
+	}
+
+	err = db.RemoveBefore(11000)
 	if err != ErrRemoveHotBucket {
 		t.Fatal("should return correct error")
 	}
 
-	// createTestDbase adds data at 3030 and 6060
-	// 6060 is in loaded as a cold bucket
-	// 3030 is not loaded into memory
+	db.Close()
 
-	err = db.RemoveBefore(4000)
+	// data paths can not be reordered
+	opts.DataPaths = []string{"/tmp/test-dbase/p1", "/tmp/test-dbase/p0"}
+	if _, err := New(opts); err != ErrShardMismatch {
+		t.Fatal("should return correct error")
+	}
+
+	opts.DataPaths = []string{"/tmp/test-dbase/p0", "/tmp/test-dbase/p1"}
+	opts.Sharding = ShardBySeries
+	if _, err := New(opts); err != ErrShardMismatch {
+		t.Fatal("should return correct error")
+	}
+}
+
+func TestShardBySeries(t *testing.T) {
+	defer cleanTestFiles()
+
+	clock.UseTestClock()
+	clock.Goto(11999)
+	cleanTestFiles()
+
+	opts := Options{
+		DatabaseName:   "test",
+		DataPaths:      []string{"/tmp/test-dbase/p0", "/tmp/test-dbase/p1"},
+		Sharding:       ShardBySeries,
+		IndexDepth:     4,
+		PayloadSize:    4,
+		BucketDuration: 1000,
+		Resolution:     10,
+		SegmentSize:    10,
+	}
+
+	db, err := New(opts)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	vals := []string{"a", "b", "c", "d"}
-	pld0 := []byte{0, 0, 0, 0}
+	pld := []byte{1, 2, 3, 4}
+	used := make(map[int]bool)
 
-	res, err := db.Get(3030, 3040, vals)
+	for i := 0; i < 10; i++ {
+		vals := []string{"a" + strconv.Itoa(i), "b", "c", "d"}
+		if err := db.Put(10990, vals, pld); err != nil {
+			t.Fatal(err)
+		}
+
+		used[db.shardIndex(vals[0])] = true
+	}
+
+	if len(used) != 2 {
+		t.Fatal("series should be placed in both paths")
+	}
+
+	db.Close()
+
+	db, err = New(opts)
 	if err != nil {
 		t.Fatal(err)
-	} else if !reflect.DeepEqual(res[0], pld0) {
-		t.Fatal("data should be removed")
 	}
 
-	// remove cold bucket
-	err = db.RemoveBefore(7000)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		vals := []string{"a" + strconv.Itoa(i), "b", "c", "d"}
+		res, err := db.Get(10990, 11000, vals)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(res, [][]byte{pld}) {
+			t.Fatal("invalid data")
+		}
+	}
+
+	out, err := db.Find(10990, 11000, []string{"", "b", "", ""})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	res, err = db.Get(6060, 6070, vals)
+	if len(out) != 10 {
+		t.Fatal("should find series from all paths")
+	}
+
+	out, err = db.Find(10990, 11000, []string{"a1", "", "", ""})
 	if err != nil {
 		t.Fatal(err)
-	} else if !reflect.DeepEqual(res[0], pld0) {
-		t.Fatal("data should be removed")
+	}
+
+	if len(out) != 1 {
+		t.Fatal("should find series from one path")
+	}
+
+	latest, err := db.LatestFind([]string{"", "b", "", ""})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(latest) != 10 {
+		t.Fatal("should find latest payloads from all paths")
+	}
+
+	pt, err := db.Latest([]string{"a1", "b", "c", "d"})
+	if err != nil {
+		t.Fatal(err)
+	} else if pt == nil || pt.Timestamp != 10990 || !reflect.DeepEqual(pt.Payload, pld) {
+		t.Fatal("invalid data")
+	}
+}
+
+func TestTiers(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+
+	opts := db.Options
+	opts.Tiers = []Tier{
+		{Path: "/tmp/test-dbase/tier1", Age: 3000},
+		{Path: "/tmp/test-dbase/tier2", Age: 6000},
+	}
+
+	db, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.MoveBuckets(); err != nil {
+		t.Fatal(err)
+	}
+
+	// bucket at 3000 ends at 4000 (age: 7999)
+	// bucket at 6000 ends at 7000 (age: 4999)
+	if _, err := os.Stat("/tmp/test-dbase/tier2/test_3000"); err != nil {
+		t.Fatal("bucket should be moved to the second tier")
+	}
+
+	if _, err := os.Stat("/tmp/test-dbase/tier1/test_6000"); err != nil {
+		t.Fatal("bucket should be moved to the first tier")
+	}
+
+	if _, err := os.Stat("/tmp/test-dbase/test_6000"); !os.IsNotExist(err) {
+		t.Fatal("bucket should be removed from the data path")
+	}
+
+	if _, err := os.Stat("/tmp/test-dbase/tier1/test_10000"); !os.IsNotExist(err) {
+		t.Fatal("hot buckets should not be moved")
+	}
+
+	vals := []string{"a", "b", "c", "d"}
+	res, err := db.Get(3030, 3040, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res[0], []byte{3, 0, 3, 0}) {
+		t.Fatal("invalid data")
+	}
+
+	res, err = db.Get(6060, 6070, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res[0], []byte{6, 0, 6, 0}) {
+		t.Fatal("invalid data")
+	}
+
+	db.Close()
+
+	// buckets should be found in tiers when reopened
+	db, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	res, err = db.Get(6060, 6070, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res[0], []byte{6, 0, 6, 0}) {
+		t.Fatal("invalid data")
+	}
+
+	if err := db.RemoveBefore(7000); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat("/tmp/test-dbase/tier1/test_6000"); !os.IsNotExist(err) {
+		t.Fatal("bucket should be removed from the tier")
+	}
+}
+
+func TestMoveHotBucket(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+
+	opts := db.Options
+	opts.Tiers = []Tier{{Path: "/tmp/test-dbase/tier1", Age: 1000}}
+
+	db, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	vals := []string{"a", "b", "c", "d"}
+	if err := db.Put(10000, vals, []byte{1, 1, 1, 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the bucket is old enough to be moved but it's still a hot bucket
+	clock.Goto(13999)
+
+	written := make([][]byte, 100)
+	moved := make(chan struct{})
+	done := make(chan error, 1)
+
+	// writes after the move should be rejected
+	go func() {
+		for i := 0; ; i++ {
+			after := false
+			select {
+			case <-moved:
+				after = true
+			default:
+			}
+
+			pld := []byte{byte(i), byte(i >> 8), 1, 1}
+			err := db.Put(10000+int64(i%100)*10, vals, pld)
+			if err == dbucket.ErrWriteOnReadOnly {
+				done <- nil
+				return
+			} else if err != nil {
+				done <- err
+				return
+			} else if after {
+				done <- errors.New("writes should be rejected after moving")
+				return
+			}
+
+			written[i%100] = pld
+		}
+	}()
+
+	if err := db.MoveBuckets(); err != nil {
+		t.Fatal(err)
+	}
+
+	close(moved)
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat("/tmp/test-dbase/tier1/test_10000/index_sealed"); err != nil {
+		t.Fatal("bucket should be sealed before moving")
+	}
+
+	res, err := db.Get(10000, 11000, vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, pld := range written {
+		if pld != nil && !reflect.DeepEqual(res[i], pld) {
+			t.Fatal("written data should be moved", i, res[i], pld)
+		}
+	}
+}
+
+func TestArchive(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+
+	opts := db.Options
+	opts.Archiver = &archive.LocalArchiver{Path: "/tmp/test-dbase/archive"}
+
+	db, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	if _, err := db.Mount(3000); err != archive.ErrArchiveNotFound {
+		t.Fatal("should return correct error")
+	}
+
+	if err := db.RemoveBefore(7000); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat("/tmp/test-dbase/test_3000"); !os.IsNotExist(err) {
+		t.Fatal("bucket should be removed")
+	}
+
+	vals := []string{"a", "b", "c", "d"}
+
+	for _, ts := range []int64{3000, 6000} {
+		bkt, err := db.Mount(ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n := byte(ts / 1000)
+		res, err := bkt.Get(ts+10*int64(n), ts+10*int64(n)+10, vals)
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(res, [][]byte{{n, 0, n, 0}}) {
+			t.Fatal("invalid data")
+		}
+
+		if err := bkt.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRemoveBefore(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	err = db.RemoveBefore(10001)
+	if err != ErrRemoveHotBucket {
+		t.Fatal("should return correct error")
+	}
+
+	// createTestDbase adds data at 3030 and 6060
+	// 6060 is in loaded as a cold bucket
+	// 3030 is not loaded into memory
+
+	err = db.RemoveBefore(4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vals := []string{"a", "b", "c", "d"}
+	pld0 := []byte{0, 0, 0, 0}
+
+	res, err := db.Get(3030, 3040, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res[0], pld0) {
+		t.Fatal("data should be removed")
+	}
+
+	// remove cold bucket
+	err = db.RemoveBefore(7000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = db.Get(6060, 6070, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res[0], pld0) {
+		t.Fatal("data should be removed")
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	vals := []string{"a", "b", "c", "d"}
+	pld1 := []byte{1, 2, 3, 4}
+	pld2 := []byte{5, 6, 7, 8}
+	pld3 := []byte{9, 9, 9, 9}
+	pld4 := []byte{4, 3, 2, 1}
+
+	// 6060 is in a cold bucket
+	if err := db.Put(6070, vals, pld1); err != dbucket.ErrWriteOnReadOnly {
+		t.Fatal("should return correct error")
+	}
+
+	bf := db.NewBackfill()
+
+	// cold bucket in memory, bucket on disk, new bucket and hot bucket
+	if err := bf.Put(6070, vals, pld1); err != nil {
+		t.Fatal(err)
+	} else if err := bf.Put(3040, vals, pld2); err != nil {
+		t.Fatal(err)
+	} else if err := bf.Put(1010, vals, pld3); err != nil {
+		t.Fatal(err)
+	} else if err := bf.Put(11010, vals, pld4); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bf.Put(12010, vals, pld4); err != ErrInvalidTimestamp {
+		t.Fatal("should return correct error")
+	}
+
+	if err := bf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ts  int64
+		res [][]byte
+	}{
+		{6060, [][]byte{{6, 0, 6, 0}, pld1}},
+		{3030, [][]byte{{3, 0, 3, 0}, pld2}},
+		{1000, [][]byte{{0, 0, 0, 0}, pld3}},
+		{11000, [][]byte{{0, 0, 0, 0}, pld4}},
+	}
+
+	for _, tt := range tests {
+		res, err := db.Get(tt.ts, tt.ts+20, vals)
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(res, tt.res) {
+			t.Fatal("incorrect data at", tt.ts, res)
+		}
+	}
+
+	// backfilled buckets are opened read only again
+	if err := db.Put(6080, vals, pld1); err != dbucket.ErrWriteOnReadOnly {
+		t.Fatal("should return correct error")
+	}
+}
+
+func TestRequestAfterClose(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	vals := []string{"a", "b", "c", "d"}
+	if err := db.Put(10990, vals, []byte{1, 2, 3, 4}); err != ErrClosed {
+		t.Fatal("should return correct error")
+	}
+
+	if _, err := db.Get(3030, 3040, vals); err != ErrClosed {
+		t.Fatal("should return correct error")
+	}
+
+	if db.HBuckets.Length() != 0 || db.CBuckets.Length() != 0 {
+		t.Fatal("buckets should be removed from memory")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	opts := db.Options
+	opts.ReadOnly = true
+	opts.RefreshInterval = time.Microsecond
+
+	// data path without buckets should not be created
+	missing := opts
+	missing.DataPath = "/tmp/test-dbase/missing"
+	mdb, err := New(missing)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mdb.Close(); err != nil {
+		t.Fatal(err)
+	} else if _, err := os.Stat(missing.DataPath); !os.IsNotExist(err) {
+		t.Fatal("should not create the data path")
+	}
+
+	rdb, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rdb.Close()
+
+	vals := []string{"a", "b", "c", "d"}
+	pld := []byte{1, 2, 3, 4}
+
+	if err := rdb.Put(10990, vals, pld); err != ErrReadOnly {
+		t.Fatal("should not write to a read only database")
+	}
+
+	if err := rdb.RemoveBefore(4000); err != ErrReadOnly {
+		t.Fatal("should not remove buckets")
+	}
+
+	res, err := rdb.Get(3030, 3040, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res[0], []byte{3, 0, 3, 0}) {
+		t.Fatal("should read existing data")
+	}
+
+	// new series fill more than one segment (10 records)
+	for i := 0; i < 12; i++ {
+		vals := []string{"a", "b", "c", "e" + strconv.Itoa(i)}
+		if err := db.Put(11050, vals, pld); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 12; i++ {
+		vals := []string{"a", "b", "c", "e" + strconv.Itoa(i)}
+		res, err := rdb.Get(11050, 11060, vals)
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(res[0], pld) {
+			t.Fatal("should read data written after opening")
+		}
+	}
+
+	// buckets created after opening
+	clock.Goto(12999)
+	defer clock.Goto(11999)
+
+	if err := db.Put(12050, vals, pld); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := rdb.Find(12050, 12060, []string{"a", "", "", ""})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(out) != 1 {
+		t.Fatal("should read buckets created after opening")
+	}
+
+	for _, plds := range out {
+		if !reflect.DeepEqual(plds[0], pld) {
+			t.Fatal("incorrect data")
+		}
+	}
+}
+
+func TestRefreshInterval(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	opts := db.Options
+	opts.ReadOnly = true
+
+	rdb, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rdb.Close()
+
+	vals := []string{"a", "b", "c", "d"}
+	pld := []byte{1, 2, 3, 4}
+
+	clock.Goto(12999)
+	defer clock.Goto(11999)
+
+	if err := db.Put(12050, vals, pld); err != nil {
+		t.Fatal(err)
+	}
+
+	// buckets are not checked again until the interval passes
+	res, err := rdb.Get(12050, 12060, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res[0], []byte{0, 0, 0, 0}) {
+		t.Fatal("should not check buckets before the interval")
+	}
+
+	clock.Goto(12999 + int64(DefaultRefreshInterval))
+
+	res, err = rdb.Get(12050, 12060, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res[0], pld) {
+		t.Fatal("should read buckets created after the interval")
+	}
+}
+
+func TestWriterLock(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := db.Options
+
+	_, err = New(opts)
+	if lerr, ok := err.(*LockError); !ok || !errors.Is(err, ErrLocked) || lerr.PID != os.Getpid() {
+		t.Fatal("should not open a second writer")
+	}
+
+	ropts := opts
+	ropts.ReadOnly = true
+	rdb, err := New(ropts)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := rdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// lock file left by a process which did not close the database
+	fpath := "/tmp/test-dbase/test.lock"
+	if err := ioutil.WriteFile(fpath, []byte("12345\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stale error
+	opts.OnError = func(err error) {
+		stale = err
+	}
+
+	db, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lerr, ok := stale.(*LockError); !ok || lerr.Err != ErrStaleLock || lerr.PID != 12345 {
+		t.Fatal("should detect the stale lock")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetPresence(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	vals := []string{"a", "b", "c", "z"}
+	if err := db.Put(11050, vals, []byte{0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put(11070, vals, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	expRes := [][]byte{{0, 0, 0, 0}, {0, 0, 0, 0}, {0, 0, 0, 0}, {1, 2, 3, 4}}
+	expPresent := []bool{false, true, false, true}
+
+	res, present, err := db.GetPresence(11040, 11080, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, expRes) || !reflect.DeepEqual(present, expPresent) {
+		t.Fatal("invalid result")
+	}
+
+	out, marks, err := db.FindPresence(11040, 11080, []string{"a", "b", "c", "z"})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(out) != 1 {
+		t.Fatal("invalid result")
+	}
+
+	for el, plds := range out {
+		if !reflect.DeepEqual(plds, expRes) || !reflect.DeepEqual(marks[el], expPresent) {
+			t.Fatal("invalid result")
+		}
+	}
+
+	// read only databases read presence files written by the writer
+	opts := db.Options
+	opts.ReadOnly = true
+
+	rdb, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rdb.Close()
+
+	res, present, err = rdb.GetPresence(11040, 11080, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, expRes) || !reflect.DeepEqual(present, expPresent) {
+		t.Fatal("invalid result")
+	}
+}
+
+func TestPutMerge(t *testing.T) {
+	defer cleanTestFiles()
+
+	clock.UseTestClock()
+	clock.Goto(11999)
+
+	cmd := exec.Command("rm", "-rf", "/tmp/test-dbase")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := New(Options{
+		DatabaseName:   "test",
+		DataPath:       "/tmp/test-dbase/",
+		IndexDepth:     4,
+		PayloadSize:    payload.IntSize,
+		BucketDuration: 1000,
+		Resolution:     10,
+		SegmentSize:    10,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	vals := []string{"a", "b", "c", "d"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := db.PutMerge(11050, vals, payload.EncodeInt(2), payload.AddInt); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if err := db.PutMerge(11050, vals, payload.EncodeInt(1), payload.MinInt); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.PutMerge(11060, vals, payload.EncodeInt(7), payload.MaxInt); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := db.Get(11050, 11070, vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok := payload.DecodeInt(res[0]); !ok || v != 1 {
+		t.Fatal("incorrect value")
+	}
+
+	if v, ok := payload.DecodeInt(res[1]); !ok || v != 7 {
+		t.Fatal("incorrect value")
+	}
+
+	if err := db.PutMerge(11050, vals, payload.EncodeInt(1), nil); err != ErrInvalidParams {
+		t.Fatal("should return correct error")
+	}
+}
+
+func TestPutMergePayloadSize(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	vals := []string{"a", "b", "c", "d"}
+	pld := []byte{1, 2, 3, 4}
+
+	if err := db.Put(11050, vals, pld); err != nil {
+		t.Fatal(err)
+	}
+
+	// built in merge functions need payloads with `payload.IntSize`
+	if err := db.PutMerge(11050, vals, pld, payload.AddInt); !errors.Is(err, payload.ErrInvalidSize) {
+		t.Fatal("should return correct error", err)
+	}
+
+	res, err := db.Get(11050, 11060, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{pld}) {
+		t.Fatal("payload should not be changed")
+	}
+}
+
+func TestLabels(t *testing.T) {
+	defer cleanTestFiles()
+
+	clock.UseTestClock()
+	clock.Goto(11999)
+	cleanTestFiles()
+
+	opts := Options{
+		DatabaseName:   "test",
+		DataPath:       "/tmp/test-dbase/",
+		Labels:         true,
+		PayloadSize:    4,
+		BucketDuration: 1000,
+		Resolution:     10,
+		SegmentSize:    10,
+	}
+
+	db, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	val1 := []string{"host=h1", "app=web"}
+	val2 := []string{"app=web", "host=h2", "zone=z1"}
+	pld0 := []byte{0, 0, 0, 0}
+	pld1 := []byte{1, 2, 3, 4}
+	pld2 := []byte{5, 6, 7, 8}
+
+	if err := db.Put(11000, val1, pld1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put(11010, val2, pld2); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := [][]string{nil, {"host"}, {"host=h1", "host=h2"}}
+	for _, vals := range invalid {
+		if err := db.Put(11000, vals, pld1); err != ErrInvalidIndexValues {
+			t.Fatal("should return correct error", vals, err)
+		}
+	}
+
+	db.Close()
+
+	// the index type is stored with each bucket
+	stored, err := dbucket.LoadOptions(dbucket.Options{
+		DatabaseName: "test",
+		DataPath:     "/tmp/test-dbase/",
+		BaseTime:     11000,
+		ReadOnly:     true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	} else if !stored.Labels {
+		t.Fatal("bucket should use a labels index")
+	}
+
+	db, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	res, err := db.Get(11000, 11020, []string{"app=web", "host=h1"})
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{pld1, pld0}) {
+		t.Fatal("labels should match in any order")
+	}
+
+	out, err := db.Find(11000, 11020, []string{"app=web"})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(out) != 2 {
+		t.Fatal("should find series with a subset of labels")
+	}
+
+	out, err = db.Find(11000, 11020, []string{"zone=z1", "app=web"})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(out) != 1 {
+		t.Fatal("should find series with all given labels")
+	}
+
+	for el, plds := range out {
+		if !reflect.DeepEqual(el.Values, []string{"app=web", "host=h2", "zone=z1"}) {
+			t.Fatal("invalid index values")
+		} else if !reflect.DeepEqual(plds, [][]byte{pld0, pld2}) {
+			t.Fatal("invalid payload")
+		}
+	}
+}
+
+func TestSeriesID(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	val1 := []string{"a", "b", "c", "d"}
+	val2 := []string{"a", "b", "c", "e"}
+	pld0 := []byte{0, 0, 0, 0}
+	pld1 := []byte{1, 2, 3, 4}
+	pld2 := []byte{5, 6, 7, 8}
+
+	id1, err := db.SeriesID(val1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id2, err := db.SeriesID(val2)
+	if err != nil {
+		t.Fatal(err)
+	} else if id1 == 0 || id2 == 0 || id1 == id2 {
+		t.Fatal("series should have different IDs", id1, id2)
+	}
+
+	if id, err := db.SeriesID(val1); err != nil {
+		t.Fatal(err)
+	} else if id != id1 {
+		t.Fatal("series should keep the same ID")
+	}
+
+	if _, err := db.SeriesID([]string{"a", "b"}); err != ErrInvalidIndexValues {
+		t.Fatal("should validate index values")
+	}
+
+	if err := db.PutByID(11000, id1, pld1); err != nil {
+		t.Fatal(err)
+	}
+
+	// written twice so the cached record position is used
+	if err := db.PutByID(11010, id2, pld1); err != nil {
+		t.Fatal(err)
+	} else if err := db.PutByID(11010, id2, pld2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.PutByID(11000, id2+1, pld1); err != ErrUnknownSeries {
+		t.Fatal("should not write unknown series", err)
+	}
+
+	res, err := db.Get(11000, 11020, val1)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{pld1, pld0}) {
+		t.Fatal("incorrect data")
+	}
+
+	res, err = db.GetByID(11000, 11020, id2)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{pld0, pld2}) {
+		t.Fatal("incorrect data")
+	}
+
+	if _, err := db.GetByID(11000, 11020, 0); err != ErrUnknownSeries {
+		t.Fatal("should not read unknown series", err)
+	}
+
+	// IDs should be visible to readers
+	opts := db.Options
+	opts.ReadOnly = true
+
+	rdb, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rdb.Close()
+
+	if id, err := rdb.SeriesID(val2); err != nil {
+		t.Fatal(err)
+	} else if id != id2 {
+		t.Fatal("reader should use the same IDs")
+	}
+
+	val3 := []string{"a", "b", "c", "f"}
+	if _, err := rdb.SeriesID(val3); err != ErrUnknownSeries {
+		t.Fatal("reader should not register series", err)
+	}
+
+	// registered after the reader loaded series
+	id3, err := db.SeriesID(val3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rdb.PutByID(11000, id3, pld1); err != ErrReadOnly {
+		t.Fatal("should not write to a read only database")
+	}
+
+	if res, err := rdb.GetByID(11000, 11020, id3); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{pld0, pld0}) {
+		t.Fatal("incorrect data")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.SeriesID(val1); err != ErrClosed {
+		t.Fatal("should not use IDs after closing", err)
+	}
+
+	db, err = New(db.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	ids := map[uint64][]string{id1: val1, id2: val2, id3: val3}
+	for id, vals := range ids {
+		if n, err := db.SeriesID(vals); err != nil {
+			t.Fatal(err)
+		} else if n != id {
+			t.Fatal("series should keep IDs after reopening")
+		}
+	}
+
+	res, err = db.GetByID(11000, 11020, id1)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{pld1, pld0}) {
+		t.Fatal("incorrect data")
+	}
+}
+
+func TestSeriesIDLabels(t *testing.T) {
+	defer cleanTestFiles()
+
+	clock.UseTestClock()
+	clock.Goto(11999)
+	cleanTestFiles()
+
+	db, err := New(Options{
+		DatabaseName:   "test",
+		DataPath:       "/tmp/test-dbase/",
+		Labels:         true,
+		PayloadSize:    4,
+		BucketDuration: 1000,
+		Resolution:     10,
+		SegmentSize:    10,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	id, err := db.SeriesID([]string{"host=h1", "app=web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := db.SeriesID([]string{"app=web", "host=h1"}); err != nil {
+		t.Fatal(err)
+	} else if n != id {
+		t.Fatal("labels should have the same ID in any order")
+	}
+
+	pld := []byte{1, 2, 3, 4}
+	if err := db.PutByID(11000, id, pld); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := db.Find(11000, 11010, []string{"app=web"})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(out) != 1 {
+		t.Fatal("should find the series")
+	}
+
+	for el, plds := range out {
+		if !reflect.DeepEqual(el.Values, []string{"app=web", "host=h1"}) {
+			t.Fatal("invalid index values")
+		} else if !reflect.DeepEqual(plds, [][]byte{pld}) {
+			t.Fatal("invalid payload")
+		}
+	}
+}
+
+func TestLatest(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	val1 := []string{"a", "b", "c", "d"}
+	val2 := []string{"a", "b", "c", "e"}
+	pld1 := []byte{1, 2, 3, 4}
+	pld2 := []byte{5, 6, 7, 8}
+
+	// hot buckets doesn't have the series yet
+	pt, err := db.Latest(val1)
+	if err != nil {
+		t.Fatal(err)
+	} else if pt == nil || pt.Timestamp != 6060 || !reflect.DeepEqual(pt.Payload, []byte{6, 0, 6, 0}) {
+		t.Fatal("should use older buckets", pt)
+	}
+
+	if err := db.Put(11055, val1, pld1); err != nil {
+		t.Fatal(err)
+	} else if err := db.Put(10020, val2, pld2); err != nil {
+		t.Fatal(err)
+	}
+
+	pt, err = db.Latest(val1)
+	if err != nil {
+		t.Fatal(err)
+	} else if pt == nil || pt.Timestamp != 11050 || !reflect.DeepEqual(pt.Payload, pld1) {
+		t.Fatal("invalid data", pt)
+	}
+
+	if pt, err := db.Latest([]string{"a", "b", "c", "f"}); err != nil {
+		t.Fatal(err)
+	} else if pt != nil {
+		t.Fatal("missing series should not have a payload")
+	}
+
+	if _, err := db.Latest([]string{"a"}); err != ErrInvalidIndexValues {
+		t.Fatal("should validate index values")
+	}
+
+	exp := map[string]*kdb.Point{
+		"d": {Timestamp: 11050, Payload: pld1},
+		"e": {Timestamp: 10020, Payload: pld2},
+	}
+
+	check := func(db *DBase) {
+		out, err := db.LatestFind([]string{"a", "b", "c", ""})
+		if err != nil {
+			t.Fatal(err)
+		} else if len(out) != len(exp) {
+			t.Fatal("should find all series")
+		}
+
+		for el, pt := range out {
+			if !reflect.DeepEqual(pt, exp[el.Values[3]]) {
+				t.Fatal("invalid data", el.Values, pt)
+			}
+		}
+	}
+
+	check(db)
+
+	opts := db.Options
+	opts.ReadOnly = true
+
+	rdb, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rdb.Close()
+
+	check(rdb)
+}
+
+func TestLatestMaxAge(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+
+	// buckets which end before 6999 are not opened
+	opts := db.Options
+	opts.LatestMaxAge = 5000
+
+	db, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	cold := metricBktsOpened.With("cold").Value()
+	vals := []string{"a", "b", "c", "d"}
+
+	// data at 6060 is older than LatestMaxAge
+	if pt, err := db.Latest(vals); err != nil {
+		t.Fatal(err)
+	} else if pt != nil {
+		t.Fatal("old data should not be returned", pt)
+	}
+
+	for _, q := range [][]string{vals, {"a", "b", "c", ""}} {
+		if out, err := db.LatestFind(q); err != nil {
+			t.Fatal(err)
+		} else if len(out) != 0 {
+			t.Fatal("old data should not be returned")
+		}
+	}
+
+	if _, err := db.CBuckets.Get(3000); err == nil {
+		t.Fatal("older buckets should not be opened")
+	} else if metricBktsOpened.With("cold").Value()-cold > 1 {
+		t.Fatal("only buckets within LatestMaxAge should be opened")
+	}
+
+	db.LatestMaxAge = 6000
+
+	if pt, err := db.Latest(vals); err != nil {
+		t.Fatal(err)
+	} else if pt == nil || pt.Timestamp != 6060 {
+		t.Fatal("invalid data", pt)
+	}
+}
+
+func TestOpenBucketOnce(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	vals := []string{"a", "b", "c", "d"}
+	pld := []byte{3, 0, 3, 0}
+	opened := metricBktsOpened.With("cold").Value()
+
+	// the cold bucket with 3030 is not in memory
+	// all requests should use the same bucket
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			res, err := db.Get(3030, 3040, vals)
+			if err == nil && (len(res) != 1 || !reflect.DeepEqual(res[0], pld)) {
+				err = errors.New("invalid data")
+			}
+
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := metricBktsOpened.With("cold").Value() - opened; n != 1 {
+		t.Fatal("bucket should be opened once, opened", n)
+	}
+}
+
+func TestOpenSealingBucket(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	vals := []string{"a", "b", "c", "d"}
+	pld := []byte{1, 2, 3, 4}
+	if err := db.Put(11060, vals, pld); err != nil {
+		t.Fatal(err)
+	}
+
+	// remove the hot bucket while a request is using it
+	// so it's sealed when the request completes
+	bkt, err := db.getBucket(11060)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.bucketMutex.Lock()
+	if _, err := db.HBuckets.Del(11000); err != nil {
+		t.Fatal(err)
+	}
+	db.sealing[11000] = bkt
+	db.bucketMutex.Unlock()
+
+	if err := bkt.evict(true); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		res, err := db.Get(11060, 11070, vals)
+		if err == nil && !reflect.DeepEqual(res[0], pld) {
+			err = errors.New("invalid data")
+		}
+
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("bucket should not be opened while sealing")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	bkt.release()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	vals := []string{"a", "b", "c", "d"}
+	var i int64
+
+	// create more buckets than `MaxColdBuckets`
+	// so cold buckets are removed while in use
+	// data at 6060 is already in a cold bucket
+	for i = 1; i <= 9; i++ {
+		if i == 6 {
+			continue
+		}
+
+		clock.Goto(i*1000 + 999)
+		pld := []byte{byte(i), 0, byte(i), 0}
+		if err := db.Put(i*1000+60, vals, pld); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock.Goto(11999)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+
+	for j := 0; j < 16; j++ {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+
+			for k := 0; k < 20; k++ {
+				var err error
+
+				switch j % 4 {
+				case 0:
+					ts := int64(11000 + 10*(j*20+k)%1000)
+					err = db.Put(ts, vals, []byte{1, 2, 3, 4})
+				case 1:
+					_, err = db.Find(1000, 10000, []string{"a", "b", "c", ""})
+				default:
+					var res [][]byte
+					res, err = db.Get(1000, 10000, vals)
+
+					for n := 1; n <= 9 && err == nil; n++ {
+						pld := []byte{byte(n), 0, byte(n), 0}
+						if !reflect.DeepEqual(res[(n*1000+60-1000)/10], pld) {
+							err = errors.New("invalid data")
+						}
+					}
+				}
+
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(j)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
 	}
 }
 
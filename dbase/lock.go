@@ -0,0 +1,141 @@
+package dbase
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// default permissions used when creating lock files
+	LockFilePermissions = 0644
+)
+
+var (
+	ErrLocked    = errors.New("locked by another writer")
+	ErrStaleLock = errors.New("stale lock left by a process which did not close the database")
+)
+
+// LockError is returned when a data path is locked by another process and
+// reported with `OnError` when a stale lock is found. It has the path of the
+// lock file and the id of the process which created it (zero if not known).
+type LockError struct {
+	Path string
+	PID  int
+	Err  error
+}
+
+func (e *LockError) Error() string {
+	msg := e.Path + ": " + e.Err.Error()
+	if e.PID != 0 {
+		msg += " (pid " + strconv.Itoa(e.PID) + ")"
+	}
+
+	return msg
+}
+
+func (e *LockError) Unwrap() error {
+	return e.Err
+}
+
+// lock takes an exclusive lock on all data paths so only one process can
+// write to the database. Locks are released by the kernel when the process
+// exits, a lock file with a process id is left only if it did not close the
+// database. Read only databases does not need to take the lock.
+func (db *DBase) lock() (err error) {
+	for _, dataPath := range db.dataPaths() {
+		file, err := db.lockDataPath(dataPath)
+		if err != nil {
+			db.unlock()
+			return err
+		}
+
+		db.locks = append(db.locks, file)
+	}
+
+	return nil
+}
+
+// lockDataPath locks the lock file and stores the id of the current process
+// * lock file path: DATA_PATH/DATABASE_NAME.lock
+func (db *DBase) lockDataPath(dataPath string) (file *os.File, err error) {
+	if err := os.MkdirAll(dataPath, DataPathPermissions); err != nil {
+		return nil, err
+	}
+
+	fpath := path.Join(dataPath, db.DatabaseName+".lock")
+	file, err = os.OpenFile(fpath, os.O_CREATE|os.O_RDWR, LockFilePermissions)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		pid := readPID(file)
+		file.Close()
+
+		if err == syscall.EWOULDBLOCK {
+			return nil, &LockError{fpath, pid, ErrLocked}
+		}
+
+		return nil, err
+	}
+
+	// the lock is not held by any process but the file has a process id
+	if pid := readPID(file); pid != 0 {
+		db.onError(&LockError{fpath, pid, ErrStaleLock})
+	}
+
+	if err := writePID(file, os.Getpid()); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// unlock removes process ids from lock files and releases all locks
+func (db *DBase) unlock() (err error) {
+	for _, file := range db.locks {
+		if e := writePID(file, 0); e != nil && err == nil {
+			err = e
+		}
+
+		if e := file.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	db.locks = nil
+	return err
+}
+
+// readPID reads the process id stored in a lock file (zero if not set)
+func readPID(file *os.File) (pid int) {
+	data := make([]byte, 20)
+	n, _ := file.ReadAt(data, 0)
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data[:n])))
+	if err != nil {
+		return 0
+	}
+
+	return pid
+}
+
+// writePID replaces the content of a lock file with a process id
+// the file is left empty if the process id is zero
+func writePID(file *os.File, pid int) (err error) {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+
+	if pid == 0 {
+		return nil
+	}
+
+	_, err = file.WriteAt([]byte(strconv.Itoa(pid)+"\n"), 0)
+	return err
+}
@@ -0,0 +1,181 @@
+package dbase
+
+import (
+	"os"
+	"path"
+	"sync"
+
+	"github.com/meteorhacks/kdb"
+	"github.com/meteorhacks/kdb/mindex"
+)
+
+// registry assigns stable IDs to series of the database. IDs are given in
+// the order series are registered starting from 1. Series are stored in an
+// index file with IDs as positions of index elements so IDs don't change
+// when the database is reopened.
+type registry struct {
+	index    *mindex.MIndex
+	series   []*kdb.IndexElement // registered series by ID (series[id-1])
+	readOnly bool
+	mutex    *sync.RWMutex // used when registering or loading series
+}
+
+// openRegistry opens the series registry of the database
+// read only databases can't open it until the writer has created it
+// * series registry file path: DATA_PATH/DATABASE_NAME.series
+func (db *DBase) openRegistry() (reg *registry, err error) {
+	db.registryMutex.Lock()
+	defer db.registryMutex.Unlock()
+
+	select {
+	case <-db.closed:
+		return nil, ErrClosed
+	default:
+	}
+
+	if db.registry != nil {
+		return db.registry, nil
+	}
+
+	if !db.ReadOnly {
+		if err := os.MkdirAll(db.DataPath, DataPathPermissions); err != nil {
+			return nil, err
+		}
+	}
+
+	index, err := mindex.NewMIndex(mindex.MIndexOpts{
+		FilePath:   path.Join(db.DataPath, db.DatabaseName+".series"),
+		IndexDepth: db.IndexDepth,
+		Labels:     db.Labels,
+		ReadOnly:   db.ReadOnly,
+	})
+
+	if os.IsNotExist(err) && db.ReadOnly {
+		return nil, ErrUnknownSeries
+	} else if err != nil {
+		return nil, err
+	}
+
+	reg = &registry{
+		index:    index,
+		readOnly: db.ReadOnly,
+		mutex:    &sync.RWMutex{},
+	}
+
+	if err := reg.load(); err != nil {
+		index.Close()
+		return nil, err
+	}
+
+	db.registry = reg
+	return reg, nil
+}
+
+// id returns the ID of the series, new series are registered
+// read only registries load series registered by the writer
+func (reg *registry) id(vals []string) (id uint64, err error) {
+	el, err := reg.index.Get(vals)
+	if err != nil {
+		return 0, err
+	} else if el != nil {
+		return uint64(el.Position), nil
+	}
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	if reg.readOnly {
+		if err := reg.refresh(); err != nil {
+			return 0, err
+		}
+	}
+
+	// the series may be registered by another request
+	el, err = reg.index.Get(vals)
+	if err != nil {
+		return 0, err
+	} else if el != nil {
+		return uint64(el.Position), nil
+	}
+
+	if reg.readOnly {
+		return 0, ErrUnknownSeries
+	}
+
+	id = uint64(len(reg.series) + 1)
+	el, err = reg.index.Add(vals, int64(id))
+	if err != nil {
+		return 0, err
+	}
+
+	reg.series = append(reg.series, el)
+	return id, nil
+}
+
+// values returns index values of the series with the ID
+func (reg *registry) values(id uint64) (vals []string, err error) {
+	reg.mutex.RLock()
+	el := reg.get(id)
+	reg.mutex.RUnlock()
+
+	if el == nil && reg.readOnly {
+		reg.mutex.Lock()
+		err = reg.refresh()
+		el = reg.get(id)
+		reg.mutex.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if el == nil {
+		return nil, ErrUnknownSeries
+	}
+
+	return el.Values, nil
+}
+
+func (reg *registry) get(id uint64) (el *kdb.IndexElement) {
+	if id == 0 || id > uint64(len(reg.series)) {
+		return nil
+	}
+
+	return reg.series[id-1]
+}
+
+// refresh loads series registered by the writer after it was opened
+// all series are loaded again so it should only be used with unknown series
+func (reg *registry) refresh() (err error) {
+	if err := reg.index.Refresh(); err != nil {
+		return err
+	}
+
+	return reg.load()
+}
+
+// load places index elements by their IDs
+func (reg *registry) load() (err error) {
+	els, err := reg.index.Find(nil)
+	if err != nil {
+		return err
+	}
+
+	for _, el := range els {
+		if el.Position <= 0 {
+			continue
+		}
+
+		for int64(len(reg.series)) < el.Position {
+			reg.series = append(reg.series, nil)
+		}
+
+		reg.series[el.Position-1] = el
+	}
+
+	return nil
+}
+
+func (reg *registry) close() (err error) {
+	return reg.index.Close()
+}
@@ -0,0 +1,216 @@
+package dbase
+
+import (
+	"errors"
+	"hash/fnv"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/meteorhacks/kdb"
+	"github.com/meteorhacks/kdb/pslice"
+)
+
+// Sharding is the strategy used to place data in multiple data paths
+type Sharding int
+
+const (
+	// whole buckets are placed in data paths in round robin order
+	// using bucket base time. Get and Find requests may need to
+	// read from more than one data path if the range is long.
+	ShardByTime Sharding = iota
+
+	// series are placed in data paths using a hash of the first index
+	// value. Each data path will have buckets for all time ranges.
+	// Find requests without a first index value will read all paths.
+	// With labels, the first label sorted by name is used and Find
+	// requests always read all paths.
+	ShardBySeries
+)
+
+const (
+	// default permissions used when creating data paths
+	DataPathPermissions = 0744
+
+	ShardsCount = 3
+
+	// indexes for values stored in the shards file
+	ShardsStrategy = 0 // sharding strategy + 1 (0 if not set yet)
+	ShardsIndex    = 1 // index of the data path
+	ShardsTotal    = 2 // number of data paths
+)
+
+var (
+	ErrShardMismatch = errors.New("data paths or sharding strategy has changed")
+)
+
+// dataPaths returns all paths used to store bucket files
+func (db *DBase) dataPaths() (paths []string) {
+	if len(db.DataPaths) == 0 {
+		return []string{db.DataPath}
+	}
+
+	return db.DataPaths
+}
+
+// pathFor returns the data path to store a new bucket with given base time
+// when sharding by time, otherwise buckets are stored in `DataPath`
+func (db *DBase) pathFor(baseTS int64) (dataPath string) {
+	paths := db.dataPaths()
+	if len(paths) == 1 || db.Sharding != ShardByTime {
+		return db.DataPath
+	}
+
+	n := int64(len(paths))
+	i := (baseTS / db.BucketDuration) % n
+	if i < 0 {
+		i += n
+	}
+
+	return paths[i]
+}
+
+// shardFor returns the shard which stores the series when sharding by series
+func (db *DBase) shardFor(vals []string) (shard *DBase) {
+	return db.shards[db.shardIndex(vals[0])]
+}
+
+func (db *DBase) shardIndex(val string) (i int) {
+	h := fnv.New32a()
+	h.Write([]byte(val))
+	return int(h.Sum32() % uint32(len(db.shards)))
+}
+
+// findShards runs the Find request on shards which may have matching series
+// Results are merged as series are never stored in more than one shard.
+func (db *DBase) findShards(start, end int64, vals []string) (res map[*kdb.IndexElement][][]byte, present map[*kdb.IndexElement][]bool, err error) {
+	// labels are sorted by name, the first label of a series
+	// may not be given when finding series by labels
+	if len(vals) > 0 && vals[0] != "" && !db.Labels {
+		return db.shardFor(vals).find(start, end, vals)
+	}
+
+	res = make(map[*kdb.IndexElement][][]byte)
+	present = make(map[*kdb.IndexElement][]bool)
+
+	for _, shard := range db.shards {
+		out, marks, err := shard.find(start, end, vals)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for el, plds := range out {
+			res[el] = plds
+			present[el] = marks[el]
+		}
+	}
+
+	return res, present, nil
+}
+
+// latestFindShards works like `findShards` with `LatestFind` requests
+func (db *DBase) latestFindShards(vals []string) (res map[*kdb.IndexElement]*kdb.Point, err error) {
+	if len(vals) > 0 && vals[0] != "" && !db.Labels {
+		return db.shardFor(vals).latestFind(vals)
+	}
+
+	res = make(map[*kdb.IndexElement]*kdb.Point)
+
+	for _, shard := range db.shards {
+		out, err := shard.latestFind(vals)
+		if err != nil {
+			return nil, err
+		}
+
+		for el, pt := range out {
+			res[el] = pt
+		}
+	}
+
+	return res, nil
+}
+
+// openShards opens a database for each data path when sharding by series
+func (db *DBase) openShards() (err error) {
+	db.shards = make([]*DBase, 0, len(db.DataPaths))
+
+	for i, dataPath := range db.DataPaths {
+		opts := db.Options
+		opts.DataPath = dataPath
+		opts.DataPaths = nil
+		opts.Tiers = shardTiers(db.Tiers, i)
+
+		if db.Archiver != nil {
+			opts.Archiver = shardArchiver{db.Archiver, strconv.Itoa(i)}
+		}
+
+		shard, err := New(opts)
+		if err != nil {
+			db.Close()
+			return err
+		}
+
+		db.shards = append(db.shards, shard)
+	}
+
+	return nil
+}
+
+// checkShards stores the sharding strategy and the position of each data
+// path in a file so placement of data stays the same when it's reopened
+// Read only databases only check data paths which already have the file.
+// * shards file path: DATA_PATH/DATABASE_NAME.shards
+func (db *DBase) checkShards() (err error) {
+	if len(db.DataPaths) == 0 {
+		return nil
+	}
+
+	total := float64(len(db.DataPaths))
+	strategy := float64(db.Sharding + 1)
+
+	for i, dataPath := range db.DataPaths {
+		fpath := path.Join(dataPath, db.DatabaseName+".shards")
+
+		var shards *pslice.Pslice
+
+		if db.ReadOnly {
+			// read only databases only check data paths created by the writer
+			shards, err = pslice.Open(fpath, ShardsCount)
+			if os.IsNotExist(err) || err == pslice.ErrFileTooSmall {
+				continue
+			}
+		} else {
+			if err := os.MkdirAll(dataPath, DataPathPermissions); err != nil {
+				return err
+			}
+
+			shards, err = pslice.New(fpath, ShardsCount)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if shards.Get(ShardsStrategy) == 0 {
+			if db.ReadOnly {
+				shards.Close()
+				continue
+			}
+
+			shards.Set(ShardsStrategy, strategy)
+			shards.Set(ShardsIndex, float64(i))
+			shards.Set(ShardsTotal, total)
+		} else if shards.Get(ShardsStrategy) != strategy ||
+			shards.Get(ShardsIndex) != float64(i) ||
+			shards.Get(ShardsTotal) != total {
+			shards.Close()
+			return ErrShardMismatch
+		}
+
+		if err := shards.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
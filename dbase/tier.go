@@ -0,0 +1,234 @@
+package dbase
+
+import (
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/meteorhacks/kdb/clock"
+)
+
+const (
+	// default time between checks for buckets which should be moved
+	DefaultTierInterval = time.Minute
+)
+
+// Tier is a secondary place to store buckets after they get old.
+// Buckets are moved to the tier with the highest `Age` less than
+// the age of the bucket (time passed since the end of the bucket).
+type Tier struct {
+	// place to store data files
+	Path string
+
+	// minimum age of buckets in nano seconds
+	Age int64
+}
+
+// allPaths returns data paths and tier paths
+// all these paths may have bucket files
+func (db *DBase) allPaths() (paths []string) {
+	paths = append([]string{}, db.dataPaths()...)
+
+	for _, tier := range db.Tiers {
+		paths = append(paths, tier.Path)
+	}
+
+	return paths
+}
+
+// tierFor returns the path where a bucket should be stored considering
+// its age. Returns an empty string if it should stay in data paths.
+func (db *DBase) tierFor(l layout, now int64) (tierPath string) {
+	var maxAge int64 = -1
+
+	for _, tier := range db.Tiers {
+		if now-l.end() >= tier.Age && tier.Age > maxAge {
+			maxAge = tier.Age
+			tierPath = tier.Path
+		}
+	}
+
+	return tierPath
+}
+
+// runMover periodically moves buckets to correct tiers
+// errors are reported with `OnError`, the move is retried on next run
+func (db *DBase) runMover() {
+	ticker := time.NewTicker(db.TierInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.closed:
+			return
+		case <-ticker.C:
+			if err := db.MoveBuckets(); err != nil {
+				db.onError(err)
+			}
+		}
+	}
+}
+
+// MoveBuckets moves all sealed buckets old enough to be in a tier.
+// Only buckets which are not hot (no more writes) will be moved, buckets
+// still in hot buckets are sealed first. Buckets used by a backfill are
+// moved later. This is done automatically in the background if `Tiers`
+// are set.
+func (db *DBase) MoveBuckets() (err error) {
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if db.shards != nil {
+		for _, shard := range db.shards {
+			if err := shard.MoveBuckets(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	now := clock.Now()
+	nowTS := now - (now % db.BucketDuration)
+	minHot := nowTS - db.BucketDuration*(MaxHotBuckets-1)
+
+	for _, l := range db.layoutsBetween(math.MinInt64, minHot) {
+		if l.end() > minHot {
+			continue
+		}
+
+		tierPath := db.tierFor(l, now)
+		if tierPath == "" || tierPath == l.DataPath {
+			continue
+		}
+
+		if !db.claimBucket(l.BaseTime) {
+			continue
+		}
+
+		err := db.moveBucket(l, tierPath)
+		db.releaseBucket(l.BaseTime)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// moveBucket copies bucket files to the tier path and updates the layout
+// files are copied to a temporary directory and renamed when completed
+// so a bucket never appears in the tier path with missing files
+func (db *DBase) moveBucket(l layout, tierPath string) (err error) {
+	name := db.DatabaseName + "_" + strconv.FormatInt(l.BaseTime, 10)
+	src := path.Join(l.DataPath, name)
+	dst := path.Join(tierPath, name)
+	tmp := path.Join(tierPath, "."+name+".tmp")
+
+	// the bucket may still be in hot buckets after it gets old
+	// it's opened read only after this so writes are rejected
+	if err := db.sealHot(l.BaseTime); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(tierPath, DataPathPermissions); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+
+	if err := copyDir(src, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	l.DataPath = tierPath
+	db.addLayout(l)
+
+	// bucket will be loaded again from the new path when needed
+	if err := db.dropBucket(l.BaseTime); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("rm", "-rf", src)
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// copyDir copies all files in a directory recursively
+// files are synced to make sure they are on disk before renaming
+func copyDir(src, dst string) (err error) {
+	return filepath.Walk(src, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, fpath)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+
+		return copyFile(fpath, target, info.Mode())
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// shardTiers returns tiers to use with a shard when sharding by series
+// * shard tier path: TIER_PATH/SHARD_INDEX
+func shardTiers(tiers []Tier, i int) (res []Tier) {
+	res = make([]Tier, len(tiers))
+
+	for j, tier := range tiers {
+		res[j] = Tier{path.Join(tier.Path, strconv.Itoa(i)), tier.Age}
+	}
+
+	return res
+}
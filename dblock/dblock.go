@@ -1,13 +1,18 @@
 package dblock
 
 import (
+	"encoding/binary"
 	"errors"
+	"io/ioutil"
 	"os"
 	"path"
 	"strconv"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/meteorhacks/kdb"
+	"github.com/meteorhacks/kdb/metrics"
 	"github.com/meteorhacks/kdb/pslice"
 )
 
@@ -23,12 +28,18 @@ const (
 	MetadataSegmentCount = 1 // number of segments in block
 	MetadataRecordCount  = 2 // number of records in block
 
+	// size of the last written payload marker of a record
+	MarkerSize = 4
+
 	// memory mapping params
 	MMapProt = syscall.PROT_READ | syscall.PROT_WRITE
 	MMapFlag = syscall.MAP_SHARED
 
 	// pre-allocation
 	PreallocChunkSize = 1024 * 1024 * 5
+
+	// number of locks used when writing payloads (see recordMutex)
+	WriteLocks = 64
 )
 
 var (
@@ -37,9 +48,18 @@ var (
 	ErrSegInvalidMmap = errors.New("requested segment mmap is not available")
 	ErrSegCannotAlloc = errors.New("could not create a new segment file")
 	ErrAllocRecord    = errors.New("could not allocate space for a new record")
+	ErrBlockTrimmed   = errors.New("write operation on a trimmed block")
+	ErrInvalidRecord  = errors.New("record does not exist in block")
+	ErrInvalidRange   = errors.New("payload positions are out of record bounds")
+	ErrInvalidPayload = errors.New("payload is larger than payload size")
 
 	// reusable byte array
 	emptyChunk = make([]byte, PreallocChunkSize, PreallocChunkSize)
+
+	// metrics reported to the default registry
+	metricPreallocTime  = metrics.NewHistogram("kdb_dblock_preallocate_seconds", "time taken to preallocate a segment", metrics.LatencyBuckets)
+	metricPreallocBytes = metrics.NewCounter("kdb_dblock_preallocated_bytes_total", "number of bytes preallocated for segments")
+	metricPinnedBytes   = metrics.NewGauge("kdb_dblock_pinned_bytes", "memory locked in physical memory for segments")
 )
 
 type Options struct {
@@ -62,15 +82,25 @@ type DBlock struct {
 	segmentFiles map[int64]*os.File // files used to store segments
 	segmentMmaps map[int64][]byte   // memory maps of segment files
 
+	presenceFiles map[int64]*os.File // files used to store presence bitmaps
+	presenceMmaps map[int64][]byte   // memory maps of presence files
+
+	markerFiles map[int64]*os.File // files used to store last written payload markers
+	markerMmaps map[int64][]byte   // memory maps of marker files
+
 	recordSize  int64  // size of a record in bytes
+	bitmapSize  int64  // size of a presence bitmap of a record in bytes
 	emptyRecord []byte // reusable when creating new records
 
-	writeMutex    *sync.Mutex
+	writeMutexes  []*sync.Mutex // used when writing payloads
+	mmapMutex     *sync.RWMutex // used when changing memory maps
 	preallocMutex *sync.Mutex
 	allocateMutex *sync.Mutex
 	preallocating bool
+	trimmed       bool  // unused space is removed from segments
+	pinned        int64 // bytes of segments locked in physical memory
 
-	metadata *pslice.Pslice // segment metadata
+	metadata *pslice.Int64 // segment metadata
 }
 
 func New(opts Options) (blk *DBlock, err error) {
@@ -82,30 +112,39 @@ func New(opts Options) (blk *DBlock, err error) {
 
 	// load metadata
 	metadataFilePath := path.Join(opts.BlockPath, "metadata")
-	metadata, err := pslice.New(metadataFilePath, MetadataCount)
+	metadata, err := pslice.NewInt64(metadataFilePath, MetadataCount)
 	if err != nil {
 		return nil, err
 	}
 
 	// set `SegmentSize` in metadata file
 	if metadata.Get(MetadataSegmentSize) == 0 {
-		size := float64(opts.SegmentSize)
-		metadata.Set(MetadataSegmentSize, size)
+		metadata.Set(MetadataSegmentSize, opts.SegmentSize)
 	}
 
 	blk = &DBlock{
 		Options:       opts,
 		segmentFiles:  segmentFiles,
 		segmentMmaps:  segmentMmaps,
+		presenceFiles: make(map[int64]*os.File),
+		presenceMmaps: make(map[int64][]byte),
+		markerFiles:   make(map[int64]*os.File),
+		markerMmaps:   make(map[int64][]byte),
 		recordSize:    recordSize,
+		bitmapSize:    BitmapSize(opts.PayloadCount),
 		emptyRecord:   emptyRecord,
-		writeMutex:    &sync.Mutex{},
+		writeMutexes:  make([]*sync.Mutex, WriteLocks),
+		mmapMutex:     &sync.RWMutex{},
 		preallocMutex: &sync.Mutex{},
 		allocateMutex: &sync.Mutex{},
 		preallocating: false,
 		metadata:      metadata,
 	}
 
+	for i := range blk.writeMutexes {
+		blk.writeMutexes[i] = &sync.Mutex{}
+	}
+
 	// load available segments
 	err = blk.loadSegments()
 	if err != nil {
@@ -127,7 +166,11 @@ func (blk *DBlock) New() (rpos int64, err error) {
 	blk.allocateMutex.Lock()
 	defer blk.allocateMutex.Unlock()
 
-	nextRecordChan := make(chan float64)
+	if blk.trimmed {
+		return 0, ErrBlockTrimmed
+	}
+
+	nextRecordChan := make(chan int64)
 	errorChan := make(chan error)
 
 	// start allocation if needed, and do it inside a goroutine
@@ -143,7 +186,7 @@ func (blk *DBlock) New() (rpos int64, err error) {
 	// that's why we need to run our logic also within a goroutine
 	go func() {
 		totalRecords := blk.totalRecords()
-		nextRecord := blk.metadata.Get(MetadataRecordCount)
+		nextRecord := blk.metadata.Load(MetadataRecordCount)
 
 		if nextRecord > totalRecords {
 			// wait until allocation
@@ -178,48 +221,117 @@ func (blk *DBlock) New() (rpos int64, err error) {
 	}
 
 	// update metadata and then unlock
-	blk.metadata.Set(MetadataRecordCount, nextRecord+1)
-	rpos = int64(nextRecord)
+	blk.metadata.Store(MetadataRecordCount, nextRecord+1)
+	rpos = nextRecord
 
 	return rpos, nil
 }
 
 // Put stores a payload `pld` on record starting at `rpos` at position `ppos`
+// errors with the record are returned as `*kdb.RecordError`
 func (blk *DBlock) Put(rpos, ppos int64, pld []byte) (err error) {
-	sno := 1 + rpos/blk.SegmentSize
-	rpos = rpos % blk.SegmentSize
+	if ppos < 0 || ppos >= blk.PayloadCount {
+		return blk.recordError(rpos, ErrInvalidRange)
+	}
 
-	mmap, ok := blk.segmentMmaps[sno]
-	if !ok {
-		panic(ErrSegInvalidMmap)
-		return ErrSegInvalidMmap
+	if int64(len(pld)) > blk.PayloadSize {
+		return blk.recordError(rpos, ErrInvalidPayload)
+	}
+
+	blk.mmapMutex.RLock()
+	defer blk.mmapMutex.RUnlock()
+
+	if blk.trimmed {
+		return ErrBlockTrimmed
+	}
+
+	mmap, offset, err := blk.record(rpos)
+	if err != nil {
+		return err
 	}
 
-	start := int(rpos*blk.recordSize + ppos*blk.PayloadSize)
-	count := len(pld)
+	start := offset + ppos*blk.PayloadSize
 
-	for i := 0; i < count; i++ {
-		mmap[start+i] = pld[i]
+	mutex := blk.recordMutex(rpos)
+	mutex.Lock()
+	copy(mmap[start:], pld)
+	blk.setPresent(rpos, ppos)
+	blk.setLatest(rpos, ppos)
+	mutex.Unlock()
+
+	return nil
+}
+
+// Merge combines payload `pld` with the payload stored on record `rpos` at
+// position `ppos` using `fn` and stores the result. Writes to the record are
+// done one at a time so other writes to the payload are not lost while
+// merging. Errors with the record are returned as `*kdb.RecordError`.
+func (blk *DBlock) Merge(rpos, ppos int64, pld []byte, fn kdb.MergeFunc) (err error) {
+	if ppos < 0 || ppos >= blk.PayloadCount {
+		return blk.recordError(rpos, ErrInvalidRange)
+	}
+
+	if int64(len(pld)) > blk.PayloadSize {
+		return blk.recordError(rpos, ErrInvalidPayload)
 	}
 
+	blk.mmapMutex.RLock()
+	defer blk.mmapMutex.RUnlock()
+
+	if blk.trimmed {
+		return ErrBlockTrimmed
+	}
+
+	mmap, offset, err := blk.record(rpos)
+	if err != nil {
+		return err
+	}
+
+	start := offset + ppos*blk.PayloadSize
+	slot := mmap[start : start+blk.PayloadSize]
+
+	mutex := blk.recordMutex(rpos)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	old := make([]byte, blk.PayloadSize)
+	copy(old, slot)
+
+	res, err := fn(old, pld)
+	if err != nil {
+		return blk.recordError(rpos, err)
+	} else if int64(len(res)) > blk.PayloadSize {
+		return blk.recordError(rpos, ErrInvalidPayload)
+	}
+
+	copy(slot, res)
+	blk.setPresent(rpos, ppos)
+	blk.setLatest(rpos, ppos)
+
 	return nil
 }
 
 // Get reads payloads from `start` to `end` on a record starting at `rpos`
+// payloads are copied so they can be used after the block is closed
+// errors with the record are returned as `*kdb.RecordError`
 func (blk *DBlock) Get(rpos, start, end int64) (res [][]byte, err error) {
-	sno := 1 + rpos/blk.SegmentSize
-	rpos = rpos % blk.SegmentSize
+	if start < 0 || end > blk.PayloadCount || start > end {
+		return nil, blk.recordError(rpos, ErrInvalidRange)
+	}
 
-	mmap, ok := blk.segmentMmaps[sno]
-	if !ok {
-		panic(ErrSegInvalidMmap)
-		return nil, ErrSegInvalidMmap
+	blk.mmapMutex.RLock()
+	defer blk.mmapMutex.RUnlock()
+
+	mmap, offset, err := blk.record(rpos)
+	if err != nil {
+		return nil, err
 	}
 
 	payloadCount := end - start
-	startOffset := rpos*blk.recordSize + start*blk.PayloadSize
+	startOffset := offset + start*blk.PayloadSize
 	endOffset := startOffset + blk.PayloadSize*payloadCount
-	resultData := mmap[startOffset:endOffset]
+	resultData := make([]byte, endOffset-startOffset)
+	copy(resultData, mmap[startOffset:endOffset])
 
 	res = make([][]byte, payloadCount, payloadCount)
 
@@ -231,14 +343,212 @@ func (blk *DBlock) Get(rpos, start, end int64) (res [][]byte, err error) {
 	return res, nil
 }
 
-// close all file handlers
+// Present reports which payloads from `start` to `end` on a record starting
+// at `rpos` were written. Payloads written with only zero bytes are present.
+// errors with the record are returned as `*kdb.RecordError`
+func (blk *DBlock) Present(rpos, start, end int64) (res []bool, err error) {
+	if start < 0 || end > blk.PayloadCount || start > end {
+		return nil, blk.recordError(rpos, ErrInvalidRange)
+	}
+
+	blk.mmapMutex.RLock()
+	defer blk.mmapMutex.RUnlock()
+
+	if _, _, err := blk.record(rpos); err != nil {
+		return nil, err
+	}
+
+	bitmap, ok := blk.bitmap(rpos)
+	if !ok {
+		return nil, blk.recordError(rpos, ErrSegInvalidMmap)
+	}
+
+	res = make([]bool, end-start)
+	for i := range res {
+		res[i] = IsPresent(bitmap, start+int64(i))
+	}
+
+	return res, nil
+}
+
+// Latest returns the payload with the highest position written on a record
+// starting at `rpos` and its position, `ppos` is -1 if the record is empty.
+// The payload is copied same as payloads returned by `Get`.
+// errors with the record are returned as `*kdb.RecordError`
+func (blk *DBlock) Latest(rpos int64) (ppos int64, pld []byte, err error) {
+	blk.mmapMutex.RLock()
+	defer blk.mmapMutex.RUnlock()
+
+	mmap, offset, err := blk.record(rpos)
+	if err != nil {
+		return -1, nil, err
+	}
+
+	marker, ok := blk.marker(rpos)
+	if !ok {
+		return -1, nil, blk.recordError(rpos, ErrSegInvalidMmap)
+	}
+
+	ppos = MarkerPosition(marker)
+	if ppos < 0 || ppos >= blk.PayloadCount {
+		return -1, nil, nil
+	}
+
+	pld = make([]byte, blk.PayloadSize)
+	copy(pld, mmap[offset+ppos*blk.PayloadSize:])
+
+	return ppos, pld, nil
+}
+
+// bitmap returns the presence bitmap of the record at `rpos`
+// memory maps should be locked for reading (see record)
+func (blk *DBlock) bitmap(rpos int64) (bitmap []byte, ok bool) {
+	sno := 1 + rpos/blk.SegmentSize
+	offset := (rpos % blk.SegmentSize) * blk.bitmapSize
+
+	mmap, ok := blk.presenceMmaps[sno]
+	if !ok || offset+blk.bitmapSize > int64(len(mmap)) {
+		return nil, false
+	}
+
+	return mmap[offset : offset+blk.bitmapSize], true
+}
+
+// setPresent marks the payload at `ppos` of the record at `rpos` as written
+// bitmaps are modified only with the record lock locked
+func (blk *DBlock) setPresent(rpos, ppos int64) {
+	if bitmap, ok := blk.bitmap(rpos); ok {
+		bitmap[ppos/8] |= 1 << uint(ppos%8)
+	}
+}
+
+// marker returns the last written payload marker of the record at `rpos`
+// memory maps should be locked for reading (see record)
+func (blk *DBlock) marker(rpos int64) (marker []byte, ok bool) {
+	sno := 1 + rpos/blk.SegmentSize
+	offset := (rpos % blk.SegmentSize) * MarkerSize
+
+	mmap, ok := blk.markerMmaps[sno]
+	if !ok || offset+MarkerSize > int64(len(mmap)) {
+		return nil, false
+	}
+
+	return mmap[offset : offset+MarkerSize], true
+}
+
+// setLatest marks `ppos` as the last written payload of the record at
+// `rpos` if it's after the marked payload. Markers are modified only
+// with the record lock locked.
+func (blk *DBlock) setLatest(rpos, ppos int64) {
+	if marker, ok := blk.marker(rpos); ok && MarkerPosition(marker) < ppos {
+		binary.LittleEndian.PutUint32(marker, uint32(ppos+1))
+	}
+}
+
+// MarkerPosition returns the payload position stored in a last written
+// payload marker, markers store the position + 1 (0 if nothing is written)
+func MarkerPosition(marker []byte) (ppos int64) {
+	if len(marker) < MarkerSize {
+		return -1
+	}
+
+	return int64(binary.LittleEndian.Uint32(marker)) - 1
+}
+
+// BitmapSize returns the size of the presence bitmap of a record in bytes
+// each payload of the record is marked with a bit (ppos 0 is the lowest bit)
+func BitmapSize(payloadCount int64) (size int64) {
+	return (payloadCount + 7) / 8
+}
+
+// IsPresent checks whether the payload at `ppos` is marked in a presence
+// bitmap, positions after the end of the bitmap are not present
+func IsPresent(bitmap []byte, ppos int64) (ok bool) {
+	if ppos/8 >= int64(len(bitmap)) {
+		return false
+	}
+
+	return bitmap[ppos/8]&(1<<uint(ppos%8)) != 0
+}
+
+// recordMutex returns the lock used when writing payloads of the record
+// at `rpos`. Records share locks so the number of locks doesn't grow with
+// records, payloads, bitmaps and markers of records don't share bytes.
+func (blk *DBlock) recordMutex(rpos int64) (mutex *sync.Mutex) {
+	return blk.writeMutexes[rpos%WriteLocks]
+}
+
+// record returns the memory map of the segment which has the record
+// at `rpos` and the offset of the record in the memory map. Memory maps
+// are added by `New` in the background and unmapped when trimming or
+// closing, `mmapMutex` should be locked for reading while using them.
+func (blk *DBlock) record(rpos int64) (mmap []byte, offset int64, err error) {
+	if rpos < 0 || rpos >= blk.metadata.Load(MetadataRecordCount) {
+		return nil, 0, blk.recordError(rpos, ErrInvalidRecord)
+	}
+
+	sno := 1 + rpos/blk.SegmentSize
+	offset = (rpos % blk.SegmentSize) * blk.recordSize
+
+	mmap, ok := blk.segmentMmaps[sno]
+	if !ok || offset+blk.recordSize > int64(len(mmap)) {
+		return nil, 0, blk.recordError(rpos, ErrSegInvalidMmap)
+	}
+
+	return mmap, offset, nil
+}
+
+func (blk *DBlock) recordError(rpos int64, err error) (rerr error) {
+	sno := 1 + rpos/blk.SegmentSize
+	if rpos < 0 {
+		sno = 0
+	}
+
+	return &kdb.RecordError{Record: rpos, Segment: sno, Err: err}
+}
+
+// close all file handlers and memory maps
+// the block can't be used after closing
 func (blk *DBlock) Close() (err error) {
+	blk.allocateMutex.Lock()
+	defer blk.allocateMutex.Unlock()
+
+	blk.preallocMutex.Lock()
+	defer blk.preallocMutex.Unlock()
+
+	blk.mmapMutex.Lock()
+	defer blk.mmapMutex.Unlock()
+
+	metricPinnedBytes.Add(-blk.pinned)
+	blk.pinned = 0
+
+	for _, mmaps := range []map[int64][]byte{blk.segmentMmaps, blk.presenceMmaps, blk.markerMmaps} {
+		for sno, mmap := range mmaps {
+			delete(mmaps, sno)
+			if err := syscall.Munmap(mmap); err != nil {
+				return err
+			}
+		}
+	}
+
 	for _, f := range blk.segmentFiles {
 		if err := f.Close(); err != nil {
 			return err
 		}
 	}
 
+	for _, f := range blk.presenceFiles {
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range blk.markerFiles {
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
 	if err := blk.metadata.Close(); err != nil {
 		return err
 	}
@@ -246,7 +556,131 @@ func (blk *DBlock) Close() (err error) {
 	return nil
 }
 
+// Trim removes preallocated space which is not used by any record.
+// The last used segment is truncated to fit `MetadataRecordCount` records
+// and segments after it are truncated to zero bytes. Records can still be
+// read after trimming but writes will fail until the block is loaded again.
+func (blk *DBlock) Trim() (err error) {
+	blk.allocateMutex.Lock()
+	defer blk.allocateMutex.Unlock()
+
+	blk.preallocMutex.Lock()
+	defer blk.preallocMutex.Unlock()
+
+	blk.mmapMutex.Lock()
+	defer blk.mmapMutex.Unlock()
+
+	// no records can be added after trimming
+	if blk.trimmed {
+		return nil
+	}
+
+	blk.trimmed = true
+
+	segments := blk.metadata.Load(MetadataSegmentCount)
+	records := blk.metadata.Load(MetadataRecordCount)
+	recordsPerSegment := blk.metadata.Get(MetadataSegmentSize)
+
+	var sno int64
+	for sno = segments; sno > 0; sno-- {
+		used := records - (sno-1)*recordsPerSegment
+		if used >= recordsPerSegment {
+			break
+		} else if used < 0 {
+			used = 0
+		}
+
+		err = blk.trimSegment(sno, used*blk.recordSize)
+		if err != nil {
+			return err
+		}
+
+		err = trimFile(blk.presenceFiles, blk.presenceMmaps, sno, used*blk.bitmapSize)
+		if err != nil {
+			return err
+		}
+
+		err = trimFile(blk.markerFiles, blk.markerMmaps, sno, used*MarkerSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// trimSegment truncates a segment file to `size` bytes and memory maps
+// the remaining data if there's any, `mmapMutex` should be locked
+func (blk *DBlock) trimSegment(sno, size int64) (err error) {
+	file, ok := blk.segmentFiles[sno]
+	if !ok {
+		return ErrSegInvalidMmap
+	}
+
+	// trimmed segments are mmaped again without locking
+	if mmap, ok := blk.segmentMmaps[sno]; ok {
+		metricPinnedBytes.Add(-int64(len(mmap)))
+		blk.pinned -= int64(len(mmap))
+	}
+
+	mmap, err := truncate(file, blk.segmentMmaps[sno], size)
+	delete(blk.segmentMmaps, sno)
+	if err != nil {
+		return err
+	}
+
+	if mmap != nil {
+		blk.segmentMmaps[sno] = mmap
+	}
+
+	return nil
+}
+
+// trimFile truncates the presence or marker file of a segment to `size`
+// bytes and memory maps the remaining data if there's any
+func trimFile(files map[int64]*os.File, mmaps map[int64][]byte, sno, size int64) (err error) {
+	file, ok := files[sno]
+	if !ok {
+		return ErrSegInvalidMmap
+	}
+
+	mmap, err := truncate(file, mmaps[sno], size)
+	delete(mmaps, sno)
+	if err != nil {
+		return err
+	}
+
+	if mmap != nil {
+		mmaps[sno] = mmap
+	}
+
+	return nil
+}
+
+// truncate unmaps `mmap` (if it's not nil), truncates the file to `size`
+// bytes and returns a new memory map of the file (nil if it's empty)
+func truncate(file *os.File, mmap []byte, size int64) (res []byte, err error) {
+	if mmap != nil {
+		if err := syscall.Munmap(mmap); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := file.Truncate(size); err != nil {
+		return nil, err
+	}
+
+	if size == 0 {
+		return nil, nil
+	}
+
+	fd := int(file.Fd())
+	return syscall.Mmap(fd, 0, int(size), MMapProt, MMapFlag)
+}
+
 func (blk *DBlock) preallocate(sno int64, records int64) (err error) {
+	defer metricPreallocTime.Since(time.Now())
+
 	size := blk.PayloadCount * blk.PayloadSize * records
 	fpath := path.Join(blk.BlockPath, "block_"+strconv.Itoa(int(sno)))
 
@@ -259,24 +693,12 @@ func (blk *DBlock) preallocate(sno int64, records int64) (err error) {
 		return err
 	}
 
-	chunks := size / PreallocChunkSize
-	extras := size % PreallocChunkSize
-
-	var i int64
-	for i = 0; i < chunks; i++ {
-		if n, err := file.Write(emptyChunk); err != nil {
-			return err
-		} else if n != PreallocChunkSize {
-			return ErrSegWriteError
-		}
-	}
-
-	if n, err := file.Write(emptyChunk[:extras]); err != nil {
+	if err := blk.fill(file, 0, size); err != nil {
 		return err
-	} else if int64(n) != extras {
-		return ErrSegWriteError
 	}
 
+	metricPreallocBytes.Add(size)
+
 	fd := int(file.Fd())
 	fsize := int(size)
 
@@ -290,28 +712,237 @@ func (blk *DBlock) preallocate(sno int64, records int64) (err error) {
 		return err
 	}
 
+	metricPinnedBytes.Add(int64(len(mmap)))
+	blk.pinned += int64(len(mmap))
+
 	blk.segmentFiles[sno] = file
-	blk.segmentMmaps[sno] = mmap
+	blk.storeMmap(blk.segmentMmaps, sno, mmap)
+
+	// new segments does not have any payloads, presence files left
+	// by segments which were not fully created are replaced
+	bitmaps := make([]byte, records*blk.bitmapSize)
+	if err := ioutil.WriteFile(blk.presencePath(sno), bitmaps, FilePermissions); err != nil {
+		return err
+	}
+
+	if err := blk.loadPresence(sno, records); err != nil {
+		return err
+	}
+
+	markers := make([]byte, records*MarkerSize)
+	if err := ioutil.WriteFile(blk.markerPath(sno), markers, FilePermissions); err != nil {
+		return err
+	}
+
+	return blk.loadMarkers(sno, records)
+}
+
+// storeMmap adds the memory map of a segment while other goroutines may be
+// reading memory maps. Memory maps are only added with `preallocMutex`
+// locked so reading them with it locked doesn't need `mmapMutex`.
+func (blk *DBlock) storeMmap(mmaps map[int64][]byte, sno int64, mmap []byte) {
+	blk.mmapMutex.Lock()
+	mmaps[sno] = mmap
+	blk.mmapMutex.Unlock()
+}
+
+// presencePath returns the path of the presence file of a segment
+// * presence file path: BLOCK_PATH/presence_1
+func (blk *DBlock) presencePath(sno int64) (fpath string) {
+	return path.Join(blk.BlockPath, "presence_"+strconv.Itoa(int(sno)))
+}
+
+// loadPresence memory maps the presence file of a segment with `records`
+// records. Presence files are created for segments created before these
+// were added, payloads with non zero bytes are marked as present.
+func (blk *DBlock) loadPresence(sno, records int64) (err error) {
+	fpath := blk.presencePath(sno)
+	size := records * blk.bitmapSize
+
+	if _, err := os.Stat(fpath); os.IsNotExist(err) {
+		if err := blk.createPresence(fpath, sno, records); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	file, mmap, err := blk.mapFile(fpath, size)
+	if err != nil {
+		return err
+	}
+
+	blk.presenceFiles[sno] = file
+	blk.storeMmap(blk.presenceMmaps, sno, mmap)
 
 	return nil
 }
 
-func (blk *DBlock) totalRecords() (total float64) {
-	segments := blk.metadata.Get(MetadataSegmentCount)
+// mapFile opens a presence or marker file and memory maps `size` bytes
+// these files are trimmed with segments, trimmed files are filled again
+func (blk *DBlock) mapFile(fpath string, size int64) (file *os.File, mmap []byte, err error) {
+	file, err = os.OpenFile(fpath, FileOpenMode, FilePermissions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	finfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	if finfo.Size() < size {
+		if err := blk.fill(file, finfo.Size(), size); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+	}
+
+	mmap, err = syscall.Mmap(int(file.Fd()), 0, int(size), MMapProt, MMapFlag)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return file, mmap, nil
+}
+
+// createPresence writes a presence file for a segment using its payloads
+// the file is written to a temporary file first and renamed so other
+// processes reading the block never see a partially written file
+func (blk *DBlock) createPresence(fpath string, sno, records int64) (err error) {
+	data := make([]byte, records*blk.bitmapSize)
+
+	if mmap, ok := blk.segmentMmaps[sno]; ok {
+		var r, p int64
+		for r = 0; r < records && (r+1)*blk.recordSize <= int64(len(mmap)); r++ {
+			bitmap := data[r*blk.bitmapSize : (r+1)*blk.bitmapSize]
+
+			for p = 0; p < blk.PayloadCount; p++ {
+				start := r*blk.recordSize + p*blk.PayloadSize
+				if !isEmpty(mmap[start : start+blk.PayloadSize]) {
+					bitmap[p/8] |= 1 << uint(p%8)
+				}
+			}
+		}
+	}
+
+	return writeFile(fpath, data)
+}
+
+// markerPath returns the path of the marker file of a segment
+// * marker file path: BLOCK_PATH/latest_1
+func (blk *DBlock) markerPath(sno int64) (fpath string) {
+	return path.Join(blk.BlockPath, "latest_"+strconv.Itoa(int(sno)))
+}
+
+// loadMarkers memory maps the last written payload markers of a segment
+// with `records` records. Marker files are created for segments created
+// before these were added using presence bitmaps (see loadPresence).
+func (blk *DBlock) loadMarkers(sno, records int64) (err error) {
+	fpath := blk.markerPath(sno)
+
+	if _, err := os.Stat(fpath); os.IsNotExist(err) {
+		if err := blk.createMarkers(fpath, sno, records); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	file, mmap, err := blk.mapFile(fpath, records*MarkerSize)
+	if err != nil {
+		return err
+	}
+
+	blk.markerFiles[sno] = file
+	blk.storeMmap(blk.markerMmaps, sno, mmap)
+
+	return nil
+}
+
+// createMarkers writes a marker file for a segment using presence bitmaps
+// of its records, the last present payload of each record is marked
+func (blk *DBlock) createMarkers(fpath string, sno, records int64) (err error) {
+	data := make([]byte, records*MarkerSize)
+
+	var r, p int64
+	for r = 0; r < records; r++ {
+		bitmap, ok := blk.bitmap((sno-1)*blk.SegmentSize + r)
+		if !ok {
+			break
+		}
+
+		for p = blk.PayloadCount - 1; p >= 0; p-- {
+			if IsPresent(bitmap, p) {
+				binary.LittleEndian.PutUint32(data[r*MarkerSize:], uint32(p+1))
+				break
+			}
+		}
+	}
+
+	return writeFile(fpath, data)
+}
+
+// writeFile writes data to a temporary file first and renames it
+// so other processes reading the block never see a partial file
+func writeFile(fpath string, data []byte) (err error) {
+	tmp := fpath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, FilePermissions); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, fpath)
+}
+
+// isEmpty checks whether the payload only has zero bytes
+func isEmpty(pld []byte) (empty bool) {
+	for _, b := range pld {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fill writes empty bytes to the file starting from `offset` until `size`
+func (blk *DBlock) fill(file *os.File, offset, size int64) (err error) {
+	for offset < size {
+		chunk := size - offset
+		if chunk > PreallocChunkSize {
+			chunk = PreallocChunkSize
+		}
+
+		if n, err := file.WriteAt(emptyChunk[:chunk], offset); err != nil {
+			return err
+		} else if int64(n) != chunk {
+			return ErrSegWriteError
+		}
+
+		offset += chunk
+	}
+
+	return nil
+}
+
+func (blk *DBlock) totalRecords() (total int64) {
+	segments := blk.metadata.Load(MetadataSegmentCount)
 	recordsPerSegemnt := blk.metadata.Get(MetadataSegmentSize)
 	return recordsPerSegemnt * segments
 }
 
 func (blk *DBlock) shouldPreallocate() (should bool, nextSegmentId int64) {
-	usedSegments := blk.metadata.Get(MetadataSegmentCount)
-	usedRecords := blk.metadata.Get(MetadataRecordCount)
+	usedSegments := blk.metadata.Load(MetadataSegmentCount)
+	usedRecords := blk.metadata.Load(MetadataRecordCount)
 	recordsPerSegment := blk.metadata.Get(MetadataSegmentSize)
 
 	totalRecords := usedSegments * recordsPerSegment
 	freeRecords := totalRecords - usedRecords
 
-	if freeRecords < recordsPerSegment/2 {
-		return true, int64(usedSegments + 1)
+	if freeRecords*2 < recordsPerSegment {
+		return true, usedSegments + 1
 	} else {
 		return false, 0
 	}
@@ -321,7 +952,7 @@ func (blk *DBlock) preallocateIfNeeded() (err error) {
 	blk.preallocMutex.Lock()
 	defer blk.preallocMutex.Unlock()
 
-	size := int64(blk.metadata.Get(MetadataSegmentSize))
+	size := blk.metadata.Get(MetadataSegmentSize)
 
 	if ok, _ := blk.shouldPreallocate(); ok {
 		if ok, sno := blk.shouldPreallocate(); ok {
@@ -330,7 +961,7 @@ func (blk *DBlock) preallocateIfNeeded() (err error) {
 				return err
 			}
 
-			blk.metadata.Set(MetadataSegmentCount, float64(sno))
+			blk.metadata.Store(MetadataSegmentCount, sno)
 		}
 	}
 
@@ -339,15 +970,18 @@ func (blk *DBlock) preallocateIfNeeded() (err error) {
 
 // load previously created segments from disk to physical memory
 // available segments are found using the metadata file
+// segments trimmed by `Trim` are allocated again to their full size
 // * segment file path: BLOCK_PATH/block_1
 func (blk *DBlock) loadSegments() (err error) {
-	countf := blk.metadata.Get(MetadataSegmentCount)
-	if countf == 0 {
+	count := blk.metadata.Load(MetadataSegmentCount)
+	if count == 0 {
 		return nil
 	}
 
-	count := int(countf)
-	for i := 1; i <= count; i++ {
+	recordsPerSegment := blk.metadata.Get(MetadataSegmentSize)
+	segmentSize := recordsPerSegment * blk.recordSize
+
+	for i := 1; i <= int(count); i++ {
 		fpath := path.Join(blk.BlockPath, "block_"+strconv.Itoa(i))
 
 		file, err := os.OpenFile(fpath, FileOpenMode, FilePermissions)
@@ -361,6 +995,15 @@ func (blk *DBlock) loadSegments() (err error) {
 		}
 
 		fsize := int(finfo.Size())
+		if int64(fsize) < segmentSize {
+			err = blk.fill(file, finfo.Size(), segmentSize)
+			if err != nil {
+				return err
+			}
+
+			fsize = int(segmentSize)
+		}
+
 		fd := int(file.Fd())
 
 		mmap, err := syscall.Mmap(fd, 0, fsize, MMapProt, MMapFlag)
@@ -373,9 +1016,20 @@ func (blk *DBlock) loadSegments() (err error) {
 			return err
 		}
 
+		metricPinnedBytes.Add(int64(len(mmap)))
+		blk.pinned += int64(len(mmap))
+
 		sno := int64(i)
 		blk.segmentFiles[sno] = file
-		blk.segmentMmaps[sno] = mmap
+		blk.storeMmap(blk.segmentMmaps, sno, mmap)
+
+		if err := blk.loadPresence(sno, recordsPerSegment); err != nil {
+			return err
+		}
+
+		if err := blk.loadMarkers(sno, recordsPerSegment); err != nil {
+			return err
+		}
 	}
 
 	return nil
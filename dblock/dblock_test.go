@@ -5,7 +5,10 @@ import (
 	"os"
 	"os/exec"
 	"reflect"
+	"sync"
 	"testing"
+
+	"github.com/meteorhacks/kdb"
 )
 
 // test creating a block struct with an empty block file
@@ -114,6 +117,455 @@ func TestPutAndGet(t *testing.T) {
 	}
 }
 
+func TestMerge(t *testing.T) {
+	defer cleanTestFiles()
+
+	blk, err := createTestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer blk.Close()
+
+	rpos, err := blk.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := func(old, new []byte) ([]byte, error) {
+		res := make([]byte, len(old))
+		for i := range old {
+			res[i] = old[i] + new[i]
+		}
+
+		return res, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := blk.Merge(rpos, 2, []byte{1, 1, 1, 1}, sum); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	res, err := blk.Get(rpos, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(res[0], []byte{200, 200, 200, 200}) {
+		t.Fatal("merges should not be lost")
+	}
+
+	large := func(old, new []byte) ([]byte, error) {
+		return make([]byte, 5), nil
+	}
+
+	if err := blk.Merge(rpos, 2, []byte{1, 1, 1, 1}, large); !errors.Is(err, ErrInvalidPayload) {
+		t.Fatal("should return correct error")
+	}
+
+	errMerge := errors.New("merge failed")
+	failed := func(old, new []byte) ([]byte, error) {
+		return nil, errMerge
+	}
+
+	if err := blk.Merge(rpos, 2, []byte{1, 1, 1, 1}, failed); !errors.Is(err, errMerge) {
+		t.Fatal("should return correct error")
+	}
+
+	res, err = blk.Get(rpos, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res[0], []byte{200, 200, 200, 200}) {
+		t.Fatal("payload should not be changed")
+	}
+}
+
+// test writing and reading records while new segments are added
+func TestConcurrentNew(t *testing.T) {
+	cleanTestFiles()
+	defer cleanTestFiles()
+
+	if err := os.MkdirAll("/tmp/test-dblock", 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	blk, err := New(Options{
+		BlockPath:    "/tmp/test-dblock",
+		PayloadSize:  4,
+		PayloadCount: 10,
+		SegmentSize:  10,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer blk.Close()
+
+	records := make(chan int64, 200)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(records)
+		for i := 0; i < 200; i++ {
+			rpos, err := blk.New()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			records <- rpos
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rpos := range records {
+				if err := blk.Put(rpos, 1, []byte{1, 2, 3, 4}); err != nil {
+					t.Error(err)
+				}
+
+				if res, err := blk.Get(rpos, 1, 2); err != nil {
+					t.Error(err)
+				} else if !reflect.DeepEqual(res[0], []byte{1, 2, 3, 4}) {
+					t.Error("should return correct payload")
+				}
+
+				if ppos, _, err := blk.Latest(rpos); err != nil {
+					t.Error(err)
+				} else if ppos != 1 {
+					t.Error("should return correct position")
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestBounds(t *testing.T) {
+	defer cleanTestFiles()
+
+	blk, err := createTestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer blk.Close()
+
+	rpos, err := blk.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pld := []byte{1, 2, 3, 4}
+
+	if err := blk.Put(rpos+1, 2, pld); !errors.Is(err, ErrInvalidRecord) {
+		t.Fatal("should return correct error")
+	}
+
+	if err := blk.Put(rpos, 100, pld); !errors.Is(err, ErrInvalidRange) {
+		t.Fatal("should return correct error")
+	}
+
+	if err := blk.Put(rpos, 2, []byte{1, 2, 3, 4, 5}); !errors.Is(err, ErrInvalidPayload) {
+		t.Fatal("should return correct error")
+	}
+
+	if _, err := blk.Get(rpos, 90, 101); !errors.Is(err, ErrInvalidRange) {
+		t.Fatal("should return correct error")
+	}
+
+	_, err = blk.Get(-1, 0, 10)
+
+	var rerr *kdb.RecordError
+	if !errors.As(err, &rerr) || rerr.Record != -1 || rerr.Err != ErrInvalidRecord {
+		t.Fatal("should return a record error")
+	}
+
+	_, err = blk.Get(rpos+100001, 0, 10)
+	if !errors.As(err, &rerr) || rerr.Segment != 2 {
+		t.Fatal("record error should have the segment number")
+	}
+}
+
+func TestPresent(t *testing.T) {
+	defer cleanTestFiles()
+
+	blk, err := createTestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rpos, err := blk.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := blk.Put(rpos, 1, []byte{0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := blk.Put(rpos, 3, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := blk.Present(rpos, 0, 5)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, []bool{false, true, false, true, false}) {
+		t.Fatal("invalid result")
+	}
+
+	if _, err := blk.Present(rpos, 0, 101); !errors.Is(err, ErrInvalidRange) {
+		t.Fatal("should return correct error")
+	}
+
+	if err := blk.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// segments created before presence files were added
+	if err := os.Remove("/tmp/test-dblock/presence_1"); err != nil {
+		t.Fatal(err)
+	}
+
+	blk, err = New(blk.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer blk.Close()
+
+	res, err = blk.Present(rpos, 0, 5)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, []bool{false, false, false, true, false}) {
+		t.Fatal("payloads with data should be present")
+	}
+}
+
+func TestLatest(t *testing.T) {
+	defer cleanTestFiles()
+
+	blk, err := createTestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rpos, err := blk.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ppos, pld, err := blk.Latest(rpos); err != nil {
+		t.Fatal(err)
+	} else if ppos != -1 || pld != nil {
+		t.Fatal("empty records should not have a payload")
+	}
+
+	pld1 := []byte{1, 2, 3, 4}
+	pld2 := []byte{5, 6, 7, 8}
+
+	if err := blk.Put(rpos, 5, pld1); err != nil {
+		t.Fatal(err)
+	}
+
+	// earlier payloads should not move the marker
+	if err := blk.Put(rpos, 2, pld2); err != nil {
+		t.Fatal(err)
+	}
+
+	if ppos, pld, err := blk.Latest(rpos); err != nil {
+		t.Fatal(err)
+	} else if ppos != 5 || !reflect.DeepEqual(pld, pld1) {
+		t.Fatal("invalid result", ppos, pld)
+	}
+
+	sum := func(old, new []byte) ([]byte, error) { return []byte{old[0] + new[0], 0, 0, 0}, nil }
+	if err := blk.Merge(rpos, 99, []byte{1, 0, 0, 0}, sum); err != nil {
+		t.Fatal(err)
+	}
+
+	if ppos, _, err := blk.Latest(rpos); err != nil {
+		t.Fatal(err)
+	} else if ppos != 99 {
+		t.Fatal("merged payloads should move the marker")
+	}
+
+	if _, _, err := blk.Latest(rpos + 1); !errors.Is(err, ErrInvalidRecord) {
+		t.Fatal("should return correct error")
+	}
+
+	if err := blk.Trim(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ppos, _, err := blk.Latest(rpos); err != nil {
+		t.Fatal(err)
+	} else if ppos != 99 {
+		t.Fatal("markers should be available after trimming")
+	}
+
+	if err := blk.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// segments created before marker files were added
+	if err := os.Remove("/tmp/test-dblock/latest_1"); err != nil {
+		t.Fatal(err)
+	}
+
+	blk, err = New(blk.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer blk.Close()
+
+	if ppos, pld, err := blk.Latest(rpos); err != nil {
+		t.Fatal(err)
+	} else if ppos != 99 || !reflect.DeepEqual(pld, []byte{1, 0, 0, 0}) {
+		t.Fatal("markers should be created with presence bitmaps")
+	}
+}
+
+func TestTrim(t *testing.T) {
+	defer cleanTestFiles()
+
+	blk, err := createTestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rpos, err := blk.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pld := []byte{1, 2, 3, 4}
+	if err := blk.Put(rpos, 2, pld); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := blk.Trim(); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := os.Stat("/tmp/test-dblock/block_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat.Size() != blk.recordSize {
+		t.Fatal("segment should only have space for used records")
+	}
+
+	res, err := blk.Get(rpos, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res[0], pld) {
+		t.Fatal("invalid result")
+	}
+
+	if err := blk.Put(rpos, 3, pld); err != ErrBlockTrimmed {
+		t.Fatal("should return correct error")
+	}
+
+	if err := blk.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// load the trimmed block again
+	blk, err = New(blk.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer blk.Close()
+
+	stat, err = os.Stat("/tmp/test-dblock/block_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat.Size() != blk.recordSize*blk.SegmentSize {
+		t.Fatal("segment should be allocated again")
+	}
+
+	if err := blk.Put(rpos, 3, pld); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = blk.Get(rpos, 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{pld, pld}) {
+		t.Fatal("invalid result")
+	}
+}
+
+func TestClose(t *testing.T) {
+	defer cleanTestFiles()
+
+	pinned := metricPinnedBytes.Value()
+
+	blk, err := createTestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metricPinnedBytes.Value() == pinned {
+		t.Fatal("segments should be pinned")
+	}
+
+	rpos, err := blk.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pld := []byte{1, 2, 3, 4}
+	if err := blk.Put(rpos, 2, pld); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := blk.Get(rpos, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := blk.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if metricPinnedBytes.Value() != pinned {
+		t.Fatal("pinned segments should be released")
+	}
+
+	if len(blk.segmentMmaps) != 0 || len(blk.presenceMmaps) != 0 || len(blk.markerMmaps) != 0 {
+		t.Fatal("memory maps should be removed")
+	}
+
+	// payloads can be used after closing
+	if !reflect.DeepEqual(res[0], pld) {
+		t.Fatal("invalid result")
+	}
+}
+
 func TestPreallocate(t *testing.T) {
 	defer cleanTestFiles()
 
@@ -173,7 +625,7 @@ func TestShouldPreallocateWhenNoSegments(t *testing.T) {
 
 	defer blk.Close()
 
-	blk.metadata.Set(MetadataSegmentCount, float64(0))
+	blk.metadata.Set(MetadataSegmentCount, 0)
 	doPreallocate, segementNo := blk.shouldPreallocate()
 
 	if !doPreallocate {
@@ -195,7 +647,7 @@ func TestShouldPreallocateWithSegments(t *testing.T) {
 
 	defer blk.Close()
 
-	blk.metadata.Set(MetadataSegmentCount, float64(10))
+	blk.metadata.Set(MetadataSegmentCount, 10)
 	doPreallocate, _ := blk.shouldPreallocate()
 
 	if doPreallocate {
@@ -214,7 +666,7 @@ func TestShouldPreallocateWhenOutOfSpace(t *testing.T) {
 	defer blk.Close()
 
 	size := blk.metadata.Get(MetadataSegmentSize)
-	blk.metadata.Set(MetadataSegmentCount, float64(1))
+	blk.metadata.Set(MetadataSegmentCount, 1)
 	blk.metadata.Set(MetadataRecordCount, size-2)
 	doPreallocate, segementNo := blk.shouldPreallocate()
 
@@ -238,7 +690,7 @@ func TestShouldPreallocateIfNeeded(t *testing.T) {
 	defer blk.Close()
 
 	records := blk.metadata.Get(MetadataSegmentSize)*12 - 2
-	blk.metadata.Set(MetadataSegmentCount, float64(12))
+	blk.metadata.Set(MetadataSegmentCount, 12)
 	blk.metadata.Set(MetadataRecordCount, records)
 
 	// try a few times, but it should only allocate one segment
@@ -249,7 +701,7 @@ func TestShouldPreallocateIfNeeded(t *testing.T) {
 	}
 
 	segmentCount := blk.metadata.Get(MetadataSegmentCount)
-	if segmentCount != float64(13) {
+	if segmentCount != 13 {
 		t.Error("allocation failed", segmentCount)
 	}
 }
@@ -5,20 +5,46 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"sync"
 
 	"github.com/meteorhacks/kdb"
 	"github.com/meteorhacks/kdb/dblock"
+	"github.com/meteorhacks/kdb/metrics"
 	"github.com/meteorhacks/kdb/mindex"
+	"github.com/meteorhacks/kdb/pslice"
 	"github.com/meteorhacks/kdb/rblock"
+	"github.com/meteorhacks/kdb/sblock"
+	"github.com/meteorhacks/kdb/sindex"
 )
 
 const (
 	FilePermissions = 0744
+
+	OptionsCount = 4
+
+	// indexes for values stored in the bucket options file
+	OptionsBucketDuration = 0 // bucket duration in nano seconds
+	OptionsResolution     = 1 // bucket resolution in nano seconds
+	OptionsBlockType      = 2 // type of block used to store records
+	OptionsIndexType      = 3 // type of index used to find records
+
+	// types of blocks used to store records
+	BlockTypeDense  = 0 // fixed size records (dblock)
+	BlockTypeSparse = 1 // sparse records promoted to fixed size (sblock)
+
+	// types of indexes used to find records
+	IndexTypeTree   = 0 // tree of values with a fixed depth
+	IndexTypeLabels = 1 // sets of labels in name=value format
 )
 
 var (
 	ErrBucketNotInDisk = errors.New("bucket is not found on disk")
 	ErrWriteOnReadOnly = errors.New("write operation on a read only bucket")
+	ErrOutOfRange      = errors.New("timestamp is out of bucket time range")
+	ErrMergeNotAllowed = errors.New("block does not support merging payloads")
+
+	// metrics reported to the default registry (by bucket path)
+	metricSeries = metrics.NewGaugeVec("kdb_bucket_series", "number of series in a bucket", "bucket")
 )
 
 type Options struct {
@@ -45,6 +71,18 @@ type Options struct {
 	// number of records per segment
 	SegmentSize int64
 
+	// store records as (position, payload) pairs
+	// until they have enough payloads to use fixed size records
+	SparseRecords bool
+
+	// ratio of filled payloads (0 - 1) in a sparse record
+	// after which the record is converted to a fixed size record
+	SparseThreshold float64
+
+	// index series by sets of labels in name=value format
+	// instead of a fixed number of values (see mindex)
+	Labels bool
+
 	// read only bucket (less RAM usage)
 	ReadOnly bool
 
@@ -52,17 +90,55 @@ type Options struct {
 	BaseTime int64
 }
 
+// indexes and blocks which preallocate disk space
+// can remove unused space when it's no longer needed
+type trimmer interface {
+	Trim() (err error)
+}
+
+// blocks which can combine a new payload with the stored payload
+type merger interface {
+	Merge(rpos, ppos int64, pld []byte, fn kdb.MergeFunc) (err error)
+}
+
+// blocks which keep track of payloads written to records
+type presenter interface {
+	Present(rpos, start, end int64) (res []bool, err error)
+}
+
+// blocks which keep the last written payload position of records
+type latester interface {
+	Latest(rpos int64) (ppos int64, pld []byte, err error)
+}
+
+// indexes and blocks opened read only can load data
+// written by other processes after they were opened
+type refresher interface {
+	Refresh() (err error)
+}
+
+// indexes which know the number of series without finding them
+type counter interface {
+	Count() (count int64)
+}
+
 type DBucket struct {
 	Options
 	index kdb.Index
 	block kdb.Block
+
+	// used when creating records for new series
+	// so a series gets only one record in the block
+	seriesMutex *sync.Mutex
+
+	// record positions by series IDs given by the database
+	// filled when a series is written with an ID (see PutByID)
+	ids      map[uint64]int64
+	idsMutex *sync.RWMutex
 }
 
 func New(opts Options) (bkt *DBucket, err error) {
-	basePath := path.Join(
-		opts.DataPath,
-		opts.DatabaseName+"_"+strconv.Itoa(int(opts.BaseTime)),
-	)
+	basePath := Path(opts)
 
 	if !opts.ReadOnly {
 		err = os.MkdirAll(basePath, FilePermissions)
@@ -71,12 +147,14 @@ func New(opts Options) (bkt *DBucket, err error) {
 		}
 	}
 
-	idxPath := path.Join(basePath, "index")
-	index, err := mindex.NewMIndex(mindex.MIndexOpts{
-		FilePath:   idxPath,
-		IndexDepth: opts.IndexDepth,
-	})
+	// bucket duration, resolution and block type stored with
+	// the bucket takes precedence over values given with options
+	opts, err = loadOptions(opts, basePath)
+	if err != nil {
+		return nil, err
+	}
 
+	index, err := openIndex(opts, basePath)
 	if err != nil {
 		// TODO: use a better way to check whether a bucket
 		// really exists on the disk.
@@ -87,11 +165,19 @@ func New(opts Options) (bkt *DBucket, err error) {
 		return nil, err
 	}
 
-	// number of payloads in a record
-	pldCount := opts.BucketDuration / opts.Resolution
+	pldCount := PayloadCount(opts)
 	var block kdb.Block
 
-	if opts.ReadOnly {
+	if opts.SparseRecords {
+		block, err = sblock.New(sblock.Options{
+			BlockPath:     basePath,
+			PayloadSize:   opts.PayloadSize,
+			PayloadCount:  pldCount,
+			SegmentSize:   opts.SegmentSize,
+			FillThreshold: opts.SparseThreshold,
+			ReadOnly:      opts.ReadOnly,
+		})
+	} else if opts.ReadOnly {
 		block, err = rblock.New(rblock.Options{
 			BlockPath:    basePath,
 			PayloadSize:  opts.PayloadSize,
@@ -108,111 +194,644 @@ func New(opts Options) (bkt *DBucket, err error) {
 	}
 
 	if err != nil {
+		index.Close()
+
+		// the bucket may be partially created by another process
+		if opts.ReadOnly && (os.IsNotExist(err) || err == pslice.ErrFileTooSmall) {
+			err = ErrBucketNotInDisk
+		}
+
 		return nil, err
 	}
 
-	bkt = &DBucket{opts, index, block}
+	// number of series already available in the bucket
+	// not reported if it's not known without finding all series
+	if c, ok := index.(counter); ok {
+		metricSeries.With(basePath).Set(c.Count())
+	}
+
+	bkt = &DBucket{opts, index, block, &sync.Mutex{}, make(map[uint64]int64), &sync.RWMutex{}}
 	return bkt, nil
 }
 
+// openIndex opens the index of the bucket. Read only buckets use the sealed
+// index if it was created with the current index file (see Seal). Sealed
+// indexes are removed when the bucket is opened for writing.
+// * index file path: BUCKET_PATH/index
+// * sealed index file path: BUCKET_PATH/index_sealed
+func openIndex(opts Options, basePath string) (index kdb.Index, err error) {
+	idxPath := path.Join(basePath, "index")
+	sealedPath := path.Join(basePath, "index_sealed")
+
+	if !opts.ReadOnly {
+		if err := os.Remove(sealedPath); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	} else if finfo, err := os.Stat(idxPath); err == nil {
+		// use the index file if the sealed index is not usable
+		sealed, err := sindex.New(sindex.Options{
+			FilePath:  sealedPath,
+			IndexSize: finfo.Size(),
+			Labels:    opts.Labels,
+		})
+
+		if err == nil {
+			return sealed, nil
+		}
+	}
+
+	return mindex.NewMIndex(mindex.MIndexOpts{
+		FilePath:   idxPath,
+		IndexDepth: opts.IndexDepth,
+		Labels:     opts.Labels,
+		ReadOnly:   opts.ReadOnly,
+	})
+}
+
+// NewWithData creates a bucket using an index and a block created elsewhere
+// useful when bucket files are not available as separate files on disk
+func NewWithData(opts Options, index kdb.Index, block kdb.Block) (bkt *DBucket) {
+	return &DBucket{opts, index, block, &sync.Mutex{}, make(map[uint64]int64), &sync.RWMutex{}}
+}
+
 // Put adds new data to correct index and block
+// errors are returned as `*kdb.BucketError` (except ErrWriteOnReadOnly)
 func (bkt *DBucket) Put(ts int64, vals []string, pld []byte) (err error) {
+	return bkt.put(ts, 0, vals, pld, nil)
+}
+
+// PutMerge combines the payload with the payload stored at `ts` using `fn`
+// and stores the result. It's done atomically by the block so payloads
+// written at the same time by other requests are not lost.
+// errors are returned as `*kdb.BucketError` (except ErrWriteOnReadOnly)
+func (bkt *DBucket) PutMerge(ts int64, vals []string, pld []byte, fn kdb.MergeFunc) (err error) {
+	return bkt.put(ts, 0, vals, pld, fn)
+}
+
+// PutByID works like `Put` with the ID of the series given by the database.
+// The record position is kept by ID so the index is only used the first
+// time the series is written with the ID after opening the bucket.
+// errors are returned as `*kdb.BucketError` (except ErrWriteOnReadOnly)
+func (bkt *DBucket) PutByID(ts int64, id uint64, vals []string, pld []byte) (err error) {
+	return bkt.put(ts, id, vals, pld, nil)
+}
+
+// put writes the payload using `fn` to merge payloads if it's not nil
+// `id` is the series ID if it's known (0 otherwise)
+func (bkt *DBucket) put(ts int64, id uint64, vals []string, pld []byte, fn kdb.MergeFunc) (err error) {
 	if bkt.ReadOnly {
 		return ErrWriteOnReadOnly
 	}
 
-	var rpos int64
+	if ts < bkt.BaseTime || ts >= bkt.end() {
+		return bkt.error("put", ErrOutOfRange)
+	}
 
-	index := bkt.index
-	el, err := index.Get(vals)
+	rpos, err := bkt.record(id, vals)
 	if err != nil {
-		return err
+		return bkt.error("put", err)
 	}
 
-	if el == nil {
-		rpos, err = bkt.block.New()
-		if err != nil {
-			return err
-		}
+	ppos := bkt.tsToPPos(ts)
 
-		el, err = index.Add(vals, rpos)
-		if err != nil {
-			return err
-		}
+	if fn == nil {
+		err = bkt.block.Put(rpos, ppos, pld)
+	} else if m, ok := bkt.block.(merger); ok {
+		err = m.Merge(rpos, ppos, pld, fn)
 	} else {
-		rpos = el.Position
+		err = ErrMergeNotAllowed
 	}
 
-	ppos := bkt.tsToPPos(ts)
-
-	err = bkt.block.Put(rpos, ppos, pld)
 	if err != nil {
-		return err
+		return bkt.error("put", err)
 	}
 
 	return nil
 }
 
 // Get method gets the payload for matching value set
+// errors are returned as `*kdb.BucketError`
 func (bkt *DBucket) Get(start, end int64, vals []string) (res [][]byte, err error) {
+	res, _, err = bkt.get(start, end, vals, false)
+	return res, err
+}
+
+// GetPresence works like `Get` and also reports which payloads were written
+// so stored zero payloads can be distinguished from missing payloads
+// errors are returned as `*kdb.BucketError`
+func (bkt *DBucket) GetPresence(start, end int64, vals []string) (res [][]byte, present []bool, err error) {
+	return bkt.get(start, end, vals, true)
+}
+
+func (bkt *DBucket) get(start, end int64, vals []string, withPresence bool) (res [][]byte, present []bool, err error) {
+	if err := bkt.checkRange(start, end); err != nil {
+		return nil, nil, bkt.error("get", err)
+	}
+
+	if err := bkt.refresh(); err != nil {
+		return nil, nil, bkt.error("get", err)
+	}
+
 	index := bkt.index
 
 	el, err := index.Get(vals)
 	if err != nil {
-		return nil, err
+		return nil, nil, bkt.error("get", err)
 	}
 
 	if el == nil {
-		return nil, nil
+		return nil, nil, nil
 	}
 
-	spos := bkt.tsToPPos(start)
-	epos := bkt.tsToPPos(end)
+	spos, epos := bkt.rangeToPPos(start, end)
 
-	res, err = bkt.block.Get(el.Position, spos, epos)
+	res, present, err = bkt.read(el.Position, spos, epos, withPresence)
 	if err != nil {
-		return nil, err
+		return nil, nil, bkt.error("get", err)
 	}
 
-	return res, nil
+	return res, present, nil
 }
 
 // Find method finds all payloads matching the given query
+// errors are returned as `*kdb.BucketError`
 func (bkt *DBucket) Find(start, end int64, vals []string) (res map[*kdb.IndexElement][][]byte, err error) {
+	res, _, err = bkt.find(start, end, vals, false)
+	return res, err
+}
+
+// FindPresence works like `Find` and also reports which payloads were
+// written for each series (using the same index elements as keys)
+// errors are returned as `*kdb.BucketError`
+func (bkt *DBucket) FindPresence(start, end int64, vals []string) (res map[*kdb.IndexElement][][]byte, present map[*kdb.IndexElement][]bool, err error) {
+	return bkt.find(start, end, vals, true)
+}
+
+func (bkt *DBucket) find(start, end int64, vals []string, withPresence bool) (res map[*kdb.IndexElement][][]byte, present map[*kdb.IndexElement][]bool, err error) {
+	if err := bkt.checkRange(start, end); err != nil {
+		return nil, nil, bkt.error("find", err)
+	}
+
+	if err := bkt.refresh(); err != nil {
+		return nil, nil, bkt.error("find", err)
+	}
+
 	res = make(map[*kdb.IndexElement][][]byte)
+	if withPresence {
+		present = make(map[*kdb.IndexElement][]bool)
+	}
 
 	index := bkt.index
 	els, err := index.Find(vals)
 	if err != nil {
-		return nil, err
+		return nil, nil, bkt.error("find", err)
 	}
 
+	spos, epos := bkt.rangeToPPos(start, end)
+
 	for _, el := range els {
-		spos := bkt.tsToPPos(start)
-		epos := bkt.tsToPPos(end)
-		res[el], err = bkt.block.Get(el.Position, spos, epos)
+		plds, marks, err := bkt.read(el.Position, spos, epos, withPresence)
 		if err != nil {
-			return nil, err
+			return nil, nil, bkt.error("find", err)
+		}
+
+		res[el] = plds
+		if withPresence {
+			present[el] = marks
+		}
+	}
+
+	return res, present, nil
+}
+
+// Latest returns the last written payload of a series with the start time
+// of its payload slot, nil is returned if the series has no data
+// errors are returned as `*kdb.BucketError`
+func (bkt *DBucket) Latest(vals []string) (res *kdb.Point, err error) {
+	if err := bkt.refresh(); err != nil {
+		return nil, bkt.error("latest", err)
+	}
+
+	el, err := bkt.index.Get(vals)
+	if err != nil {
+		return nil, bkt.error("latest", err)
+	}
+
+	if el == nil {
+		return nil, nil
+	}
+
+	res, err = bkt.latest(el.Position)
+	if err != nil {
+		return nil, bkt.error("latest", err)
+	}
+
+	return res, nil
+}
+
+// LatestFind works like `Latest` with all series matching `vals`
+// series without data are not included in the result
+// errors are returned as `*kdb.BucketError`
+func (bkt *DBucket) LatestFind(vals []string) (res map[*kdb.IndexElement]*kdb.Point, err error) {
+	if err := bkt.refresh(); err != nil {
+		return nil, bkt.error("latest", err)
+	}
+
+	els, err := bkt.index.Find(vals)
+	if err != nil {
+		return nil, bkt.error("latest", err)
+	}
+
+	res = make(map[*kdb.IndexElement]*kdb.Point)
+	for _, el := range els {
+		pt, err := bkt.latest(el.Position)
+		if err != nil {
+			return nil, bkt.error("latest", err)
+		}
+
+		if pt != nil {
+			res[el] = pt
 		}
 	}
 
 	return res, nil
 }
 
+// latest finds the last written payload of a record. All payloads of the
+// record are read if the block doesn't keep the last written position.
+func (bkt *DBucket) latest(rpos int64) (res *kdb.Point, err error) {
+	var ppos int64
+	var pld []byte
+
+	if l, ok := bkt.block.(latester); ok {
+		ppos, pld, err = l.Latest(rpos)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		plds, present, err := bkt.read(rpos, 0, PayloadCount(bkt.Options), true)
+		if err != nil {
+			return nil, err
+		}
+
+		for ppos = int64(len(plds)) - 1; ppos >= 0; ppos-- {
+			if present[ppos] {
+				pld = plds[ppos]
+				break
+			}
+		}
+	}
+
+	if ppos < 0 {
+		return nil, nil
+	}
+
+	return &kdb.Point{Timestamp: bkt.BaseTime + ppos*bkt.Resolution, Payload: pld}, nil
+}
+
+// read gets payloads of a record from the block and which of them were
+// written if `withPresence` is true. Payloads with non zero bytes are
+// considered written if the block doesn't keep track of written payloads.
+func (bkt *DBucket) read(rpos, spos, epos int64, withPresence bool) (res [][]byte, present []bool, err error) {
+	res, err = bkt.block.Get(rpos, spos, epos)
+	if err != nil || !withPresence {
+		return res, nil, err
+	}
+
+	if p, ok := bkt.block.(presenter); ok {
+		present, err = p.Present(rpos, spos, epos)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return res, present, nil
+	}
+
+	present = make([]bool, len(res))
+	for i, pld := range res {
+		present[i] = !isEmpty(pld)
+	}
+
+	return res, present, nil
+}
+
+// isEmpty checks whether the payload only has zero bytes
+func isEmpty(pld []byte) (empty bool) {
+	for _, b := range pld {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (bkt *DBucket) Close() (err error) {
+	metricSeries.Delete(Path(bkt.Options))
+
 	err = bkt.index.Close()
 	if err != nil {
-		return err
+		return bkt.error("close", err)
 	}
 
 	err = bkt.block.Close()
 	if err != nil {
+		return bkt.error("close", err)
+	}
+
+	return nil
+}
+
+// Trim removes disk space preallocated for the bucket but not used.
+// It should be used when no more data will be written to the bucket.
+func (bkt *DBucket) Trim() (err error) {
+	if bkt.ReadOnly {
+		return nil
+	}
+
+	if idx, ok := bkt.index.(trimmer); ok {
+		if err := idx.Trim(); err != nil {
+			return bkt.error("trim", err)
+		}
+	}
+
+	if blk, ok := bkt.block.(trimmer); ok {
+		if err := blk.Trim(); err != nil {
+			return bkt.error("trim", err)
+		}
+	}
+
+	return nil
+}
+
+// Seal trims the bucket and writes a sorted copy of the index which is
+// used when the bucket is opened read only. Sealed indexes are not loaded
+// into memory so opening the bucket is fast even with many series.
+// It should be used when the bucket will not receive more writes.
+func (bkt *DBucket) Seal() (err error) {
+	if bkt.ReadOnly {
+		return nil
+	}
+
+	if err := bkt.Trim(); err != nil {
 		return err
 	}
 
+	return bkt.SealIndex()
+}
+
+// SealIndex writes the sorted copy of the index (see Seal) without
+// modifying other bucket files so it can be used with read only buckets.
+// Nothing is written if the bucket is already using a sealed index.
+func (bkt *DBucket) SealIndex() (err error) {
+	if _, ok := bkt.index.(*sindex.SIndex); ok {
+		return nil
+	}
+
+	els, err := bkt.index.Find(make([]string, bkt.IndexDepth))
+	if err != nil {
+		return bkt.error("seal", err)
+	}
+
+	basePath := Path(bkt.Options)
+	finfo, err := os.Stat(path.Join(basePath, "index"))
+	if err != nil {
+		return bkt.error("seal", err)
+	}
+
+	err = sindex.Write(sindex.Options{
+		FilePath:  path.Join(basePath, "index_sealed"),
+		IndexSize: finfo.Size(),
+		Labels:    bkt.Labels,
+	}, els)
+
+	if err != nil {
+		return bkt.error("seal", err)
+	}
+
+	return nil
+}
+
+// record returns the record position of the series, a record is created
+// if it's a new series. Positions are kept by series ID if `id` is set.
+func (bkt *DBucket) record(id uint64, vals []string) (rpos int64, err error) {
+	if id != 0 {
+		bkt.idsMutex.RLock()
+		rpos, ok := bkt.ids[id]
+		bkt.idsMutex.RUnlock()
+
+		if ok {
+			return rpos, nil
+		}
+	}
+
+	el, err := bkt.index.Get(vals)
+	if err != nil {
+		return 0, err
+	}
+
+	if el == nil {
+		el, err = bkt.addSeries(vals)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if id != 0 {
+		bkt.idsMutex.Lock()
+		bkt.ids[id] = el.Position
+		bkt.idsMutex.Unlock()
+	}
+
+	return el.Position, nil
+}
+
+// addSeries creates a record for a new series and adds it to the index
+// the index is checked again in case another request added the series
+func (bkt *DBucket) addSeries(vals []string) (el *kdb.IndexElement, err error) {
+	bkt.seriesMutex.Lock()
+	defer bkt.seriesMutex.Unlock()
+
+	el, err = bkt.index.Get(vals)
+	if err != nil || el != nil {
+		return el, err
+	}
+
+	rpos, err := bkt.block.New()
+	if err != nil {
+		return nil, err
+	}
+
+	el, err = bkt.index.Add(vals, rpos)
+	if err != nil {
+		return nil, err
+	}
+
+	metricSeries.With(Path(bkt.Options)).Inc()
+
+	return el, nil
+}
+
+// refresh loads data written by other processes to read only buckets
+// the index and the block are refreshed if they support refreshing
+func (bkt *DBucket) refresh() (err error) {
+	if !bkt.ReadOnly {
+		return nil
+	}
+
+	if r, ok := bkt.index.(refresher); ok {
+		if err := r.Refresh(); err != nil {
+			return err
+		}
+	}
+
+	if r, ok := bkt.block.(refresher); ok {
+		if err := r.Refresh(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (bkt *DBucket) tsToPPos(ts int64) (pos int64) {
 	return (ts - bkt.BaseTime) / bkt.Resolution
 }
+
+// rangeToPPos converts a time range to payload positions. The end position
+// is rounded up so partially covered payloads are included in the result.
+func (bkt *DBucket) rangeToPPos(start, end int64) (spos, epos int64) {
+	spos = bkt.tsToPPos(start)
+	epos = bkt.tsToPPos(end + bkt.Resolution - 1)
+	return spos, epos
+}
+
+// checkRange validates a time range used with queries
+// the range should be within the time range of the bucket
+func (bkt *DBucket) checkRange(start, end int64) (err error) {
+	if start < bkt.BaseTime || end > bkt.end() || start > end {
+		return ErrOutOfRange
+	}
+
+	return nil
+}
+
+// end returns the timestamp right after the last payload of the bucket
+func (bkt *DBucket) end() (ts int64) {
+	return bkt.BaseTime + bkt.BucketDuration
+}
+
+func (bkt *DBucket) error(op string, err error) (berr error) {
+	return &kdb.BucketError{Op: op, BaseTime: bkt.BaseTime, Err: err}
+}
+
+// Path returns the directory used to store bucket files
+// * bucket path: DATA_PATH/DATABASE_NAME_BASE_TIME
+func Path(opts Options) (bpath string) {
+	name := opts.DatabaseName + "_" + strconv.FormatInt(opts.BaseTime, 10)
+	return path.Join(opts.DataPath, name)
+}
+
+// PayloadCount returns the number of payloads in a record
+// a bucket may not be aligned to its resolution if it was
+// shortened to fit between buckets with different durations
+func PayloadCount(opts Options) (count int64) {
+	return (opts.BucketDuration + opts.Resolution - 1) / opts.Resolution
+}
+
+// LoadOptions returns options with the bucket duration, resolution, block
+// type and index type used when the bucket was created. Buckets created before these
+// values were stored on disk are assumed to use values given with `opts`.
+func LoadOptions(opts Options) (res Options, err error) {
+	basePath := Path(opts)
+
+	if _, err := os.Stat(basePath); err != nil {
+		if os.IsNotExist(err) {
+			err = ErrBucketNotInDisk
+		}
+
+		return opts, err
+	}
+
+	opts.ReadOnly = true
+	return loadOptions(opts, basePath)
+}
+
+// loadOptions reads bucket duration, resolution, block type and index type
+// from the options file.
+// Writable buckets will store values from `opts` if it's a new bucket.
+// * options file path: BUCKET_PATH/options
+func loadOptions(opts Options, basePath string) (res Options, err error) {
+	fpath := path.Join(basePath, "options")
+
+	if opts.ReadOnly {
+		// read only buckets must not create or modify files
+		// options files created before some values were
+		// stored are shorter, missing values are zero
+		file, err := os.Open(fpath)
+		if os.IsNotExist(err) {
+			return opts, nil
+		} else if err != nil {
+			return opts, err
+		}
+
+		defer file.Close()
+
+		values, err := pslice.Load(file, OptionsCount)
+		if err != nil {
+			return opts, err
+		}
+
+		return StoredOptions(opts, values), nil
+	}
+
+	stored, err := pslice.New(fpath, OptionsCount)
+	if err != nil {
+		return opts, err
+	}
+
+	if stored.Get(OptionsBucketDuration) == 0 {
+		blockType := float64(BlockTypeDense)
+		if opts.SparseRecords {
+			blockType = BlockTypeSparse
+		}
+
+		indexType := float64(IndexTypeTree)
+		if opts.Labels {
+			indexType = IndexTypeLabels
+		}
+
+		stored.Set(OptionsBucketDuration, float64(opts.BucketDuration))
+		stored.Set(OptionsResolution, float64(opts.Resolution))
+		stored.Set(OptionsBlockType, blockType)
+		stored.Set(OptionsIndexType, indexType)
+	} else {
+		opts = StoredOptions(opts, []float64{
+			stored.Get(OptionsBucketDuration),
+			stored.Get(OptionsResolution),
+			stored.Get(OptionsBlockType),
+			stored.Get(OptionsIndexType),
+		})
+	}
+
+	if err := stored.Close(); err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+// StoredOptions returns options with values read from an options file
+// values which are not set (created before these were stored) are ignored
+// buckets created before the index type was stored use a tree index
+func StoredOptions(opts Options, values []float64) (res Options) {
+	if len(values) <= OptionsBlockType || values[OptionsBucketDuration] == 0 {
+		return opts
+	}
+
+	opts.BucketDuration = int64(values[OptionsBucketDuration])
+	opts.Resolution = int64(values[OptionsResolution])
+	opts.SparseRecords = values[OptionsBlockType] == BlockTypeSparse
+	opts.Labels = len(values) > OptionsIndexType && values[OptionsIndexType] == IndexTypeLabels
+	return opts
+}
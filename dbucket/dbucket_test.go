@@ -2,9 +2,15 @@ package dbucket
 
 import (
 	"errors"
+	"os"
 	"os/exec"
+	"path"
 	"reflect"
 	"testing"
+
+	"github.com/meteorhacks/kdb"
+	"github.com/meteorhacks/kdb/mindex"
+	"github.com/meteorhacks/kdb/sindex"
 )
 
 func TestNewBucketNewData(t *testing.T) {
@@ -127,6 +133,432 @@ func TestPutAndFind(t *testing.T) {
 	}
 }
 
+func TestPutByID(t *testing.T) {
+	defer cleanTestFiles()
+
+	bkt, err := createTestBucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer bkt.Close()
+
+	vals := []string{"a", "b", "c", "d"}
+	pld1 := []byte{1, 2, 3, 4}
+	pld2 := []byte{5, 6, 7, 8}
+
+	if err := bkt.PutByID(10, 7, vals, pld1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the record position is used without the index
+	if err := bkt.PutByID(20, 7, nil, pld2); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := bkt.Get(10, 30, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{pld1, pld2}) {
+		t.Fatal("invalid response")
+	}
+
+	if err := bkt.PutByID(1000, 7, vals, pld1); err == nil {
+		t.Fatal("should check the timestamp")
+	}
+}
+
+func TestLatest(t *testing.T) {
+	defer cleanTestFiles()
+
+	bkt, err := createTestBucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	val1 := []string{"a", "b", "c", "d"}
+	val2 := []string{"a", "b", "c", "e"}
+	pld0 := []byte{0, 0, 0, 0}
+	pld1 := []byte{1, 2, 3, 4}
+
+	if err := bkt.Put(30, val1, pld1); err != nil {
+		t.Fatal(err)
+	} else if err := bkt.Put(10, val1, pld0); err != nil {
+		t.Fatal(err)
+	}
+
+	// zero payloads are written payloads
+	if err := bkt.Put(500, val2, pld0); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(bkt *DBucket) {
+		pt, err := bkt.Latest(val1)
+		if err != nil {
+			t.Fatal(err)
+		} else if pt == nil || pt.Timestamp != 30 || !reflect.DeepEqual(pt.Payload, pld1) {
+			t.Fatal("invalid response", pt)
+		}
+
+		if pt, err := bkt.Latest([]string{"a", "b", "c", "f"}); err != nil {
+			t.Fatal(err)
+		} else if pt != nil {
+			t.Fatal("missing series should not have a payload")
+		}
+
+		out, err := bkt.LatestFind([]string{"a", "b", "c", ""})
+		if err != nil {
+			t.Fatal(err)
+		} else if len(out) != 2 {
+			t.Fatal("invalid response")
+		}
+
+		for el, pt := range out {
+			if el.Values[3] == "e" && (pt.Timestamp != 500 || !reflect.DeepEqual(pt.Payload, pld0)) {
+				t.Fatal("invalid response", pt)
+			}
+		}
+	}
+
+	check(bkt)
+
+	if err := bkt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := bkt.Options
+	opts.ReadOnly = true
+
+	bkt, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(bkt)
+	bkt.Close()
+
+	// read only blocks use presence bitmaps without marker files
+	if err := os.Remove(path.Join(Path(opts), "latest_1")); err != nil {
+		t.Fatal(err)
+	}
+
+	bkt, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer bkt.Close()
+
+	check(bkt)
+}
+
+func TestStoredOptions(t *testing.T) {
+	defer cleanTestFiles()
+
+	bkt, err := createTestBucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vals := []string{"a", "b", "c", "d"}
+	pld := []byte{1, 2, 3, 4}
+
+	err = bkt.Put(30, vals, pld)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bkt.Close()
+
+	// options stored with the bucket should be used
+	// even if the bucket is opened with different values
+	opts := bkt.Options
+	opts.BucketDuration = 2000
+	opts.Resolution = 20
+
+	loaded, err := LoadOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.BucketDuration != 1000 || loaded.Resolution != 10 {
+		t.Fatal("incorrect options loaded from disk")
+	}
+
+	bkt, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer bkt.Close()
+
+	if bkt.BucketDuration != 1000 || bkt.Resolution != 10 {
+		t.Fatal("bucket should use options stored on disk")
+	}
+
+	res, err := bkt.Get(30, 40, vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res) != 1 || !reflect.DeepEqual(res[0], pld) {
+		t.Fatal("invalid response")
+	}
+
+	opts.BaseTime = 5000
+	if _, err := LoadOptions(opts); err != ErrBucketNotInDisk {
+		t.Fatal("should return correct error")
+	}
+}
+
+func TestOutOfRange(t *testing.T) {
+	defer cleanTestFiles()
+
+	bkt, err := createTestBucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer bkt.Close()
+
+	vals := []string{"a", "b", "c", "d"}
+	pld := []byte{1, 2, 3, 4}
+
+	// timestamps of the next bucket should not be
+	// written to a record of this bucket
+	err = bkt.Put(1000, vals, pld)
+
+	var berr *kdb.BucketError
+	if !errors.As(err, &berr) || berr.Op != "put" || berr.Err != ErrOutOfRange {
+		t.Fatal("should return a bucket error")
+	}
+
+	if err := bkt.Put(-10, vals, pld); !errors.Is(err, ErrOutOfRange) {
+		t.Fatal("should return correct error")
+	}
+
+	if _, err := bkt.Get(0, 1010, vals); !errors.Is(err, ErrOutOfRange) {
+		t.Fatal("should return correct error")
+	}
+
+	if _, err := bkt.Find(50, 40, vals); !errors.Is(err, ErrOutOfRange) {
+		t.Fatal("should return correct error")
+	}
+
+	// errors from the block has the record position
+	if err := bkt.Put(30, vals, []byte{1, 2, 3, 4, 5}); !errors.As(err, new(*kdb.RecordError)) {
+		t.Fatal("should return a record error")
+	}
+}
+
+func TestTrimAndReadOnly(t *testing.T) {
+	defer cleanTestFiles()
+
+	bkt, err := createTestBucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vals := []string{"a", "b", "c", "d"}
+	pld := []byte{1, 2, 3, 4}
+
+	err = bkt.Put(990, vals, pld)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bkt.Trim(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bkt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// trimmed buckets can be read using rblock
+	opts := bkt.Options
+	opts.ReadOnly = true
+
+	bkt, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer bkt.Close()
+
+	res, err := bkt.Get(980, 1000, vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := [][]byte{[]byte{0, 0, 0, 0}, pld}
+	if !reflect.DeepEqual(res, exp) {
+		t.Fatal("invalid response")
+	}
+}
+
+func TestSeal(t *testing.T) {
+	defer cleanTestFiles()
+
+	bkt, err := createTestBucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vals := []string{"a", "b", "c", "d"}
+	pld := []byte{1, 2, 3, 4}
+
+	if err := bkt.Put(990, vals, pld); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bkt.Seal(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bkt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// read only buckets should use the sealed index
+	opts := bkt.Options
+	opts.ReadOnly = true
+
+	bkt, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := bkt.index.(*sindex.SIndex); !ok {
+		t.Fatal("should use the sealed index")
+	}
+
+	res, err := bkt.Get(980, 1000, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{{0, 0, 0, 0}, pld}) {
+		t.Fatal("invalid response")
+	}
+
+	out, err := bkt.Find(980, 1000, []string{"a", "", "", "d"})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(out) != 1 {
+		t.Fatal("invalid response")
+	}
+
+	bkt.Close()
+
+	// sealed indexes are removed when writing to the bucket
+	opts.ReadOnly = false
+	bkt, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bkt.Put(980, []string{"a", "b", "c", "e"}, pld); err != nil {
+		t.Fatal(err)
+	}
+
+	bkt.Close()
+
+	opts.ReadOnly = true
+	bkt, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer bkt.Close()
+
+	if _, ok := bkt.index.(*mindex.MIndex); !ok {
+		t.Fatal("should not use a removed sealed index")
+	}
+
+	out, err = bkt.Find(980, 1000, []string{"a", "b", "c", ""})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(out) != 2 {
+		t.Fatal("invalid response")
+	}
+
+	// read only buckets can write the sealed index
+	if err := bkt.SealIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	bkt2, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer bkt2.Close()
+
+	if _, ok := bkt2.index.(*sindex.SIndex); !ok {
+		t.Fatal("should use the sealed index")
+	}
+
+	out, err = bkt2.Find(980, 1000, []string{"a", "b", "c", ""})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(out) != 2 {
+		t.Fatal("invalid response")
+	}
+}
+
+func TestSparseRecords(t *testing.T) {
+	defer cleanTestFiles()
+
+	bkt, err := createTestBucket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bkt.Close()
+	cleanTestFiles()
+
+	opts := bkt.Options
+	opts.SparseRecords = true
+
+	bkt, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vals := []string{"a", "b", "c", "d"}
+	pld := []byte{1, 2, 3, 4}
+
+	err = bkt.Put(30, vals, pld)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bkt.Close()
+
+	// block type stored with the bucket should be used
+	opts.SparseRecords = false
+
+	bkt, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer bkt.Close()
+
+	if !bkt.SparseRecords {
+		t.Fatal("bucket should use sparse records")
+	}
+
+	res, err := bkt.Get(20, 40, vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := [][]byte{[]byte{0, 0, 0, 0}, pld}
+	if !reflect.DeepEqual(res, exp) {
+		t.Fatal("invalid response")
+	}
+}
+
 func BenchmarkPut(b *testing.B) {
 	defer cleanTestFiles()
 
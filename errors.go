@@ -0,0 +1,44 @@
+package kdb
+
+import (
+	"strconv"
+)
+
+// RecordError is returned by blocks when an operation on a record fails.
+// It has the position of the record and the number of the segment used to
+// store it. `Segment` is zero if the block does not use segments.
+type RecordError struct {
+	Record  int64
+	Segment int64
+	Err     error
+}
+
+func (e *RecordError) Error() string {
+	msg := "record " + strconv.FormatInt(e.Record, 10)
+	if e.Segment != 0 {
+		msg += " (segment " + strconv.FormatInt(e.Segment, 10) + ")"
+	}
+
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// BucketError is returned by buckets when an operation fails.
+// It has the operation ("put", "get", "find", "trim" or "close")
+// and the base time of the bucket. `Err` may be a `*RecordError`.
+type BucketError struct {
+	Op       string
+	BaseTime int64
+	Err      error
+}
+
+func (e *BucketError) Error() string {
+	return "bucket " + strconv.FormatInt(e.BaseTime, 10) + ": " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *BucketError) Unwrap() error {
+	return e.Err
+}
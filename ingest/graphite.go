@@ -0,0 +1,83 @@
+package ingest
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/meteorhacks/kdb/clock"
+	"github.com/meteorhacks/kdb/dbase"
+	"github.com/meteorhacks/kdb/payload"
+)
+
+// parseGraphite parses a line in graphite plaintext protocol
+// path parts are mapped to index levels using the template
+// * line format: DOTTED.PATH VALUE [TIMESTAMP_IN_SECONDS]
+func (l *Listener) parseGraphite(line string) (pts []dbase.Point, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, ErrInvalidLine
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, ErrInvalidValue
+	}
+
+	ts := clock.Now()
+	if len(fields) == 3 && fields[2] != "-1" {
+		sec, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, ErrInvalidLine
+		}
+
+		ts = int64(sec * 1e9)
+	}
+
+	parts := strings.Split(fields[0], ".")
+	for _, part := range parts {
+		if part == "" {
+			return nil, ErrInvalidLine
+		}
+	}
+
+	names := l.Levels
+	if l.Template != "" {
+		names = strings.Split(l.Template, ".")
+	}
+
+	values := make(map[string]string)
+
+	for i, name := range names {
+		if i >= len(parts) {
+			break
+		}
+
+		// the last name can use all remaining parts
+		if i == len(names)-1 && strings.HasSuffix(name, "*") {
+			values[name[:len(name)-1]] = strings.Join(parts[i:], ".")
+			parts = parts[:len(names)]
+			break
+		}
+
+		if name != "" {
+			values[name] = parts[i]
+		}
+	}
+
+	if l.Strict && len(parts) > len(names) {
+		return nil, ErrLineNotFit
+	}
+
+	vals, err := l.indexValues(values)
+	if err != nil {
+		return nil, err
+	}
+
+	pt := dbase.Point{
+		Timestamp: ts,
+		Values:    vals,
+		Payload:   payload.EncodeFloat(value),
+	}
+
+	return []dbase.Point{pt}, nil
+}
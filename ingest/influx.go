@@ -0,0 +1,138 @@
+package ingest
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/meteorhacks/kdb/clock"
+	"github.com/meteorhacks/kdb/dbase"
+	"github.com/meteorhacks/kdb/payload"
+)
+
+var unescaper = strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ", `\"`, `"`, `\\`, `\`)
+
+// parseInflux parses a line in InfluxDB line protocol
+// a data point is created for each numeric field in the line
+// * line format: MEASUREMENT[,TAG=VALUE...] FIELD=VALUE[,FIELD=VALUE...] [TIMESTAMP]
+func (l *Listener) parseInflux(line string) (pts []dbase.Point, err error) {
+	parts := split(line, ' ')
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, ErrInvalidLine
+	}
+
+	ts := clock.Now()
+	if len(parts) == 3 {
+		ts, err = strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return nil, ErrInvalidLine
+		}
+	}
+
+	keys := split(parts[0], ',')
+	if keys[0] == "" {
+		return nil, ErrInvalidLine
+	}
+
+	values := map[string]string{
+		LevelMeasurement: unescaper.Replace(keys[0]),
+	}
+
+	for _, tag := range keys[1:] {
+		kv := split(tag, '=')
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, ErrInvalidLine
+		}
+
+		values[unescaper.Replace(kv[0])] = unescaper.Replace(kv[1])
+	}
+
+	for _, field := range split(parts[1], ',') {
+		kv := split(field, '=')
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, ErrInvalidLine
+		}
+
+		value, ok, err := parseFieldValue(kv[1])
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			// string fields can't be stored as numbers
+			continue
+		}
+
+		values[LevelField] = unescaper.Replace(kv[0])
+		vals, err := l.indexValues(values)
+		if err != nil {
+			return nil, err
+		}
+
+		pts = append(pts, dbase.Point{
+			Timestamp: ts,
+			Values:    vals,
+			Payload:   payload.EncodeFloat(value),
+		})
+	}
+
+	if len(pts) == 0 {
+		return nil, ErrInvalidValue
+	}
+
+	return pts, nil
+}
+
+// parseFieldValue parses float, integer and boolean field values
+// `ok` is false for string field values
+func parseFieldValue(str string) (value float64, ok bool, err error) {
+	if str == "" {
+		return 0, false, ErrInvalidValue
+	}
+
+	switch str {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+
+	if str[0] == '"' {
+		return 0, false, nil
+	}
+
+	// integers end with "i" and unsigned integers end with "u"
+	if last := str[len(str)-1]; last == 'i' || last == 'u' {
+		n, err := strconv.ParseInt(str[:len(str)-1], 10, 64)
+		if err != nil {
+			return 0, false, ErrInvalidValue
+		}
+
+		return float64(n), true, nil
+	}
+
+	value, err = strconv.ParseFloat(str, 64)
+	if err != nil {
+		return 0, false, ErrInvalidValue
+	}
+
+	return value, true, nil
+}
+
+// split splits the string with the separator ignoring
+// escaped separators and separators inside quotes
+func split(str string, sep byte) (parts []string) {
+	start := 0
+	quoted := false
+
+	for i := 0; i < len(str); i++ {
+		switch c := str[i]; {
+		case c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, str[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, str[start:])
+}
@@ -0,0 +1,386 @@
+package ingest
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/meteorhacks/kdb/dbase"
+	"github.com/meteorhacks/kdb/payload"
+)
+
+// Format is the protocol used by clients to send data points
+type Format int
+
+const (
+	// InfluxDB line protocol
+	// ex: "cpu,host=h1,region=us usage=0.5,idle=0.4 1440000000000000000"
+	FormatInflux Format = iota
+
+	// Graphite plaintext protocol
+	// ex: "servers.h1.cpu.usage 0.5 1440000000"
+	FormatGraphite
+)
+
+const (
+	// special level names used with line protocol
+	// all other level names are used as tag names
+	LevelMeasurement = "measurement"
+	LevelField       = "field"
+
+	// default index value used when a line doesn't have a level
+	DefaultMissingValue = "-"
+
+	// default number of points written at once
+	DefaultBatchSize = 1000
+
+	// default maximum time to keep points before writing
+	DefaultBatchInterval = time.Second
+
+	// maximum size of a udp packet
+	MaxPacketSize = 64 * 1024
+)
+
+var (
+	ErrInvalidLine   = errors.New("invalid line")
+	ErrInvalidValue  = errors.New("invalid value")
+	ErrLineNotFit    = errors.New("line does not fit the index depth")
+	ErrLevelCount    = errors.New("number of levels should match index depth")
+	ErrPayloadSize   = errors.New("payload size should be 9 bytes")
+	ErrInvalidFormat = errors.New("invalid format")
+)
+
+type Options struct {
+	// protocol used by clients
+	Format Format
+
+	// network to listen ("tcp" or "udp")
+	Network string
+
+	// address to listen (ex: "localhost:8089")
+	Address string
+
+	// names of values stored in each level of the index tree. With line
+	// protocol, use "measurement", "field" or a tag name. With graphite,
+	// use names given in `Template`. Length should match index depth.
+	Levels []string
+
+	// names of dotted graphite path parts (ex: "region.host.measurement")
+	// Empty names can be used to skip parts (ex: "region..measurement")
+	// and the last name can end with "*" to use all remaining parts.
+	// If empty, path parts are used as index values in the same order.
+	Template string
+
+	// reject lines with values which can't be stored in index levels
+	// or with index levels which doesn't have values. Otherwise missing
+	// levels will use `MissingValue` and extra values are not stored.
+	Strict bool
+
+	// index value used for levels which doesn't have a value
+	MissingValue string
+
+	// number of points to write at once
+	BatchSize int
+
+	// maximum time to keep points before writing
+	BatchInterval time.Duration
+}
+
+// Stats has counters for a listener
+type Stats struct {
+	Lines       int64 // lines received
+	Points      int64 // points written
+	ParseErrors int64 // lines with invalid format
+	Rejected    int64 // lines which doesn't fit the index
+	WriteErrors int64 // points failed to write
+}
+
+// Listener accepts data points from clients and writes them in batches
+type Listener struct {
+	Options
+	db    *dbase.DBase
+	parse func(line string) (pts []dbase.Point, err error)
+	stats Stats
+
+	listener net.Listener
+	packets  net.PacketConn
+
+	batch      []dbase.Point
+	batchMutex *sync.Mutex
+
+	conns     map[net.Conn]bool
+	connMutex *sync.Mutex
+	done      chan struct{}
+	wg        *sync.WaitGroup
+}
+
+func New(db *dbase.DBase, opts Options) (l *Listener, err error) {
+	if len(opts.Levels) != int(db.IndexDepth) {
+		return nil, ErrLevelCount
+	}
+
+	if db.PayloadSize != payload.FloatSize {
+		return nil, ErrPayloadSize
+	}
+
+	if opts.MissingValue == "" {
+		opts.MissingValue = DefaultMissingValue
+	}
+
+	if opts.BatchSize == 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+
+	if opts.BatchInterval == 0 {
+		opts.BatchInterval = DefaultBatchInterval
+	}
+
+	l = &Listener{
+		Options:    opts,
+		db:         db,
+		batch:      make([]dbase.Point, 0, opts.BatchSize),
+		batchMutex: &sync.Mutex{},
+		conns:      make(map[net.Conn]bool),
+		connMutex:  &sync.Mutex{},
+		done:       make(chan struct{}),
+		wg:         &sync.WaitGroup{},
+	}
+
+	switch opts.Format {
+	case FormatInflux:
+		l.parse = l.parseInflux
+	case FormatGraphite:
+		l.parse = l.parseGraphite
+	default:
+		return nil, ErrInvalidFormat
+	}
+
+	if opts.Network == "udp" {
+		l.packets, err = net.ListenPacket("udp", opts.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		l.wg.Add(1)
+		go l.readPackets()
+	} else {
+		l.listener, err = net.Listen("tcp", opts.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		l.wg.Add(1)
+		go l.accept()
+	}
+
+	l.wg.Add(1)
+	go l.flushPeriodically()
+
+	return l, nil
+}
+
+// Addr returns the address the listener is listening on
+func (l *Listener) Addr() (addr net.Addr) {
+	if l.packets != nil {
+		return l.packets.LocalAddr()
+	}
+
+	return l.listener.Addr()
+}
+
+// Stats returns current values of listener counters
+func (l *Listener) Stats() (stats Stats) {
+	return Stats{
+		Lines:       atomic.LoadInt64(&l.stats.Lines),
+		Points:      atomic.LoadInt64(&l.stats.Points),
+		ParseErrors: atomic.LoadInt64(&l.stats.ParseErrors),
+		Rejected:    atomic.LoadInt64(&l.stats.Rejected),
+		WriteErrors: atomic.LoadInt64(&l.stats.WriteErrors),
+	}
+}
+
+// Flush writes all points received so far
+func (l *Listener) Flush() {
+	l.batchMutex.Lock()
+	pts := l.batch
+	l.batch = make([]dbase.Point, 0, l.BatchSize)
+	l.batchMutex.Unlock()
+
+	l.write(pts)
+}
+
+// Close stops accepting data points and writes remaining points
+// the database is not closed with the listener
+func (l *Listener) Close() (err error) {
+	close(l.done)
+
+	if l.packets != nil {
+		err = l.packets.Close()
+	} else {
+		err = l.listener.Close()
+	}
+
+	l.connMutex.Lock()
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.connMutex.Unlock()
+
+	l.wg.Wait()
+	l.Flush()
+
+	return err
+}
+
+// HandleLine parses a line and adds its data points to the batch
+func (l *Listener) HandleLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return
+	}
+
+	atomic.AddInt64(&l.stats.Lines, 1)
+
+	pts, err := l.parse(line)
+	if err == ErrLineNotFit {
+		atomic.AddInt64(&l.stats.Rejected, 1)
+		return
+	} else if err != nil {
+		atomic.AddInt64(&l.stats.ParseErrors, 1)
+		return
+	}
+
+	l.batchMutex.Lock()
+	l.batch = append(l.batch, pts...)
+	var full []dbase.Point
+	if len(l.batch) >= l.BatchSize {
+		full = l.batch
+		l.batch = make([]dbase.Point, 0, l.BatchSize)
+	}
+	l.batchMutex.Unlock()
+
+	if full != nil {
+		l.write(full)
+	}
+}
+
+func (l *Listener) write(pts []dbase.Point) {
+	if len(pts) == 0 {
+		return
+	}
+
+	failed, _ := l.db.PutBatch(pts)
+	atomic.AddInt64(&l.stats.Points, int64(len(pts)-failed))
+	atomic.AddInt64(&l.stats.WriteErrors, int64(failed))
+}
+
+// indexValues returns index values using values available in a line
+// returns ErrLineNotFit if the line doesn't fit when using strict mode
+func (l *Listener) indexValues(values map[string]string) (vals []string, err error) {
+	vals = make([]string, len(l.Levels))
+	used := 0
+
+	for i, name := range l.Levels {
+		val, ok := values[name]
+		if !ok || val == "" {
+			if l.Strict {
+				return nil, ErrLineNotFit
+			}
+
+			val = l.MissingValue
+		} else {
+			used++
+		}
+
+		vals[i] = val
+	}
+
+	if l.Strict && used != len(values) {
+		return nil, ErrLineNotFit
+	}
+
+	return vals, nil
+}
+
+func (l *Listener) flushPeriodically() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.BatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.Flush()
+		}
+	}
+}
+
+func (l *Listener) accept() {
+	defer l.wg.Done()
+
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+				continue
+			}
+		}
+
+		l.connMutex.Lock()
+		l.conns[conn] = true
+		l.connMutex.Unlock()
+
+		l.wg.Add(1)
+		go l.serve(conn)
+	}
+}
+
+// serve reads lines from a tcp connection until it's closed
+func (l *Listener) serve(conn net.Conn) {
+	defer l.wg.Done()
+
+	defer func() {
+		l.connMutex.Lock()
+		delete(l.conns, conn)
+		l.connMutex.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		l.HandleLine(scanner.Text())
+	}
+}
+
+// readPackets reads udp packets, each packet may have many lines
+func (l *Listener) readPackets() {
+	defer l.wg.Done()
+
+	buf := make([]byte, MaxPacketSize)
+
+	for {
+		n, _, err := l.packets.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+				continue
+			}
+		}
+
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			l.HandleLine(line)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package ingest
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/meteorhacks/kdb/clock"
+	"github.com/meteorhacks/kdb/dbase"
+	"github.com/meteorhacks/kdb/payload"
+)
+
+func TestParseInflux(t *testing.T) {
+	l := &Listener{Options: Options{
+		Levels:       []string{"measurement", "host", "field"},
+		MissingValue: DefaultMissingValue,
+	}}
+
+	pts, err := l.parseInflux(`cpu\ load,host=h\,1,region=us usage=0.5,count=3i,ok=t,name="a b" 1000000000`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []dbase.Point{
+		testPoint(1000000000, []string{"cpu load", "h,1", "usage"}, 0.5),
+		testPoint(1000000000, []string{"cpu load", "h,1", "count"}, 3),
+		testPoint(1000000000, []string{"cpu load", "h,1", "ok"}, 1),
+	}
+
+	if !reflect.DeepEqual(pts, exp) {
+		t.Fatal("incorrect points", pts)
+	}
+
+	// missing tags should use the missing value
+	pts, err = l.parseInflux(`cpu usage=1 1000000000`)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(pts[0].Values, []string{"cpu", "-", "usage"}) {
+		t.Fatal("incorrect index values")
+	}
+
+	invalid := []string{
+		`cpu`,
+		`cpu usage=`,
+		`cpu usage=abc 1000`,
+		`cpu,host usage=1`,
+		`cpu usage=1 abc`,
+		`cpu name="a"`,
+	}
+
+	for _, line := range invalid {
+		if _, err := l.parseInflux(line); err != ErrInvalidLine && err != ErrInvalidValue {
+			t.Fatal("should return an error for", line)
+		}
+	}
+
+	l.Strict = true
+
+	if _, err := l.parseInflux(`cpu usage=1`); err != ErrLineNotFit {
+		t.Fatal("lines with missing levels should be rejected")
+	}
+
+	if _, err := l.parseInflux(`cpu,host=h1,region=us usage=1`); err != ErrLineNotFit {
+		t.Fatal("lines with extra tags should be rejected")
+	}
+
+	if _, err := l.parseInflux(`cpu,host=h1 usage=1`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseGraphite(t *testing.T) {
+	l := &Listener{Options: Options{
+		Levels:       []string{"measurement", "host", "field"},
+		Template:     "region.host.measurement.field*",
+		MissingValue: DefaultMissingValue,
+	}}
+
+	pts, err := l.parseGraphite("us.h1.cpu.usage.user 0.5 1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []dbase.Point{
+		testPoint(1000000000000, []string{"cpu", "h1", "usage.user"}, 0.5),
+	}
+
+	if !reflect.DeepEqual(pts, exp) {
+		t.Fatal("incorrect points", pts)
+	}
+
+	l.Template = ".host.measurement"
+	pts, err = l.parseGraphite("us.h1.cpu.usage 1 1000")
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(pts[0].Values, []string{"cpu", "h1", "-"}) {
+		t.Fatal("incorrect index values", pts[0].Values)
+	}
+
+	// without a template, parts are used in the same order
+	l.Template = ""
+	pts, err = l.parseGraphite("a.b 1 1000")
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(pts[0].Values, []string{"a", "b", "-"}) {
+		t.Fatal("incorrect index values", pts[0].Values)
+	}
+
+	for _, line := range []string{"a.b", "a..b 1", "a.b x", "a.b 1 x"} {
+		if _, err := l.parseGraphite(line); err != ErrInvalidLine && err != ErrInvalidValue {
+			t.Fatal("should return an error for", line)
+		}
+	}
+
+	l.Strict = true
+
+	if _, err := l.parseGraphite("a.b 1"); err != ErrLineNotFit {
+		t.Fatal("lines with missing levels should be rejected")
+	}
+
+	if _, err := l.parseGraphite("a.b.c.d 1"); err != ErrLineNotFit {
+		t.Fatal("lines with extra parts should be rejected")
+	}
+}
+
+func TestInfluxTCP(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	l, err := New(db, Options{
+		Format:  FormatInflux,
+		Network: "tcp",
+		Address: "127.0.0.1:0",
+		Levels:  []string{"measurement", "host", "field"},
+		Strict:  true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprintln(conn, "cpu,host=h1 usage=0.5,idle=0.25 1000000000000")
+	fmt.Fprintln(conn, "cpu,host=h1,region=us usage=1 1000000000000")
+	fmt.Fprintln(conn, "cpu,host=h1 usage=abc 1000000000000")
+	fmt.Fprintln(conn, "cpu,host=h1 usage=2 99000000000000")
+	conn.Close()
+
+	waitForLines(t, l, 4)
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := Stats{Lines: 4, Points: 2, ParseErrors: 1, Rejected: 1, WriteErrors: 1}
+	if stats := l.Stats(); stats != exp {
+		t.Fatal("incorrect stats", stats)
+	}
+
+	res, err := db.Get(1000000000000, 1001000000000, []string{"cpu", "h1", "idle"})
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{payload.EncodeFloat(0.25)}) {
+		t.Fatal("incorrect data")
+	}
+}
+
+func TestGraphiteUDP(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	l, err := New(db, Options{
+		Format:        FormatGraphite,
+		Network:       "udp",
+		Address:       "127.0.0.1:0",
+		Levels:        []string{"measurement", "host", "field"},
+		Template:      "host.measurement.field",
+		BatchSize:     2,
+		BatchInterval: time.Hour,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	conn, err := net.Dial("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	fmt.Fprint(conn, "h1.cpu.usage 0.5 1000\nh1.cpu.idle 0.25 1000\n")
+
+	// points are written when the batch is full
+	for i := 0; i < 500 && l.Stats().Points < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	res, err := db.Get(1000000000000, 1001000000000, []string{"cpu", "h1", "usage"})
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{payload.EncodeFloat(0.5)}) {
+		t.Fatal("incorrect data")
+	}
+}
+
+// ---------- //
+
+func createTestDbase() (db *dbase.DBase, err error) {
+	clock.UseTestClock()
+	clock.Goto(int64(3599 * time.Second))
+	cleanTestFiles()
+
+	return dbase.New(dbase.Options{
+		DatabaseName:   "test",
+		DataPath:       "/tmp/test-ingest",
+		IndexDepth:     3,
+		PayloadSize:    payload.FloatSize,
+		BucketDuration: int64(time.Hour),
+		Resolution:     int64(time.Second),
+		SegmentSize:    10,
+	})
+}
+
+func testPoint(ts int64, vals []string, value float64) (pt dbase.Point) {
+	return dbase.Point{
+		Timestamp: ts,
+		Values:    vals,
+		Payload:   payload.EncodeFloat(value),
+	}
+}
+
+func waitForLines(t *testing.T, l *Listener, n int64) {
+	for i := 0; i < 500; i++ {
+		if l.Stats().Lines == n {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("listener did not receive lines")
+}
+
+func cleanTestFiles() {
+	cmd := exec.Command("rm", "-rf", "/tmp/test-ingest")
+	cmd.Run()
+}
@@ -8,6 +8,11 @@ type Database interface {
 	Get(start, end int64, vals []string) (res [][]byte, err error)
 	Find(start, end int64, vals []string) (res map[*IndexElement][][]byte, err error)
 
+	// most recent payload of a series or of each series matching `vals`
+	// older buckets are used when newer buckets doesn't have the series
+	Latest(vals []string) (res *Point, err error)
+	LatestFind(vals []string) (res map[*IndexElement]*Point, err error)
+
 	// remove all data before given timestamp
 	RemoveBefore(ts int64) (err error)
 
@@ -26,7 +31,8 @@ type Bucket interface {
 
 // Blocks are used to stores arbitrary data ([]byte) as a series in records.
 // At the moment, KDB only supports fixed size payloads using `dblock` package.
-// Payloads are placed as records ordered by time.
+// Payloads are placed as records ordered by time. The `sblock` package can be
+// used to store records with only a few payloads as sparse records.
 type Block interface {
 	New() (rpos int64, err error)
 	Put(rpos, ppos int64, pld []byte) (err error)
@@ -34,6 +40,12 @@ type Block interface {
 	Close() (err error)
 }
 
+// MergeFunc combines a payload stored in a block (`old`) with a new payload
+// and returns the payload to store. `old` is an empty payload (all zeros)
+// if nothing is stored yet. The result must not be larger than `old`.
+// Nothing is stored if an error is returned (ex: unsupported payloads).
+type MergeFunc func(old, new []byte) (res []byte, err error)
+
 // Indexes are a map of record position to some pre configured fields.
 // All queries are first made to an Index and later used with Blocks.
 type Index interface {
@@ -43,12 +55,16 @@ type Index interface {
 	Close() (err error)
 }
 
-// Struct representing an element in the index. Here we are maintaining a
-// tree structure. So, it's `Values` field is only available in leaf nodes
-// `Children` is  only available in root and intermediate level nodes.
-// All the data elements are on the lowest level, which are leaf nodes.
+// Struct representing a series in the index with its index values and the
+// position of its record. Indexes keep their own structures (ex: a tree) to
+// find elements, elements only have the data needed for each series.
 type IndexElement struct {
 	Values   []string
 	Position int64
-	Children map[string]*IndexElement
+}
+
+// Point is a stored payload with the start time of its payload slot
+type Point struct {
+	Timestamp int64
+	Payload   []byte
 }
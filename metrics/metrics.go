@@ -0,0 +1,454 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+var (
+	// default upper bounds of histogram buckets used with latencies (seconds)
+	LatencyBuckets = []float64{0.00001, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+	// registry used by all kdb packages
+	// published with expvar as "kdb"
+	Default = NewRegistry()
+)
+
+func init() {
+	expvar.Publish("kdb", expvar.Func(Default.Values))
+}
+
+// metric is a counter, a gauge or a histogram
+type metric interface {
+	// value used with expvar
+	value() interface{}
+
+	// writes samples in prometheus text format
+	write(w io.Writer, name, labels string)
+}
+
+type entry struct {
+	name  string
+	help  string
+	kind  string
+	label string // label name used with vectors
+
+	// metrics by label value (empty string if not a vector)
+	metrics map[string]metric
+	mutex   *sync.RWMutex
+}
+
+// Registry holds metrics reported by different parts of the database
+type Registry struct {
+	entries map[string]*entry
+	mutex   *sync.Mutex
+}
+
+func NewRegistry() (r *Registry) {
+	return &Registry{
+		entries: make(map[string]*entry),
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// Counter returns the counter with given name
+// it's created if it's not available in the registry
+func (r *Registry) Counter(name, help string) (c *Counter) {
+	return r.entry(name, help, typeCounter, "").get("", newCounter).(*Counter)
+}
+
+// Gauge returns the gauge with given name
+// it's created if it's not available in the registry
+func (r *Registry) Gauge(name, help string) (g *Gauge) {
+	return r.entry(name, help, typeGauge, "").get("", newGauge).(*Gauge)
+}
+
+// Histogram returns the histogram with given name
+// it's created with `buckets` if it's not available in the registry
+func (r *Registry) Histogram(name, help string, buckets []float64) (h *Histogram) {
+	return r.entry(name, help, typeHistogram, "").get("", func() metric {
+		return newHistogram(buckets)
+	}).(*Histogram)
+}
+
+// CounterVec returns a set of counters with a label
+func (r *Registry) CounterVec(name, help, label string) (v *CounterVec) {
+	return &CounterVec{r.entry(name, help, typeCounter, label)}
+}
+
+// GaugeVec returns a set of gauges with a label
+func (r *Registry) GaugeVec(name, help, label string) (v *GaugeVec) {
+	return &GaugeVec{r.entry(name, help, typeGauge, label)}
+}
+
+// Values returns values of all metrics
+// vectors are returned as maps of label values to values
+func (r *Registry) Values() (values interface{}) {
+	res := make(map[string]interface{})
+
+	for _, e := range r.sorted() {
+		e.mutex.RLock()
+		if e.label == "" {
+			res[e.name] = e.metrics[""].value()
+		} else {
+			vals := make(map[string]interface{})
+			for lval, m := range e.metrics {
+				vals[lval] = m.value()
+			}
+
+			res[e.name] = vals
+		}
+		e.mutex.RUnlock()
+	}
+
+	return res
+}
+
+// WritePrometheus writes all metrics in prometheus text format
+func (r *Registry) WritePrometheus(w io.Writer) (err error) {
+	for _, e := range r.sorted() {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", e.name, e.help, e.name, e.kind); err != nil {
+			return err
+		}
+
+		e.mutex.RLock()
+		lvals := make([]string, 0, len(e.metrics))
+		for lval := range e.metrics {
+			lvals = append(lvals, lval)
+		}
+		sort.Strings(lvals)
+
+		for _, lval := range lvals {
+			labels := ""
+			if e.label != "" {
+				labels = e.label + "=" + strconv.Quote(lval)
+			}
+
+			e.metrics[lval].write(w, e.name, labels)
+		}
+		e.mutex.RUnlock()
+	}
+
+	return nil
+}
+
+// Handler returns a http handler which serves metrics
+// in prometheus text format (or json with "?format=json")
+func (r *Registry) Handler() (h http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(r.Values())
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WritePrometheus(w)
+	})
+}
+
+func (r *Registry) entry(name, help, kind, label string) (e *entry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if e, ok := r.entries[name]; ok {
+		if e.kind != kind || e.label != label {
+			panic("metric " + name + " is already registered with a different type")
+		}
+
+		return e
+	}
+
+	e = &entry{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		label:   label,
+		metrics: make(map[string]metric),
+		mutex:   &sync.RWMutex{},
+	}
+
+	r.entries[name] = e
+	return e
+}
+
+func (r *Registry) sorted() (entries []*entry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	names := make([]string, 0, len(r.entries))
+	for name := range r.entries {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		entries = append(entries, r.entries[name])
+	}
+
+	return entries
+}
+
+func (e *entry) get(lval string, create func() metric) (m metric) {
+	e.mutex.RLock()
+	m, ok := e.metrics[lval]
+	e.mutex.RUnlock()
+
+	if ok {
+		return m
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if m, ok := e.metrics[lval]; ok {
+		return m
+	}
+
+	m = create()
+	e.metrics[lval] = m
+	return m
+}
+
+func (e *entry) del(lval string) {
+	e.mutex.Lock()
+	delete(e.metrics, lval)
+	e.mutex.Unlock()
+}
+
+//   Counter
+// -----------
+
+// Counter is a value which only increases
+type Counter struct {
+	val int64
+}
+
+func newCounter() metric {
+	return &Counter{}
+}
+
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.val, 1)
+}
+
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.val, n)
+}
+
+func (c *Counter) Value() (n int64) {
+	return atomic.LoadInt64(&c.val)
+}
+
+func (c *Counter) value() interface{} {
+	return c.Value()
+}
+
+func (c *Counter) write(w io.Writer, name, labels string) {
+	fmt.Fprintf(w, "%s%s %d\n", name, braces(labels), c.Value())
+}
+
+//   Gauge
+// ---------
+
+// Gauge is a value which can increase and decrease
+type Gauge struct {
+	val int64
+}
+
+func newGauge() metric {
+	return &Gauge{}
+}
+
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.val, 1)
+}
+
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.val, -1)
+}
+
+func (g *Gauge) Set(n int64) {
+	atomic.StoreInt64(&g.val, n)
+}
+
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.val, n)
+}
+
+func (g *Gauge) Value() (n int64) {
+	return atomic.LoadInt64(&g.val)
+}
+
+func (g *Gauge) value() interface{} {
+	return g.Value()
+}
+
+func (g *Gauge) write(w io.Writer, name, labels string) {
+	fmt.Fprintf(w, "%s%s %d\n", name, braces(labels), g.Value())
+}
+
+//   Histogram
+// -------------
+
+// Histogram counts observed values in buckets
+// bucket counts are cumulative as in prometheus
+type Histogram struct {
+	bounds []float64
+	counts []int64 // one more than bounds (+Inf)
+	count  int64
+	sum    uint64 // float64 bits
+}
+
+func newHistogram(bounds []float64) metric {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.count, 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, sum) {
+			return
+		}
+	}
+}
+
+// Since observes the time passed since `start` in seconds
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Count returns the number of observed values
+func (h *Histogram) Count() (n int64) {
+	return atomic.LoadInt64(&h.count)
+}
+
+// Sum returns the sum of observed values
+func (h *Histogram) Sum() (sum float64) {
+	return math.Float64frombits(atomic.LoadUint64(&h.sum))
+}
+
+func (h *Histogram) value() interface{} {
+	buckets := make(map[string]int64)
+	var total int64
+
+	for i, bound := range h.bounds {
+		total += atomic.LoadInt64(&h.counts[i])
+		buckets[formatFloat(bound)] = total
+	}
+
+	return map[string]interface{}{
+		"count":   h.Count(),
+		"sum":     h.Sum(),
+		"buckets": buckets,
+	}
+}
+
+func (h *Histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+
+	var total int64
+	for i, bound := range h.bounds {
+		total += atomic.LoadInt64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{%s%sle=%q} %d\n", name, labels, sep, formatFloat(bound), total)
+	}
+
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.Count())
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(labels), formatFloat(h.Sum()))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braces(labels), h.Count())
+}
+
+//   Vectors
+// -----------
+
+// CounterVec is a set of counters with different label values
+type CounterVec struct {
+	e *entry
+}
+
+// With returns the counter with given label value
+func (v *CounterVec) With(lval string) (c *Counter) {
+	return v.e.get(lval, newCounter).(*Counter)
+}
+
+// GaugeVec is a set of gauges with different label values
+type GaugeVec struct {
+	e *entry
+}
+
+// With returns the gauge with given label value
+func (v *GaugeVec) With(lval string) (g *Gauge) {
+	return v.e.get(lval, newGauge).(*Gauge)
+}
+
+// Delete removes the gauge with given label value
+func (v *GaugeVec) Delete(lval string) {
+	v.e.del(lval)
+}
+
+//   Default Registry
+// --------------------
+
+func NewCounter(name, help string) (c *Counter) {
+	return Default.Counter(name, help)
+}
+
+func NewGauge(name, help string) (g *Gauge) {
+	return Default.Gauge(name, help)
+}
+
+func NewHistogram(name, help string, buckets []float64) (h *Histogram) {
+	return Default.Histogram(name, help, buckets)
+}
+
+func NewCounterVec(name, help, label string) (v *CounterVec) {
+	return Default.CounterVec(name, help, label)
+}
+
+func NewGaugeVec(name, help, label string) (v *GaugeVec) {
+	return Default.GaugeVec(name, help, label)
+}
+
+// Handler serves metrics in the default registry
+func Handler() (h http.Handler) {
+	return Default.Handler()
+}
+
+func braces(labels string) (str string) {
+	if labels == "" {
+		return ""
+	}
+
+	return "{" + labels + "}"
+}
+
+func formatFloat(v float64) (str string) {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
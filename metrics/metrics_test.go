@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"reflect"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	c := r.Counter("test_counter", "a counter")
+	c.Inc()
+	c.Add(2)
+
+	if r.Counter("test_counter", "a counter") != c {
+		t.Fatal("should return the same counter")
+	}
+
+	g := r.GaugeVec("test_gauge", "a gauge", "bucket")
+	g.With("a").Set(5)
+	g.With("b").Inc()
+	g.With("c").Inc()
+	g.Delete("c")
+
+	h := r.Histogram("test_histogram", "a histogram", []float64{1, 2})
+	h.Observe(0.5)
+	h.Observe(1.5)
+	h.Observe(3)
+
+	exp := map[string]interface{}{
+		"test_counter": int64(3),
+		"test_gauge":   map[string]interface{}{"a": int64(5), "b": int64(1)},
+		"test_histogram": map[string]interface{}{
+			"count":   int64(3),
+			"sum":     float64(5),
+			"buckets": map[string]int64{"1": 1, "2": 2},
+		},
+	}
+
+	if !reflect.DeepEqual(r.Values(), exp) {
+		t.Fatal("incorrect values", r.Values())
+	}
+
+	var buf bytes.Buffer
+	if err := r.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	text := `# HELP test_counter a counter
+# TYPE test_counter counter
+test_counter 3
+# HELP test_gauge a gauge
+# TYPE test_gauge gauge
+test_gauge{bucket="a"} 5
+test_gauge{bucket="b"} 1
+# HELP test_histogram a histogram
+# TYPE test_histogram histogram
+test_histogram_bucket{le="1"} 1
+test_histogram_bucket{le="2"} 2
+test_histogram_bucket{le="+Inf"} 3
+test_histogram_sum 5
+test_histogram_count 3
+`
+
+	if buf.String() != text {
+		t.Fatal("incorrect prometheus text", buf.String())
+	}
+}
+
+func TestTypeMismatch(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("test_metric", "a counter")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("should panic")
+		}
+	}()
+
+	r.Gauge("test_metric", "a gauge")
+}
+
+func TestExpvar(t *testing.T) {
+	c := NewCounter("test_expvar_counter", "a counter")
+	c.Inc()
+
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(expvar.Get("kdb").String()), &values); err != nil {
+		t.Fatal(err)
+	}
+
+	if values["test_expvar_counter"] != float64(c.Value()) {
+		t.Fatal("default registry should be published with expvar")
+	}
+}
@@ -0,0 +1,108 @@
+package mindex
+
+import (
+	"sync"
+)
+
+const (
+	// number of shards used by the interner to reduce lock contention
+	// when many indexes (buckets) are adding elements at the same time
+	InternShards = 32
+)
+
+// strs is shared by all indexes so index values used in many buckets
+// (or in many levels of the same index) are only stored once in memory
+var strs = newInterner()
+
+// interner keeps a single copy of strings used as index values
+// strings are counted and removed when they are not used by any element
+type interner struct {
+	shards [InternShards]internShard
+}
+
+type internShard struct {
+	mutex   sync.Mutex
+	strings map[string]interned
+}
+
+// interned is a shared string with the number of places it's used
+type interned struct {
+	value string
+	refs  int64
+}
+
+func newInterner() (in *interner) {
+	in = &interner{}
+	for i := range in.shards {
+		in.shards[i].strings = make(map[string]interned)
+	}
+
+	return in
+}
+
+// acquire returns the shared copy of the string
+// every acquired string should be released once it's not used
+func (in *interner) acquire(s string) (res string) {
+	shard := in.shard(s)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	str, ok := shard.strings[s]
+	if !ok {
+		str.value = s
+		metricInterned.Inc()
+	}
+
+	str.refs++
+	shard.strings[s] = str
+
+	return str.value
+}
+
+// release removes the string from the interner if it's not used anymore
+func (in *interner) release(s string) {
+	shard := in.shard(s)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	str, ok := shard.strings[s]
+	if !ok {
+		return
+	}
+
+	if str.refs--; str.refs > 0 {
+		shard.strings[s] = str
+		return
+	}
+
+	delete(shard.strings, s)
+	metricInterned.Dec()
+}
+
+// values returns a copy of index values using shared strings
+func (in *interner) values(vals []string) (res []string) {
+	res = make([]string, len(vals))
+	for i, v := range vals {
+		res[i] = in.acquire(v)
+	}
+
+	return res
+}
+
+// releaseValues releases all strings used by index values
+func (in *interner) releaseValues(vals []string) {
+	for _, v := range vals {
+		in.release(v)
+	}
+}
+
+// shard returns the shard used with the string (fnv-1a hash)
+func (in *interner) shard(s string) (shard *internShard) {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+
+	return &in.shards[h%InternShards]
+}
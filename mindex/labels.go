@@ -0,0 +1,165 @@
+package mindex
+
+import (
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/meteorhacks/kdb"
+)
+
+// Labels validates labels of a series (name=value) and returns them sorted
+// by name. Names and values should not be empty and names should be unique.
+// Sorted labels are used as index values with `Labels` indexes.
+func Labels(vals []string) (res []string, err error) {
+	res = make([]string, len(vals))
+	copy(res, vals)
+	sort.Strings(res)
+
+	for i, l := range res {
+		eq := strings.IndexByte(l, '=')
+		if eq <= 0 || eq == len(l)-1 || strings.IndexByte(l, 0) >= 0 {
+			return nil, ErrInvalidLabel
+		}
+
+		// labels with the same name are next to each other when sorted
+		// the name is followed by '=' which can't be a part of the name
+		if i > 0 && strings.HasPrefix(res[i-1], l[:eq+1]) {
+			return nil, ErrDuplicateLabel
+		}
+	}
+
+	return res, nil
+}
+
+// labelsHash returns the hash used to find a series with sorted labels
+// series are stored by hash to avoid storing labels again as a map key
+// labels are hashed with fnv-1a, each label is followed by a zero byte
+func labelsHash(labels []string) (h uint64) {
+	h = 14695981039346656037
+	for _, l := range labels {
+		for i := 0; i < len(l); i++ {
+			h ^= uint64(l[i])
+			h *= 1099511628211
+		}
+
+		h *= 1099511628211
+	}
+
+	return h
+}
+
+// labelsElement returns the element with the same labels from a list of
+// elements with the same hash (hashes of different labels may collide)
+func labelsElement(els []*kdb.IndexElement, labels []string) (i int) {
+	for i, el := range els {
+		if slices.Equal(el.Values, labels) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// getLabels returns the element with the same labels
+func (idx *MIndex) getLabels(vals []string) (el *kdb.IndexElement, err error) {
+	labels, err := Labels(vals)
+	if err != nil {
+		return nil, err
+	}
+
+	idx.treeMutex.RLock()
+	defer idx.treeMutex.RUnlock()
+
+	els := idx.series[labelsHash(labels)]
+	if i := labelsElement(els, labels); i >= 0 {
+		return els[i], nil
+	}
+
+	return nil, nil
+}
+
+// findLabels returns elements which have all given labels
+// empty values are ignored, all elements match if there are no labels
+func (idx *MIndex) findLabels(vals []string) (els []*kdb.IndexElement, err error) {
+	var query []string
+	for _, v := range vals {
+		if v != "" {
+			query = append(query, v)
+		}
+	}
+
+	labels, err := Labels(query)
+	if err != nil {
+		return nil, err
+	}
+
+	idx.treeMutex.RLock()
+	defer idx.treeMutex.RUnlock()
+
+	els = make([]*kdb.IndexElement, 0)
+
+	if len(labels) == 0 {
+		for _, list := range idx.series {
+			els = append(els, list...)
+		}
+
+		return els, nil
+	}
+
+	// check elements of the label with the least number of elements
+	smallest := idx.postings[labels[0]]
+	for _, l := range labels[1:] {
+		if len(idx.postings[l]) < len(smallest) {
+			smallest = idx.postings[l]
+		}
+	}
+
+outer:
+	for _, el := range smallest {
+		for _, l := range labels {
+			i := sort.SearchStrings(el.Values, l)
+			if i == len(el.Values) || el.Values[i] != l {
+				continue outer
+			}
+		}
+
+		els = append(els, el)
+	}
+
+	return els, nil
+}
+
+// addLabels adds an element with sorted labels to the index
+// an element with the same labels is replaced if it's available
+func (idx *MIndex) addLabels(el *kdb.IndexElement) (err error) {
+	hash := labelsHash(el.Values)
+	els := idx.series[hash]
+
+	i := labelsElement(els, el.Values)
+	if i < 0 {
+		idx.series[hash] = append(els, el)
+		idx.elements++
+		metricElements.Inc()
+
+		for _, l := range el.Values {
+			idx.postings[l] = append(idx.postings[l], el)
+		}
+
+		return nil
+	}
+
+	old := els[i]
+	els[i] = el
+	strs.releaseValues(old.Values)
+
+	for _, l := range el.Values {
+		for j, e := range idx.postings[l] {
+			if e == old {
+				idx.postings[l][j] = el
+			}
+		}
+	}
+
+	return nil
+}
@@ -6,6 +6,7 @@ package mindex
 import (
 	"encoding/binary"
 	"errors"
+	"io"
 	"os"
 	"runtime"
 	"sync"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/glycerine/go-capnproto"
 	"github.com/meteorhacks/kdb"
+	"github.com/meteorhacks/kdb/metrics"
 )
 
 const (
@@ -29,6 +31,15 @@ var (
 	ErrMIndexBytesWrittenToBuffer = errors.New("incorrect number of bytes written to temporary buffer")
 	ErrMIndexBytesReadFromFile    = errors.New("incorrect number of bytes read from index file")
 	ErrMIndexBytesReadFromBuffer  = errors.New("incorrect number of bytes read from temporary buffer")
+	ErrMIndexReadOnly             = errors.New("write operation on a read only index")
+	ErrInvalidLabel               = errors.New("labels should be in name=value format")
+	ErrDuplicateLabel             = errors.New("label names should be unique in a series")
+
+	// metrics reported to the default registry
+	metricElements = metrics.NewGauge("kdb_mindex_elements", "number of index elements in open indexes")
+	metricAdded    = metrics.NewCounter("kdb_mindex_elements_added_total", "number of index elements added")
+	metricGrowth   = metrics.NewCounter("kdb_mindex_file_growth_bytes_total", "number of bytes preallocated for index files")
+	metricInterned = metrics.NewGauge("kdb_mindex_interned_strings", "number of distinct index values shared by open indexes")
 )
 
 type MIndexOpts struct {
@@ -37,23 +48,44 @@ type MIndexOpts struct {
 
 	// depth of the index tree
 	IndexDepth int64
+
+	// index series by sets of labels instead of a tree of values
+	// each value should be a label in name=value format, series can have
+	// any number of labels in any order and `IndexDepth` is not used.
+	// Labels of index elements are sorted by name.
+	Labels bool
+
+	// read only index, the index file will not be created or modified
+	// elements added by other processes are loaded with `Refresh`
+	ReadOnly bool
 }
 
 // Base struct of the MIndex
 // `root` is the starting point of the tree
+// index values of elements are shared by all indexes (see interner)
 type MIndex struct {
 	MIndexOpts
-	root            *kdb.IndexElement // root element of the index tree
-	file            *os.File          // file used to store index nodes
-	currentFileSize int64             // file size (offset to place next index)
-	totalFileSize   int64             // total file of the file
-	mmapedData      []byte            // mmaped file data
-	mmapedOffset    int64             // offset of the mmap
+	root            *node                          // root node of the index tree
+	series          map[uint64][]*kdb.IndexElement // elements by hash of labels (`Labels` mode)
+	postings        map[string][]*kdb.IndexElement // elements by each label (`Labels` mode)
+	file            *os.File                       // file used to store index nodes
+	currentFileSize int64                          // file size (offset to place next index)
+	totalFileSize   int64                          // total file of the file
+	mmapedData      []byte                         // mmaped file data
+	mmapedOffset    int64                          // offset of the mmap
+	elements        int64                          // number of elements in the tree
 	mutex           *sync.Mutex
+	treeMutex       *sync.RWMutex // used when reading or changing the tree
+	addMutex        *sync.Mutex   // elements are added one at a time
 }
 
 func NewMIndex(opts MIndexOpts) (idx *MIndex, err error) {
-	file, err := os.OpenFile(opts.FilePath, MIndexFMode, MIndexFPerms)
+	mode := MIndexFMode
+	if opts.ReadOnly {
+		mode = os.O_RDONLY
+	}
+
+	file, err := os.OpenFile(opts.FilePath, mode, MIndexFPerms)
 	if err != nil {
 		// A not found error will be thrown here if the bucket which
 		// is creating this index does not exist in the filesystem.
@@ -63,9 +95,7 @@ func NewMIndex(opts MIndexOpts) (idx *MIndex, err error) {
 		return nil, err
 	}
 
-	root := &kdb.IndexElement{
-		Children: make(map[string]*kdb.IndexElement),
-	}
+	root := &node{}
 
 	finfo, err := file.Stat()
 	if err != nil {
@@ -79,9 +109,35 @@ func NewMIndex(opts MIndexOpts) (idx *MIndex, err error) {
 
 	mutex := &sync.Mutex{}
 
-	idx = &MIndex{opts, root, file, currentFileSize, totalFileSize, mmapedData, mmapedOffset, mutex}
+	series := make(map[uint64][]*kdb.IndexElement)
+	postings := make(map[string][]*kdb.IndexElement)
+
+	idx = &MIndex{opts, root, series, postings, file, currentFileSize, totalFileSize, mmapedData, mmapedOffset, 0, mutex, &sync.RWMutex{}, &sync.Mutex{}}
 
 	if err := idx.load(); err != nil {
+		idx.release()
+		file.Close()
+		return nil, err
+	}
+
+	return idx, nil
+}
+
+// NewMIndexFromData creates a read only index using index file data
+// useful when the index file is not available as a separate file on disk
+func NewMIndexFromData(opts MIndexOpts, data []byte) (idx *MIndex, err error) {
+	idx = &MIndex{
+		MIndexOpts: opts,
+		root:       &node{},
+		series:     make(map[uint64][]*kdb.IndexElement),
+		postings:   make(map[string][]*kdb.IndexElement),
+		mutex:      &sync.Mutex{},
+		treeMutex:  &sync.RWMutex{},
+		addMutex:   &sync.Mutex{},
+	}
+
+	if _, err := idx.parse(data); err != nil {
+		idx.release()
 		return nil, err
 	}
 
@@ -90,6 +146,19 @@ func NewMIndex(opts MIndexOpts) (idx *MIndex, err error) {
 
 // Add Item to the index with provided record position
 func (idx *MIndex) Add(vals []string, rpos int64) (el *kdb.IndexElement, err error) {
+	if idx.file == nil || idx.ReadOnly {
+		return nil, ErrMIndexReadOnly
+	}
+
+	if idx.Labels {
+		if vals, err = Labels(vals); err != nil {
+			return nil, err
+		}
+	}
+
+	idx.addMutex.Lock()
+	defer idx.addMutex.Unlock()
+
 	el = &kdb.IndexElement{
 		Position: rpos,
 		Values:   vals,
@@ -105,29 +174,54 @@ func (idx *MIndex) Add(vals []string, rpos int64) (el *kdb.IndexElement, err err
 		return nil, err
 	}
 
+	metricAdded.Inc()
+
 	return el, nil
 }
 
 // Get the IndexElement for given set of values
+// with `Labels` indexes, the series should have exactly the same labels
 func (idx *MIndex) Get(vals []string) (el *kdb.IndexElement, err error) {
-	el = idx.root
-	var ok bool
+	if idx.Labels {
+		return idx.getLabels(vals)
+	}
+
+	idx.treeMutex.RLock()
+	defer idx.treeMutex.RUnlock()
+
+	last := int(idx.IndexDepth) - 1
+	if len(vals) != last+1 {
+		return nil, nil
+	}
 
-	for _, v := range vals {
-		if el, ok = el.Children[v]; !ok {
+	n := idx.root
+	for _, v := range vals[:last] {
+		if n = n.child(v); n == nil {
 			return nil, nil
 		}
 	}
 
-	return el, nil
+	return n.element(vals[last], last), nil
 }
 
-// Get the IndexElement for given set of values
+// Find IndexElements matching the given set of values, empty values match
+// any value. With `Labels` indexes, series having all given labels match.
 func (idx *MIndex) Find(vals []string) (els []*kdb.IndexElement, err error) {
+	if idx.Labels {
+		return idx.findLabels(vals)
+	}
+
+	idx.treeMutex.RLock()
+	defer idx.treeMutex.RUnlock()
+
 	els = make([]*kdb.IndexElement, 0)
-	root := idx.root
-	var ok bool
+	last := int(idx.IndexDepth) - 1
+	if len(vals) > last+1 {
+		return els, nil
+	}
 
+	n := idx.root
+	level := 0
 	needsFilter := false
 
 	for j, v := range vals {
@@ -141,12 +235,22 @@ func (idx *MIndex) Find(vals []string) (els []*kdb.IndexElement, err error) {
 			break
 		}
 
-		if root, ok = root.Children[v]; !ok {
+		if j == last {
+			if el := n.element(v, last); el != nil {
+				els = append(els, el)
+			}
+
 			return els, nil
 		}
+
+		if n = n.child(v); n == nil {
+			return els, nil
+		}
+
+		level++
 	}
 
-	els = idx.find(root, els)
+	els = n.collect(level, last, els)
 	if !needsFilter {
 		return els, nil
 	}
@@ -167,13 +271,33 @@ outer:
 	return filtered, nil
 }
 
+// Count returns the number of elements in the index
+func (idx *MIndex) Count() (count int64) {
+	idx.treeMutex.RLock()
+	defer idx.treeMutex.RUnlock()
+
+	return idx.elements
+}
+
 // close the file handler
 func (idx *MIndex) Close() (err error) {
+	idx.release()
+
+	// indexes created with data does not use files
+	if idx.file == nil {
+		return nil
+	}
+
 	err = idx.file.Close()
 	if err != nil {
 		return err
 	}
 
+	// index files trimmed to zero bytes are not mmaped
+	if len(idx.mmapedData) == 0 {
+		return nil
+	}
+
 	err = syscall.Munmap(idx.mmapedData)
 	if err != nil {
 		return err
@@ -182,96 +306,231 @@ func (idx *MIndex) Close() (err error) {
 	return nil
 }
 
+// Trim removes preallocated space at the end of the index file
+// the file will be pre allocated again when adding new elements
+func (idx *MIndex) Trim() (err error) {
+	if idx.file == nil || idx.ReadOnly {
+		return nil
+	}
+
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	if len(idx.mmapedData) != 0 {
+		err = syscall.Munmap(idx.mmapedData)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = idx.file.Truncate(idx.currentFileSize)
+	if err != nil {
+		return err
+	}
+
+	idx.totalFileSize = idx.currentFileSize
+
+	return idx.loadData(0, idx.totalFileSize)
+}
+
+// Refresh loads elements added to the index file by other processes
+// It's only useful with read only indexes, other indexes are not changed.
+func (idx *MIndex) Refresh() (err error) {
+	if idx.file == nil || !idx.ReadOnly {
+		return nil
+	}
+
+	idx.addMutex.Lock()
+	defer idx.addMutex.Unlock()
+
+	return idx.readElements()
+}
+
 // loads index data from a file containing protobuf encoded index elements
 // TODO: handle corrupt index files (load valid index points)
 func (idx *MIndex) load() (err error) {
+	// read only indexes are read without mmaping the file
+	// because the file may grow while the index is used
+	if idx.ReadOnly {
+		idx.currentFileSize = 0
+		return idx.readElements()
+	}
+
 	err = idx.loadData(0, idx.totalFileSize)
 	if err != nil {
 		return err
 	}
 
-	data := idx.mmapedData
+	offset, err := idx.parse(idx.mmapedData)
+	if err != nil {
+		return err
+	}
+
+	idx.currentFileSize = offset
+
+	err = idx.preAllocateIfNeeded(0)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// parse adds all index elements available in index file data to the tree
+// and returns the offset right after the last element (start of free space)
+func (idx *MIndex) parse(data []byte) (offset int64, err error) {
 	dataSize := int64(len(data))
-	var offset int64 = 0
 
-	for offset != dataSize {
+	for offset+MIndexElHeaderSize <= dataSize {
 		// read element header (element size as int64) from data
 		sizeData := data[offset : offset+MIndexElHeaderSize]
 		idxElSize, n := binary.Varint(sizeData)
 		if n <= 0 {
-			return ErrMIndexBytesReadFromBuffer
+			return 0, ErrMIndexBytesReadFromBuffer
 		}
 
 		// read encoded element and Unmarshal it
 		start := offset + MIndexElHeaderSize
 		end := start + idxElSize
-		if end > idx.totalFileSize {
-			return errors.New("data size is too small to filled into protobuf")
+		if end > dataSize {
+			return 0, errors.New("data size is too small to filled into protobuf")
 		}
 
-		seg := capn.NewBuffer(data[start:end])
-		if len(seg.Data) == 0 {
+		el, ok := decodeElement(data[start:end])
+		if !ok {
 			// invalid data
 			break
 		}
 
-		mel := ReadRootMIndexEl(seg)
-		el := &kdb.IndexElement{
-			Position: mel.Position(),
-			Values:   mel.Values().ToArray(),
-		}
-
 		if err = idx.addElement(el); err != nil {
-			return err
+			return 0, err
 		}
 
 		// set offset to point to the end of bytes already read
 		offset += MIndexElHeaderSize + idxElSize
 	}
 
-	idx.currentFileSize = offset
+	return offset, nil
+}
 
-	err = idx.preAllocateIfNeeded(0)
-	if err != nil {
-		return err
+// readElements reads elements from the index file starting at the end of
+// the last element read. It stops at the first empty or incomplete element.
+func (idx *MIndex) readElements() (err error) {
+	header := make([]byte, MIndexElHeaderSize, MIndexElHeaderSize)
+
+	for {
+		n, err := idx.file.ReadAt(header, idx.currentFileSize)
+		if n != MIndexElHeaderSize {
+			if err == io.EOF {
+				return nil
+			}
+
+			return err
+		}
+
+		idxElSize, n := binary.Varint(header)
+		if n <= 0 {
+			return ErrMIndexBytesReadFromFile
+		}
+
+		// empty space preallocated by the writer
+		if idxElSize == 0 {
+			return nil
+		}
+
+		data := make([]byte, idxElSize, idxElSize)
+		n, err = idx.file.ReadAt(data, idx.currentFileSize+MIndexElHeaderSize)
+		if int64(n) != idxElSize {
+			if err == io.EOF {
+				return nil
+			}
+
+			return err
+		}
+
+		el, ok := decodeElement(data)
+		if !ok {
+			return nil
+		}
+
+		if err := idx.addElement(el); err != nil {
+			return err
+		}
+
+		idx.currentFileSize += MIndexElHeaderSize + idxElSize
 	}
+}
 
-	return nil
+// decodeElement reads an index element encoded with capnp
+func decodeElement(data []byte) (el *kdb.IndexElement, ok bool) {
+	seg := capn.NewBuffer(data)
+	if len(seg.Data) == 0 {
+		return nil, false
+	}
+
+	mel := ReadRootMIndexEl(seg)
+	el = &kdb.IndexElement{
+		Position: mel.Position(),
+		Values:   mel.Values().ToArray(),
+	}
+
+	return el, true
 }
 
-// recursively go through all tree branches and collect leaf nodes
-func (idx *MIndex) find(root *kdb.IndexElement, els []*kdb.IndexElement) []*kdb.IndexElement {
-	if root.Children == nil {
-		return append(els, root)
+// release removes all elements from the index
+// and releases index values shared with other indexes
+func (idx *MIndex) release() {
+	idx.treeMutex.Lock()
+	defer idx.treeMutex.Unlock()
+
+	var els []*kdb.IndexElement
+	if idx.Labels {
+		for _, list := range idx.series {
+			els = append(els, list...)
+		}
+	} else {
+		els = idx.root.collect(0, int(idx.IndexDepth)-1, els)
 	}
 
-	for _, el := range root.Children {
-		els = idx.find(el, els)
+	for _, el := range els {
+		strs.releaseValues(el.Values)
 	}
 
-	return els
+	idx.root = &node{}
+	idx.series = make(map[uint64][]*kdb.IndexElement)
+	idx.postings = make(map[string][]*kdb.IndexElement)
+
+	metricElements.Add(-idx.elements)
+	idx.elements = 0
 }
 
 // add IndexElement to the tree
+// index values are replaced with values shared with other indexes
 func (idx *MIndex) addElement(el *kdb.IndexElement) (err error) {
-	root := idx.root
-	tempVals := make([]string, 4)
+	idx.treeMutex.Lock()
+	defer idx.treeMutex.Unlock()
 
-	for i, v := range el.Values[0 : idx.IndexDepth-1] {
-		newRoot, ok := root.Children[v]
-		tempVals[i] = v
+	el.Values = strs.values(el.Values)
 
-		if !ok {
-			newRoot = &kdb.IndexElement{}
-			newRoot.Children = make(map[string]*kdb.IndexElement)
-			root.Children[v] = newRoot
-		}
+	if idx.Labels {
+		return idx.addLabels(el)
+	}
+
+	last := int(idx.IndexDepth) - 1
+	n := idx.root
 
-		root = newRoot
+	for _, v := range el.Values[:last] {
+		n = n.addChild(v)
 	}
 
-	lastValue := el.Values[idx.IndexDepth-1]
-	root.Children[lastValue] = el
+	old := n.setElement(el, last)
+	if old != nil {
+		strs.releaseValues(old.Values)
+		return nil
+	}
+
+	idx.elements++
+	metricElements.Inc()
 
 	return nil
 }
@@ -309,20 +568,18 @@ func (idx *MIndex) saveElement(el *kdb.IndexElement) (err error) {
 
 	var lc int64 = 0
 
-	for lc = 0; lc < int64(MIndexElHeaderSize); lc++ {
+	// the header is written after the element data so other processes
+	// reading the file never find a header with incomplete element data
+	for lc = 0; lc < int64(len(data)); lc++ {
 		// We may read from a different offset and didn't start from the begining
 		// In that case, we need to reduce the mmap starting point from the offset
-		pos := offset + lc - idx.mmapedOffset
-		idx.mmapedData[pos] = header[lc]
+		pos := offset + MIndexElHeaderSize + lc - idx.mmapedOffset
+		idx.mmapedData[pos] = data[lc]
 	}
 
-	offset += MIndexElHeaderSize
-
-	for lc = 0; lc < int64(len(data)); lc++ {
-		// We may read from a different offset and didn't start from the begining
-		// In that case, we need to reduce the mmap starting point from the offset
+	for lc = 0; lc < int64(MIndexElHeaderSize); lc++ {
 		pos := offset + lc - idx.mmapedOffset
-		idx.mmapedData[pos] = data[lc]
+		idx.mmapedData[pos] = header[lc]
 	}
 
 	idx.currentFileSize += dtSz
@@ -353,6 +610,7 @@ func (idx *MIndex) preAllocateIfNeeded(sizeNeedToWrite int64) (err error) {
 
 		// let's allocate again
 		idx.totalFileSize += allocateAmount
+		metricGrowth.Add(allocateAmount)
 
 		// TODO: right now we need to start from 0 to read even we are appending
 		// reading from random places works well in OSX. But on linux, we need
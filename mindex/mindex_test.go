@@ -2,10 +2,15 @@ package mindex
 
 import (
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
+	"unsafe"
 
 	"github.com/meteorhacks/kdb"
 )
@@ -126,9 +131,8 @@ func TestMIndexAdd(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if el == nil || len(el.Children) != 0 ||
-		!reflect.DeepEqual(el.Values, vals) ||
-		el != idx.root.Children["a"].Children["b"].Children["c"].Children["d"] {
+	if el == nil || !reflect.DeepEqual(el.Values, vals) ||
+		el != idx.root.child("a").child("b").child("c").element("d", 3) {
 		t.Fatal("should return a valid element")
 	}
 }
@@ -199,6 +203,364 @@ func TestMIndexFind(t *testing.T) {
 	}
 }
 
+func TestMIndexTrim(t *testing.T) {
+	fpath := "/tmp/i1"
+	defer os.Remove(fpath)
+
+	idx, err := NewMIndex(MIndexOpts{
+		FilePath:   fpath,
+		IndexDepth: 4,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = idx.Add([]string{"a", "b", "c", "d"}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := idx.Trim(); err != nil {
+		t.Fatal(err)
+	}
+
+	finfo, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if finfo.Size() != idx.currentFileSize {
+		t.Fatal("index file should be trimmed")
+	}
+
+	// elements can be added after trimming
+	_, err = idx.Add([]string{"a", "b", "c", "e"}, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := idx.Trim(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := idx.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err = NewMIndex(MIndexOpts{
+		FilePath:   fpath,
+		IndexDepth: 4,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer idx.Close()
+
+	els, err := idx.Find([]string{"a", "b", "c", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(els) != 2 {
+		t.Fatal("should return correct number of elements")
+	}
+}
+
+func TestMIndexReadOnly(t *testing.T) {
+	fpath := "/tmp/i1"
+	defer os.Remove(fpath)
+
+	opts := MIndexOpts{
+		FilePath:   fpath,
+		IndexDepth: 4,
+		ReadOnly:   true,
+	}
+
+	if _, err := NewMIndex(opts); !os.IsNotExist(err) {
+		t.Fatal("should not create the index file")
+	}
+
+	idx, err := NewMIndex(MIndexOpts{
+		FilePath:   fpath,
+		IndexDepth: 4,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer idx.Close()
+
+	_, err = idx.Add([]string{"a", "b", "c", "d"}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ridx, err := NewMIndex(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ridx.Close()
+
+	if _, err := ridx.Add([]string{"a", "b", "c", "e"}, 200); err != ErrMIndexReadOnly {
+		t.Fatal("should not add elements")
+	}
+
+	if el, err := ridx.Get([]string{"a", "b", "c", "d"}); err != nil || el.Position != 100 {
+		t.Fatal("should load elements")
+	}
+
+	// elements added after loading are available after refreshing
+	_, err = idx.Add([]string{"a", "b", "c", "e"}, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ridx.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	if el, err := ridx.Get([]string{"a", "b", "c", "e"}); err != nil || el.Position != 200 {
+		t.Fatal("should load new elements")
+	}
+}
+
+func TestMIndexLargeNodes(t *testing.T) {
+	fpath := "/tmp/i1"
+	defer os.Remove(fpath)
+
+	opts := MIndexOpts{
+		FilePath:   fpath,
+		IndexDepth: 2,
+	}
+
+	idx, err := NewMIndex(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nodes with many children are indexed with a map
+	count := MIndexSortedChildren * 3
+	for _, i := range rand.Perm(count) {
+		vals := []string{"a" + strconv.Itoa(i%2), "b" + strconv.Itoa(i)}
+		if _, err := idx.Add(vals, int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(idx *MIndex) {
+		for i := 0; i < count; i++ {
+			vals := []string{"a" + strconv.Itoa(i%2), "b" + strconv.Itoa(i)}
+			el, err := idx.Get(vals)
+			if err != nil {
+				t.Fatal(err)
+			} else if el == nil || el.Position != int64(i) {
+				t.Fatal("should return correct element", vals)
+			}
+
+			els, err := idx.Find([]string{"", vals[1]})
+			if err != nil {
+				t.Fatal(err)
+			} else if len(els) != 1 || els[0] != el {
+				t.Fatal("should return correct elements", vals)
+			}
+		}
+
+		if el, err := idx.Get([]string{"a0", "b1"}); err != nil || el != nil {
+			t.Fatal("should not return an element")
+		}
+
+		els, err := idx.Find([]string{"a1", ""})
+		if err != nil {
+			t.Fatal(err)
+		} else if len(els) != count/2 {
+			t.Fatal("should return correct number of elements")
+		}
+	}
+
+	check(idx)
+
+	if idx.root.child("a0").positions == nil {
+		t.Fatal("large nodes should be indexed with a map")
+	}
+
+	if err := idx.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err = NewMIndex(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer idx.Close()
+
+	check(idx)
+}
+
+func TestMIndexInterning(t *testing.T) {
+	defer os.Remove("/tmp/i1")
+	defer os.Remove("/tmp/i2")
+
+	idxs := make([]*MIndex, 2)
+	els := make([]*kdb.IndexElement, 2)
+
+	for i := range idxs {
+		idx, err := NewMIndex(MIndexOpts{
+			FilePath:   "/tmp/i" + strconv.Itoa(i+1),
+			IndexDepth: 2,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// values are created separately for each index
+		vals := []string{"interned-" + strconv.Itoa(1), "interned-" + strconv.Itoa(1)}
+		if els[i], err = idx.Add(vals, 100); err != nil {
+			t.Fatal(err)
+		}
+
+		idxs[i] = idx
+	}
+
+	v1, v2 := els[0].Values, els[1].Values
+	if unsafe.StringData(v1[0]) != unsafe.StringData(v2[0]) ||
+		unsafe.StringData(v1[0]) != unsafe.StringData(v1[1]) {
+		t.Fatal("index values should be shared")
+	}
+
+	refs := func() int64 {
+		shard := strs.shard("interned-1")
+		shard.mutex.Lock()
+		defer shard.mutex.Unlock()
+		return shard.strings["interned-1"].refs
+	}
+
+	if refs() != 4 {
+		t.Fatal("shared values should be counted")
+	}
+
+	// replaced elements should release values
+	if _, err := idxs[0].Add([]string{"interned-1", "interned-1"}, 200); err != nil {
+		t.Fatal(err)
+	} else if refs() != 4 {
+		t.Fatal("replaced elements should release values")
+	}
+
+	for _, idx := range idxs {
+		if err := idx.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if refs() != 0 {
+		t.Fatal("values should be released when indexes are closed")
+	}
+}
+
+func TestMIndexLabels(t *testing.T) {
+	fpath := "/tmp/i1"
+	defer os.Remove(fpath)
+
+	opts := MIndexOpts{
+		FilePath: fpath,
+		Labels:   true,
+	}
+
+	idx, err := NewMIndex(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	series := [][]string{
+		{"host=h1", "app=web"},
+		{"app=web", "host=h2", "zone=z1"},
+		{"app=db", "host=h1"},
+	}
+
+	for i, vals := range series {
+		if _, err := idx.Add(vals, int64(i*100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	el, err := idx.Get([]string{"app=web", "host=h1"})
+	if err != nil {
+		t.Fatal(err)
+	} else if el == nil || el.Position != 0 {
+		t.Fatal("should return correct element")
+	} else if !reflect.DeepEqual(el.Values, []string{"app=web", "host=h1"}) {
+		t.Fatal("labels should be sorted by name")
+	}
+
+	if el, err := idx.Get([]string{"app=web"}); err != nil || el != nil {
+		t.Fatal("should not match a subset of labels")
+	}
+
+	find := map[string][]int64{
+		"app=web":         {0, 100},
+		"host=h1":         {0, 200},
+		"host=h1,app=web": {0},
+		"zone=z1":         {100},
+		"app=db,zone=z1":  {},
+		"host=h3":         {},
+		"":                {0, 100, 200},
+	}
+
+	check := func(idx *MIndex) {
+		for query, exp := range find {
+			els, err := idx.Find(strings.Split(query, ","))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res := make([]int64, 0)
+			for _, el := range els {
+				res = append(res, el.Position)
+			}
+
+			sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+			if !reflect.DeepEqual(res, exp) {
+				t.Fatal("should return correct elements", query, res)
+			}
+		}
+	}
+
+	check(idx)
+
+	invalid := map[string]error{
+		"host":            ErrInvalidLabel,
+		"=h1":             ErrInvalidLabel,
+		"host=":           ErrInvalidLabel,
+		"host=h1,host=h2": ErrDuplicateLabel,
+	}
+
+	for vals, exp := range invalid {
+		if _, err := idx.Add(strings.Split(vals, ","), 300); err != exp {
+			t.Fatal("should return correct error", vals, err)
+		}
+	}
+
+	if err := idx.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// labels should be loaded from the index file
+	idx, err = NewMIndex(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer idx.Close()
+
+	check(idx)
+}
+
 func BenchmarkMIndexAdd(b *testing.B) {
 	fpath := "/tmp/i1"
 	defer os.Remove(fpath)
@@ -301,3 +663,55 @@ func BenchmarkMIndexFindQueryAtEnd(b *testing.B) {
 		}
 	}
 }
+
+// BenchmarkMIndexHeap reports heap memory used by index elements
+// the same series are added to two indexes like buckets of a database
+// values are created for each series like values read from requests
+func BenchmarkMIndexHeap(b *testing.B) {
+	const count = 100000
+
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		idxs := make([]*MIndex, 2)
+		for j := range idxs {
+			fpath := "/tmp/i" + strconv.Itoa(j+1)
+			os.Remove(fpath)
+			defer os.Remove(fpath)
+
+			idx, err := NewMIndex(MIndexOpts{
+				FilePath:   fpath,
+				IndexDepth: 4,
+			})
+
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			for k := 0; k < count; k++ {
+				vals := []string{
+					"app-" + strconv.Itoa(k%10),
+					"host-" + strconv.Itoa(k/100),
+					"metric-" + strconv.Itoa(k%100),
+					"stat-" + strconv.Itoa(k%3),
+				}
+
+				if _, err := idx.Add(vals, int64(k)); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			idxs[j] = idx
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/count, "heap-bytes/series")
+
+		for _, idx := range idxs {
+			idx.Close()
+		}
+	}
+}
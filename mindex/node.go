@@ -0,0 +1,153 @@
+package mindex
+
+import (
+	"slices"
+
+	"github.com/meteorhacks/kdb"
+)
+
+const (
+	// nodes with more children use a map to find children
+	// smaller nodes keep children sorted by value in arrays
+	MIndexSortedChildren = 64
+)
+
+// node is an intermediate node of the index tree. Children of the node are
+// nodes of the next level or index elements when the next level is the last
+// level (only one of `nodes` and `elements` is used). `value` is the index
+// value of the node in its level, the value of an element is taken from its
+// `Values`. Children are kept sorted by value and found with a binary search
+// which uses much less memory than a map with a few children. Once a node
+// has more than `MIndexSortedChildren` children, new children are appended
+// and positions of all children are kept in the `positions` map.
+type node struct {
+	value     string
+	nodes     []*node
+	elements  []*kdb.IndexElement
+	positions map[string]int32
+}
+
+// child returns the child node with the value
+func (n *node) child(v string) (child *node) {
+	if i, ok := n.search(v, -1); ok {
+		return n.nodes[i]
+	}
+
+	return nil
+}
+
+// element returns the child element with the value at given level
+func (n *node) element(v string, level int) (el *kdb.IndexElement) {
+	if i, ok := n.search(v, level); ok {
+		return n.elements[i]
+	}
+
+	return nil
+}
+
+// addChild returns the child node with the value
+// a new node is created if it's not available
+func (n *node) addChild(v string) (child *node) {
+	i, ok := n.search(v, -1)
+	if ok {
+		return n.nodes[i]
+	}
+
+	child = &node{value: v}
+	if n.positions != nil {
+		n.positions[v] = int32(len(n.nodes))
+		n.nodes = append(n.nodes, child)
+		return child
+	}
+
+	n.nodes = slices.Insert(n.nodes, i, child)
+	n.indexIfNeeded(len(n.nodes), -1)
+
+	return child
+}
+
+// setElement adds an element with its value at given level as a child
+// the element with the same value is replaced and returned if available
+func (n *node) setElement(el *kdb.IndexElement, level int) (old *kdb.IndexElement) {
+	v := el.Values[level]
+	i, ok := n.search(v, level)
+	if ok {
+		old = n.elements[i]
+		n.elements[i] = el
+		return old
+	}
+
+	if n.positions != nil {
+		n.positions[v] = int32(len(n.elements))
+		n.elements = append(n.elements, el)
+		return nil
+	}
+
+	n.elements = slices.Insert(n.elements, i, el)
+	n.indexIfNeeded(len(n.elements), level)
+
+	return nil
+}
+
+// search finds the position of the child with the value, `level` is the
+// level of child elements or -1 to search child nodes. The position where
+// it should be added is returned if the child is not available.
+func (n *node) search(v string, level int) (i int, ok bool) {
+	if n.positions != nil {
+		pos, ok := n.positions[v]
+		return int(pos), ok
+	}
+
+	count := len(n.nodes)
+	if level >= 0 {
+		count = len(n.elements)
+	}
+
+	lo, hi := 0, count
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if n.valueAt(mid, level) < v {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	return lo, lo < count && n.valueAt(lo, level) == v
+}
+
+// valueAt returns the value of the child at the position
+func (n *node) valueAt(i, level int) (v string) {
+	if level >= 0 {
+		return n.elements[i].Values[level]
+	}
+
+	return n.nodes[i].value
+}
+
+// indexIfNeeded starts using a map when the node has too many children
+// to keep them sorted without copying large arrays for each new child
+func (n *node) indexIfNeeded(count, level int) {
+	if count <= MIndexSortedChildren {
+		return
+	}
+
+	n.positions = make(map[string]int32, count)
+	for i := 0; i < count; i++ {
+		n.positions[n.valueAt(i, level)] = int32(i)
+	}
+}
+
+// collect appends all elements under the node, `level` is the level of
+// the node and `last` is the level of elements (index depth - 1)
+func (n *node) collect(level, last int, els []*kdb.IndexElement) []*kdb.IndexElement {
+	if level == last {
+		return append(els, n.elements...)
+	}
+
+	for _, child := range n.nodes {
+		els = child.collect(level+1, last, els)
+	}
+
+	return els
+}
@@ -0,0 +1,152 @@
+package payload
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var (
+	ErrInvalidSize = errors.New("payload size is not supported by the merge function")
+)
+
+const (
+	// size of a payload used to store a float64 value
+	// a flag byte followed by the value (little endian)
+	FloatSize = 9
+)
+
+// EncodeFloat encodes the value with a flag byte so values
+// equal to 0 are not confused with empty payloads
+func EncodeFloat(value float64) (pld []byte) {
+	pld = make([]byte, FloatSize)
+	pld[0] = 1
+	binary.LittleEndian.PutUint64(pld[1:], math.Float64bits(value))
+	return pld
+}
+
+// DecodeFloat decodes a value encoded with `EncodeFloat`
+// `ok` is false if the payload is empty or has an incorrect size
+func DecodeFloat(pld []byte) (value float64, ok bool) {
+	if len(pld) != FloatSize || pld[0] == 0 {
+		return 0, false
+	}
+
+	value = math.Float64frombits(binary.LittleEndian.Uint64(pld[1:]))
+	return value, true
+}
+
+const (
+	// size of a payload used to store an int64 value
+	// a flag byte followed by the value (little endian)
+	IntSize = 9
+)
+
+// EncodeInt encodes the value with a flag byte so values
+// equal to 0 are not confused with empty payloads
+func EncodeInt(value int64) (pld []byte) {
+	pld = make([]byte, IntSize)
+	pld[0] = 1
+	binary.LittleEndian.PutUint64(pld[1:], uint64(value))
+	return pld
+}
+
+// DecodeInt decodes a value encoded with `EncodeInt`
+// `ok` is false if the payload is empty or has an incorrect size
+func DecodeInt(pld []byte) (value int64, ok bool) {
+	if len(pld) != IntSize || pld[0] == 0 {
+		return 0, false
+	}
+
+	value = int64(binary.LittleEndian.Uint64(pld[1:]))
+	return value, true
+}
+
+// Merge functions to use with `PutMerge` (see kdb.MergeFunc)
+// Int and Float functions use payloads encoded with `EncodeInt` and
+// `EncodeFloat`. If one of the payloads doesn't have a value, the
+// other payload is stored. These return ErrInvalidSize if payloads
+// don't have the correct size (`PayloadSize` of the database).
+
+// Replace stores the new payload, same as writing with `Put`
+func Replace(old, new []byte) (res []byte, err error) {
+	return new, nil
+}
+
+// AddInt stores the sum of both values
+func AddInt(old, new []byte) (res []byte, err error) {
+	return mergeInt(old, new, func(a, b int64) int64 { return a + b })
+}
+
+// MinInt stores the smaller value
+func MinInt(old, new []byte) (res []byte, err error) {
+	return mergeInt(old, new, func(a, b int64) int64 {
+		if b < a {
+			return b
+		}
+
+		return a
+	})
+}
+
+// MaxInt stores the larger value
+func MaxInt(old, new []byte) (res []byte, err error) {
+	return mergeInt(old, new, func(a, b int64) int64 {
+		if b > a {
+			return b
+		}
+
+		return a
+	})
+}
+
+// AddFloat stores the sum of both values
+func AddFloat(old, new []byte) (res []byte, err error) {
+	return mergeFloat(old, new, func(a, b float64) float64 { return a + b })
+}
+
+// MinFloat stores the smaller value
+func MinFloat(old, new []byte) (res []byte, err error) {
+	return mergeFloat(old, new, math.Min)
+}
+
+// MaxFloat stores the larger value
+func MaxFloat(old, new []byte) (res []byte, err error) {
+	return mergeFloat(old, new, math.Max)
+}
+
+func mergeInt(old, new []byte, fn func(a, b int64) int64) (res []byte, err error) {
+	if len(old) != IntSize || len(new) != IntSize {
+		return nil, ErrInvalidSize
+	}
+
+	a, ok := DecodeInt(old)
+	if !ok {
+		return new, nil
+	}
+
+	b, ok := DecodeInt(new)
+	if !ok {
+		return old, nil
+	}
+
+	return EncodeInt(fn(a, b)), nil
+}
+
+func mergeFloat(old, new []byte, fn func(a, b float64) float64) (res []byte, err error) {
+	if len(old) != FloatSize || len(new) != FloatSize {
+		return nil, ErrInvalidSize
+	}
+
+	a, ok := DecodeFloat(old)
+	if !ok {
+		return new, nil
+	}
+
+	b, ok := DecodeFloat(new)
+	if !ok {
+		return old, nil
+	}
+
+	return EncodeFloat(fn(a, b)), nil
+}
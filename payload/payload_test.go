@@ -0,0 +1,95 @@
+package payload
+
+import (
+	"testing"
+)
+
+func TestFloat(t *testing.T) {
+	for _, v := range []float64{0, 1.5, -3} {
+		pld := EncodeFloat(v)
+		if len(pld) != FloatSize {
+			t.Fatal("incorrect payload size")
+		}
+
+		res, ok := DecodeFloat(pld)
+		if !ok || res != v {
+			t.Fatal("incorrect value")
+		}
+	}
+
+	if _, ok := DecodeFloat(make([]byte, FloatSize)); ok {
+		t.Fatal("empty payloads should not have a value")
+	}
+}
+
+func TestInt(t *testing.T) {
+	for _, v := range []int64{0, 5, -3} {
+		res, ok := DecodeInt(EncodeInt(v))
+		if !ok || res != v {
+			t.Fatal("incorrect value")
+		}
+	}
+
+	if _, ok := DecodeInt(make([]byte, IntSize)); ok {
+		t.Fatal("empty payloads should not have a value")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	empty := make([]byte, IntSize)
+
+	ints := []struct {
+		fn       func(old, new []byte) ([]byte, error)
+		old, new []byte
+		exp      int64
+	}{
+		{AddInt, EncodeInt(2), EncodeInt(3), 5},
+		{AddInt, empty, EncodeInt(3), 3},
+		{MinInt, EncodeInt(2), EncodeInt(3), 2},
+		{MinInt, empty, EncodeInt(3), 3},
+		{MaxInt, EncodeInt(2), EncodeInt(3), 3},
+		{MaxInt, EncodeInt(2), empty, 2},
+		{Replace, EncodeInt(2), EncodeInt(3), 3},
+	}
+
+	for _, c := range ints {
+		pld, err := c.fn(c.old, c.new)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, ok := DecodeInt(pld)
+		if !ok || res != c.exp {
+			t.Fatal("incorrect value")
+		}
+	}
+
+	floats := []struct {
+		fn       func(old, new []byte) ([]byte, error)
+		old, new []byte
+		exp      float64
+	}{
+		{AddFloat, EncodeFloat(1.5), EncodeFloat(2), 3.5},
+		{MinFloat, EncodeFloat(1.5), EncodeFloat(-2), -2},
+		{MaxFloat, empty, EncodeFloat(-2), -2},
+	}
+
+	for _, c := range floats {
+		pld, err := c.fn(c.old, c.new)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, ok := DecodeFloat(pld)
+		if !ok || res != c.exp {
+			t.Fatal("incorrect value")
+		}
+	}
+
+	// payloads of other sizes are not replaced silently
+	for _, fn := range []func(old, new []byte) ([]byte, error){AddInt, MinInt, MaxInt, AddFloat, MinFloat, MaxFloat} {
+		if _, err := fn(make([]byte, 4), []byte{1, 2, 3, 4}); err != ErrInvalidSize {
+			t.Fatal("should return correct error")
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package prom
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/meteorhacks/kdb/clock"
+	"github.com/meteorhacks/kdb/dbase"
+	"github.com/meteorhacks/kdb/dbucket"
+	"github.com/meteorhacks/kdb/payload"
+)
+
+const (
+	// payload size required to store samples
+	PayloadSize = payload.FloatSize
+
+	// label which holds the metric name
+	MetricNameLabel = "__name__"
+
+	// default index value used when a series doesn't have a label
+	DefaultMissingValue = "-"
+
+	// prometheus uses milliseconds, kdb uses nano seconds
+	nsPerMs = 1000000
+)
+
+var (
+	ErrLabelCount   = errors.New("number of labels should match index depth")
+	ErrPayloadSize  = errors.New("payload size should be 9 bytes")
+	ErrInvalidRegex = errors.New("invalid regular expression in matcher")
+)
+
+type Options struct {
+	// label names stored in each level of the index tree (ex: "__name__",
+	// "job", "instance"). The number of labels should match index depth.
+	// Other labels of a series are not stored with samples.
+	Labels []string
+
+	// index value stored for labels not available in a series
+	// it should not be a value used with any label
+	MissingValue string
+}
+
+// Adapter stores samples received with Prometheus remote_write requests
+// and returns stored samples for remote_read requests.
+type Adapter struct {
+	Options
+	db *dbase.DBase
+
+	// index level of each label in `Labels`
+	levels map[string]int
+}
+
+func New(db *dbase.DBase, opts Options) (a *Adapter, err error) {
+	if len(opts.Labels) != int(db.IndexDepth) {
+		return nil, ErrLabelCount
+	}
+
+	if db.PayloadSize != PayloadSize {
+		return nil, ErrPayloadSize
+	}
+
+	if opts.MissingValue == "" {
+		opts.MissingValue = DefaultMissingValue
+	}
+
+	levels := make(map[string]int)
+	for i, name := range opts.Labels {
+		levels[name] = i
+	}
+
+	a = &Adapter{
+		Options: opts,
+		db:      db,
+		levels:  levels,
+	}
+
+	return a, nil
+}
+
+// Handler returns a http handler with remote storage endpoints
+// use "/write" with remote_write and "/read" with remote_read
+func (a *Adapter) Handler() (h http.Handler) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write", a.ServeWrite)
+	mux.HandleFunc("/read", a.ServeRead)
+	return mux
+}
+
+// ServeWrite handles snappy compressed remote_write requests
+func (a *Adapter) ServeWrite(w http.ResponseWriter, r *http.Request) {
+	var req WriteRequest
+	if err := readRequest(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := a.Write(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ServeRead handles snappy compressed remote_read requests
+// only sampled responses are supported (not streamed chunks)
+func (a *Adapter) ServeRead(w http.ResponseWriter, r *http.Request) {
+	var req ReadRequest
+	if err := readRequest(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := a.Read(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	w.Write(snappy.Encode(nil, res.Marshal()))
+}
+
+// Write stores all samples in the request and returns the number of
+// samples skipped because they are too old or came from future.
+func (a *Adapter) Write(req *WriteRequest) (skipped int, err error) {
+	for _, ts := range req.Timeseries {
+		vals := a.indexValues(ts.Labels)
+
+		for _, s := range ts.Samples {
+			err := a.db.Put(s.Timestamp*nsPerMs, vals, payload.EncodeFloat(s.Value))
+			if err == dbucket.ErrWriteOnReadOnly || err == dbase.ErrInvalidTimestamp {
+				skipped++
+				continue
+			} else if err != nil {
+				return skipped, err
+			}
+		}
+	}
+
+	return skipped, nil
+}
+
+// Read runs all queries in the request. Equality matchers on labels stored
+// in the index are used to find series, other matchers are used to filter.
+func (a *Adapter) Read(req *ReadRequest) (res *ReadResponse, err error) {
+	res = &ReadResponse{
+		Results: make([]QueryResult, len(req.Queries)),
+	}
+
+	for i, q := range req.Queries {
+		series, err := a.query(q)
+		if err != nil {
+			return nil, err
+		}
+
+		res.Results[i].Timeseries = series
+	}
+
+	return res, nil
+}
+
+func (a *Adapter) query(q Query) (series []TimeSeries, err error) {
+	match, err := newMatcher(q.Matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	// equality matchers on labels stored in the index
+	// are used as index values, others match any value
+	vals := make([]string, len(a.Labels))
+	for _, m := range q.Matchers {
+		if i, ok := a.levels[m.Name]; ok && m.Type == MatchEqual {
+			vals[i] = m.Value
+			if vals[i] == "" {
+				vals[i] = a.MissingValue
+			}
+		}
+	}
+
+	// end is extended to include the payload with the end timestamp
+	// data from the current resolution period is not available yet
+	start := q.StartTimestampMs * nsPerMs
+	end := q.EndTimestampMs*nsPerMs + a.db.Resolution
+	if now := clock.Now(); end > now {
+		end = now
+	}
+
+	// dbase floors the start time by resolution
+	start -= start % a.db.Resolution
+	if end <= start {
+		return nil, nil
+	}
+
+	out, err := a.db.Find(start, end, vals)
+	if err != nil {
+		return nil, err
+	}
+
+	for el, plds := range out {
+		labels := a.labels(el.Values)
+		if !match(labels) {
+			continue
+		}
+
+		ts := TimeSeries{Labels: labels}
+
+		for i, pld := range plds {
+			value, ok := payload.DecodeFloat(pld)
+			if !ok {
+				continue
+			}
+
+			tsMs := (start + int64(i)*a.db.Resolution) / nsPerMs
+			if tsMs < q.StartTimestampMs || tsMs > q.EndTimestampMs {
+				continue
+			}
+
+			ts.Samples = append(ts.Samples, Sample{value, tsMs})
+		}
+
+		if len(ts.Samples) > 0 {
+			series = append(series, ts)
+		}
+	}
+
+	// series are sorted by labels to return results in a stable order
+	sort.Sort(byLabels(series))
+
+	return series, nil
+}
+
+// indexValues returns index values for a series using configured labels
+func (a *Adapter) indexValues(labels []Label) (vals []string) {
+	vals = make([]string, len(a.Labels))
+	for i := range vals {
+		vals[i] = a.MissingValue
+	}
+
+	for _, l := range labels {
+		if i, ok := a.levels[l.Name]; ok && l.Value != "" {
+			vals[i] = l.Value
+		}
+	}
+
+	return vals
+}
+
+// labels converts index values back to series labels
+func (a *Adapter) labels(vals []string) (labels []Label) {
+	for i, name := range a.Labels {
+		if vals[i] != a.MissingValue {
+			labels = append(labels, Label{name, vals[i]})
+		}
+	}
+
+	return labels
+}
+
+// newMatcher returns a function which checks whether a
+// series with given labels matches all label matchers
+func newMatcher(matchers []LabelMatcher) (fn func(labels []Label) bool, err error) {
+	regexps := make([]*regexp.Regexp, len(matchers))
+
+	for i, m := range matchers {
+		if m.Type == MatchRegexp || m.Type == MatchNotRegexp {
+			// prometheus regular expressions are fully anchored
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return nil, ErrInvalidRegex
+			}
+
+			regexps[i] = re
+		}
+	}
+
+	fn = func(labels []Label) bool {
+		for i, m := range matchers {
+			// missing labels are considered as empty values
+			var value string
+			for _, l := range labels {
+				if l.Name == m.Name {
+					value = l.Value
+					break
+				}
+			}
+
+			var ok bool
+			switch m.Type {
+			case MatchEqual:
+				ok = value == m.Value
+			case MatchNotEqual:
+				ok = value != m.Value
+			case MatchRegexp:
+				ok = regexps[i].MatchString(value)
+			case MatchNotRegexp:
+				ok = !regexps[i].MatchString(value)
+			}
+
+			if !ok {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return fn, nil
+}
+
+type byLabels []TimeSeries
+
+func (s byLabels) Len() int           { return len(s) }
+func (s byLabels) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLabels) Less(i, j int) bool { return labelsKey(s[i].Labels) < labelsKey(s[j].Labels) }
+
+func labelsKey(labels []Label) (key string) {
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = l.Name + "\xff" + l.Value
+	}
+
+	return strings.Join(parts, "\xff")
+}
+
+// readRequest reads a snappy compressed protobuf message from request body
+func readRequest(r *http.Request, msg interface {
+	Unmarshal(data []byte) error
+}) (err error) {
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return err
+	}
+
+	return msg.Unmarshal(data)
+}
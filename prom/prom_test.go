@@ -0,0 +1,223 @@
+package prom
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/meteorhacks/kdb/clock"
+	"github.com/meteorhacks/kdb/dbase"
+)
+
+func TestDecodeFixtures(t *testing.T) {
+	var wreq WriteRequest
+	if err := readFixture("testdata/write_request.snappy", &wreq); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []TimeSeries{
+		{
+			Labels: []Label{
+				{"__name__", "http_requests_total"},
+				{"code", "200"},
+				{"instance", "host1:9100"},
+				{"job", "api"},
+			},
+			Samples: []Sample{{5, 1000}, {0, 2000}, {7.5, 3000}},
+		},
+		{
+			Labels:  []Label{{"__name__", "up"}, {"job", "api"}},
+			Samples: []Sample{{1, 1000}},
+		},
+	}
+
+	if !reflect.DeepEqual(wreq.Timeseries, exp) {
+		t.Fatal("incorrect write request")
+	}
+
+	var rreq ReadRequest
+	if err := readFixture("testdata/read_request.snappy", &rreq); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rreq.Queries) != 2 || rreq.Queries[0].EndTimestampMs != 5000 {
+		t.Fatal("incorrect read request")
+	}
+
+	expm := []LabelMatcher{
+		{MatchEqual, "__name__", "http_requests_total"},
+		{MatchRegexp, "instance", "host.*"},
+	}
+
+	if !reflect.DeepEqual(rreq.Queries[0].Matchers, expm) {
+		t.Fatal("incorrect matchers")
+	}
+
+	// encoded messages should decode to the same value
+	var wreq2 WriteRequest
+	if err := wreq2.Unmarshal(wreq.Marshal()); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(wreq, wreq2) {
+		t.Fatal("incorrect encoded write request")
+	}
+
+	var rreq2 ReadRequest
+	if err := rreq2.Unmarshal(rreq.Marshal()); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(rreq, rreq2) {
+		t.Fatal("incorrect encoded read request")
+	}
+
+	data := wreq.Marshal()
+	if err := wreq2.Unmarshal(data[:len(data)-1]); err == nil {
+		t.Fatal("should return an error")
+	}
+}
+
+func TestWriteAndRead(t *testing.T) {
+	defer cleanTestFiles()
+
+	a, err := createTestAdapter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer a.db.Close()
+
+	srv := httptest.NewServer(a.Handler())
+	defer srv.Close()
+
+	res, err := postFixture(srv.URL+"/write", "testdata/write_request.snappy")
+	if err != nil {
+		t.Fatal(err)
+	} else if res.StatusCode != http.StatusNoContent {
+		t.Fatal("incorrect status code", res.StatusCode)
+	}
+
+	res, err = postFixture(srv.URL+"/read", "testdata/read_request.snappy")
+	if err != nil {
+		t.Fatal(err)
+	} else if res.StatusCode != http.StatusOK {
+		t.Fatal("incorrect status code", res.StatusCode)
+	}
+
+	defer res.Body.Close()
+
+	compressed, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rres ReadResponse
+	if err := rres.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// labels not in `Labels` option are not stored
+	// samples with value 0 should not be treated as empty
+	exp := []QueryResult{
+		{[]TimeSeries{{
+			Labels: []Label{
+				{"__name__", "http_requests_total"},
+				{"job", "api"},
+				{"instance", "host1:9100"},
+			},
+			Samples: []Sample{{5, 1000}, {0, 2000}, {7.5, 3000}},
+		}}},
+		{[]TimeSeries{{
+			Labels:  []Label{{"__name__", "up"}, {"job", "api"}},
+			Samples: []Sample{{1, 1000}},
+		}}},
+	}
+
+	if !reflect.DeepEqual(rres.Results, exp) {
+		t.Fatal("incorrect read response", rres.Results)
+	}
+
+	res, err = http.Post(srv.URL+"/write", "application/x-protobuf", bytes.NewReader([]byte{1, 2, 3}))
+	if err != nil {
+		t.Fatal(err)
+	} else if res.StatusCode != http.StatusBadRequest {
+		t.Fatal("invalid requests should be rejected")
+	}
+}
+
+func TestNewAdapterValidation(t *testing.T) {
+	defer cleanTestFiles()
+
+	a, err := createTestAdapter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer a.db.Close()
+
+	if _, err := New(a.db, Options{Labels: []string{"__name__"}}); err != ErrLabelCount {
+		t.Fatal("should return correct error")
+	}
+}
+
+// ---------- //
+
+func createTestAdapter() (a *Adapter, err error) {
+	clock.UseTestClock()
+	clock.Goto(int64(10 * time.Second))
+	cleanTestFiles()
+
+	db, err := dbase.New(dbase.Options{
+		DatabaseName:   "test",
+		DataPath:       "/tmp/test-prom",
+		IndexDepth:     3,
+		PayloadSize:    PayloadSize,
+		BucketDuration: int64(time.Hour),
+		Resolution:     int64(time.Second),
+		SegmentSize:    10,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return New(db, Options{Labels: []string{"__name__", "job", "instance"}})
+}
+
+func readFixture(fpath string, msg interface {
+	Unmarshal(data []byte) error
+}) (err error) {
+	compressed, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return err
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return err
+	}
+
+	return msg.Unmarshal(data)
+}
+
+func postFixture(url, fpath string) (res *http.Response, err error) {
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.Post(url, "application/x-protobuf", bytes.NewReader(data))
+}
+
+func cleanTestFiles() {
+	cmd := exec.Command("rm", "-rf", "/tmp/test-prom")
+	cmd.Run()
+}
@@ -0,0 +1,441 @@
+package prom
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Messages used with Prometheus remote storage protocol. Only fields
+// used by the adapter are encoded/decoded, all other fields are skipped.
+// Field numbers match prompb (prometheus/prompb/remote.proto, types.proto).
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// label matcher types
+const (
+	MatchEqual     = 0
+	MatchNotEqual  = 1
+	MatchRegexp    = 2
+	MatchNotRegexp = 3
+)
+
+var (
+	ErrProtoTruncated = errors.New("protobuf message is truncated")
+	ErrProtoWireType  = errors.New("unsupported protobuf wire type")
+)
+
+type WriteRequest struct {
+	Timeseries []TimeSeries // field 1
+}
+
+type TimeSeries struct {
+	Labels  []Label  // field 1
+	Samples []Sample // field 2
+}
+
+type Label struct {
+	Name  string // field 1
+	Value string // field 2
+}
+
+type Sample struct {
+	Value     float64 // field 1
+	Timestamp int64   // field 2 (milliseconds)
+}
+
+type ReadRequest struct {
+	Queries []Query // field 1
+}
+
+type Query struct {
+	StartTimestampMs int64          // field 1
+	EndTimestampMs   int64          // field 2
+	Matchers         []LabelMatcher // field 3
+}
+
+type LabelMatcher struct {
+	Type  int    // field 1
+	Name  string // field 2
+	Value string // field 3
+}
+
+type ReadResponse struct {
+	Results []QueryResult // field 1
+}
+
+type QueryResult struct {
+	Timeseries []TimeSeries // field 1
+}
+
+//   Decoding
+// ------------
+
+func (m *WriteRequest) Unmarshal(data []byte) (err error) {
+	return decode(data, func(field, wire int, b *pbuf) error {
+		if field == 1 && wire == wireBytes {
+			var ts TimeSeries
+			if err := b.message(ts.Unmarshal); err != nil {
+				return err
+			}
+
+			m.Timeseries = append(m.Timeseries, ts)
+			return nil
+		}
+
+		return b.skip(wire)
+	})
+}
+
+func (m *TimeSeries) Unmarshal(data []byte) (err error) {
+	return decode(data, func(field, wire int, b *pbuf) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			var l Label
+			if err := b.message(l.Unmarshal); err != nil {
+				return err
+			}
+
+			m.Labels = append(m.Labels, l)
+		case field == 2 && wire == wireBytes:
+			var s Sample
+			if err := b.message(s.Unmarshal); err != nil {
+				return err
+			}
+
+			m.Samples = append(m.Samples, s)
+		default:
+			return b.skip(wire)
+		}
+
+		return nil
+	})
+}
+
+func (m *Label) Unmarshal(data []byte) (err error) {
+	return decode(data, func(field, wire int, b *pbuf) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			return b.str(&m.Name)
+		case field == 2 && wire == wireBytes:
+			return b.str(&m.Value)
+		}
+
+		return b.skip(wire)
+	})
+}
+
+func (m *Sample) Unmarshal(data []byte) (err error) {
+	return decode(data, func(field, wire int, b *pbuf) error {
+		switch {
+		case field == 1 && wire == wireFixed64:
+			v, err := b.fixed64()
+			m.Value = math.Float64frombits(v)
+			return err
+		case field == 2 && wire == wireVarint:
+			v, err := b.varint()
+			m.Timestamp = int64(v)
+			return err
+		}
+
+		return b.skip(wire)
+	})
+}
+
+func (m *ReadRequest) Unmarshal(data []byte) (err error) {
+	return decode(data, func(field, wire int, b *pbuf) error {
+		if field == 1 && wire == wireBytes {
+			var q Query
+			if err := b.message(q.Unmarshal); err != nil {
+				return err
+			}
+
+			m.Queries = append(m.Queries, q)
+			return nil
+		}
+
+		return b.skip(wire)
+	})
+}
+
+func (m *Query) Unmarshal(data []byte) (err error) {
+	return decode(data, func(field, wire int, b *pbuf) error {
+		switch {
+		case field == 1 && wire == wireVarint:
+			v, err := b.varint()
+			m.StartTimestampMs = int64(v)
+			return err
+		case field == 2 && wire == wireVarint:
+			v, err := b.varint()
+			m.EndTimestampMs = int64(v)
+			return err
+		case field == 3 && wire == wireBytes:
+			var lm LabelMatcher
+			if err := b.message(lm.Unmarshal); err != nil {
+				return err
+			}
+
+			m.Matchers = append(m.Matchers, lm)
+			return nil
+		}
+
+		return b.skip(wire)
+	})
+}
+
+func (m *LabelMatcher) Unmarshal(data []byte) (err error) {
+	return decode(data, func(field, wire int, b *pbuf) error {
+		switch {
+		case field == 1 && wire == wireVarint:
+			v, err := b.varint()
+			m.Type = int(v)
+			return err
+		case field == 2 && wire == wireBytes:
+			return b.str(&m.Name)
+		case field == 3 && wire == wireBytes:
+			return b.str(&m.Value)
+		}
+
+		return b.skip(wire)
+	})
+}
+
+func (m *ReadResponse) Unmarshal(data []byte) (err error) {
+	return decode(data, func(field, wire int, b *pbuf) error {
+		if field == 1 && wire == wireBytes {
+			var r QueryResult
+			if err := b.message(r.Unmarshal); err != nil {
+				return err
+			}
+
+			m.Results = append(m.Results, r)
+			return nil
+		}
+
+		return b.skip(wire)
+	})
+}
+
+func (m *QueryResult) Unmarshal(data []byte) (err error) {
+	return decode(data, func(field, wire int, b *pbuf) error {
+		if field == 1 && wire == wireBytes {
+			var ts TimeSeries
+			if err := b.message(ts.Unmarshal); err != nil {
+				return err
+			}
+
+			m.Timeseries = append(m.Timeseries, ts)
+			return nil
+		}
+
+		return b.skip(wire)
+	})
+}
+
+//   Encoding
+// ------------
+
+func (m *WriteRequest) Marshal() (data []byte) {
+	for _, ts := range m.Timeseries {
+		data = appendBytes(data, 1, ts.Marshal())
+	}
+
+	return data
+}
+
+func (m *TimeSeries) Marshal() (data []byte) {
+	for _, l := range m.Labels {
+		data = appendBytes(data, 1, l.Marshal())
+	}
+
+	for _, s := range m.Samples {
+		data = appendBytes(data, 2, s.Marshal())
+	}
+
+	return data
+}
+
+func (m *Label) Marshal() (data []byte) {
+	data = appendBytes(data, 1, []byte(m.Name))
+	data = appendBytes(data, 2, []byte(m.Value))
+	return data
+}
+
+func (m *Sample) Marshal() (data []byte) {
+	data = appendTag(data, 1, wireFixed64)
+	data = appendFixed64(data, math.Float64bits(m.Value))
+	data = appendTag(data, 2, wireVarint)
+	data = appendVarint(data, uint64(m.Timestamp))
+	return data
+}
+
+func (m *ReadRequest) Marshal() (data []byte) {
+	for _, q := range m.Queries {
+		data = appendBytes(data, 1, q.Marshal())
+	}
+
+	return data
+}
+
+func (m *Query) Marshal() (data []byte) {
+	data = appendTag(data, 1, wireVarint)
+	data = appendVarint(data, uint64(m.StartTimestampMs))
+	data = appendTag(data, 2, wireVarint)
+	data = appendVarint(data, uint64(m.EndTimestampMs))
+
+	for _, lm := range m.Matchers {
+		data = appendBytes(data, 3, lm.Marshal())
+	}
+
+	return data
+}
+
+func (m *LabelMatcher) Marshal() (data []byte) {
+	data = appendTag(data, 1, wireVarint)
+	data = appendVarint(data, uint64(m.Type))
+	data = appendBytes(data, 2, []byte(m.Name))
+	data = appendBytes(data, 3, []byte(m.Value))
+	return data
+}
+
+func (m *ReadResponse) Marshal() (data []byte) {
+	for _, r := range m.Results {
+		data = appendBytes(data, 1, r.Marshal())
+	}
+
+	return data
+}
+
+func (m *QueryResult) Marshal() (data []byte) {
+	for _, ts := range m.Timeseries {
+		data = appendBytes(data, 1, ts.Marshal())
+	}
+
+	return data
+}
+
+//   Wire Format
+// ---------------
+
+// pbuf reads protobuf encoded values from a buffer
+type pbuf struct {
+	data []byte
+	pos  int
+}
+
+// decode calls `fn` with the field number and wire type of each field
+// `fn` must read or skip the value of the field from the buffer
+func decode(data []byte, fn func(field, wire int, b *pbuf) error) (err error) {
+	b := &pbuf{data: data}
+
+	for b.pos < len(b.data) {
+		tag, err := b.varint()
+		if err != nil {
+			return err
+		}
+
+		if err := fn(int(tag>>3), int(tag&7), b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *pbuf) varint() (v uint64, err error) {
+	v, n := binary.Uvarint(b.data[b.pos:])
+	if n <= 0 {
+		return 0, ErrProtoTruncated
+	}
+
+	b.pos += n
+	return v, nil
+}
+
+func (b *pbuf) fixed64() (v uint64, err error) {
+	if len(b.data)-b.pos < 8 {
+		return 0, ErrProtoTruncated
+	}
+
+	v = binary.LittleEndian.Uint64(b.data[b.pos:])
+	b.pos += 8
+	return v, nil
+}
+
+func (b *pbuf) bytes() (data []byte, err error) {
+	size, err := b.varint()
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(b.data)-b.pos) < size {
+		return nil, ErrProtoTruncated
+	}
+
+	data = b.data[b.pos : b.pos+int(size)]
+	b.pos += int(size)
+	return data, nil
+}
+
+func (b *pbuf) str(s *string) (err error) {
+	data, err := b.bytes()
+	*s = string(data)
+	return err
+}
+
+func (b *pbuf) message(unmarshal func(data []byte) error) (err error) {
+	data, err := b.bytes()
+	if err != nil {
+		return err
+	}
+
+	return unmarshal(data)
+}
+
+func (b *pbuf) skip(wire int) (err error) {
+	switch wire {
+	case wireVarint:
+		_, err = b.varint()
+	case wireFixed64:
+		_, err = b.fixed64()
+	case wireBytes:
+		_, err = b.bytes()
+	case wireFixed32:
+		if len(b.data)-b.pos < 4 {
+			return ErrProtoTruncated
+		}
+
+		b.pos += 4
+	default:
+		return ErrProtoWireType
+	}
+
+	return err
+}
+
+func appendTag(data []byte, field, wire int) []byte {
+	return appendVarint(data, uint64(field<<3|wire))
+}
+
+func appendBytes(data []byte, field int, val []byte) []byte {
+	data = appendTag(data, field, wireBytes)
+	data = appendVarint(data, uint64(len(val)))
+	return append(data, val...)
+}
+
+func appendFixed64(data []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(data, buf[:]...)
+}
+
+func appendVarint(data []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(data, buf[:n]...)
+}
@@ -0,0 +1,201 @@
+package pslice
+
+//  # File Format
+//  A data file starts with a 16 byte header followed by 8 byte values.
+//
+//  | magic (4) | version (1) | kind (1) | byte order (1) | reserved (9) |
+//
+//  Values are stored in the byte order of the platform which created the
+//  file. Files created on a platform with a different byte order are
+//  converted when opened with `New`, read only slices convert values on
+//  each Get so these files can be used without modifying them.
+//
+//  Files created before the header was added only have float64 values in
+//  the platform byte order. These are upgraded when opened with `New`.
+//
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"unsafe"
+)
+
+// Kind is the type of values stored in a data file
+type Kind uint8
+
+const (
+	KindFloat64 Kind = 1
+	KindInt64   Kind = 2
+	KindUint64  Kind = 3
+)
+
+// ByteOrder is the byte order of values stored in a data file
+type ByteOrder uint8
+
+const (
+	LittleEndian ByteOrder = 1
+	BigEndian    ByteOrder = 2
+)
+
+const (
+	// current version of the file format
+	Version = 1
+
+	// size of the file header in bytes
+	HeaderSize = 16
+)
+
+var (
+	Magic = []byte("PSLC")
+
+	ErrInvalidHeader = errors.New("invalid data file header")
+	ErrVersion       = errors.New("unsupported data file version")
+	ErrKindMismatch  = errors.New("data file has a different value type")
+
+	// returned by readHeader for files created before the header was added
+	errNoHeader = errors.New("data file does not have a header")
+
+	// byte order of this platform
+	nativeOrder = func() ByteOrder {
+		x := uint16(1)
+		if *(*byte)(unsafe.Pointer(&x)) == 1 {
+			return LittleEndian
+		}
+
+		return BigEndian
+	}()
+)
+
+type header struct {
+	kind  Kind
+	order ByteOrder
+}
+
+// encoding returns the binary package byte order
+func (o ByteOrder) encoding() binary.ByteOrder {
+	if o == BigEndian {
+		return binary.BigEndian
+	}
+
+	return binary.LittleEndian
+}
+
+// readHeader reads the header from the beginning of a data file
+// returns errNoHeader if the file doesn't start with the magic bytes
+func readHeader(r io.ReaderAt) (h header, err error) {
+	data := make([]byte, HeaderSize)
+	n, err := r.ReadAt(data, 0)
+	if err != nil && err != io.EOF {
+		return h, err
+	}
+
+	if n < len(Magic) || !bytes.Equal(data[:len(Magic)], Magic) {
+		return h, errNoHeader
+	}
+
+	if n < HeaderSize {
+		return h, ErrInvalidHeader
+	}
+
+	if data[4] != Version {
+		return h, ErrVersion
+	}
+
+	h = header{Kind(data[5]), ByteOrder(data[6])}
+	if h.kind < KindFloat64 || h.kind > KindUint64 || h.order < LittleEndian || h.order > BigEndian {
+		return h, ErrInvalidHeader
+	}
+
+	return h, nil
+}
+
+func writeHeader(data []byte, h header) {
+	copy(data, Magic)
+	data[4] = Version
+	data[5] = byte(h.kind)
+	data[6] = byte(h.order)
+}
+
+// Upgrade converts a data file created before the header was added to the
+// current format. Values are converted from float64 to `kind`. Files which
+// already have a header are not changed, missing files are created with
+// only the header. The new file is written and then renamed.
+func Upgrade(filename string, kind Kind) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if _, err := readHeader(bytes.NewReader(data)); err != errNoHeader {
+		return err
+	}
+
+	order := nativeOrder.encoding()
+	count := len(data) / 8
+	out := make([]byte, HeaderSize+count*8)
+	writeHeader(out, header{kind, nativeOrder})
+
+	for i := 0; i < count; i++ {
+		v := math.Float64frombits(order.Uint64(data[i*8:]))
+
+		var bits uint64
+		switch kind {
+		case KindInt64:
+			bits = uint64(int64(v))
+		case KindUint64:
+			bits = uint64(v)
+		default:
+			bits = math.Float64bits(v)
+		}
+
+		order.PutUint64(out[HeaderSize+i*8:], bits)
+	}
+
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(out); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
+
+// convertOrder changes the byte order of values in a data file with
+// `size` bytes (including the header) to the platform byte order
+func convertOrder(f *os.File, size int64) (err error) {
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, 0); err != nil {
+		return err
+	}
+
+	for i := int64(HeaderSize); i+8 <= size; i += 8 {
+		v := binary.LittleEndian.Uint64(data[i:])
+		binary.BigEndian.PutUint64(data[i:], v)
+	}
+
+	data[6] = byte(nativeOrder)
+
+	_, err = f.WriteAt(data, 0)
+	return err
+}
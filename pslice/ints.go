@@ -0,0 +1,124 @@
+package pslice
+
+// Int64 is an int64 slice stored in a data file
+// useful to store counts and positions without losing precision
+type Int64 struct {
+	mapping
+}
+
+// NewInt64 creates a new int64 slice of the given length at the given filename
+// Data files created before the file header was added are upgraded.
+func NewInt64(filename string, length int64) (*Int64, error) {
+	value := &Int64{}
+	if err := value.init(filename, length, KindInt64, false); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// OpenInt64 opens an existing int64 slice without modifying the data file
+// values of old data files without a header are converted from float64
+func OpenInt64(filename string, length int64) (*Int64, error) {
+	value := &Int64{}
+	if err := value.init(filename, length, KindInt64, true); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// Get the value of an index
+func (i *Int64) Get(index int64) int64 {
+	return int64(i.get(index))
+}
+
+// Set the value to an index
+// Must not be used with slices opened with `OpenInt64`
+func (i *Int64) Set(index int64, value int64) {
+	i.set(index, uint64(value))
+}
+
+// Load atomically reads the value of an index
+func (i *Int64) Load(index int64) int64 {
+	return int64(i.getAtomic(index))
+}
+
+// Store atomically sets the value to an index
+// Must not be used with slices opened with `OpenInt64`
+func (i *Int64) Store(index int64, value int64) {
+	i.setAtomic(index, uint64(value))
+}
+
+// Add atomically adds `delta` to the value of an index and returns the
+// new value. Must not be used with slices opened with `OpenInt64`
+func (i *Int64) Add(index int64, delta int64) int64 {
+	return int64(i.addAtomic(index, uint64(delta)))
+}
+
+// CompareAndSwap atomically sets the value to an index if it's `old`
+// Must not be used with slices opened with `OpenInt64`
+func (i *Int64) CompareAndSwap(index int64, old, new int64) bool {
+	return i.casAtomic(index, uint64(old), uint64(new))
+}
+
+// Uint64 is an uint64 slice stored in a data file
+type Uint64 struct {
+	mapping
+}
+
+// NewUint64 creates a new uint64 slice of the given length at the given filename
+// Data files created before the file header was added are upgraded.
+func NewUint64(filename string, length int64) (*Uint64, error) {
+	value := &Uint64{}
+	if err := value.init(filename, length, KindUint64, false); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// OpenUint64 opens an existing uint64 slice without modifying the data file
+// values of old data files without a header are converted from float64
+func OpenUint64(filename string, length int64) (*Uint64, error) {
+	value := &Uint64{}
+	if err := value.init(filename, length, KindUint64, true); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// Get the value of an index
+func (i *Uint64) Get(index int64) uint64 {
+	return i.get(index)
+}
+
+// Set the value to an index
+// Must not be used with slices opened with `OpenUint64`
+func (i *Uint64) Set(index int64, value uint64) {
+	i.set(index, value)
+}
+
+// Load atomically reads the value of an index
+func (i *Uint64) Load(index int64) uint64 {
+	return i.getAtomic(index)
+}
+
+// Store atomically sets the value to an index
+// Must not be used with slices opened with `OpenUint64`
+func (i *Uint64) Store(index int64, value uint64) {
+	i.setAtomic(index, value)
+}
+
+// Add atomically adds `delta` to the value of an index and returns the
+// new value. Must not be used with slices opened with `OpenUint64`
+func (i *Uint64) Add(index int64, delta uint64) uint64 {
+	return i.addAtomic(index, delta)
+}
+
+// CompareAndSwap atomically sets the value to an index if it's `old`
+// Must not be used with slices opened with `OpenUint64`
+func (i *Uint64) CompareAndSwap(index int64, old, new uint64) bool {
+	return i.casAtomic(index, old, new)
+}
@@ -8,145 +8,443 @@ package pslice
 //  We can resize the slice as well
 //  (we've a different API than the original go slices)
 //
-//  ### Known Issues
-//  * data file is not cross platform friendly
+//  Int64 and Uint64 slices are also available, they are stored the same way.
+//  Data files start with a header with the element type and the byte order
+//  (see format.go) so they can be read on any platform.
 //
 //
 import (
 	"errors"
+	"io"
+	"math"
+	"math/bits"
 	"os"
-	"reflect"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 )
 
-type Pslice struct {
+var (
+	ErrFileTooSmall = errors.New("data file is smaller than the slice")
+)
+
+// mapping is a data file mmaped to the memory
+// values are stored after the header as 8 byte elements
+type mapping struct {
 	// data file of the slice
 	Filename string
 	// lenght of the slice or otherwise number of elements in the slice
 	Length int64
-	// actual byte size = sizeof(float64) * Lenght
+	// type of elements stored in the data file
+	Kind Kind
+	// byte size of mapped values, it's larger than 8 * Lenght
+	// after growing the slice so it's not mapped on each resize
 	size int64
-	// pointer to the mmaped memory
-	pointer unsafe.Pointer
-	// slice with the allocated memory
-	slice []float64
+	// current memory map, replaced when resizing
+	region atomic.Pointer[region]
+	// memory maps replaced when resizing, these are unmapped when
+	// closing the slice as other goroutines may be still using them.
+	// Memory maps are replaced only when growing past the mapped size
+	// which is doubled each time so only a few maps are kept.
+	retired [][]byte
+	// opened with `Open`, the data file is not modified
+	readOnly bool
+	// used when resizing or closing the slice
+	mutex sync.Mutex
+}
+
+// region is a memory map of the data file
+// all memory maps of a file share the same memory pages
+type region struct {
+	// mmaped data file (header and values)
+	data []byte
+	// mmaped values (after the header)
+	values []byte
+	// number of values in the memory map
+	length int64
+	// values are stored in a different byte order than this platform
+	swap bool
+	// float64 values stored without a header (opened read only)
+	legacy bool
+}
+
+// Pslice is a float64 slice stored in a data file
+type Pslice struct {
+	mapping
 }
 
 // Create a new splice of the given lenght at the given filename
+// Data files created before the file header was added are upgraded.
 func New(filename string, length int64) (*Pslice, error) {
-	value := Pslice{}
-	value.Filename = filename
-	value.Length = length
-	value.size = length * 8 // because we use float64
+	value := &Pslice{}
+	if err := value.init(filename, length, KindFloat64, false); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
 
-	if err := value.load(); err != nil {
+// Open an existing slice of the given length without modifying the data file
+// The file must have enough data for the slice and values must not be set.
+// Values set by other processes using the same data file are visible.
+func Open(filename string, length int64) (*Pslice, error) {
+	value := &Pslice{}
+	if err := value.init(filename, length, KindFloat64, true); err != nil {
 		return nil, err
 	}
 
-	return &value, nil
+	return value, nil
+}
+
+// Get the value of an index
+func (i *Pslice) Get(index int64) float64 {
+	return math.Float64frombits(i.get(index))
+}
+
+// Set the value to an index
+// Must not be used with slices opened with `Open`
+func (i *Pslice) Set(index int64, value float64) {
+	i.set(index, math.Float64bits(value))
+}
+
+// Load atomically reads the value of an index
+func (i *Pslice) Load(index int64) float64 {
+	return math.Float64frombits(i.getAtomic(index))
+}
+
+// Store atomically sets the value to an index
+// Must not be used with slices opened with `Open`
+func (i *Pslice) Store(index int64, value float64) {
+	i.setAtomic(index, math.Float64bits(value))
+}
+
+// Add atomically adds `delta` to the value of an index and returns the
+// new value. Must not be used with slices opened with `Open`
+func (i *Pslice) Add(index int64, delta float64) float64 {
+	for {
+		old := i.getAtomic(index)
+		value := math.Float64frombits(old) + delta
+		if i.casAtomic(index, old, math.Float64bits(value)) {
+			return value
+		}
+	}
+}
+
+// CompareAndSwap atomically sets the value to an index if it's `old`
+// values are compared using their bits (NaN values can be swapped)
+// Must not be used with slices opened with `Open`
+func (i *Pslice) CompareAndSwap(index int64, old, new float64) bool {
+	return i.casAtomic(index, math.Float64bits(old), math.Float64bits(new))
+}
+
+func (m *mapping) init(filename string, length int64, kind Kind, readOnly bool) error {
+	m.Filename = filename
+	m.Length = length
+	m.Kind = kind
+	m.size = length * 8
+	m.readOnly = readOnly
+
+	return m.load()
 }
 
 // Load the pslice into the memory. Should not call this manually
-func (i *Pslice) load() error {
-	if i.pointer != nil {
+func (m *mapping) load() error {
+	if m.region.Load() != nil {
 		return errors.New("already loaded")
 	}
 
-	f, err := os.OpenFile(i.Filename, os.O_CREATE|os.O_RDWR, 0644)
+	r, err := m.mmap()
 	if err != nil {
 		return err
 	}
+
+	m.region.Store(r)
+	return nil
+}
+
+// mmap maps the data file with enough space for `Length` values
+// the data file is created, upgraded or extended if needed
+func (m *mapping) mmap() (r *region, err error) {
+	mode := os.O_CREATE | os.O_RDWR
+	prot := syscall.PROT_READ | syscall.PROT_WRITE
+	if m.readOnly {
+		mode = os.O_RDONLY
+		prot = syscall.PROT_READ
+	}
+
+	f, err := os.OpenFile(m.Filename, mode, 0644)
+	if err != nil {
+		return nil, err
+	}
 	// it's okay to close the file even we mmap used FD of this file
 	// mmap maintain it's own mappeing after mmaped with the FD
 	// to munmap, we don't need the FD
 	defer f.Close()
 
+	legacy := false
+
+	h, err := readHeader(f)
+	if err == errNoHeader && !m.readOnly {
+		// files without a header are upgraded before using
+		// new files are created with a header for this platform
+		f.Close()
+		if err := Upgrade(m.Filename, m.Kind); err != nil {
+			return nil, err
+		}
+
+		return m.mmap()
+	} else if err == errNoHeader {
+		// read only slices can't upgrade old files
+		// values are read as float64 in platform byte order
+		h, legacy = header{KindFloat64, nativeOrder}, true
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !legacy && h.kind != m.Kind {
+		return nil, ErrKindMismatch
+	}
+
+	offset := int64(HeaderSize)
+	if legacy {
+		offset = 0
+	}
+
 	stat, err := f.Stat()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// read only slices can't allocate space for missing values
+	if m.readOnly && stat.Size() < offset+m.size {
+		return nil, ErrFileTooSmall
 	}
 
 	// write the default number of bytes if it does not have enough data
-	if stat.Size() < i.size {
-		sizeToAllocate := i.size - stat.Size()
+	if stat.Size() < offset+m.size {
+		sizeToAllocate := offset + m.size - stat.Size()
 		payload := make([]byte, sizeToAllocate)
 		n, err := f.WriteAt(payload, stat.Size())
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		if int64(n) != sizeToAllocate {
-			return errors.New("Couldn't write full payload to metadata")
+			return nil, errors.New("Couldn't write full payload to metadata")
+		}
+	}
+
+	// values stored in a different byte order are converted when
+	// the slice is writable so atomic operations can be used
+	if !m.readOnly && h.order != nativeOrder {
+		if err := convertOrder(f, offset+m.size); err != nil {
+			return nil, err
 		}
+
+		h.order = nativeOrder
 	}
 
 	// load the memory map file
-	prot := syscall.PROT_READ | syscall.PROT_WRITE
 	flags := syscall.MAP_SHARED
-	data, err := syscall.Mmap(int(f.Fd()), 0, int(i.size), prot, flags)
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(offset+m.size), prot, flags)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// get the pointer to the data
-	ptr := unsafe.Pointer(&data[0])
-	i.pointer = ptr
+	r = &region{
+		data:   data,
+		values: data[offset : offset+m.Length*8],
+		length: m.Length,
+		swap:   h.order != nativeOrder,
+		legacy: legacy,
+	}
+
+	return r, nil
+}
+
+// Close the pslice by ummapping allocated memory via mmap
+// The slice must not be used by other goroutines when closing.
+func (m *mapping) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	r := m.region.Load()
+	if r == nil {
+		return errors.New("not loaded yet")
+	}
+
+	for _, data := range m.retired {
+		if err := syscall.Munmap(data); err != nil {
+			return err
+		}
+	}
+
+	m.retired = nil
+
+	err := syscall.Munmap(r.data)
+	if err != nil {
+		return err
+	}
 
-	// create the slice and assign the mmaped pointer as the data of the above slice
-	slice := make([]float64, i.Length)
-	header := (*reflect.SliceHeader)(unsafe.Pointer(&slice))
-	header.Data = (uintptr)(i.pointer)
-	i.slice = slice
+	m.Length = 0
+	m.size = 0
+	m.region.Store(nil)
 
 	return nil
 }
 
-// Close the pslice by ummapping allocated memory via mmap
-func (i *Pslice) Close() error {
-	if i.pointer == nil {
+// Resize the slice with a newLenght
+// It's possible to downsize, in that case excess elements won't get deleted
+// The slice can be used by other goroutines while resizing. The memory map
+// is used again if it has enough space, otherwise writable slices map twice
+// the space needed before. The previous memory map is kept until the slice
+// is closed and shares memory pages with the new one, values set using it
+// are not lost.
+func (m *mapping) Resize(newLength int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	old := m.region.Load()
+	if old == nil {
 		return errors.New("not loaded yet")
 	}
 
-	data := make([]byte, i.size)
-	header := (*reflect.SliceHeader)(unsafe.Pointer(&data))
-	header.Data = (uintptr)(i.pointer)
+	if newLength*8 <= m.size {
+		r := *old
+		r.values = old.values[:newLength*8]
+		r.length = newLength
+
+		m.Length = newLength
+		m.region.Store(&r)
+
+		return nil
+	}
+
+	length, size := m.Length, m.size
+	m.Length = newLength
+	m.size = newLength * 8
 
-	err := syscall.Munmap(data)
+	// read only slices can't allocate space for missing values
+	if !m.readOnly && m.size < 2*size {
+		m.size = 2 * size
+	}
+
+	r, err := m.mmap()
 	if err != nil {
+		m.Length, m.size = length, size
 		return err
 	}
 
-	i.Length = 0
-	i.pointer = nil
-	i.size = 0
-	i.slice = nil
+	m.region.Store(r)
+	m.retired = append(m.retired, old.data)
 
 	return nil
 }
 
-// Get the value of an index
-func (i *Pslice) Get(index int64) float64 {
-	return i.slice[index]
+// Len returns the number of values in the slice
+// safe to use while the slice is resized by another goroutine
+func (m *mapping) Len() int64 {
+	return m.region.Load().length
 }
 
-// Set the value to an index
-func (i *Pslice) Set(index int64, value float64) {
-	i.slice[index] = value
+// ptr returns a pointer to the value of an index in the memory map
+func (r *region) ptr(index int64) *uint64 {
+	_ = r.values[index*8+7]
+	return (*uint64)(unsafe.Pointer(&r.values[index*8]))
 }
 
-// Resize the slice with a newLenght
-// It's possible to downsize, in that case excess elements won't get deleted
-func (i *Pslice) Resize(newLength int64) error {
-	if err := i.Close(); err != nil {
-		return err
+// value converts a value read from the memory map to
+// the bits of a value with the type of the slice
+func (m *mapping) value(r *region, v uint64) uint64 {
+	if r.swap {
+		v = bits.ReverseBytes64(v)
 	}
 
-	i.Length = newLength
-	i.size = newLength * 8
-	if err := i.load(); err != nil {
-		return err
+	if r.legacy {
+		f := math.Float64frombits(v)
+
+		switch m.Kind {
+		case KindInt64:
+			return uint64(int64(f))
+		case KindUint64:
+			return uint64(f)
+		}
 	}
 
-	return nil
+	return v
+}
+
+// get returns the bits of the value of an index
+func (m *mapping) get(index int64) uint64 {
+	r := m.region.Load()
+	return m.value(r, *r.ptr(index))
+}
+
+func (m *mapping) set(index int64, v uint64) {
+	r := m.region.Load()
+	if r.swap {
+		v = bits.ReverseBytes64(v)
+	}
+
+	*r.ptr(index) = v
+}
+
+// getAtomic reads the value of an index atomically
+func (m *mapping) getAtomic(index int64) uint64 {
+	r := m.region.Load()
+	return m.value(r, atomic.LoadUint64(r.ptr(index)))
+}
+
+// writable slices always use the platform byte order
+// these must not be used with slices opened read only
+
+func (m *mapping) setAtomic(index int64, v uint64) {
+	atomic.StoreUint64(m.region.Load().ptr(index), v)
+}
+
+func (m *mapping) addAtomic(index int64, delta uint64) uint64 {
+	return atomic.AddUint64(m.region.Load().ptr(index), delta)
+}
+
+func (m *mapping) casAtomic(index int64, old, new uint64) bool {
+	return atomic.CompareAndSwapUint64(m.region.Load().ptr(index), old, new)
+}
+
+// Load reads values of a pslice data file from any reader without mmaping
+// useful when the data file is not available as a separate file on disk
+// Integer values are converted to float64.
+func Load(r io.ReaderAt, length int64) ([]float64, error) {
+	h, err := readHeader(r)
+	offset := int64(HeaderSize)
+	if err == errNoHeader {
+		h, offset = header{KindFloat64, nativeOrder}, 0
+	} else if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, length*8)
+	n, err := r.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// missing values are considered zero
+	// same as when loading with `New`
+	order := h.order.encoding()
+	values := make([]float64, length)
+	for i := int64(0); i < int64(n)/8; i++ {
+		v := order.Uint64(data[i*8:])
+
+		switch h.kind {
+		case KindInt64:
+			values[i] = float64(int64(v))
+		case KindUint64:
+			values[i] = float64(v)
+		default:
+			values[i] = math.Float64frombits(v)
+		}
+	}
+
+	return values, nil
 }
@@ -1,7 +1,11 @@
 package pslice
 
 import (
+	"bytes"
+	"io/ioutil"
+	"math"
 	"os"
+	"sync"
 	"testing"
 )
 
@@ -187,3 +191,332 @@ func BenchmarkGetSameValueWithSmallSize(b *testing.B) {
 
 	slice.Close()
 }
+
+func TestOpen(t *testing.T) {
+	filename := "/tmp/data.txt"
+	var length int64 = 8
+	defer os.Remove(filename)
+
+	if _, err := Open(filename, length); !os.IsNotExist(err) {
+		t.Fatal("should not create the data file")
+	}
+
+	slice, err := New(filename, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer slice.Close()
+
+	slice2, err := Open(filename, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer slice2.Close()
+
+	// values set with the writable slice should be visible
+	slice.Set(2, 200)
+	if slice2.Get(2) != 200 {
+		t.Fatal("incorrect value")
+	}
+
+	if _, err := Open(filename, length*2); err != ErrFileTooSmall {
+		t.Fatal("should not open a slice larger than the file")
+	}
+}
+
+func TestTypedSlices(t *testing.T) {
+	filename := "/tmp/data.txt"
+	var length int64 = 8
+	defer os.Remove(filename)
+
+	ints, err := NewInt64(filename, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// values above 2^53 can't be stored in float64 without losing precision
+	var big int64 = 1<<53 + 1
+	ints.Set(2, big)
+	ints.Set(3, -5)
+
+	if err := ints.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New(filename, length); err != ErrKindMismatch {
+		t.Fatal("should not open with a different type")
+	}
+
+	ints, err = OpenInt64(filename, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ints.Close()
+
+	if ints.Get(2) != big || ints.Get(3) != -5 {
+		t.Fatal("incorrect value")
+	}
+
+	os.Remove(filename + "2")
+	defer os.Remove(filename + "2")
+
+	uints, err := NewUint64(filename+"2", length)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer uints.Close()
+
+	uints.Set(1, math.MaxUint64)
+	if uints.Get(1) != math.MaxUint64 {
+		t.Fatal("incorrect value")
+	}
+}
+
+func TestHeader(t *testing.T) {
+	filename := "/tmp/data.txt"
+	var length int64 = 8
+	defer os.Remove(filename)
+
+	slice, err := New(filename, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slice.Set(0, 1.5)
+	slice.Close()
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if int64(len(data)) != HeaderSize+length*8 ||
+		!bytes.Equal(data[:4], Magic) ||
+		data[4] != Version ||
+		Kind(data[5]) != KindFloat64 ||
+		ByteOrder(data[6]) != nativeOrder {
+		t.Fatal("incorrect header")
+	}
+
+	// values stored with a different byte order are converted
+	var order ByteOrder = BigEndian
+	if nativeOrder == BigEndian {
+		order = LittleEndian
+	}
+
+	data[6] = byte(order)
+	order.encoding().PutUint64(data[HeaderSize:], math.Float64bits(2.5))
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	slice, err = New(filename, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer slice.Close()
+
+	if slice.Get(0) != 2.5 {
+		t.Fatal("should convert byte order")
+	}
+
+	values, err := Load(bytes.NewReader(data), length)
+	if err != nil {
+		t.Fatal(err)
+	} else if values[0] != 2.5 {
+		t.Fatal("should convert byte order when loading")
+	}
+
+	data[4] = Version + 1
+	if _, err := Load(bytes.NewReader(data), length); err != ErrVersion {
+		t.Fatal("should not load unknown versions")
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	filename := "/tmp/data.txt"
+	var length int64 = 4
+	defer os.Remove(filename)
+
+	// files created before the header was added
+	data := make([]byte, length*8)
+	nativeOrder.encoding().PutUint64(data[8:], math.Float64bits(300))
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := Load(bytes.NewReader(data), length)
+	if err != nil {
+		t.Fatal(err)
+	} else if values[1] != 300 {
+		t.Fatal("should load files without a header")
+	}
+
+	// read only slices should not upgrade files
+	ro, err := OpenInt64(filename, length)
+	if err != nil {
+		t.Fatal(err)
+	} else if ro.Get(1) != 300 {
+		t.Fatal("should read files without a header")
+	}
+
+	ro.Close()
+
+	ints, err := NewInt64(filename, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ints.Close()
+
+	if ints.Get(1) != 300 {
+		t.Fatal("should convert values when upgrading")
+	}
+
+	data, err = ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := readHeader(bytes.NewReader(data))
+	if err != nil || h.kind != KindInt64 {
+		t.Fatal("should upgrade the file")
+	}
+}
+
+func TestAtomic(t *testing.T) {
+	filename := "/tmp/data.txt"
+	var length int64 = 8
+	defer os.Remove(filename)
+
+	ints, err := NewInt64(filename, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ints.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				ints.Add(1, 2)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if ints.Load(1) != 16000 {
+		t.Fatal("incorrect value")
+	}
+
+	if ints.CompareAndSwap(1, 10, 20) || !ints.CompareAndSwap(1, 16000, 20) {
+		t.Fatal("incorrect swap")
+	}
+
+	ints.Store(2, -3)
+	if ints.Load(1) != 20 || ints.Get(2) != -3 {
+		t.Fatal("incorrect value")
+	}
+
+	os.Remove(filename + "2")
+	defer os.Remove(filename + "2")
+
+	floats, err := New(filename+"2", length)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer floats.Close()
+
+	floats.Store(0, 1.5)
+	if floats.Add(0, 2) != 3.5 || !floats.CompareAndSwap(0, 3.5, 1) || floats.Load(0) != 1 {
+		t.Fatal("incorrect value")
+	}
+}
+
+func TestConcurrentResize(t *testing.T) {
+	filename := "/tmp/data.txt"
+	var length int64 = 8
+	defer os.Remove(filename)
+
+	slice, err := NewUint64(filename, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer slice.Close()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				slice.Add(0, 1)
+			}
+		}()
+	}
+
+	for i := int64(1); i <= 100; i++ {
+		if err := slice.Resize(length + i); err != nil {
+			t.Fatal(err)
+		}
+
+		// values set after resizing are visible with the old mmap
+		slice.Store(length+i-1, uint64(i))
+	}
+
+	wg.Wait()
+
+	// values set using old mmaps should not be lost
+	if slice.Len() != length+100 || slice.Load(length+99) != 100 || slice.Load(0) != 4000 {
+		t.Fatal("incorrect value")
+	}
+}
+
+func TestResizeRetired(t *testing.T) {
+	filename := "/tmp/data.txt"
+	defer os.Remove(filename)
+
+	slice, err := NewInt64(filename, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer slice.Close()
+
+	for i := int64(2); i <= 1000; i++ {
+		if err := slice.Resize(i); err != nil {
+			t.Fatal(err)
+		}
+
+		slice.Store(i-1, i)
+	}
+
+	// memory maps are replaced only when the mapped size is doubled
+	if len(slice.retired) > 10 {
+		t.Fatal("too many memory maps kept", len(slice.retired))
+	}
+
+	if err := slice.Resize(10); err != nil {
+		t.Fatal(err)
+	} else if slice.Len() != 10 || slice.Load(9) != 10 {
+		t.Fatal("incorrect value")
+	}
+
+	if err := slice.Resize(1000); err != nil {
+		t.Fatal(err)
+	} else if slice.Len() != 1000 || slice.Load(999) != 1000 {
+		t.Fatal("excess values should not be removed")
+	}
+}
@@ -0,0 +1,156 @@
+package query
+
+import (
+	"math"
+	"sort"
+)
+
+// aggregators combine values of a window or values of many series
+// at the same time, values are given in time order (or series order)
+var aggregators = map[string]func(values []float64) (res float64){
+	"avg": func(values []float64) (res float64) {
+		for _, v := range values {
+			res += v
+		}
+
+		return res / float64(len(values))
+	},
+
+	"sum": func(values []float64) (res float64) {
+		for _, v := range values {
+			res += v
+		}
+
+		return res
+	},
+
+	"min": func(values []float64) (res float64) {
+		res = math.Inf(1)
+		for _, v := range values {
+			res = math.Min(res, v)
+		}
+
+		return res
+	},
+
+	"max": func(values []float64) (res float64) {
+		res = math.Inf(-1)
+		for _, v := range values {
+			res = math.Max(res, v)
+		}
+
+		return res
+	},
+
+	"count": func(values []float64) (res float64) {
+		return float64(len(values))
+	},
+
+	"first": func(values []float64) (res float64) {
+		return values[0]
+	},
+
+	"last": func(values []float64) (res float64) {
+		return values[len(values)-1]
+	},
+}
+
+// apply runs an aggregation on series read from `start`
+// `labels` is set when series values are labels (see Options)
+func apply(fn Func, series []Series, start int64, labels bool) (res []Series) {
+	agg := aggregators[fn.Name]
+
+	if fn.Window != 0 {
+		for _, s := range series {
+			res = append(res, Series{s.Values, window(agg, s.Points, start, fn.Window)})
+		}
+
+		return res
+	}
+
+	if len(series) == 0 {
+		return nil
+	}
+
+	return []Series{combine(agg, series, labels)}
+}
+
+// window aggregates points into windows of `size` nano seconds
+// aligned to `start`, each window is placed at its start time
+func window(agg func([]float64) float64, points []Point, start, size int64) (res []Point) {
+	var values []float64
+	var current int64
+
+	for _, p := range points {
+		ws := p.Timestamp - (p.Timestamp-start)%size
+		if len(values) > 0 && ws != current {
+			res = append(res, Point{current, agg(values)})
+			values = values[:0]
+		}
+
+		current = ws
+		values = append(values, p.Value)
+	}
+
+	if len(values) > 0 {
+		res = append(res, Point{current, agg(values)})
+	}
+
+	return res
+}
+
+// combine aggregates values of all series at the same time into one series
+// index values which are not the same in all series are left empty, labels
+// which are not available in all series are removed
+func combine(agg func([]float64) float64, series []Series, labels bool) (res Series) {
+	res.Values = append([]string(nil), series[0].Values...)
+	byTime := make(map[int64][]float64)
+
+	for _, s := range series {
+		if labels {
+			res.Values = common(res.Values, s.Values)
+		} else {
+			for i, v := range s.Values {
+				if res.Values[i] != v {
+					res.Values[i] = ""
+				}
+			}
+		}
+
+		for _, p := range s.Points {
+			byTime[p.Timestamp] = append(byTime[p.Timestamp], p.Value)
+		}
+	}
+
+	times := make([]int64, 0, len(byTime))
+	for ts := range byTime {
+		times = append(times, ts)
+	}
+
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	for _, ts := range times {
+		res.Points = append(res.Points, Point{ts, agg(byTime[ts])})
+	}
+
+	return res
+}
+
+// common returns labels available in both sorted label sets
+func common(a, b []string) (res []string) {
+	res = a[:0]
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+
+	return res
+}
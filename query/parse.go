@@ -0,0 +1,317 @@
+package query
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// SyntaxError is returned when a query can't be parsed
+// it has the position (byte offset) where the error was found
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return "query: syntax error at position " + strconv.Itoa(e.Pos) + ": " + e.Msg
+}
+
+// Parse parses a query (see the package documentation for the syntax)
+func Parse(text string) (q *Query, err error) {
+	p := &parser{text: text}
+	q = &Query{}
+
+	if q.Matchers, err = p.selector(); err != nil {
+		return nil, err
+	}
+
+	if q.Range, err = p.timeRange(); err != nil {
+		return nil, err
+	}
+
+	for p.skip(); p.pos < len(p.text); p.skip() {
+		if err := p.expect('|'); err != nil {
+			return nil, err
+		}
+
+		fn, err := p.function()
+		if err != nil {
+			return nil, err
+		}
+
+		q.Pipeline = append(q.Pipeline, fn)
+	}
+
+	return q, nil
+}
+
+// parser reads a query from left to right
+// `pos` is the byte offset of the next character
+type parser struct {
+	text string
+	pos  int
+}
+
+func (p *parser) error(msg string) (err error) {
+	return &SyntaxError{p.pos, msg}
+}
+
+// skip moves over white spaces
+func (p *parser) skip() {
+	for p.pos < len(p.text) && unicode.IsSpace(rune(p.text[p.pos])) {
+		p.pos++
+	}
+}
+
+// peek returns the next character after white spaces (0 at the end)
+func (p *parser) peek() (c byte) {
+	p.skip()
+	if p.pos >= len(p.text) {
+		return 0
+	}
+
+	return p.text[p.pos]
+}
+
+func (p *parser) expect(c byte) (err error) {
+	if p.peek() != c {
+		return p.error("expected '" + string(c) + "'")
+	}
+
+	p.pos++
+	return nil
+}
+
+// selector = "{" [ matcher { "," matcher } ] "}"
+func (p *parser) selector() (ms []Matcher, err error) {
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+
+	if p.peek() == '}' {
+		p.pos++
+		return nil, nil
+	}
+
+	for {
+		m, err := p.matcher()
+		if err != nil {
+			return nil, err
+		}
+
+		ms = append(ms, m)
+
+		if p.peek() == ',' {
+			p.pos++
+			continue
+		}
+
+		if err := p.expect('}'); err != nil {
+			return nil, err
+		}
+
+		return ms, nil
+	}
+}
+
+// matcher = name ( "=" | "!=" | "=~" | "!~" ) string
+func (p *parser) matcher() (m Matcher, err error) {
+	if m.Level, err = p.ident(); err != nil {
+		return m, err
+	}
+
+	p.skip()
+
+	ops := []struct {
+		op string
+		t  MatchType
+	}{
+		{"=~", MatchRegexp},
+		{"!~", MatchNotRegexp},
+		{"!=", MatchNotEqual},
+		{"=", MatchEqual},
+	}
+
+	found := false
+	for _, o := range ops {
+		if strings.HasPrefix(p.text[p.pos:], o.op) {
+			m.Type = o.t
+			p.pos += len(o.op)
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return m, p.error("expected a match operator")
+	}
+
+	m.Value, err = p.str()
+	return m, err
+}
+
+func (p *parser) ident() (name string, err error) {
+	p.skip()
+	start := p.pos
+
+	for p.pos < len(p.text) {
+		c := rune(p.text[p.pos])
+		if c != '_' && !unicode.IsLetter(c) && !(unicode.IsDigit(c) && p.pos > start) {
+			break
+		}
+
+		p.pos++
+	}
+
+	if p.pos == start {
+		return "", p.error("expected a name")
+	}
+
+	return p.text[start:p.pos], nil
+}
+
+// str reads a double quoted string with Go escape sequences
+func (p *parser) str() (s string, err error) {
+	if p.peek() != '"' {
+		return "", p.error("expected a quoted string")
+	}
+
+	start := p.pos
+	for p.pos++; p.pos < len(p.text); p.pos++ {
+		if p.text[p.pos] == '\\' {
+			p.pos++
+		} else if p.text[p.pos] == '"' {
+			p.pos++
+
+			s, err := strconv.Unquote(p.text[start:p.pos])
+			if err != nil {
+				p.pos = start
+				return "", p.error("invalid quoted string")
+			}
+
+			return s, nil
+		}
+	}
+
+	p.pos = start
+	return "", p.error("unterminated string")
+}
+
+// timeRange = "[" duration [ "offset" duration ] "]" | "[" time "," time "]"
+func (p *parser) timeRange() (r Range, err error) {
+	if err := p.expect('['); err != nil {
+		return r, err
+	}
+
+	start := p.pos
+	end := strings.IndexByte(p.text[start:], ']')
+	if end < 0 {
+		return r, p.error("expected ']'")
+	}
+
+	body := p.text[start : start+end]
+	p.pos = start + end + 1
+
+	if parts := strings.Split(body, ","); len(parts) == 2 {
+		if r.Start, err = parseTime(parts[0]); err != nil {
+			return r, &SyntaxError{start, err.Error()}
+		}
+
+		if r.End, err = parseTime(parts[1]); err != nil {
+			return r, &SyntaxError{start + len(parts[0]) + 1, err.Error()}
+		}
+
+		return r, nil
+	}
+
+	fields := strings.Fields(body)
+	if len(fields) != 1 && (len(fields) != 3 || fields[1] != "offset") {
+		return r, &SyntaxError{start, "expected a duration or two timestamps"}
+	}
+
+	if r.Duration, err = parseDuration(fields[0]); err != nil {
+		return r, &SyntaxError{start, err.Error()}
+	}
+
+	if len(fields) == 3 {
+		if r.Offset, err = parseDuration(fields[2]); err != nil {
+			return r, &SyntaxError{start, err.Error()}
+		}
+	}
+
+	if r.Duration <= 0 {
+		return r, &SyntaxError{start, "duration should be positive"}
+	}
+
+	return r, nil
+}
+
+// function = name [ "(" [ duration ] ")" ]
+func (p *parser) function() (fn Func, err error) {
+	if fn.Name, err = p.ident(); err != nil {
+		return fn, err
+	}
+
+	if p.peek() != '(' {
+		return fn, nil
+	}
+
+	p.pos++
+	start := p.pos
+	end := strings.IndexByte(p.text[start:], ')')
+	if end < 0 {
+		return fn, p.error("expected ')'")
+	}
+
+	p.pos = start + end + 1
+
+	if arg := strings.TrimSpace(p.text[start : start+end]); arg != "" {
+		if fn.Window, err = parseDuration(arg); err != nil {
+			return fn, &SyntaxError{start, err.Error()}
+		}
+
+		if fn.Window <= 0 {
+			return fn, &SyntaxError{start, "window should be positive"}
+		}
+	}
+
+	return fn, nil
+}
+
+// parseDuration parses Go durations (ex: 1h30m) and days (ex: 7d)
+func parseDuration(s string) (d int64, err error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		if err != nil {
+			return 0, errors.New("invalid duration " + strconv.Quote(s))
+		}
+
+		return days * int64(24*time.Hour), nil
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(v), nil
+}
+
+// parseTime parses RFC3339 times and timestamps in nano seconds
+func parseTime(s string) (ts int64, err error) {
+	s = strings.TrimSpace(s)
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ts, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.UnixNano(), nil
+}
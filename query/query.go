@@ -0,0 +1,341 @@
+package query
+
+//  # Query
+//  A small query language to read series from a kdb database.
+//
+//  {level0="app", level2=~"web-.*"}[1h] | avg(1m)
+//
+//  Series are selected with matchers on index values (inside braces),
+//  data is read from a time range (inside brackets) and results are
+//  passed through a pipeline of aggregations (after each `|`).
+//
+//  Matchers:  name="value", name!="value", name=~"regexp", name!~"regexp"
+//             Index levels are named level0, level1, ... unless names are
+//             given with `Options.Levels`. Regular expressions are fully
+//             anchored. Levels without a matcher match any value.
+//             With `Options.Labels`, matchers use label names and series
+//             without a label have an empty value for it.
+//  Ranges:    [1h] (until now), [1h offset 30m] (until 30 minutes ago)
+//             [2015-08-01T10:00:00Z, 2015-08-01T11:00:00Z] (RFC3339 or
+//             nano second timestamps). Durations may use "d" for days.
+//  Functions: avg, sum, min, max, count, first and last
+//             With a duration (ex: avg(1m)), values of each series are
+//             aggregated into windows of that duration. Without a duration
+//             (ex: sum), series are aggregated into a single series.
+//
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/meteorhacks/kdb"
+	"github.com/meteorhacks/kdb/clock"
+	"github.com/meteorhacks/kdb/payload"
+)
+
+var (
+	ErrUnknownLevel    = errors.New("unknown index level in matcher")
+	ErrUnknownFunction = errors.New("unknown aggregation function")
+	ErrInvalidRegex    = errors.New("invalid regular expression in matcher")
+	ErrInvalidRange    = errors.New("time range should start before it ends")
+	ErrInvalidWindow   = errors.New("window should be a multiple of the resolution")
+	ErrResolution      = errors.New("resolution should be set")
+)
+
+// MatchType is the operator used with a matcher
+type MatchType int
+
+const (
+	MatchEqual     MatchType = iota // =
+	MatchNotEqual                   // !=
+	MatchRegexp                     // =~
+	MatchNotRegexp                  // !~
+)
+
+// Matcher selects series using values of an index level
+type Matcher struct {
+	Level string
+	Type  MatchType
+	Value string
+}
+
+// Range is the time range of a query in nano seconds. Relative ranges have
+// a `Duration` and end `Offset` nano seconds before the time of execution,
+// absolute ranges have `Start` and `End` timestamps.
+type Range struct {
+	Duration int64
+	Offset   int64
+
+	Start int64
+	End   int64
+}
+
+// Func is an aggregation in the pipeline. Values of each series are
+// aggregated into windows if `Window` is set (in nano seconds),
+// otherwise all series are aggregated into a single series.
+type Func struct {
+	Name   string
+	Window int64
+}
+
+// Query is a parsed query which can be executed many times
+type Query struct {
+	Matchers []Matcher
+	Range    Range
+	Pipeline []Func
+}
+
+type Options struct {
+	// names of index levels used with matchers (ex: "host", "app")
+	// levels are named level0, level1, ... by default
+	Levels []string
+
+	// index depth of the database
+	// not required if `Levels` are given
+	IndexDepth int64
+
+	// the database indexes series by labels in name=value format
+	// matchers use label names instead of index levels
+	Labels bool
+
+	// resolution of the database in nano seconds
+	Resolution int64
+
+	// decodes the value stored in a payload, `ok` should be false for
+	// empty payloads. Values encoded with payload.EncodeFloat are
+	// decoded if not set.
+	Decode func(pld []byte) (value float64, ok bool)
+}
+
+// Series is a series selected by a query with its index values
+// aggregated series only have index values common to all series
+type Series struct {
+	Values []string
+	Points []Point
+}
+
+// Point is a value of a series at a time (in nano seconds)
+type Point struct {
+	Timestamp int64
+	Value     float64
+}
+
+// databases which report which payloads were written (ex: dbase)
+type presenceFinder interface {
+	FindPresence(start, end int64, vals []string) (res map[*kdb.IndexElement][][]byte, present map[*kdb.IndexElement][]bool, err error)
+}
+
+// Exec runs the query on the database and returns matching series
+// sorted by index values. Series without any values are not returned.
+func (q *Query) Exec(db kdb.Database, opts Options) (res []Series, err error) {
+	if opts.Resolution <= 0 {
+		return nil, ErrResolution
+	}
+
+	if opts.Levels == nil {
+		opts.Levels = make([]string, opts.IndexDepth)
+		for i := range opts.Levels {
+			opts.Levels[i] = "level" + strconv.Itoa(i)
+		}
+	}
+
+	if opts.Decode == nil {
+		opts.Decode = payload.DecodeFloat
+	}
+
+	selector := q.selector
+	if opts.Labels {
+		selector = q.labelSelector
+	}
+
+	vals, match, err := selector(opts.Levels)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fn := range q.Pipeline {
+		if _, ok := aggregators[fn.Name]; !ok {
+			return nil, ErrUnknownFunction
+		}
+
+		if fn.Window%opts.Resolution != 0 {
+			return nil, ErrInvalidWindow
+		}
+	}
+
+	start, end := q.Range.Start, q.Range.End
+	if q.Range.Duration != 0 {
+		end = clock.Now() - q.Range.Offset
+		start = end - q.Range.Duration
+	}
+
+	// dbase floors timestamps by resolution
+	start -= start % opts.Resolution
+	end -= end % opts.Resolution
+	if start >= end {
+		return nil, ErrInvalidRange
+	}
+
+	var out map[*kdb.IndexElement][][]byte
+	var present map[*kdb.IndexElement][]bool
+
+	if p, ok := db.(presenceFinder); ok {
+		out, present, err = p.FindPresence(start, end, vals)
+	} else {
+		out, err = db.Find(start, end, vals)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for el, plds := range out {
+		if !match(el.Values) {
+			continue
+		}
+
+		s := Series{Values: el.Values}
+		marks := present[el]
+
+		for i, pld := range plds {
+			if marks != nil && !marks[i] {
+				continue
+			}
+
+			value, ok := opts.Decode(pld)
+			if !ok {
+				continue
+			}
+
+			ts := start + int64(i)*opts.Resolution
+			s.Points = append(s.Points, Point{ts, value})
+		}
+
+		if len(s.Points) > 0 {
+			res = append(res, s)
+		}
+	}
+
+	sort.Sort(byValues(res))
+
+	for _, fn := range q.Pipeline {
+		res = apply(fn, res, start, opts.Labels)
+	}
+
+	return res, nil
+}
+
+// selector returns index values used to find series and a function to
+// filter series. Equality matchers are used as index values, all other
+// matchers are checked with the filter.
+func (q *Query) selector(levels []string) (vals []string, match func(vals []string) bool, err error) {
+	index := make(map[string]int)
+	for i, name := range levels {
+		index[name] = i
+	}
+
+	vals = make([]string, len(levels))
+	positions := make([]int, len(q.Matchers))
+	regexps := make([]*regexp.Regexp, len(q.Matchers))
+
+	for i, m := range q.Matchers {
+		pos, ok := index[m.Level]
+		if !ok {
+			return nil, nil, ErrUnknownLevel
+		}
+
+		positions[i] = pos
+
+		switch m.Type {
+		case MatchEqual:
+			vals[pos] = m.Value
+		case MatchRegexp, MatchNotRegexp:
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return nil, nil, ErrInvalidRegex
+			}
+
+			regexps[i] = re
+		}
+	}
+
+	match = func(vals []string) bool {
+		for i, m := range q.Matchers {
+			if !m.matches(vals[positions[i]], regexps[i]) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return vals, match, nil
+}
+
+// matches checks a value with the matcher, `re` is the compiled
+// regular expression used with regexp matchers
+func (m *Matcher) matches(value string, re *regexp.Regexp) (ok bool) {
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return re.MatchString(value)
+	case MatchNotRegexp:
+		return !re.MatchString(value)
+	}
+
+	return false
+}
+
+// labelSelector is the selector used with databases indexed by labels
+// equality matchers are used as labels to find series, `levels` are not used
+func (q *Query) labelSelector(levels []string) (vals []string, match func(vals []string) bool, err error) {
+	regexps := make([]*regexp.Regexp, len(q.Matchers))
+
+	for i, m := range q.Matchers {
+		switch m.Type {
+		case MatchEqual:
+			if m.Value != "" {
+				vals = append(vals, m.Level+"="+m.Value)
+			}
+		case MatchRegexp, MatchNotRegexp:
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return nil, nil, ErrInvalidRegex
+			}
+
+			regexps[i] = re
+		}
+	}
+
+	match = func(vals []string) bool {
+		labels := make(map[string]string, len(vals))
+		for _, l := range vals {
+			if eq := strings.IndexByte(l, '='); eq > 0 {
+				labels[l[:eq]] = l[eq+1:]
+			}
+		}
+
+		for i, m := range q.Matchers {
+			if !m.matches(labels[m.Level], regexps[i]) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return vals, match, nil
+}
+
+type byValues []Series
+
+func (s byValues) Len() int      { return len(s) }
+func (s byValues) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byValues) Less(i, j int) bool {
+	return strings.Join(s[i].Values, "\x00") < strings.Join(s[j].Values, "\x00")
+}
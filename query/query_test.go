@@ -0,0 +1,280 @@
+package query
+
+import (
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/meteorhacks/kdb/clock"
+	"github.com/meteorhacks/kdb/dbase"
+	"github.com/meteorhacks/kdb/payload"
+)
+
+func TestParse(t *testing.T) {
+	q, err := Parse(`{level0="app", level2=~"web-.*"}[1h] | avg(1m) | sum`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &Query{
+		Matchers: []Matcher{
+			{"level0", MatchEqual, "app"},
+			{"level2", MatchRegexp, "web-.*"},
+		},
+		Range: Range{Duration: int64(time.Hour)},
+		Pipeline: []Func{
+			{"avg", int64(time.Minute)},
+			{"sum", 0},
+		},
+	}
+
+	if !reflect.DeepEqual(q, exp) {
+		t.Fatal("incorrect query")
+	}
+
+	q, err = Parse(`{ host != "h\"1", app!~"a|b" } [ 2d offset 30m ]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp = &Query{
+		Matchers: []Matcher{
+			{"host", MatchNotEqual, `h"1`},
+			{"app", MatchNotRegexp, "a|b"},
+		},
+		Range: Range{Duration: int64(48 * time.Hour), Offset: int64(30 * time.Minute)},
+	}
+
+	if !reflect.DeepEqual(q, exp) {
+		t.Fatal("incorrect query")
+	}
+
+	q, err = Parse(`{}[2015-08-01T10:00:00Z, 1438427400000000000]|max()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp = &Query{
+		Range:    Range{Start: 1438423200000000000, End: 1438427400000000000},
+		Pipeline: []Func{{"max", 0}},
+	}
+
+	if !reflect.DeepEqual(q, exp) {
+		t.Fatal("incorrect query")
+	}
+
+	invalid := map[string]int{
+		`level0="app"}[1h]`:       0,
+		`{level0 "app"}[1h]`:      8,
+		`{level0="app"[1h]`:       13,
+		`{level0=app}[1h]`:        8,
+		`{level0="app}[1h]`:       8,
+		`{level0="app"}`:          14,
+		`{level0="app"}[1h`:       15,
+		`{level0="app"}[1x]`:      15,
+		`{level0="app"}[-1h]`:     15,
+		`{level0="app"}[1h] avg`:  19,
+		`{level0="app"}[1h] | 1m`: 21,
+		`{}[1h] | avg(1h`:         13,
+		`{}[1h] | avg(0s)`:        13,
+	}
+
+	for text, pos := range invalid {
+		_, err := Parse(text)
+		if serr, ok := err.(*SyntaxError); !ok || serr.Pos != pos {
+			t.Fatal("should return a syntax error", text, err)
+		}
+	}
+}
+
+func TestExec(t *testing.T) {
+	defer cleanTestFiles()
+
+	db, err := createTestDbase()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	opts := Options{IndexDepth: 3, Resolution: int64(time.Second)}
+
+	res, err := run(t, db, `{level0="app", level2=~"web-.*"}[10s]`, opts)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(res) != 2 || len(res[0].Points) != 10 {
+		t.Fatal("incorrect result")
+	} else if !reflect.DeepEqual(res[0].Values, []string{"app", "h1", "web-1"}) {
+		t.Fatal("series should be sorted by values")
+	} else if res[0].Points[3] != (Point{int64(103 * time.Second), 3}) {
+		t.Fatal("incorrect point")
+	}
+
+	res, err = run(t, db, `{level0="app", level2=~"web-.*"}[10s] | avg(5s)`, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []Point{{int64(100 * time.Second), 2}, {int64(105 * time.Second), 7}}
+	if len(res) != 2 || !reflect.DeepEqual(res[0].Points, exp) {
+		t.Fatal("incorrect result")
+	}
+
+	res, err = run(t, db, `{level2=~"web-.*"}[10s] | sum(5s) | sum`, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp = []Point{{int64(100 * time.Second), 110}, {int64(105 * time.Second), 385}}
+	if len(res) != 1 || !reflect.DeepEqual(res[0].Points, exp) {
+		t.Fatal("incorrect result")
+	} else if !reflect.DeepEqual(res[0].Values, []string{"app", "", ""}) {
+		t.Fatal("only common values should be kept")
+	}
+
+	// absolute ranges and names given to levels
+	opts.Levels = []string{"app", "host", "name"}
+	res, err = run(t, db, `{host!="h1"}[100000000000, 102000000000] | count(2s)`, opts)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(res) != 2 || res[0].Values[2] != "web-2" {
+		t.Fatal("incorrect result")
+	} else if res[0].Points[0] != (Point{int64(100 * time.Second), 2}) {
+		t.Fatal("incorrect result")
+	}
+
+	invalid := map[string]error{
+		`{level0="app"}[10s]`:            ErrUnknownLevel,
+		`{name=~"("}[10s]`:               ErrInvalidRegex,
+		`{}[10s] | median`:               ErrUnknownFunction,
+		`{}[10s] | avg(1500ms)`:          ErrInvalidWindow,
+		`{}[102000000000, 100000000000]`: ErrInvalidRange,
+		`{}[100500000000, 100900000000]`: ErrInvalidRange,
+	}
+
+	for text, exp := range invalid {
+		if _, err := run(t, db, text, opts); err != exp {
+			t.Fatal("should return correct error", text, err)
+		}
+	}
+}
+
+func TestExecLabels(t *testing.T) {
+	defer cleanTestFiles()
+
+	clock.UseTestClock()
+	clock.Goto(int64(110 * time.Second))
+	cleanTestFiles()
+
+	db, err := dbase.New(dbase.Options{
+		DatabaseName:   "test",
+		DataPath:       "/tmp/test-query",
+		Labels:         true,
+		PayloadSize:    payload.FloatSize,
+		BucketDuration: int64(time.Hour),
+		Resolution:     int64(time.Second),
+		SegmentSize:    10,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	series := [][]string{
+		{"app=web", "host=h1"},
+		{"app=web", "host=h2", "zone=z1"},
+		{"app=db", "host=h3", "zone=z1"},
+	}
+
+	ts := int64(100 * time.Second)
+	for i, labels := range series {
+		if err := db.Put(ts, labels, payload.EncodeFloat(float64(i+1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := Options{Labels: true, Resolution: int64(time.Second)}
+
+	res, err := run(t, db, `{zone="z1"}[100000000000, 101000000000]`, opts)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(res) != 2 || !reflect.DeepEqual(res[0].Values, series[2]) {
+		t.Fatal("should match series with the label")
+	}
+
+	res, err = run(t, db, `{app="web", zone=""}[100000000000, 101000000000]`, opts)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(res) != 1 || !reflect.DeepEqual(res[0].Values, series[0]) {
+		t.Fatal("missing labels should have empty values")
+	}
+
+	res, err = run(t, db, `{host=~"h[23]"}[100000000000, 101000000000] | sum`, opts)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(res) != 1 || res[0].Points[0] != (Point{ts, 5}) {
+		t.Fatal("incorrect result")
+	} else if !reflect.DeepEqual(res[0].Values, []string{"zone=z1"}) {
+		t.Fatal("only common labels should be kept")
+	}
+}
+
+func run(t *testing.T, db *dbase.DBase, text string, opts Options) (res []Series, err error) {
+	q, err := Parse(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return q.Exec(db, opts)
+}
+
+// A test clock is used to control the time
+// series have a value each second from 100s to 109s
+// web-1 has values 0 to 9, web-2 has 0 to 90 and db-1 has 0 to 900
+func createTestDbase() (db *dbase.DBase, err error) {
+	clock.UseTestClock()
+	clock.Goto(int64(110 * time.Second))
+	cleanTestFiles()
+
+	db, err = dbase.New(dbase.Options{
+		DatabaseName:   "test",
+		DataPath:       "/tmp/test-query",
+		IndexDepth:     3,
+		PayloadSize:    payload.FloatSize,
+		BucketDuration: int64(time.Hour),
+		Resolution:     int64(time.Second),
+		SegmentSize:    10,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	series := map[string]float64{"web-1": 1, "web-2": 10, "db-1": 100}
+	for name, scale := range series {
+		host := "h" + name[len(name)-1:]
+		if name == "db-1" {
+			host = "h3"
+		}
+
+		for i := 0; i < 10; i++ {
+			ts := int64(100+i) * int64(time.Second)
+			pld := payload.EncodeFloat(float64(i) * scale)
+			if err := db.Put(ts, []string{"app", host, name}, pld); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return db, nil
+}
+
+func cleanTestFiles() {
+	cmd := exec.Command("rm", "-rf", "/tmp/test-query")
+	if err := cmd.Run(); err != nil {
+		panic(err)
+	}
+}
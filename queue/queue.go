@@ -6,69 +6,100 @@ import (
 )
 
 var (
-	ErrKeyExists  = errors.New("key already exists")
-	ErrKeyMissing = errors.New("key does not exist")
+	ErrKeyExists   = errors.New("key already exists")
+	ErrKeyMissing  = errors.New("key does not exist")
+	ErrQueueClosed = errors.New("queue is closed")
 )
 
+// Queue keeps a limited number of values in the order they were added.
+// When a value is added to a full queue, the oldest value is removed.
 type Queue interface {
 	Add(key int64, val interface{}) (err error)
 	Get(key int64) (val interface{}, err error)
 	Del(key int64) (val interface{}, err error)
-	Out() (ch <-chan interface{})
 	Flush() (data map[int64]interface{})
 
+	// Close removes all values and returns them. Values can't be
+	// added after closing the queue, Add returns ErrQueueClosed.
+	Close() (data map[int64]interface{}, err error)
+
 	Length() (length int)
 }
 
+// EvictFunc is called with values removed from a full queue when adding a
+// new value. It's called without holding the queue lock after the new value
+// is added, so it can use the queue. `Add` returns when it returns.
+type EvictFunc func(key int64, val interface{})
+
 type queue struct {
-	data map[int64]interface{}
-	keys []int64
-	head int
-	tail int
-	lnth int
-	size int
-	mutx *sync.Mutex
-	outc chan interface{}
+	data   map[int64]interface{}
+	keys   []int64 // keys in the order they were added
+	size   int
+	mutx   *sync.Mutex
+	evict  EvictFunc
+	closed bool
 }
 
+// NewQueue creates a queue which drops values removed when it's full
 func NewQueue(size int) (q Queue) {
-	return newQueue(size)
+	return newQueue(size, nil)
 }
 
-func newQueue(size int) (q *queue) {
+// NewQueueWithCallback creates a queue which calls `fn`
+// with each value removed when the queue is full
+func NewQueueWithCallback(size int, fn EvictFunc) (q Queue) {
+	return newQueue(size, fn)
+}
+
+func newQueue(size int, fn EvictFunc) (q *queue) {
 	return &queue{
-		data: make(map[int64]interface{}, size),
-		keys: make([]int64, size, size),
-		size: size,
-		mutx: &sync.Mutex{},
-		outc: make(chan interface{}),
+		data:  make(map[int64]interface{}, size),
+		keys:  make([]int64, 0, size),
+		size:  size,
+		mutx:  &sync.Mutex{},
+		evict: fn,
 	}
 }
 
 func (q *queue) Add(key int64, val interface{}) (err error) {
 	q.mutx.Lock()
-	defer q.mutx.Unlock()
+
+	if q.closed {
+		q.mutx.Unlock()
+		return ErrQueueClosed
+	}
 
 	if _, ok := q.data[key]; ok {
+		q.mutx.Unlock()
 		return ErrKeyExists
 	}
 
-	if q.lnth == q.size {
-		k := q.keys[q.head]
-		v := q.data[k]
-		q.outc <- v
-		q.del(k)
+	var evictedKey int64
+	var evicted interface{}
+	var full bool
+
+	if len(q.keys) == q.size {
+		evictedKey = q.keys[0]
+		evicted = q.data[evictedKey]
+		full = true
+		q.del(0)
 	}
 
-	q.keys[q.tail] = key
+	q.keys = append(q.keys, key)
 	q.data[key] = val
-	q.tail = (q.tail + 1) % q.size
-	q.lnth++
+	q.mutx.Unlock()
+
+	if full && q.evict != nil {
+		q.evict(evictedKey, evicted)
+	}
 
 	return nil
 }
 
 func (q *queue) Get(key int64) (val interface{}, err error) {
+	q.mutx.Lock()
+	defer q.mutx.Unlock()
+
 	val, ok := q.data[key]
 	if !ok {
 		return nil, ErrKeyMissing
@@ -78,36 +109,67 @@ func (q *queue) Get(key int64) (val interface{}, err error) {
 }
 
 func (q *queue) Del(key int64) (val interface{}, err error) {
+	q.mutx.Lock()
+	defer q.mutx.Unlock()
+
 	val, ok := q.data[key]
 	if !ok {
 		return nil, ErrKeyMissing
 	}
 
-	q.del(key)
+	for i, k := range q.keys {
+		if k == key {
+			q.del(i)
+			break
+		}
+	}
 
 	return val, nil
 }
 
-func (q *queue) Out() (ch <-chan interface{}) {
-	return q.outc
+// Flush removes all values and returns them
+func (q *queue) Flush() (data map[int64]interface{}) {
+	q.mutx.Lock()
+	defer q.mutx.Unlock()
+
+	return q.flush()
 }
 
-func (q *queue) Flush() (data map[int64]interface{}) {
+func (q *queue) Close() (data map[int64]interface{}, err error) {
 	q.mutx.Lock()
 	defer q.mutx.Unlock()
 
-	data = q.data
-	q.data = make(map[int64]interface{}, q.size)
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
 
-	return data
+	q.closed = true
+	return q.flush(), nil
 }
 
 func (q *queue) Length() (length int) {
-	return q.lnth
+	q.mutx.Lock()
+	defer q.mutx.Unlock()
+
+	return len(q.keys)
 }
 
-func (q *queue) del(key int64) {
-	delete(q.data, key)
-	q.head = (q.head + 1) % q.size
-	q.lnth--
+// del removes the key at index `i` of `keys` and its value
+func (q *queue) del(i int) {
+	delete(q.data, q.keys[i])
+
+	if i == 0 {
+		q.keys = q.keys[1:]
+		return
+	}
+
+	q.keys = append(q.keys[:i], q.keys[i+1:]...)
+}
+
+func (q *queue) flush() (data map[int64]interface{}) {
+	data = q.data
+	q.data = make(map[int64]interface{}, q.size)
+	q.keys = make([]int64, 0, q.size)
+
+	return data
 }
@@ -1,11 +1,12 @@
 package queue
 
 import (
+	"reflect"
 	"testing"
 )
 
 func TestAdd(t *testing.T) {
-	q := newQueue(3)
+	q := newQueue(3, nil)
 
 	if err := q.Add(0, 10); err != nil {
 		t.Fatal(err)
@@ -17,7 +18,7 @@ func TestAdd(t *testing.T) {
 }
 
 func TestAddDuplicate(t *testing.T) {
-	q := newQueue(3)
+	q := newQueue(3, nil)
 
 	if err := q.Add(0, 10); err != nil {
 		t.Fatal(err)
@@ -30,26 +31,120 @@ func TestAddDuplicate(t *testing.T) {
 }
 
 func TestAddFull(t *testing.T) {
-	q := newQueue(3)
-
-	go func() {
-		// fill the bucket and
-		// add 2 extra items
-		for i := 0; i < q.size+2; i++ {
-			key := int64(i)
-			q.Add(key, i*10)
+	var evicted []interface{}
+	q := newQueue(3, func(key int64, val interface{}) {
+		if val != int(key)*10 {
+			t.Fatal("invalid key")
 		}
-	}()
 
-	for i := 0; i < 2; i++ {
-		if val := <-q.Out(); val != i*10 {
-			t.Fatal("invalid value")
+		evicted = append(evicted, val)
+	})
+
+	// fill the bucket and
+	// add 2 extra items
+	for i := 0; i < q.size+2; i++ {
+		key := int64(i)
+		if err := q.Add(key, i*10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !reflect.DeepEqual(evicted, []interface{}{0, 10}) {
+		t.Fatal("invalid value")
+	}
+
+	if q.Length() != 3 {
+		t.Fatal("invalid length")
+	}
+}
+
+func TestEvictFuncUsesQueue(t *testing.T) {
+	var q Queue
+
+	// the queue is not locked when calling the function
+	q = NewQueueWithCallback(1, func(key int64, val interface{}) {
+		if _, err := q.Get(1); err != nil {
+			t.Fatal(err)
 		}
+	})
+
+	q.Add(0, 0)
+	q.Add(1, 10)
+}
+
+func TestDel(t *testing.T) {
+	var evicted []interface{}
+	q := newQueue(3, func(key int64, val interface{}) {
+		evicted = append(evicted, val)
+	})
+
+	q.Add(0, 0)
+	q.Add(1, 10)
+	q.Add(2, 20)
+
+	// deleting a key in the middle should not
+	// change the order of remaining keys
+	if val, err := q.Del(1); err != nil || val != 10 {
+		t.Fatal("invalid value")
+	}
+
+	if _, err := q.Del(1); err != ErrKeyMissing {
+		t.Fatal("key should be missing")
+	}
+
+	q.Add(3, 30)
+	q.Add(4, 40)
+
+	if !reflect.DeepEqual(evicted, []interface{}{0}) {
+		t.Fatal("oldest value should be evicted")
+	}
+
+	if _, err := q.Get(2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	q := newQueue(2, nil)
+	q.Add(0, 0)
+	q.Add(1, 10)
+
+	data := q.Flush()
+	if len(data) != 2 || q.Length() != 0 {
+		t.Fatal("all values should be removed")
+	}
+
+	// values can be added again without evicting
+	q.Add(2, 20)
+	q.Add(3, 30)
+
+	if q.Length() != 2 || q.data[2] != 20 || q.data[3] != 30 {
+		t.Fatal("invalid values after flush")
+	}
+}
+
+func TestClose(t *testing.T) {
+	q := newQueue(2, nil)
+	q.Add(0, 0)
+
+	data, err := q.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(data) != 1 || data[0] != 0 {
+		t.Fatal("invalid values")
+	}
+
+	if err := q.Add(1, 10); err != ErrQueueClosed {
+		t.Fatal("should not add after closing")
+	}
+
+	if _, err := q.Close(); err != ErrQueueClosed {
+		t.Fatal("should return correct error")
 	}
 }
 
 func BenchmarkAdd(b *testing.B) {
-	q := newQueue(b.N)
+	q := newQueue(b.N, nil)
 
 	var i int64
 	var N int64 = int64(b.N)
@@ -61,7 +156,7 @@ func BenchmarkAdd(b *testing.B) {
 }
 
 func BenchmarkGet(b *testing.B) {
-	q := newQueue(b.N)
+	q := newQueue(b.N, nil)
 
 	var i int64
 	var N int64 = int64(b.N)
@@ -76,7 +171,7 @@ func BenchmarkGet(b *testing.B) {
 }
 
 func BenchmarkDel(b *testing.B) {
-	q := newQueue(b.N)
+	q := newQueue(b.N, nil)
 
 	var i int64
 	var N int64 = int64(b.N)
@@ -2,10 +2,14 @@ package rblock
 
 import (
 	"errors"
+	"io"
 	"os"
 	"path"
 	"strconv"
+	"sync"
 
+	"github.com/meteorhacks/kdb"
+	"github.com/meteorhacks/kdb/dblock"
 	"github.com/meteorhacks/kdb/pslice"
 )
 
@@ -26,6 +30,8 @@ var (
 	ErrSegReadError    = errors.New("error while reading from segment file")
 	ErrSegInvalidMmap  = errors.New("requested segment mmap is not available")
 	ErrWriteOnReadOnly = errors.New("write operation on a read only block")
+	ErrInvalidRecord   = errors.New("record does not exist in block")
+	ErrInvalidRange    = errors.New("payload positions are out of record bounds")
 )
 
 type Options struct {
@@ -44,27 +50,35 @@ type Options struct {
 
 type DBlock struct {
 	Options
-	segmentFiles map[int64]*os.File // files used to store segments
-	recordSize   int64              // size of a record in bytes
-	metadata     *pslice.Pslice     // segment metadata
+	segmentFiles  map[int64]io.ReaderAt // files used to store segments
+	presenceFiles map[int64]io.ReaderAt // files used to store presence bitmaps
+	markerFiles   map[int64]io.ReaderAt // files used to store last written payload markers
+	recordSize    int64                 // size of a record in bytes
+	bitmapSize    int64                 // size of a presence bitmap in bytes
+	metadata      *pslice.Int64         // segment metadata
+	mutex         *sync.RWMutex         // used when loading new segments
 }
 
 func New(opts Options) (blk *DBlock, err error) {
-	segmentFiles := make(map[int64]*os.File)
+	segmentFiles := make(map[int64]io.ReaderAt)
 	recordSize := opts.PayloadSize * opts.PayloadCount
 
 	// load metadata
 	metadataFilePath := path.Join(opts.BlockPath, "metadata")
-	metadata, err := pslice.New(metadataFilePath, MetadataCount)
+	metadata, err := pslice.OpenInt64(metadataFilePath, MetadataCount)
 	if err != nil {
 		return nil, err
 	}
 
 	blk = &DBlock{
-		Options:      opts,
-		segmentFiles: segmentFiles,
-		recordSize:   recordSize,
-		metadata:     metadata,
+		Options:       opts,
+		segmentFiles:  segmentFiles,
+		presenceFiles: make(map[int64]io.ReaderAt),
+		markerFiles:   make(map[int64]io.ReaderAt),
+		recordSize:    recordSize,
+		bitmapSize:    dblock.BitmapSize(opts.PayloadCount),
+		metadata:      metadata,
+		mutex:         &sync.RWMutex{},
 	}
 
 	// load available segments
@@ -76,6 +90,33 @@ func New(opts Options) (blk *DBlock, err error) {
 	return blk, nil
 }
 
+// NewWithSegments creates a block which reads segment data from readers
+// useful when segment files are not available as separate files on disk
+// `BlockPath` option is not used with blocks created with this function
+// Payloads with non zero bytes are considered present (see `Present`).
+func NewWithSegments(opts Options, segments map[int64]io.ReaderAt) (blk *DBlock) {
+	return NewWithFiles(opts, segments, nil)
+}
+
+// NewWithFiles works like `NewWithSegments` and also reads presence
+// bitmaps of segments from readers (by segment number). Last written
+// payloads are found with presence bitmaps (see `Latest`).
+func NewWithFiles(opts Options, segments, presence map[int64]io.ReaderAt) (blk *DBlock) {
+	if presence == nil {
+		presence = make(map[int64]io.ReaderAt)
+	}
+
+	return &DBlock{
+		Options:       opts,
+		segmentFiles:  segments,
+		presenceFiles: presence,
+		markerFiles:   make(map[int64]io.ReaderAt),
+		recordSize:    opts.PayloadSize * opts.PayloadCount,
+		bitmapSize:    dblock.BitmapSize(opts.PayloadCount),
+		mutex:         &sync.RWMutex{},
+	}
+}
+
 func (blk *DBlock) New() (rpos int64, err error) {
 	return 0, ErrWriteOnReadOnly
 }
@@ -84,28 +125,51 @@ func (blk *DBlock) Put(rpos, ppos int64, pld []byte) (err error) {
 	return ErrWriteOnReadOnly
 }
 
+func (blk *DBlock) Merge(rpos, ppos int64, pld []byte, fn kdb.MergeFunc) (err error) {
+	return ErrWriteOnReadOnly
+}
+
 // Get reads payloads from `start` to `end` on a record starting at `rpos`
+// errors with the record are returned as `*kdb.RecordError`
 func (blk *DBlock) Get(rpos, start, end int64) (res [][]byte, err error) {
+	if start < 0 || end > blk.PayloadCount || start > end {
+		return nil, blk.recordError(rpos, ErrInvalidRange)
+	}
+
+	// blocks created with segment readers does not have metadata
+	// the record count is not known but the segment must be available
+	if rpos < 0 || (blk.metadata != nil && rpos >= blk.metadata.Load(MetadataRecordCount)) {
+		return nil, blk.recordError(rpos, ErrInvalidRecord)
+	}
+
 	sno := 1 + rpos/blk.SegmentSize
-	rpos = rpos % blk.SegmentSize
+	file, ok := blk.segment(sno)
+	if !ok && blk.metadata != nil {
+		// the segment may be created by another process after loading
+		if err := blk.Refresh(); err != nil {
+			return nil, blk.recordError(rpos, err)
+		}
+
+		file, ok = blk.segment(sno)
+	}
 
-	file, ok := blk.segmentFiles[sno]
 	if !ok {
-		panic(ErrSegInvalidMmap)
-		return nil, ErrSegInvalidMmap
+		return nil, blk.recordError(rpos, ErrSegInvalidMmap)
 	}
 
 	payloadCount := end - start
-	startOffset := rpos*blk.recordSize + start*blk.PayloadSize
+	startOffset := (rpos%blk.SegmentSize)*blk.recordSize + start*blk.PayloadSize
 
 	resultBytes := payloadCount * blk.PayloadSize
 	resultData := make([]byte, resultBytes, resultBytes)
 
+	// segment files may be trimmed to remove unused space
+	// bytes after the end of the file are considered empty
 	n, err := file.ReadAt(resultData, startOffset)
-	if err != nil {
-		return nil, err
-	} else if int64(n) != resultBytes {
-		return nil, ErrSegReadError
+	if err != nil && err != io.EOF {
+		return nil, blk.recordError(rpos, err)
+	} else if err == nil && int64(n) != resultBytes {
+		return nil, blk.recordError(rpos, ErrSegReadError)
 	}
 
 	res = make([][]byte, payloadCount, payloadCount)
@@ -118,14 +182,191 @@ func (blk *DBlock) Get(rpos, start, end int64) (res [][]byte, err error) {
 	return res, nil
 }
 
+// Present reports which payloads from `start` to `end` on a record starting
+// at `rpos` were written. Segments created before presence files were added
+// does not have one, payloads with non zero bytes are present with these.
+// errors with the record are returned as `*kdb.RecordError`
+func (blk *DBlock) Present(rpos, start, end int64) (res []bool, err error) {
+	plds, err := blk.Get(rpos, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	res = make([]bool, len(plds))
+
+	sno := 1 + rpos/blk.SegmentSize
+	file, ok := blk.presence(sno)
+	if !ok {
+		for i, pld := range plds {
+			res[i] = !isEmpty(pld)
+		}
+
+		return res, nil
+	}
+
+	// presence files may be trimmed with segment files
+	// bytes after the end of the file are considered empty
+	bitmap := make([]byte, blk.bitmapSize)
+	offset := (rpos % blk.SegmentSize) * blk.bitmapSize
+	if _, err := file.ReadAt(bitmap, offset); err != nil && err != io.EOF {
+		return nil, blk.recordError(rpos, err)
+	}
+
+	for i := range res {
+		res[i] = dblock.IsPresent(bitmap, start+int64(i))
+	}
+
+	return res, nil
+}
+
+// Latest returns the payload with the highest position written on a record
+// starting at `rpos` and its position, `ppos` is -1 if the record is empty.
+// Segments without marker files use presence bitmaps (see `Present`).
+// errors with the record are returned as `*kdb.RecordError`
+func (blk *DBlock) Latest(rpos int64) (ppos int64, pld []byte, err error) {
+	ppos, err = blk.latest(rpos)
+	if err != nil || ppos < 0 {
+		return -1, nil, err
+	}
+
+	res, err := blk.Get(rpos, ppos, ppos+1)
+	if err != nil {
+		return -1, nil, err
+	}
+
+	return ppos, res[0], nil
+}
+
+// latest returns the position of the last written payload of the record
+func (blk *DBlock) latest(rpos int64) (ppos int64, err error) {
+	sno := 1 + rpos/blk.SegmentSize
+	file, ok := blk.marker(sno)
+	if !ok {
+		present, err := blk.Present(rpos, 0, blk.PayloadCount)
+		if err != nil {
+			return -1, err
+		}
+
+		for ppos = int64(len(present)) - 1; ppos >= 0; ppos-- {
+			if present[ppos] {
+				break
+			}
+		}
+
+		return ppos, nil
+	}
+
+	// checks whether the record exists
+	if _, err := blk.Get(rpos, 0, 0); err != nil {
+		return -1, err
+	}
+
+	// marker files may be trimmed with segment files
+	// bytes after the end of the file are considered empty
+	marker := make([]byte, dblock.MarkerSize)
+	offset := (rpos % blk.SegmentSize) * dblock.MarkerSize
+	if _, err := file.ReadAt(marker, offset); err != nil && err != io.EOF {
+		return -1, blk.recordError(rpos, err)
+	}
+
+	ppos = dblock.MarkerPosition(marker)
+	if ppos >= blk.PayloadCount {
+		return -1, nil
+	}
+
+	return ppos, nil
+}
+
+// isEmpty checks whether the payload only has zero bytes
+func isEmpty(pld []byte) (empty bool) {
+	for _, b := range pld {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (blk *DBlock) segment(sno int64) (file io.ReaderAt, ok bool) {
+	blk.mutex.RLock()
+	defer blk.mutex.RUnlock()
+
+	file, ok = blk.segmentFiles[sno]
+	return file, ok
+}
+
+func (blk *DBlock) presence(sno int64) (file io.ReaderAt, ok bool) {
+	blk.mutex.RLock()
+	defer blk.mutex.RUnlock()
+
+	file, ok = blk.presenceFiles[sno]
+	return file, ok
+}
+
+func (blk *DBlock) marker(sno int64) (file io.ReaderAt, ok bool) {
+	blk.mutex.RLock()
+	defer blk.mutex.RUnlock()
+
+	file, ok = blk.markerFiles[sno]
+	return file, ok
+}
+
+func (blk *DBlock) recordError(rpos int64, err error) (rerr error) {
+	sno := 1 + rpos/blk.SegmentSize
+	if rpos < 0 {
+		sno = 0
+	}
+
+	return &kdb.RecordError{Record: rpos, Segment: sno, Err: err}
+}
+
+// Refresh opens segment files created by other processes after the
+// block was loaded. Records added to existing segments are available
+// without refreshing because segment files are read on each request.
+func (blk *DBlock) Refresh() (err error) {
+	// blocks created with segment readers does not have metadata
+	if blk.metadata == nil {
+		return nil
+	}
+
+	blk.mutex.Lock()
+	defer blk.mutex.Unlock()
+
+	return blk.loadSegments()
+}
+
 // close all file handlers
 func (blk *DBlock) Close() (err error) {
-	for _, f := range blk.segmentFiles {
-		if err := f.Close(); err != nil {
-			return err
+	for _, r := range blk.segmentFiles {
+		if f, ok := r.(io.Closer); ok {
+			if err := f.Close(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, r := range blk.presenceFiles {
+		if f, ok := r.(io.Closer); ok {
+			if err := f.Close(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, r := range blk.markerFiles {
+		if f, ok := r.(io.Closer); ok {
+			if err := f.Close(); err != nil {
+				return err
+			}
 		}
 	}
 
+	// blocks created with segment readers does not have metadata
+	if blk.metadata == nil {
+		return nil
+	}
+
 	if err := blk.metadata.Close(); err != nil {
 		return err
 	}
@@ -133,25 +374,53 @@ func (blk *DBlock) Close() (err error) {
 	return nil
 }
 
-// open previously created segment files
+// open previously created segment files with their presence and marker files
 // * segment file path: BLOCK_PATH/block_1
+// * presence file path: BLOCK_PATH/presence_1
+// * marker file path: BLOCK_PATH/latest_1
 func (blk *DBlock) loadSegments() (err error) {
-	countf := blk.metadata.Get(MetadataSegmentCount)
-	if countf == 0 {
+	count := blk.metadata.Load(MetadataSegmentCount)
+	if count == 0 {
 		return nil
 	}
 
-	count := int(countf)
-	for i := 1; i <= count; i++ {
+	for i := 1; i <= int(count); i++ {
+		sno := int64(i)
+		if _, ok := blk.segmentFiles[sno]; ok {
+			continue
+		}
+
 		fpath := path.Join(blk.BlockPath, "block_"+strconv.Itoa(i))
 		file, err := os.OpenFile(fpath, FileOpenMode, FilePermissions)
 		if err != nil {
 			return err
 		}
 
-		sno := int64(i)
 		blk.segmentFiles[sno] = file
+
+		// segments created before presence and marker files were added
+		// have these files only after they're opened by a writer
+		if err := openOptional(blk.presenceFiles, sno, path.Join(blk.BlockPath, "presence_"+strconv.Itoa(i))); err != nil {
+			return err
+		}
+
+		if err := openOptional(blk.markerFiles, sno, path.Join(blk.BlockPath, "latest_"+strconv.Itoa(i))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// openOptional opens a file of a segment if it's available
+func openOptional(files map[int64]io.ReaderAt, sno int64, fpath string) (err error) {
+	file, err := os.OpenFile(fpath, FileOpenMode, FilePermissions)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
 	}
 
+	files[sno] = file
 	return nil
 }
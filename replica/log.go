@@ -0,0 +1,380 @@
+package replica
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/meteorhacks/kdb/pslice"
+)
+
+const (
+	// default file permissions and modes
+	LogFileMode  = os.O_CREATE | os.O_RDWR | os.O_APPEND
+	LogFilePerms = 0644
+
+	// size of the entry header (entry size as a varint)
+	LogHeaderSize = 8
+
+	// indexes for values stored in the log start file
+	LogStartCount   = 2
+	LogStartOffset  = 0 // position of the first entry in the log file
+	LogStartPending = 1 // start position used by an incomplete truncation
+)
+
+var (
+	ErrLogBytesWritten = errors.New("incorrect number of bytes written to log file")
+	ErrLogInvalidEntry = errors.New("invalid log entry")
+	ErrLogInvalidPos   = errors.New("invalid log position")
+)
+
+// Log is an append only file with all data points accepted by the leader.
+// Followers use the byte offset of the log as their replication position.
+// Old entries are removed with `Truncate`, positions are not changed by it
+// so the position of the first entry in the file is stored separately.
+// Entries are saved in format [header ts values payload], entries without
+// values and payload remove data before `ts` (see Leader.RemoveBefore).
+// * log start file path: LOG_PATH.start
+type Log struct {
+	// path to the log file
+	FilePath string
+
+	file    *os.File
+	start   *pslice.Int64
+	size    int64
+	mutex   *sync.RWMutex
+	changed chan struct{}
+
+	// used to run only one truncation at a time
+	truncMutex *sync.Mutex
+}
+
+// OpenLog opens the log file at given path, the file is created if needed
+// An incomplete truncation is completed or discarded when opening the log.
+func OpenLog(fpath string) (lg *Log, err error) {
+	start, err := pslice.NewInt64(fpath+".start", LogStartCount)
+	if err != nil {
+		return nil, err
+	}
+
+	// the new log file replaced the log file if it's not available
+	tmpPath := fpath + ".tmp"
+	if pending := start.Load(LogStartPending); pending != 0 {
+		if _, err := os.Stat(tmpPath); os.IsNotExist(err) {
+			start.Store(LogStartOffset, pending)
+		}
+
+		start.Store(LogStartPending, 0)
+	}
+
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		start.Close()
+		return nil, err
+	}
+
+	file, err := os.OpenFile(fpath, LogFileMode, LogFilePerms)
+	if err != nil {
+		start.Close()
+		return nil, err
+	}
+
+	finfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		start.Close()
+		return nil, err
+	}
+
+	lg = &Log{
+		FilePath:   fpath,
+		file:       file,
+		start:      start,
+		size:       start.Load(LogStartOffset) + finfo.Size(),
+		mutex:      &sync.RWMutex{},
+		changed:    make(chan struct{}),
+		truncMutex: &sync.Mutex{},
+	}
+
+	return lg, nil
+}
+
+// Append adds a data point to the end of the log
+// and returns the position right after the entry
+func (lg *Log) Append(ts int64, vals []string, pld []byte) (pos int64, err error) {
+	data := EncodeEntry(ts, vals, pld)
+
+	lg.mutex.Lock()
+	defer lg.mutex.Unlock()
+
+	n, err := lg.file.Write(data)
+	if err != nil {
+		return 0, err
+	} else if n != len(data) {
+		return 0, ErrLogBytesWritten
+	}
+
+	lg.size += int64(n)
+
+	// wake up everyone waiting for new entries
+	close(lg.changed)
+	lg.changed = make(chan struct{})
+
+	return lg.size, nil
+}
+
+// ReadAt reads raw log data starting from `pos`
+// it's safe to use while entries are being appended
+// entries removed with `Truncate` can't be read
+func (lg *Log) ReadAt(data []byte, pos int64) (n int, err error) {
+	lg.mutex.RLock()
+	defer lg.mutex.RUnlock()
+
+	start := lg.start.Load(LogStartOffset)
+	if pos < start {
+		return 0, ErrLogInvalidPos
+	}
+
+	return lg.file.ReadAt(data, pos-start)
+}
+
+// Changes returns current size of the log and a channel
+// which will be closed when new entries are appended
+func (lg *Log) Changes() (size int64, ch <-chan struct{}) {
+	lg.mutex.RLock()
+	defer lg.mutex.RUnlock()
+
+	return lg.size, lg.changed
+}
+
+// Size returns the position right after the last entry
+func (lg *Log) Size() (size int64) {
+	lg.mutex.RLock()
+	defer lg.mutex.RUnlock()
+
+	return lg.size
+}
+
+// Start returns the position of the first entry available in the log
+func (lg *Log) Start() (pos int64) {
+	return lg.start.Load(LogStartOffset)
+}
+
+// Truncate removes the oldest entries so the log has at most `keep` bytes.
+// Entries are copied to a new log file which replaces the log file. The
+// position of the first entry is stored before replacing the file so an
+// incomplete truncation can be completed when the log is opened again.
+// Appends are blocked only while copying entries appended meanwhile.
+// * new log file path: LOG_PATH.tmp
+func (lg *Log) Truncate(keep int64) (err error) {
+	lg.truncMutex.Lock()
+	defer lg.truncMutex.Unlock()
+
+	// the file is only replaced by truncations
+	// and existing entries are never modified
+	size := lg.Size()
+	start := lg.Start()
+	if size-start <= keep {
+		return nil
+	}
+
+	from, err := lg.boundary(start, size-keep, size)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := lg.FilePath + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, LogFileMode|os.O_TRUNC, LogFilePerms)
+	if err != nil {
+		return err
+	}
+
+	if err := lg.copyTo(tmp, from-start, size-start); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	lg.mutex.Lock()
+	defer lg.mutex.Unlock()
+
+	// entries appended while copying
+	err = lg.copyTo(tmp, size-start, lg.size-start)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	lg.start.Store(LogStartPending, from)
+
+	if err := os.Rename(tmpPath, lg.FilePath); err != nil {
+		lg.start.Store(LogStartPending, 0)
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	lg.start.Store(LogStartOffset, from)
+	lg.start.Store(LogStartPending, 0)
+
+	lg.file.Close()
+	lg.file = tmp
+
+	return nil
+}
+
+// boundary returns the position of the first entry at or after `pos`
+// entries are read starting from `start` which is an entry position
+func (lg *Log) boundary(start, pos, size int64) (res int64, err error) {
+	reader := bufio.NewReader(io.NewSectionReader(lg.file, 0, size-start))
+	header := make([]byte, LogHeaderSize)
+
+	for res = start; res < pos; {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return 0, err
+		}
+
+		n, err := DecodeHeader(header)
+		if err != nil {
+			return 0, err
+		}
+
+		if _, err := reader.Discard(int(n)); err != nil {
+			return 0, err
+		}
+
+		res += LogHeaderSize + n
+	}
+
+	return res, nil
+}
+
+// copyTo appends log file data between file offsets `from` and `to`
+func (lg *Log) copyTo(file *os.File, from, to int64) (err error) {
+	n, err := io.Copy(file, io.NewSectionReader(lg.file, from, to-from))
+	if err != nil {
+		return err
+	} else if n != to-from {
+		return ErrLogBytesWritten
+	}
+
+	return nil
+}
+
+// close the file handler
+func (lg *Log) Close() (err error) {
+	if err := lg.file.Close(); err != nil {
+		lg.start.Close()
+		return err
+	}
+
+	return lg.start.Close()
+}
+
+// EncodeEntry creates a log entry with header for a data point
+func EncodeEntry(ts int64, vals []string, pld []byte) (data []byte) {
+	size := 8 + binary.MaxVarintLen64*(len(vals)+2) + len(pld)
+	for _, v := range vals {
+		size += len(v)
+	}
+
+	data = make([]byte, LogHeaderSize+size)
+	body := data[LogHeaderSize:]
+
+	binary.LittleEndian.PutUint64(body, uint64(ts))
+	n := 8
+
+	n += binary.PutUvarint(body[n:], uint64(len(vals)))
+	for _, v := range vals {
+		n += binary.PutUvarint(body[n:], uint64(len(v)))
+		n += copy(body[n:], v)
+	}
+
+	n += binary.PutUvarint(body[n:], uint64(len(pld)))
+	n += copy(body[n:], pld)
+
+	binary.PutVarint(data[:LogHeaderSize], int64(n))
+
+	return data[:LogHeaderSize+n]
+}
+
+// IsRemoval checks whether a decoded entry removes data before its
+// timestamp instead of writing a data point
+func IsRemoval(vals []string, pld []byte) (ok bool) {
+	return len(vals) == 0 && len(pld) == 0
+}
+
+// DecodeHeader reads the size of the entry body from the entry header
+func DecodeHeader(header []byte) (size int64, err error) {
+	size, n := binary.Varint(header[:LogHeaderSize])
+	if n <= 0 || size <= 0 {
+		return 0, ErrLogInvalidEntry
+	}
+
+	return size, nil
+}
+
+// DecodeEntry reads a data point from an entry body (without the header)
+func DecodeEntry(body []byte) (ts int64, vals []string, pld []byte, err error) {
+	if len(body) < 8 {
+		return 0, nil, nil, ErrLogInvalidEntry
+	}
+
+	ts = int64(binary.LittleEndian.Uint64(body))
+	body = body[8:]
+
+	count, err := readUvarint(&body)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	vals = make([]string, count)
+	for i := range vals {
+		val, err := readBytes(&body)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+
+		vals[i] = string(val)
+	}
+
+	pld, err = readBytes(&body)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	return ts, vals, pld, nil
+}
+
+func readUvarint(data *[]byte) (val uint64, err error) {
+	val, n := binary.Uvarint(*data)
+	if n <= 0 {
+		return 0, ErrLogInvalidEntry
+	}
+
+	*data = (*data)[n:]
+	return val, nil
+}
+
+func readBytes(data *[]byte) (val []byte, err error) {
+	size, err := readUvarint(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(*data)) < size {
+		return nil, ErrLogInvalidEntry
+	}
+
+	val = (*data)[:size]
+	*data = (*data)[size:]
+
+	return val, nil
+}
@@ -0,0 +1,579 @@
+package replica
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/meteorhacks/kdb"
+	"github.com/meteorhacks/kdb/dbase"
+	"github.com/meteorhacks/kdb/dbucket"
+	"github.com/meteorhacks/kdb/metrics"
+	"github.com/meteorhacks/kdb/pslice"
+)
+
+const (
+	// maximum number of log bytes sent to a follower at once
+	SendChunkSize = 1024 * 1024
+
+	// default time to wait before reconnecting to the leader
+	DefaultRetryInterval = time.Second
+
+	// default maximum size of the replication log
+	DefaultMaxLogSize = 1024 * 1024 * 1024
+
+	// indexes for values stored in the follower position file
+	PositionCount  = 1
+	PositionOffset = 0 // log position of the last applied entry
+)
+
+var (
+	ErrReadOnlyFollower = errors.New("write operation on a follower")
+	ErrLogTruncated     = errors.New("log entries removed before replicated to the follower")
+)
+
+var (
+	// errors returned by the follower database for entries it can't write
+	rejectedErrors = []error{
+		dbase.ErrInvalidTimestamp,
+		dbase.ErrInvalidIndexValues,
+		dbase.ErrInvalidPayload,
+		dbase.ErrRemoveHotBucket,
+		dbucket.ErrOutOfRange,
+	}
+
+	metricSkipped = metrics.NewCounter("kdb_replica_skipped_bytes_total", "number of log bytes removed before replicated to the follower")
+)
+
+type LeaderOptions struct {
+	// address to listen for followers (ex: "localhost:7000")
+	Address string
+
+	// path to the replication log file
+	// defaults to DATA_PATH/DATABASE_NAME.log
+	LogPath string
+
+	// maximum size of the replication log in bytes. Oldest entries are
+	// removed when it grows larger so the log keeps about half of it.
+	// Followers which are further behind miss these entries.
+	// defaults to DefaultMaxLogSize
+	MaxLogSize int64
+
+	// called with errors when removing old log entries
+	// errors are logged with the standard logger if it's not set
+	OnError func(err error)
+}
+
+// Leader accepts writes and streams all accepted data points to followers.
+// Data removed with `RemoveBefore` is also removed from followers. The
+// database rejects writes which are not sent to followers (PutMerge and
+// PutByID) so it should only be written using the leader.
+// Followers send the log position to start from when they connect and
+// the leader sends all log entries after that position as they arrive.
+// The leader replies with the position it starts from which is later
+// than the position sent by the follower if entries were removed.
+type Leader struct {
+	LeaderOptions
+
+	db       *dbase.DBase
+	log      *Log
+	listener net.Listener
+	mutex    *sync.Mutex
+
+	// set while the log is truncated in the background
+	truncating bool
+
+	conns     map[net.Conn]bool
+	connMutex *sync.Mutex
+	done      chan struct{}
+	wg        *sync.WaitGroup
+}
+
+func NewLeader(db *dbase.DBase, opts LeaderOptions) (l *Leader, err error) {
+	if opts.LogPath == "" {
+		opts.LogPath = path.Join(db.DataPath, db.DatabaseName+".log")
+	}
+
+	if opts.MaxLogSize == 0 {
+		opts.MaxLogSize = DefaultMaxLogSize
+	}
+
+	lg, err := OpenLog(opts.LogPath)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", opts.Address)
+	if err != nil {
+		lg.Close()
+		return nil, err
+	}
+
+	db.SetReplicated()
+
+	l = &Leader{
+		LeaderOptions: opts,
+		db:            db,
+		log:           lg,
+		listener:      listener,
+		mutex:         &sync.Mutex{},
+		conns:         make(map[net.Conn]bool),
+		connMutex:     &sync.Mutex{},
+		done:          make(chan struct{}),
+		wg:            &sync.WaitGroup{},
+	}
+
+	l.wg.Add(1)
+	go l.accept()
+
+	return l, nil
+}
+
+// Addr returns the address the leader is listening on
+func (l *Leader) Addr() (addr net.Addr) {
+	return l.listener.Addr()
+}
+
+// Position returns the position right after the last log entry
+func (l *Leader) Position() (pos int64) {
+	return l.log.Size()
+}
+
+// Put writes the data point to the database and adds it to the log.
+// Data points rejected by the database are not sent to followers.
+func (l *Leader) Put(ts int64, vals []string, pld []byte) (err error) {
+	// log entries should be in the same order as writes
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if err := l.db.Put(ts, vals, pld); err != nil {
+		return err
+	}
+
+	return l.append(ts, vals, pld)
+}
+
+// append adds an entry to the log and removes old entries in the
+// background if the log is too large, `mutex` should be locked
+func (l *Leader) append(ts int64, vals []string, pld []byte) (err error) {
+	size, err := l.log.Append(ts, vals, pld)
+	if err != nil {
+		return err
+	}
+
+	if size-l.log.Start() > l.MaxLogSize && !l.truncating {
+		l.truncating = true
+		l.wg.Add(1)
+		go l.truncate()
+	}
+
+	return nil
+}
+
+// truncate removes old log entries in the background
+// so writes are not blocked while the log is copied
+func (l *Leader) truncate() {
+	defer l.wg.Done()
+
+	if err := l.log.Truncate(l.MaxLogSize / 2); err != nil {
+		onError(l.OnError, err)
+	}
+
+	l.mutex.Lock()
+	l.truncating = false
+	l.mutex.Unlock()
+}
+
+func (l *Leader) Get(start, end int64, vals []string) (res [][]byte, err error) {
+	return l.db.Get(start, end, vals)
+}
+
+func (l *Leader) Find(start, end int64, vals []string) (res map[*kdb.IndexElement][][]byte, err error) {
+	return l.db.Find(start, end, vals)
+}
+
+func (l *Leader) Latest(vals []string) (res *kdb.Point, err error) {
+	return l.db.Latest(vals)
+}
+
+func (l *Leader) LatestFind(vals []string) (res map[*kdb.IndexElement]*kdb.Point, err error) {
+	return l.db.LatestFind(vals)
+}
+
+// RemoveBefore removes old data from the database and adds a removal
+// entry to the log so followers remove the same data (see IsRemoval)
+func (l *Leader) RemoveBefore(ts int64) (err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if err := l.db.RemoveBefore(ts); err != nil {
+		return err
+	}
+
+	return l.append(ts, nil, nil)
+}
+
+// Close stops replication and closes the database
+func (l *Leader) Close() (err error) {
+	close(l.done)
+	l.listener.Close()
+
+	l.connMutex.Lock()
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.connMutex.Unlock()
+
+	l.wg.Wait()
+
+	if err := l.log.Close(); err != nil {
+		return err
+	}
+
+	return l.db.Close()
+}
+
+func (l *Leader) accept() {
+	defer l.wg.Done()
+
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+				continue
+			}
+		}
+
+		l.connMutex.Lock()
+		l.conns[conn] = true
+		l.connMutex.Unlock()
+
+		l.wg.Add(1)
+		go l.serve(conn)
+	}
+}
+
+// serve sends log entries to a follower starting
+// from the position sent by the follower
+func (l *Leader) serve(conn net.Conn) {
+	defer l.wg.Done()
+
+	defer func() {
+		l.connMutex.Lock()
+		delete(l.conns, conn)
+		l.connMutex.Unlock()
+		conn.Close()
+	}()
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+
+	pos := int64(binary.LittleEndian.Uint64(header))
+	if pos < 0 || pos > l.log.Size() {
+		return
+	}
+
+	// entries before the log start are not available anymore
+	if start := l.log.Start(); pos < start {
+		pos = start
+	}
+
+	binary.LittleEndian.PutUint64(header, uint64(pos))
+	if _, err := conn.Write(header); err != nil {
+		return
+	}
+
+	data := make([]byte, SendChunkSize)
+
+	for {
+		size, changed := l.log.Changes()
+
+		if pos == size {
+			select {
+			case <-changed:
+				continue
+			case <-l.done:
+				return
+			}
+		}
+
+		count := size - pos
+		if count > SendChunkSize {
+			count = SendChunkSize
+		}
+
+		// the follower reconnects if entries were removed
+		n, err := l.log.ReadAt(data[:count], pos)
+		if err != nil && n == 0 {
+			return
+		}
+
+		if _, err := conn.Write(data[:n]); err != nil {
+			return
+		}
+
+		pos += int64(n)
+	}
+}
+
+type FollowerOptions struct {
+	// address of the leader (ex: "localhost:7000")
+	Address string
+
+	// path to the file used to store replication position
+	// defaults to DATA_PATH/DATABASE_NAME.replica
+	PositionPath string
+
+	// time to wait before reconnecting to the leader
+	RetryInterval time.Duration
+
+	// called with entries rejected by the follower database and with
+	// ErrLogTruncated when log entries are missed by the follower.
+	// Rejected entries are skipped, the follower reconnects on other
+	// errors. Errors are logged with the standard logger if it's not set.
+	OnError func(err error)
+}
+
+// Follower applies data points received from the leader to its own
+// database. Replication continues from the last applied position after
+// a disconnect. Followers only accept read requests from users.
+// Data points older than hot buckets are written with a backfill.
+type Follower struct {
+	FollowerOptions
+
+	db       *dbase.DBase
+	position *pslice.Int64
+	conn     net.Conn
+	mutex    *sync.Mutex
+	done     chan struct{}
+	wg       *sync.WaitGroup
+}
+
+func NewFollower(db *dbase.DBase, opts FollowerOptions) (f *Follower, err error) {
+	if opts.PositionPath == "" {
+		opts.PositionPath = path.Join(db.DataPath, db.DatabaseName+".replica")
+	}
+
+	if opts.RetryInterval == 0 {
+		opts.RetryInterval = DefaultRetryInterval
+	}
+
+	position, err := pslice.NewInt64(opts.PositionPath, PositionCount)
+	if err != nil {
+		return nil, err
+	}
+
+	f = &Follower{
+		FollowerOptions: opts,
+		db:              db,
+		position:        position,
+		mutex:           &sync.Mutex{},
+		done:            make(chan struct{}),
+		wg:              &sync.WaitGroup{},
+	}
+
+	f.wg.Add(1)
+	go f.run()
+
+	return f, nil
+}
+
+// Position returns the log position of the last applied entry
+func (f *Follower) Position() (pos int64) {
+	return f.position.Load(PositionOffset)
+}
+
+func (f *Follower) Put(ts int64, vals []string, pld []byte) (err error) {
+	return ErrReadOnlyFollower
+}
+
+func (f *Follower) Get(start, end int64, vals []string) (res [][]byte, err error) {
+	return f.db.Get(start, end, vals)
+}
+
+func (f *Follower) Find(start, end int64, vals []string) (res map[*kdb.IndexElement][][]byte, err error) {
+	return f.db.Find(start, end, vals)
+}
+
+func (f *Follower) Latest(vals []string) (res *kdb.Point, err error) {
+	return f.db.Latest(vals)
+}
+
+func (f *Follower) LatestFind(vals []string) (res map[*kdb.IndexElement]*kdb.Point, err error) {
+	return f.db.LatestFind(vals)
+}
+
+// RemoveBefore removes old data from the follower database
+// data removed from the leader is not removed automatically
+func (f *Follower) RemoveBefore(ts int64) (err error) {
+	return f.db.RemoveBefore(ts)
+}
+
+// Close stops replication and closes the database
+func (f *Follower) Close() (err error) {
+	close(f.done)
+
+	f.mutex.Lock()
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	f.mutex.Unlock()
+
+	f.wg.Wait()
+
+	if err := f.position.Close(); err != nil {
+		return err
+	}
+
+	return f.db.Close()
+}
+
+// run connects to the leader and reconnects on failures
+func (f *Follower) run() {
+	defer f.wg.Done()
+
+	for {
+		conn, err := net.Dial("tcp", f.Address)
+		if err == nil {
+			f.mutex.Lock()
+			select {
+			case <-f.done:
+				f.mutex.Unlock()
+				conn.Close()
+				return
+			default:
+				f.conn = conn
+			}
+			f.mutex.Unlock()
+
+			f.replicate(conn)
+			conn.Close()
+		}
+
+		select {
+		case <-f.done:
+			return
+		case <-time.After(f.RetryInterval):
+		}
+	}
+}
+
+// replicate sends the current position to the leader
+// and applies all log entries received from the leader
+func (f *Follower) replicate(conn net.Conn) (err error) {
+	pos := f.Position()
+
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint64(header, uint64(pos))
+	if _, err := conn.Write(header); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+
+	if start := int64(binary.LittleEndian.Uint64(header)); start > pos {
+		metricSkipped.Add(start - pos)
+		onError(f.OnError, ErrLogTruncated)
+
+		pos = start
+		f.position.Store(PositionOffset, pos)
+	}
+
+	bf := f.db.NewBackfill()
+	defer func() {
+		if err := bf.Close(); err != nil {
+			onError(f.OnError, err)
+		}
+	}()
+
+	for {
+		// seal old buckets when there are no more entries to write
+		if reader.Buffered() == 0 {
+			if err := bf.Close(); err != nil {
+				onError(f.OnError, err)
+			}
+		}
+
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return err
+		}
+
+		size, err := DecodeHeader(header)
+		if err != nil {
+			return err
+		}
+
+		body := make([]byte, size)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return err
+		}
+
+		ts, vals, pld, err := DecodeEntry(body)
+		if err != nil {
+			return err
+		}
+
+		// the entry is written again after reconnecting
+		// unless it's rejected because of its data
+		if err := f.apply(bf, ts, vals, pld); err != nil {
+			onError(f.OnError, err)
+			if !rejected(err) {
+				return err
+			}
+		}
+
+		pos += LogHeaderSize + size
+		f.position.Store(PositionOffset, pos)
+	}
+}
+
+// apply writes a data point or removes data for a removal entry
+// buckets opened by the backfill are closed before removing data
+func (f *Follower) apply(bf *dbase.Backfill, ts int64, vals []string, pld []byte) (err error) {
+	if !IsRemoval(vals, pld) {
+		return bf.Put(ts, vals, pld)
+	}
+
+	if err := bf.Close(); err != nil {
+		return err
+	}
+
+	return f.db.RemoveBefore(ts)
+}
+
+// rejected checks whether an entry was rejected by the follower database
+// because of its data, these entries can't be written after reconnecting
+func rejected(err error) (ok bool) {
+	for _, e := range rejectedErrors {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// onError reports errors using `fn` if it's set or the standard logger
+func onError(fn func(err error), err error) {
+	if fn != nil {
+		fn(err)
+		return
+	}
+
+	log.Println("kdb:", err)
+}
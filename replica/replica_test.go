@@ -0,0 +1,583 @@
+package replica
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meteorhacks/kdb/clock"
+	"github.com/meteorhacks/kdb/dbase"
+	"github.com/meteorhacks/kdb/payload"
+	"github.com/meteorhacks/kdb/pslice"
+)
+
+func TestEncodeDecodeEntry(t *testing.T) {
+	vals := []string{"a", "b", "c", "d"}
+	pld := []byte{1, 2, 3, 4}
+
+	data := EncodeEntry(1234, vals, pld)
+
+	size, err := DecodeHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size != int64(len(data)-LogHeaderSize) {
+		t.Fatal("incorrect entry size")
+	}
+
+	ts, vals2, pld2, err := DecodeEntry(data[LogHeaderSize:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ts != 1234 || !reflect.DeepEqual(vals, vals2) || !reflect.DeepEqual(pld, pld2) {
+		t.Fatal("incorrect entry")
+	}
+
+	if _, _, _, err := DecodeEntry(data[LogHeaderSize : len(data)-1]); err == nil {
+		t.Fatal("should return an error")
+	}
+}
+
+func TestLog(t *testing.T) {
+	defer cleanTestFiles()
+	cleanTestFiles()
+
+	if err := exec.Command("mkdir", "-p", "/tmp/test-replica").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	lg, err := OpenLog("/tmp/test-replica/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, changed := lg.Changes()
+	if size != 0 {
+		t.Fatal("log should be empty")
+	}
+
+	pos, err := lg.Append(10, []string{"a"}, []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-changed:
+	default:
+		t.Fatal("change channel should be closed")
+	}
+
+	lg.Close()
+
+	lg, err = OpenLog("/tmp/test-replica/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lg.Close()
+
+	if lg.Size() != pos {
+		t.Fatal("log size should be loaded from disk")
+	}
+}
+
+func TestLogTruncate(t *testing.T) {
+	defer cleanTestFiles()
+	cleanTestFiles()
+
+	if err := exec.Command("mkdir", "-p", "/tmp/test-replica").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	lg, err := OpenLog("/tmp/test-replica/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pos []int64
+	for i := 0; i < 10; i++ {
+		p, err := lg.Append(int64(i), []string{"a"}, []byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pos = append(pos, p)
+	}
+
+	size := lg.Size()
+	entry := pos[1] - pos[0]
+
+	// keeps whole entries
+	if err := lg.Truncate(3*entry + 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if lg.Start() != pos[6] || lg.Size() != size {
+		t.Fatal("incorrect log positions", lg.Start(), lg.Size())
+	}
+
+	data := make([]byte, entry)
+	if _, err := lg.ReadAt(data, pos[5]); err != ErrLogInvalidPos {
+		t.Fatal("should return correct error")
+	}
+
+	if _, err := lg.ReadAt(data, pos[6]); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, _, pld, err := DecodeEntry(data[LogHeaderSize:])
+	if err != nil {
+		t.Fatal(err)
+	} else if ts != 7 || !reflect.DeepEqual(pld, []byte{7}) {
+		t.Fatal("incorrect entry")
+	}
+
+	p, err := lg.Append(10, []string{"a"}, []byte{10})
+	if err != nil {
+		t.Fatal(err)
+	} else if p != size+entry {
+		t.Fatal("incorrect position")
+	}
+
+	lg.Close()
+
+	lg, err = OpenLog("/tmp/test-replica/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lg.Start() != pos[6] || lg.Size() != p {
+		t.Fatal("log positions should be loaded from disk")
+	}
+
+	lg.Close()
+
+	// truncation interrupted after replacing the log file
+	start, err := pslice.NewInt64("/tmp/test-replica/log.start", LogStartCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start.Store(LogStartOffset, pos[5])
+	start.Store(LogStartPending, pos[6])
+	start.Close()
+
+	lg, err = OpenLog("/tmp/test-replica/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lg.Start() != pos[6] || lg.Size() != p {
+		t.Fatal("truncation should be completed")
+	}
+
+	lg.Close()
+
+	// truncation interrupted before replacing the log file
+	start, err = pslice.NewInt64("/tmp/test-replica/log.start", LogStartCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start.Store(LogStartPending, pos[8])
+	start.Close()
+
+	if err := ioutil.WriteFile("/tmp/test-replica/log.tmp", []byte{1}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lg, err = OpenLog("/tmp/test-replica/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer lg.Close()
+
+	if lg.Start() != pos[6] || lg.Size() != p {
+		t.Fatal("truncation should be discarded")
+	}
+
+	if _, err := os.Stat("/tmp/test-replica/log.tmp"); !os.IsNotExist(err) {
+		t.Fatal("new log file should be removed")
+	}
+}
+
+func TestReplication(t *testing.T) {
+	defer cleanTestFiles()
+
+	leader, follower, err := createTestReplicas()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vals := []string{"a", "b", "c", "d"}
+	pld1 := []byte{1, 2, 3, 4}
+	pld2 := []byte{5, 6, 7, 8}
+
+	if err := leader.Put(10990, vals, pld1); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForPosition(t, follower, leader.Position())
+
+	res, err := follower.Get(10990, 11000, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{pld1}) {
+		t.Fatal("data should be replicated")
+	}
+
+	if err := follower.Put(10990, vals, pld1); err != ErrReadOnlyFollower {
+		t.Fatal("should return correct error")
+	}
+
+	// write while the follower is offline
+	if err := follower.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := leader.Put(11000, vals, pld2); err != nil {
+		t.Fatal(err)
+	}
+
+	follower, err = createTestFollower(leader.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer follower.Close()
+	defer leader.Close()
+
+	waitForPosition(t, follower, leader.Position())
+
+	res, err = follower.Get(10990, 11010, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{pld1, pld2}) {
+		t.Fatal("follower should catch up")
+	}
+}
+
+func TestReplicationOldBuckets(t *testing.T) {
+	defer cleanTestFiles()
+
+	leader, follower, err := createTestReplicas()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer leader.Close()
+
+	if err := follower.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	vals := []string{"a", "b", "c", "d"}
+	pld := []byte{1, 2, 3, 4}
+
+	if err := leader.Put(11000, vals, pld); err != nil {
+		t.Fatal(err)
+	}
+
+	// the bucket is not hot when the follower catches up
+	clock.Goto(14999)
+
+	var errs []error
+	var mutex sync.Mutex
+	follower, err = createTestFollower(leader.Addr().String(), func(err error) {
+		mutex.Lock()
+		errs = append(errs, err)
+		mutex.Unlock()
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForPosition(t, follower, leader.Position())
+
+	if err := follower.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	mutex.Unlock()
+
+	db, err := dbase.New(testOptions("/tmp/test-replica/follower"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	res, err := db.Get(11000, 11010, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{pld}) {
+		t.Fatal("old data should be replicated")
+	}
+}
+
+func TestReplicationTruncatedLog(t *testing.T) {
+	defer cleanTestFiles()
+	clock.UseTestClock()
+	clock.Goto(11999)
+	cleanTestFiles()
+
+	db, err := dbase.New(testOptions("/tmp/test-replica/leader"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leader, err := NewLeader(db, LeaderOptions{Address: "127.0.0.1:0", MaxLogSize: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer leader.Close()
+
+	vals := []string{"a", "b", "c", "d"}
+	for i := byte(0); i < 20; i++ {
+		if err := leader.Put(11000+int64(i)*10, vals, []byte{i, i, i, i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// old entries are removed in the background
+	for i := 0; i < 500 && leader.log.Start() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if leader.log.Start() == 0 {
+		t.Fatal("old log entries should be removed")
+	} else if leader.Position()-leader.log.Start() > 200 {
+		t.Fatal("log should be smaller than MaxLogSize")
+	}
+
+	skipped := metricSkipped.Value()
+
+	errs := make(chan error, 10)
+	follower, err := createTestFollower(leader.Addr().String(), func(err error) {
+		errs <- err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer follower.Close()
+
+	waitForPosition(t, follower, leader.Position())
+
+	select {
+	case err := <-errs:
+		if err != ErrLogTruncated {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("missed entries should be reported")
+	}
+
+	if metricSkipped.Value()-skipped != leader.log.Start() {
+		t.Fatal("missed bytes should be counted")
+	}
+
+	res, err := follower.Get(11180, 11200, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{{18, 18, 18, 18}, {19, 19, 19, 19}}) {
+		t.Fatal("available entries should be replicated")
+	}
+}
+
+func TestReplicationRejectedEntry(t *testing.T) {
+	defer cleanTestFiles()
+
+	leader, follower, err := createTestReplicas()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer leader.Close()
+
+	if err := follower.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	vals := []string{"a", "b", "c", "d"}
+	pld := []byte{1, 2, 3, 4}
+
+	// an entry the follower database can't write
+	if _, err := leader.log.Append(11000, vals, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := leader.Put(11010, vals, pld); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 10)
+	follower, err = createTestFollower(leader.Addr().String(), func(err error) {
+		errs <- err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer follower.Close()
+
+	waitForPosition(t, follower, leader.Position())
+
+	select {
+	case err := <-errs:
+		if err != dbase.ErrInvalidPayload {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("rejected entries should be reported")
+	}
+
+	res, err := follower.Get(11010, 11020, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{pld}) {
+		t.Fatal("entries after the rejected entry should be replicated")
+	}
+}
+
+func TestReplicationRemoveBefore(t *testing.T) {
+	defer cleanTestFiles()
+
+	leader, follower, err := createTestReplicas()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer leader.Close()
+
+	if err := follower.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	vals := []string{"a", "b", "c", "d"}
+	pld := []byte{1, 2, 3, 4}
+
+	clock.Goto(5999)
+	if err := leader.Put(5000, vals, pld); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Goto(11999)
+	if err := leader.RemoveBefore(10000); err != nil {
+		t.Fatal(err)
+	}
+
+	// the follower writes the data point and removes it again
+	follower, err = createTestFollower(leader.Addr().String(), func(err error) {
+		t.Error(err)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer follower.Close()
+
+	waitForPosition(t, follower, leader.Position())
+
+	if _, err := os.Stat("/tmp/test-replica/follower/test_5000"); !os.IsNotExist(err) {
+		t.Fatal("removed buckets should be removed from followers")
+	}
+
+	res, err := follower.Get(5000, 5010, vals)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{{0, 0, 0, 0}}) {
+		t.Fatal("removed data should be removed from followers")
+	}
+
+	if err := leader.db.PutMerge(11000, vals, pld, payload.AddInt); err != dbase.ErrReplicated {
+		t.Fatal("should return correct error")
+	}
+
+	if err := leader.db.PutByID(11000, 1, pld); err != dbase.ErrReplicated {
+		t.Fatal("should return correct error")
+	}
+}
+
+// ---------- //
+
+func createTestReplicas() (leader *Leader, follower *Follower, err error) {
+	clock.UseTestClock()
+	clock.Goto(11999)
+	cleanTestFiles()
+
+	db, err := dbase.New(testOptions("/tmp/test-replica/leader"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	leader, err = NewLeader(db, LeaderOptions{Address: "127.0.0.1:0"})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	follower, err = createTestFollower(leader.Addr().String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return leader, follower, nil
+}
+
+func createTestFollower(addr string, onError func(err error)) (follower *Follower, err error) {
+	db, err := dbase.New(testOptions("/tmp/test-replica/follower"))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFollower(db, FollowerOptions{
+		Address:       addr,
+		RetryInterval: 10 * time.Millisecond,
+		OnError:       onError,
+	})
+}
+
+func testOptions(dataPath string) (opts dbase.Options) {
+	return dbase.Options{
+		DatabaseName:   "test",
+		DataPath:       dataPath,
+		IndexDepth:     4,
+		PayloadSize:    4,
+		BucketDuration: 1000,
+		Resolution:     10,
+		SegmentSize:    10,
+	}
+}
+
+func waitForPosition(t *testing.T, f *Follower, pos int64) {
+	for i := 0; i < 500; i++ {
+		if f.Position() == pos {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("follower did not reach position", pos)
+}
+
+func cleanTestFiles() {
+	cmd := exec.Command("rm", "-rf", "/tmp/test-replica")
+	cmd.Run()
+}
@@ -0,0 +1,625 @@
+package sblock
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/meteorhacks/kdb"
+	"github.com/meteorhacks/kdb/dblock"
+	"github.com/meteorhacks/kdb/pslice"
+	"github.com/meteorhacks/kdb/rblock"
+)
+
+const (
+	// default file permissions and modes
+	FileOpenMode    = os.O_CREATE | os.O_RDWR | os.O_APPEND
+	FilePermissions = 0744
+
+	MetadataCount = 1
+
+	// indexes for metadata values
+	MetadataRecordCount = 0 // number of records in block
+
+	// size of record and payload positions stored with each entry
+	EntryHeaderSize = 16
+
+	// size of a promoted record entry (sparse and dense record positions)
+	PromotedEntrySize = 16
+
+	// default ratio of payloads which should be filled
+	// before a sparse record is converted to a dense record
+	DefaultFillThreshold = 0.25
+)
+
+var (
+	ErrWriteOnReadOnly = errors.New("write operation on a read only block")
+	ErrInvalidRecord   = errors.New("record does not exist in block")
+	ErrEntryWriteError = errors.New("error while writing to sparse block file")
+	ErrInvalidRange    = errors.New("payload positions are out of record bounds")
+	ErrInvalidPayload  = errors.New("payload is larger than payload size")
+	ErrDenseNotLoaded  = errors.New("dense block is not available")
+)
+
+type Options struct {
+	// path to block files
+	BlockPath string
+
+	// maximum payload size in bytes
+	PayloadSize int64
+
+	// number of payloads in a record
+	PayloadCount int64
+
+	// number of records per segment (used by the dense block)
+	SegmentSize int64
+
+	// ratio of filled payloads (0 - 1) in a record
+	// after which the record is moved to the dense block
+	FillThreshold float64
+
+	// read only block, files will not be created or modified
+	ReadOnly bool
+}
+
+// dense blocks (dblock and rblock) keep track of written payloads
+type presenter interface {
+	Present(rpos, start, end int64) (res []bool, err error)
+}
+
+// dense blocks (dblock and rblock) find the last written payload of records
+type latester interface {
+	Latest(rpos int64) (ppos int64, pld []byte, err error)
+}
+
+// SBlock stores payloads as (position, payload) pairs until the record
+// has enough payloads to be stored efficiently in a dense block (dblock).
+// Sparse payloads are appended to a file and kept in memory, dense records
+// are stored in a `dblock` block created in a sub directory when needed.
+type SBlock struct {
+	Options
+
+	sparseFile   *os.File // file used to store sparse payloads
+	promotedFile *os.File // file used to store dense record positions
+
+	records  map[int64]map[int64][]byte // sparse payloads by rpos and ppos
+	promoted map[int64]int64            // dense record positions by rpos
+
+	dense    kdb.Block     // block with dense records (created when needed)
+	metadata *pslice.Int64 // block metadata
+
+	sparseOffset   int64 // size of sparse payloads file already read
+	promotedOffset int64 // size of promoted records file already read
+
+	entrySize   int64  // size of a sparse entry in bytes
+	threshold   int    // number of payloads needed to promote a record
+	emptyPld    []byte // reusable empty payload used with results
+	mutex       *sync.RWMutex
+	densePath   string
+	sparsePath  string
+	promotePath string
+}
+
+func New(opts Options) (blk *SBlock, err error) {
+	if opts.FillThreshold <= 0 {
+		opts.FillThreshold = DefaultFillThreshold
+	}
+
+	threshold := int(opts.FillThreshold * float64(opts.PayloadCount))
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	blk = &SBlock{
+		Options:     opts,
+		records:     make(map[int64]map[int64][]byte),
+		promoted:    make(map[int64]int64),
+		entrySize:   EntryHeaderSize + opts.PayloadSize,
+		threshold:   threshold,
+		emptyPld:    make([]byte, opts.PayloadSize, opts.PayloadSize),
+		mutex:       &sync.RWMutex{},
+		densePath:   path.Join(opts.BlockPath, "dense"),
+		sparsePath:  path.Join(opts.BlockPath, "sparse"),
+		promotePath: path.Join(opts.BlockPath, "promoted"),
+	}
+
+	if err = blk.load(); err != nil {
+		blk.Close()
+		return nil, err
+	}
+
+	return blk, nil
+}
+
+// New creates a new sparse record and returns its position (rpos)
+func (blk *SBlock) New() (rpos int64, err error) {
+	if blk.ReadOnly {
+		return 0, ErrWriteOnReadOnly
+	}
+
+	return blk.metadata.Add(MetadataRecordCount, 1) - 1, nil
+}
+
+// Put stores a payload `pld` on record `rpos` at position `ppos`
+// Sparse records are moved to the dense block when they have
+// more payloads than the threshold set with `FillThreshold`.
+// Errors with the record are returned as `*kdb.RecordError`.
+func (blk *SBlock) Put(rpos, ppos int64, pld []byte) (err error) {
+	if blk.ReadOnly {
+		return ErrWriteOnReadOnly
+	}
+
+	if ppos < 0 || ppos >= blk.PayloadCount {
+		return &kdb.RecordError{Record: rpos, Err: ErrInvalidRange}
+	}
+
+	if int64(len(pld)) > blk.PayloadSize {
+		return &kdb.RecordError{Record: rpos, Err: ErrInvalidPayload}
+	}
+
+	blk.mutex.Lock()
+	defer blk.mutex.Unlock()
+
+	if drpos, ok := blk.promoted[rpos]; ok {
+		dense, err := blk.denseBlock(rpos)
+		if err != nil {
+			return err
+		}
+
+		return dense.Put(drpos, ppos, pld)
+	}
+
+	if err := blk.checkRecord(rpos); err != nil {
+		return err
+	}
+
+	return blk.putSparse(rpos, ppos, pld)
+}
+
+// Merge combines payload `pld` with the payload stored on record `rpos` at
+// position `ppos` using `fn` and stores the result. Writes are done one at
+// a time so other writes to the payload are not lost while merging.
+// Errors with the record are returned as `*kdb.RecordError`.
+func (blk *SBlock) Merge(rpos, ppos int64, pld []byte, fn kdb.MergeFunc) (err error) {
+	if blk.ReadOnly {
+		return ErrWriteOnReadOnly
+	}
+
+	if ppos < 0 || ppos >= blk.PayloadCount {
+		return &kdb.RecordError{Record: rpos, Err: ErrInvalidRange}
+	}
+
+	if int64(len(pld)) > blk.PayloadSize {
+		return &kdb.RecordError{Record: rpos, Err: ErrInvalidPayload}
+	}
+
+	blk.mutex.Lock()
+	defer blk.mutex.Unlock()
+
+	if drpos, ok := blk.promoted[rpos]; ok {
+		dense, err := blk.denseBlock(rpos)
+		if err != nil {
+			return err
+		}
+
+		return dense.(*dblock.DBlock).Merge(drpos, ppos, pld, fn)
+	}
+
+	if err := blk.checkRecord(rpos); err != nil {
+		return err
+	}
+
+	old := make([]byte, blk.PayloadSize)
+	copy(old, blk.records[rpos][ppos])
+
+	res, err := fn(old, pld)
+	if err != nil {
+		return &kdb.RecordError{Record: rpos, Err: err}
+	} else if int64(len(res)) > blk.PayloadSize {
+		return &kdb.RecordError{Record: rpos, Err: ErrInvalidPayload}
+	}
+
+	return blk.putSparse(rpos, ppos, res)
+}
+
+// putSparse appends the payload to the sparse payloads file
+// and promotes the record if it has enough payloads
+func (blk *SBlock) putSparse(rpos, ppos int64, pld []byte) (err error) {
+	entry := make([]byte, blk.entrySize, blk.entrySize)
+	binary.LittleEndian.PutUint64(entry[0:], uint64(rpos))
+	binary.LittleEndian.PutUint64(entry[8:], uint64(ppos))
+	copy(entry[EntryHeaderSize:], pld)
+
+	if err := blk.write(blk.sparseFile, entry); err != nil {
+		return err
+	}
+
+	blk.setPayload(rpos, ppos, entry[EntryHeaderSize:])
+
+	if len(blk.records[rpos]) > blk.threshold {
+		return blk.promote(rpos)
+	}
+
+	return nil
+}
+
+// Get reads payloads from `start` to `end` on a record `rpos`
+// Empty payloads are used where the sparse record doesn't have data.
+// Errors with the record are returned as `*kdb.RecordError`.
+func (blk *SBlock) Get(rpos, start, end int64) (res [][]byte, err error) {
+	if start < 0 || end > blk.PayloadCount || start > end {
+		return nil, &kdb.RecordError{Record: rpos, Err: ErrInvalidRange}
+	}
+
+	blk.mutex.RLock()
+	defer blk.mutex.RUnlock()
+
+	if drpos, ok := blk.promoted[rpos]; ok {
+		dense, err := blk.denseBlock(rpos)
+		if err != nil {
+			return nil, err
+		}
+
+		return dense.Get(drpos, start, end)
+	}
+
+	if err := blk.checkRecord(rpos); err != nil {
+		return nil, err
+	}
+
+	count := end - start
+	res = make([][]byte, count, count)
+	for i := range res {
+		res[i] = blk.emptyPld
+	}
+
+	for ppos, pld := range blk.records[rpos] {
+		if ppos >= start && ppos < end {
+			res[ppos-start] = pld
+		}
+	}
+
+	return res, nil
+}
+
+// Present reports which payloads from `start` to `end` on a record `rpos`
+// were written. Payloads of promoted records are checked with the dense block.
+// Errors with the record are returned as `*kdb.RecordError`.
+func (blk *SBlock) Present(rpos, start, end int64) (res []bool, err error) {
+	if start < 0 || end > blk.PayloadCount || start > end {
+		return nil, &kdb.RecordError{Record: rpos, Err: ErrInvalidRange}
+	}
+
+	blk.mutex.RLock()
+	defer blk.mutex.RUnlock()
+
+	if drpos, ok := blk.promoted[rpos]; ok {
+		dense, err := blk.denseBlock(rpos)
+		if err != nil {
+			return nil, err
+		}
+
+		return dense.(presenter).Present(drpos, start, end)
+	}
+
+	if err := blk.checkRecord(rpos); err != nil {
+		return nil, err
+	}
+
+	res = make([]bool, end-start)
+	for ppos := range blk.records[rpos] {
+		if ppos >= start && ppos < end {
+			res[ppos-start] = true
+		}
+	}
+
+	return res, nil
+}
+
+// Latest returns the payload with the highest position written on a record
+// `rpos` and its position, `ppos` is -1 if nothing is written on the record.
+// Errors with the record are returned as `*kdb.RecordError`.
+func (blk *SBlock) Latest(rpos int64) (ppos int64, pld []byte, err error) {
+	blk.mutex.RLock()
+	defer blk.mutex.RUnlock()
+
+	if drpos, ok := blk.promoted[rpos]; ok {
+		dense, err := blk.denseBlock(rpos)
+		if err != nil {
+			return -1, nil, err
+		}
+
+		return dense.(latester).Latest(drpos)
+	}
+
+	if err := blk.checkRecord(rpos); err != nil {
+		return -1, nil, err
+	}
+
+	ppos = -1
+	for p, val := range blk.records[rpos] {
+		if p > ppos {
+			ppos, pld = p, val
+		}
+	}
+
+	return ppos, pld, nil
+}
+
+// Trim removes preallocated space from the dense block if it's available
+func (blk *SBlock) Trim() (err error) {
+	blk.mutex.Lock()
+	defer blk.mutex.Unlock()
+
+	if d, ok := blk.dense.(*dblock.DBlock); ok {
+		return d.Trim()
+	}
+
+	return nil
+}
+
+// close all file handlers
+func (blk *SBlock) Close() (err error) {
+	if blk.sparseFile != nil {
+		if err := blk.sparseFile.Close(); err != nil {
+			return err
+		}
+	}
+
+	if blk.promotedFile != nil {
+		if err := blk.promotedFile.Close(); err != nil {
+			return err
+		}
+	}
+
+	if blk.dense != nil {
+		if err := blk.dense.Close(); err != nil {
+			return err
+		}
+	}
+
+	if blk.metadata != nil {
+		if err := blk.metadata.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// promote moves all payloads of a sparse record to a new dense record
+// the record is marked as promoted only after all payloads are copied
+func (blk *SBlock) promote(rpos int64) (err error) {
+	if blk.dense == nil {
+		if err := blk.loadDense(); err != nil {
+			return err
+		}
+	}
+
+	drpos, err := blk.dense.New()
+	if err != nil {
+		return err
+	}
+
+	for ppos, pld := range blk.records[rpos] {
+		if err := blk.dense.Put(drpos, ppos, pld); err != nil {
+			return err
+		}
+	}
+
+	entry := make([]byte, PromotedEntrySize, PromotedEntrySize)
+	binary.LittleEndian.PutUint64(entry[0:], uint64(rpos))
+	binary.LittleEndian.PutUint64(entry[8:], uint64(drpos))
+
+	if err := blk.write(blk.promotedFile, entry); err != nil {
+		return err
+	}
+
+	blk.promoted[rpos] = drpos
+	delete(blk.records, rpos)
+
+	return nil
+}
+
+// denseBlock returns the dense block used by the promoted record `rpos`.
+// Read only blocks don't have it if it was partially created by another
+// process when loading, it's loaded again when refreshing (see readNew).
+func (blk *SBlock) denseBlock(rpos int64) (dense kdb.Block, err error) {
+	if blk.dense == nil {
+		return nil, &kdb.RecordError{Record: rpos, Err: ErrDenseNotLoaded}
+	}
+
+	return blk.dense, nil
+}
+
+func (blk *SBlock) setPayload(rpos, ppos int64, pld []byte) {
+	plds, ok := blk.records[rpos]
+	if !ok {
+		plds = make(map[int64][]byte)
+		blk.records[rpos] = plds
+	}
+
+	plds[ppos] = pld
+}
+
+func (blk *SBlock) checkRecord(rpos int64) (err error) {
+	if rpos < 0 || rpos >= blk.metadata.Load(MetadataRecordCount) {
+		return &kdb.RecordError{Record: rpos, Err: ErrInvalidRecord}
+	}
+
+	return nil
+}
+
+func (blk *SBlock) write(file *os.File, data []byte) (err error) {
+	n, err := file.Write(data)
+	if err != nil {
+		return err
+	} else if n != len(data) {
+		return ErrEntryWriteError
+	}
+
+	return nil
+}
+
+// load reads metadata, sparse payloads and promoted records from disk
+// * metadata file path: BLOCK_PATH/metadata
+// * sparse payloads file path: BLOCK_PATH/sparse
+// * promoted records file path: BLOCK_PATH/promoted
+// * dense block path: BLOCK_PATH/dense
+func (blk *SBlock) load() (err error) {
+	metadataPath := path.Join(blk.BlockPath, "metadata")
+
+	mode := FileOpenMode
+	if blk.ReadOnly {
+		mode = os.O_RDONLY
+
+		// read only blocks must not create or modify files
+		blk.metadata, err = pslice.OpenInt64(metadataPath, MetadataCount)
+	} else {
+		blk.metadata, err = pslice.NewInt64(metadataPath, MetadataCount)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	blk.sparseFile, err = os.OpenFile(blk.sparsePath, mode, FilePermissions)
+	if err != nil {
+		return err
+	}
+
+	blk.promotedFile, err = os.OpenFile(blk.promotePath, mode, FilePermissions)
+	if err != nil {
+		return err
+	}
+
+	return blk.readNew()
+}
+
+// Refresh loads payloads and records added by other processes
+// It's only useful with read only blocks, other blocks are not changed.
+func (blk *SBlock) Refresh() (err error) {
+	if !blk.ReadOnly {
+		return nil
+	}
+
+	blk.mutex.Lock()
+	defer blk.mutex.Unlock()
+
+	return blk.readNew()
+}
+
+// readNew reads sparse payloads and promoted records written after the
+// last read and opens the dense block if it's created after loading
+func (blk *SBlock) readNew() (err error) {
+	blk.sparseOffset, err = blk.readEntries(blk.sparseFile, blk.sparseOffset, blk.entrySize, func(entry []byte) {
+		rpos := int64(binary.LittleEndian.Uint64(entry[0:]))
+		ppos := int64(binary.LittleEndian.Uint64(entry[8:]))
+
+		// payloads of promoted records are read from the dense block
+		if _, ok := blk.promoted[rpos]; !ok {
+			blk.setPayload(rpos, ppos, entry[EntryHeaderSize:])
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	blk.promotedOffset, err = blk.readEntries(blk.promotedFile, blk.promotedOffset, PromotedEntrySize, func(entry []byte) {
+		rpos := int64(binary.LittleEndian.Uint64(entry[0:]))
+		drpos := int64(binary.LittleEndian.Uint64(entry[8:]))
+		blk.promoted[rpos] = drpos
+		delete(blk.records, rpos)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if blk.dense != nil {
+		return nil
+	}
+
+	if _, err := os.Stat(blk.densePath); err != nil {
+		return nil
+	}
+
+	// the dense block may be partially created by another process
+	// read only blocks will try to load it again when refreshing
+	err = blk.loadDense()
+	if blk.ReadOnly && (os.IsNotExist(err) || err == pslice.ErrFileTooSmall) {
+		return nil
+	}
+
+	return err
+}
+
+// readEntries reads fixed size entries from the file starting at `offset`
+// and returns the offset after the last entry. Incomplete entries at the
+// end of the file (if any) will be ignored.
+func (blk *SBlock) readEntries(file *os.File, offset, size int64, fn func(entry []byte)) (next int64, err error) {
+	finfo, err := file.Stat()
+	if err != nil {
+		return offset, err
+	}
+
+	count := (finfo.Size() - offset) / size
+	if count <= 0 {
+		return offset, nil
+	}
+
+	data := make([]byte, count*size)
+
+	if _, err := file.ReadAt(data, offset); err != nil && err != io.EOF {
+		return offset, err
+	}
+
+	var i int64
+	for i = 0; i < count; i++ {
+		fn(data[i*size : (i+1)*size])
+	}
+
+	return offset + count*size, nil
+}
+
+// loadDense opens the dense block, a new dense block
+// will be created if it's not available on disk
+func (blk *SBlock) loadDense() (err error) {
+	if blk.ReadOnly {
+		dense, err := rblock.New(rblock.Options{
+			BlockPath:    blk.densePath,
+			PayloadSize:  blk.PayloadSize,
+			PayloadCount: blk.PayloadCount,
+			SegmentSize:  blk.SegmentSize,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		blk.dense = dense
+		return nil
+	}
+
+	if err := os.MkdirAll(blk.densePath, FilePermissions); err != nil {
+		return err
+	}
+
+	dense, err := dblock.New(dblock.Options{
+		BlockPath:    blk.densePath,
+		PayloadSize:  blk.PayloadSize,
+		PayloadCount: blk.PayloadCount,
+		SegmentSize:  blk.SegmentSize,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	blk.dense = dense
+	return nil
+}
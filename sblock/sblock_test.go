@@ -0,0 +1,516 @@
+package sblock
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestNewSBlockNewData(t *testing.T) {
+	defer cleanTestFiles()
+
+	blk, err := createTestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer blk.Close()
+
+	if blk.dense != nil {
+		t.Fatal("dense block should be created only when needed")
+	}
+
+	if _, err := os.Stat("/tmp/test-sblock/dense"); !os.IsNotExist(err) {
+		t.Fatal("dense block files should not be created")
+	}
+
+	if blk.threshold != 2 {
+		t.Fatal("threshold should be FillThreshold x PayloadCount")
+	}
+}
+
+func TestNewRecord(t *testing.T) {
+	defer cleanTestFiles()
+
+	blk, err := createTestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer blk.Close()
+
+	for i := 0; i < 5; i++ {
+		if rpos, err := blk.New(); err != nil {
+			t.Fatal(err)
+		} else if rpos != int64(i) {
+			t.Fatal("incorrect rpos")
+		}
+	}
+}
+
+func TestPutAndGet(t *testing.T) {
+	defer cleanTestFiles()
+
+	blk, err := createTestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer blk.Close()
+
+	rpos, err := blk.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pld0 := []byte{0, 0, 0, 0}
+	pld1 := []byte{1, 2, 3, 4}
+	if err := blk.Put(rpos, 2, pld1); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := blk.Get(rpos, 1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := [][]byte{pld0, pld1, pld0}
+	if !reflect.DeepEqual(res, exp) {
+		t.Fatal("invalid result")
+	}
+
+	if _, ok := blk.promoted[rpos]; ok {
+		t.Fatal("record should not be promoted")
+	}
+
+	if err := blk.Put(rpos+1, 2, pld1); !errors.Is(err, ErrInvalidRecord) {
+		t.Fatal("should return correct error")
+	}
+}
+
+func TestPromote(t *testing.T) {
+	defer cleanTestFiles()
+
+	blk, err := createTestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rpos, err := blk.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pld := []byte{1, 2, 3, 4}
+	for i := 0; i < 3; i++ {
+		if err := blk.Put(rpos, int64(i), pld); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := blk.promoted[rpos]; !ok {
+		t.Fatal("record should be promoted")
+	}
+
+	// write directly to the dense record
+	if err := blk.Put(rpos, 5, pld); err != nil {
+		t.Fatal(err)
+	}
+
+	pld0 := []byte{0, 0, 0, 0}
+	exp := [][]byte{pld, pld, pld, pld0, pld0, pld}
+
+	res, err := blk.Get(rpos, 0, 6)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, exp) {
+		t.Fatal("invalid result")
+	}
+
+	if err := blk.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// promoted records should be loaded from disk
+	blk, err = New(blk.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer blk.Close()
+
+	res, err = blk.Get(rpos, 0, 6)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, exp) {
+		t.Fatal("invalid result")
+	}
+}
+
+func TestPresent(t *testing.T) {
+	defer cleanTestFiles()
+
+	blk, err := createTestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer blk.Close()
+
+	rpos, err := blk.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := blk.Put(rpos, 1, []byte{0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := blk.Present(rpos, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, []bool{false, true, false}) {
+		t.Fatal("invalid result")
+	}
+
+	// promote the record to the dense block
+	for ppos := int64(4); ppos <= 5; ppos++ {
+		if err := blk.Put(rpos, ppos, []byte{1, 2, 3, 4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := blk.promoted[rpos]; !ok {
+		t.Fatal("record should be promoted")
+	}
+
+	res, err = blk.Present(rpos, 0, 6)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, []bool{false, true, false, false, true, true}) {
+		t.Fatal("invalid result")
+	}
+}
+
+func TestLatest(t *testing.T) {
+	defer cleanTestFiles()
+
+	blk, err := createTestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer blk.Close()
+
+	rpos, err := blk.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ppos, _, err := blk.Latest(rpos); err != nil {
+		t.Fatal(err)
+	} else if ppos != -1 {
+		t.Fatal("empty records should not have a payload")
+	}
+
+	pld1 := []byte{1, 2, 3, 4}
+	pld2 := []byte{5, 6, 7, 8}
+
+	if err := blk.Put(rpos, 3, pld1); err != nil {
+		t.Fatal(err)
+	} else if err := blk.Put(rpos, 1, pld2); err != nil {
+		t.Fatal(err)
+	}
+
+	if ppos, pld, err := blk.Latest(rpos); err != nil {
+		t.Fatal(err)
+	} else if ppos != 3 || !reflect.DeepEqual(pld, pld1) {
+		t.Fatal("invalid result")
+	}
+
+	// promote the record to the dense block
+	if err := blk.Put(rpos, 0, pld2); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := blk.promoted[rpos]; !ok {
+		t.Fatal("record should be promoted")
+	}
+
+	if ppos, pld, err := blk.Latest(rpos); err != nil {
+		t.Fatal(err)
+	} else if ppos != 3 || !reflect.DeepEqual(pld, pld1) {
+		t.Fatal("invalid result")
+	}
+
+	if err := blk.Put(rpos, 7, pld2); err != nil {
+		t.Fatal(err)
+	}
+
+	if ppos, pld, err := blk.Latest(rpos); err != nil {
+		t.Fatal(err)
+	} else if ppos != 7 || !reflect.DeepEqual(pld, pld2) {
+		t.Fatal("invalid result")
+	}
+
+	if _, _, err := blk.Latest(rpos + 1); !errors.Is(err, ErrInvalidRecord) {
+		t.Fatal("should return correct error")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	defer cleanTestFiles()
+
+	blk, err := createTestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer blk.Close()
+
+	rpos, err := blk.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := func(old, new []byte) ([]byte, error) {
+		res := make([]byte, len(old))
+		for i := range old {
+			res[i] = old[i] + new[i]
+		}
+
+		return res, nil
+	}
+
+	pld := []byte{1, 2, 3, 4}
+	for i := 0; i < 2; i++ {
+		if err := blk.Merge(rpos, 0, pld, sum); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// promote the record to the dense block
+	for ppos := int64(1); ppos <= 3; ppos++ {
+		if err := blk.Put(rpos, ppos, pld); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := blk.promoted[rpos]; !ok {
+		t.Fatal("record should be promoted")
+	}
+
+	if err := blk.Merge(rpos, 0, pld, sum); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := blk.Get(rpos, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(res[0], []byte{3, 6, 9, 12}) {
+		t.Fatal("incorrect result")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	defer cleanTestFiles()
+
+	blk, err := createTestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rpos1, _ := blk.New()
+	rpos2, _ := blk.New()
+
+	pld := []byte{1, 2, 3, 4}
+	if err := blk.Put(rpos1, 4, pld); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := blk.Put(rpos2, int64(i), pld); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := blk.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := blk.Options
+	opts.ReadOnly = true
+
+	blk, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer blk.Close()
+
+	res, err := blk.Get(rpos1, 4, 5)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{pld}) {
+		t.Fatal("invalid result")
+	}
+
+	res, err = blk.Get(rpos2, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, [][]byte{pld, pld, pld}) {
+		t.Fatal("invalid result")
+	}
+
+	if err := blk.Put(rpos1, 5, pld); err != ErrWriteOnReadOnly {
+		t.Fatal("should return correct error")
+	}
+
+	if _, err := blk.New(); err != ErrWriteOnReadOnly {
+		t.Fatal("should return correct error")
+	}
+}
+
+func TestReadOnlyPartialDense(t *testing.T) {
+	defer cleanTestFiles()
+
+	blk, err := createTestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rpos, _ := blk.New()
+
+	// promote the record to the dense block
+	pld := []byte{1, 2, 3, 4}
+	for i := 0; i < 3; i++ {
+		if err := blk.Put(rpos, int64(i), pld); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := blk.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the dense block is partially created by another process
+	if err := os.Truncate("/tmp/test-sblock/dense/metadata", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := blk.Options
+	opts.ReadOnly = true
+
+	blk, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer blk.Close()
+
+	if _, err := blk.Get(rpos, 0, 3); !errors.Is(err, ErrDenseNotLoaded) {
+		t.Fatal("should return correct error")
+	}
+
+	if _, err := blk.Present(rpos, 0, 3); !errors.Is(err, ErrDenseNotLoaded) {
+		t.Fatal("should return correct error")
+	}
+
+	if _, _, err := blk.Latest(rpos); !errors.Is(err, ErrDenseNotLoaded) {
+		t.Fatal("should return correct error")
+	}
+}
+
+// TODO: randomize without affecting the benchmark
+func BenchmarkPut(b *testing.B) {
+	defer cleanTestFiles()
+
+	blk, err := createTestBlock()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer blk.Close()
+
+	rpos, err := blk.New()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	pld := []byte{1, 2, 3, 4}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		blk.Put(rpos, 2, pld)
+	}
+}
+
+// TODO: randomize without affecting the benchmark
+func BenchmarkGet(b *testing.B) {
+	defer cleanTestFiles()
+
+	blk, err := createTestBlock()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer blk.Close()
+
+	rpos, err := blk.New()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	pld := []byte{1, 2, 3, 4}
+	if err := blk.Put(rpos, 2, pld); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		blk.Get(rpos, 0, 10)
+	}
+}
+
+// ---------- //
+
+// create a SBlock with test settings
+func createTestBlock() (blk *SBlock, err error) {
+	cmd := exec.Command("rm", "-rf", "/tmp/test-sblock")
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll("/tmp/test-sblock", 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	blk, err = New(Options{
+		BlockPath:     "/tmp/test-sblock",
+		PayloadSize:   4,
+		PayloadCount:  10,
+		SegmentSize:   100,
+		FillThreshold: 0.2,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if blk == nil {
+		err = errors.New("block should not be nil")
+		return nil, err
+	}
+
+	return blk, nil
+}
+
+func cleanTestFiles() {
+	cmd := exec.Command("rm", "-rf", "/tmp/test-sblock")
+	cmd.Run()
+}
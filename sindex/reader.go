@@ -0,0 +1,118 @@
+package sindex
+
+import (
+	"encoding/binary"
+
+	"github.com/meteorhacks/kdb"
+)
+
+// reader decodes a record of the sealed index file
+// `err` is set if the record is outside file data
+type reader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *reader) uint64() (n uint64) {
+	if r.err != nil || r.pos+8 > len(r.data) {
+		r.err = ErrInvalidFile
+		return 0
+	}
+
+	n = binary.LittleEndian.Uint64(r.data[r.pos:])
+	r.pos += 8
+	return n
+}
+
+func (r *reader) uvarint() (n uint64) {
+	if r.err != nil {
+		return 0
+	}
+
+	n, size := binary.Uvarint(r.data[r.pos:])
+	if size <= 0 {
+		r.err = ErrInvalidFile
+		return 0
+	}
+
+	r.pos += size
+	return n
+}
+
+// bytes returns a length prefixed value without copying it
+func (r *reader) bytes() (b []byte) {
+	size := r.uvarint()
+	if r.err != nil || size > uint64(len(r.data)-r.pos) {
+		r.err = ErrInvalidFile
+		return nil
+	}
+
+	b = r.data[r.pos : r.pos+int(size)]
+	r.pos += int(size)
+	return b
+}
+
+// str returns a copy of a length prefixed value
+func (r *reader) str() (s string) {
+	return string(r.bytes())
+}
+
+// compare compares values of a series record with `vals` (see compare)
+// If `prefix` is set, series starting with `vals` are equal to `vals`.
+// The record is read with a copy so it can be read again.
+func (rd *reader) compare(vals []string, prefix bool) (cmp int, err error) {
+	r := *rd
+	r.uint64()
+	count := r.uvarint()
+
+	for i := uint64(0); i < count; i++ {
+		if i == uint64(len(vals)) {
+			if prefix {
+				return 0, r.err
+			}
+
+			return 1, r.err
+		}
+
+		// the conversion does not copy the value
+		v := r.bytes()
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		if s := string(v); s != vals[i] {
+			if s < vals[i] {
+				return -1, nil
+			}
+
+			return 1, nil
+		}
+	}
+
+	if count < uint64(len(vals)) {
+		return -1, r.err
+	}
+
+	return 0, r.err
+}
+
+// element returns an index element with a series record
+func (r *reader) element() (el *kdb.IndexElement, err error) {
+	pos := int64(r.uint64())
+	count := r.uvarint()
+	if r.err != nil || count > uint64(len(r.data)-r.pos) {
+		return nil, ErrInvalidFile
+	}
+
+	vals := make([]string, count)
+	for i := range vals {
+		vals[i] = r.str()
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return &kdb.IndexElement{Values: vals, Position: pos}, nil
+}
@@ -0,0 +1,512 @@
+package sindex
+
+//  # Sealed Index
+//  A read only index stored as a sorted table of series. It's written when
+//  a bucket will not receive more writes and opened by read only buckets
+//  without loading index elements into memory. Series are found with a
+//  binary search over the mmaped file.
+//
+//  header:  magic (8) | flags (8) | index size (8) | series count (8) |
+//           label count (8)
+//  offsets: offset of each series (8 each) sorted by index values
+//           offset of each label (8 each) sorted by label (`Labels` only)
+//  series:  record position (8) | value count | (value length | value)...
+//  labels:  label length | label | series count | series number...
+//
+//  Integers are little endian, counts and lengths are unsigned varints.
+//  Series numbers of a label are sorted (positions in the series table).
+//
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"sort"
+	"syscall"
+
+	"github.com/meteorhacks/kdb"
+	"github.com/meteorhacks/kdb/mindex"
+)
+
+const (
+	// default file permissions
+	FilePermissions = 0644
+
+	HeaderSize = 40
+
+	// flags stored in the header
+	FlagLabels = 1 // series are indexed by labels
+)
+
+var (
+	Magic = []byte("KDBSIDX1")
+
+	ErrInvalidFile = errors.New("invalid sealed index file")
+	ErrStale       = errors.New("sealed index does not match the index file")
+	ErrReadOnly    = errors.New("write operation on a sealed index")
+)
+
+type Options struct {
+	// path to the sealed index file
+	FilePath string
+
+	// size of the index file used to create the sealed index
+	// sealed indexes created with a different index are not used
+	IndexSize int64
+
+	// index series by sets of labels (see mindex.MIndexOpts)
+	Labels bool
+}
+
+// SIndex is a sealed index read from file data (usually mmaped)
+type SIndex struct {
+	Options
+	data   []byte // sealed index file data
+	mmaped bool   // data should be unmapped when closing
+	count  int64  // number of series
+	labels int64  // number of labels (`Labels` only)
+}
+
+// New opens a sealed index file. ErrStale is returned if it was not created
+// with an index file with the size `IndexSize`.
+func New(opts Options) (idx *SIndex, err error) {
+	file, err := os.Open(opts.FilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// the file is not needed after mmaping it
+	defer file.Close()
+
+	finfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if finfo.Size() < HeaderSize {
+		return nil, ErrInvalidFile
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(finfo.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	idx, err = NewFromData(opts, data)
+	if err != nil {
+		syscall.Munmap(data)
+		return nil, err
+	}
+
+	idx.mmaped = true
+	return idx, nil
+}
+
+// NewFromData creates a sealed index using sealed index file data
+// useful when the file is not available as a separate file on disk
+func NewFromData(opts Options, data []byte) (idx *SIndex, err error) {
+	if len(data) < HeaderSize || !bytes.Equal(data[:8], Magic) {
+		return nil, ErrInvalidFile
+	}
+
+	flags := binary.LittleEndian.Uint64(data[8:])
+	if (flags&FlagLabels != 0) != opts.Labels {
+		return nil, ErrInvalidFile
+	}
+
+	if int64(binary.LittleEndian.Uint64(data[16:])) != opts.IndexSize {
+		return nil, ErrStale
+	}
+
+	count := binary.LittleEndian.Uint64(data[24:])
+	labels := binary.LittleEndian.Uint64(data[32:])
+	if (count+labels)*8 > uint64(len(data)-HeaderSize) {
+		return nil, ErrInvalidFile
+	}
+
+	idx = &SIndex{
+		Options: opts,
+		data:    data,
+		count:   int64(count),
+		labels:  int64(labels),
+	}
+
+	return idx, nil
+}
+
+// Write creates a sealed index file with index elements. The file is written
+// to a temporary file first so a partially written file is never used.
+func Write(opts Options, els []*kdb.IndexElement) (err error) {
+	els = append([]*kdb.IndexElement(nil), els...)
+	sort.Slice(els, func(i, j int) bool {
+		return compare(els[i].Values, els[j].Values) < 0
+	})
+
+	var flags uint64
+	var labels []string
+	postings := make(map[string][]int)
+
+	if opts.Labels {
+		flags |= FlagLabels
+
+		for i, el := range els {
+			for _, l := range el.Values {
+				if _, ok := postings[l]; !ok {
+					labels = append(labels, l)
+				}
+
+				postings[l] = append(postings[l], i)
+			}
+		}
+
+		sort.Strings(labels)
+	}
+
+	offsets := make([]uint64, 0, len(els)+len(labels))
+	body := make([]byte, 0)
+	start := uint64(HeaderSize + 8*(len(els)+len(labels)))
+
+	for _, el := range els {
+		offsets = append(offsets, start+uint64(len(body)))
+		body = binary.LittleEndian.AppendUint64(body, uint64(el.Position))
+		body = binary.AppendUvarint(body, uint64(len(el.Values)))
+		for _, v := range el.Values {
+			body = appendString(body, v)
+		}
+	}
+
+	for _, l := range labels {
+		offsets = append(offsets, start+uint64(len(body)))
+		body = appendString(body, l)
+		body = binary.AppendUvarint(body, uint64(len(postings[l])))
+		for _, n := range postings[l] {
+			body = binary.AppendUvarint(body, uint64(n))
+		}
+	}
+
+	data := make([]byte, 0, int(start)+len(body))
+	data = append(data, Magic...)
+	data = binary.LittleEndian.AppendUint64(data, flags)
+	data = binary.LittleEndian.AppendUint64(data, uint64(opts.IndexSize))
+	data = binary.LittleEndian.AppendUint64(data, uint64(len(els)))
+	data = binary.LittleEndian.AppendUint64(data, uint64(len(labels)))
+	for _, off := range offsets {
+		data = binary.LittleEndian.AppendUint64(data, off)
+	}
+
+	data = append(data, body...)
+
+	tmpPath := opts.FilePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, FilePermissions); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, opts.FilePath)
+}
+
+// Add is not supported with sealed indexes
+func (idx *SIndex) Add(vals []string, rpos int64) (el *kdb.IndexElement, err error) {
+	return nil, ErrReadOnly
+}
+
+// Get the IndexElement for given set of values
+// with `Labels` indexes, the series should have exactly the same labels
+func (idx *SIndex) Get(vals []string) (el *kdb.IndexElement, err error) {
+	if idx.Labels {
+		if vals, err = mindex.Labels(vals); err != nil {
+			return nil, err
+		}
+	}
+
+	i, err := idx.search(vals, false)
+	if err != nil || i == idx.count {
+		return nil, err
+	}
+
+	r, err := idx.series(i)
+	if err != nil {
+		return nil, err
+	}
+
+	if cmp, err := r.compare(vals, false); err != nil || cmp != 0 {
+		return nil, err
+	}
+
+	return r.element()
+}
+
+// Find IndexElements matching the given set of values, empty values match
+// any value. With `Labels` indexes, series having all given labels match.
+func (idx *SIndex) Find(vals []string) (els []*kdb.IndexElement, err error) {
+	if idx.Labels {
+		return idx.findLabels(vals)
+	}
+
+	// series with the same leading values are next to each other
+	prefix := vals
+	for i, v := range vals {
+		if v == "" {
+			prefix = vals[:i]
+			break
+		}
+	}
+
+	els = make([]*kdb.IndexElement, 0)
+
+	i, err := idx.search(prefix, true)
+	if err != nil {
+		return nil, err
+	}
+
+	for ; i < idx.count; i++ {
+		r, err := idx.series(i)
+		if err != nil {
+			return nil, err
+		}
+
+		if cmp, err := r.compare(prefix, true); err != nil {
+			return nil, err
+		} else if cmp != 0 {
+			break
+		}
+
+		el, err := r.element()
+		if err != nil {
+			return nil, err
+		}
+
+		if matches(el.Values, vals) {
+			els = append(els, el)
+		}
+	}
+
+	return els, nil
+}
+
+// Count returns the number of series in the index
+func (idx *SIndex) Count() (count int64) {
+	return idx.count
+}
+
+// Close unmaps the sealed index file data
+func (idx *SIndex) Close() (err error) {
+	if !idx.mmaped || idx.data == nil {
+		return nil
+	}
+
+	data := idx.data
+	idx.data = nil
+
+	return syscall.Munmap(data)
+}
+
+// findLabels returns series which have all given labels using series
+// numbers stored with the label with the least number of series
+func (idx *SIndex) findLabels(vals []string) (els []*kdb.IndexElement, err error) {
+	var query []string
+	for _, v := range vals {
+		if v != "" {
+			query = append(query, v)
+		}
+	}
+
+	labels, err := mindex.Labels(query)
+	if err != nil {
+		return nil, err
+	}
+
+	els = make([]*kdb.IndexElement, 0)
+
+	if len(labels) == 0 {
+		for i := int64(0); i < idx.count; i++ {
+			r, err := idx.series(i)
+			if err != nil {
+				return nil, err
+			}
+
+			el, err := r.element()
+			if err != nil {
+				return nil, err
+			}
+
+			els = append(els, el)
+		}
+
+		return els, nil
+	}
+
+	var smallest *reader
+	var size uint64
+
+	for _, l := range labels {
+		r, n, err := idx.label(l)
+		if err != nil {
+			return nil, err
+		} else if r == nil {
+			return els, nil
+		}
+
+		if smallest == nil || n < size {
+			smallest, size = r, n
+		}
+	}
+
+	for j := uint64(0); j < size; j++ {
+		n := smallest.uvarint()
+		if smallest.err != nil || n >= uint64(idx.count) {
+			return nil, ErrInvalidFile
+		}
+
+		r, err := idx.series(int64(n))
+		if err != nil {
+			return nil, err
+		}
+
+		el, err := r.element()
+		if err != nil {
+			return nil, err
+		}
+
+		if hasLabels(el.Values, labels) {
+			els = append(els, el)
+		}
+	}
+
+	return els, nil
+}
+
+// label returns a reader at the series numbers of the label and the number
+// of series. The reader is nil if the label is not available.
+func (idx *SIndex) label(l string) (r *reader, count uint64, err error) {
+	var searchErr error
+
+	i := sort.Search(int(idx.labels), func(i int) bool {
+		r, err := idx.at(idx.count + int64(i))
+		if err != nil {
+			searchErr = err
+			return true
+		}
+
+		// the conversion does not copy the label
+		return string(r.bytes()) >= l
+	})
+
+	if searchErr != nil {
+		return nil, 0, searchErr
+	} else if int64(i) == idx.labels {
+		return nil, 0, nil
+	}
+
+	rd, err := idx.at(idx.count + int64(i))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if string(rd.bytes()) != l {
+		return nil, 0, nil
+	}
+
+	count = rd.uvarint()
+	if rd.err != nil {
+		return nil, 0, rd.err
+	}
+
+	return &rd, count, nil
+}
+
+// search returns the position of the first series with values not less
+// than `vals` (or the number of series). If `prefix` is set, series starting
+// with `vals` are considered equal to `vals`.
+func (idx *SIndex) search(vals []string, prefix bool) (i int64, err error) {
+	var searchErr error
+
+	n := sort.Search(int(idx.count), func(i int) bool {
+		r, err := idx.series(int64(i))
+		if err != nil {
+			searchErr = err
+			return true
+		}
+
+		cmp, err := r.compare(vals, prefix)
+		if err != nil {
+			searchErr = err
+			return true
+		}
+
+		return cmp >= 0
+	})
+
+	return int64(n), searchErr
+}
+
+// series returns a reader at the start of the series record
+func (idx *SIndex) series(i int64) (r reader, err error) {
+	return idx.at(i)
+}
+
+// at returns a reader at the record with the offset at position `i`
+// of the offsets table (series offsets are followed by label offsets)
+func (idx *SIndex) at(i int64) (r reader, err error) {
+	if idx.data == nil {
+		return r, ErrInvalidFile
+	}
+
+	off := binary.LittleEndian.Uint64(idx.data[HeaderSize+8*i:])
+	if off < HeaderSize || off >= uint64(len(idx.data)) {
+		return r, ErrInvalidFile
+	}
+
+	return reader{data: idx.data, pos: int(off)}, nil
+}
+
+// compare compares index values in order, shorter values are smaller
+// if the other values start with them
+func compare(a, b []string) (cmp int) {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+
+			return 1
+		}
+	}
+
+	return len(a) - len(b)
+}
+
+// matches checks whether values match the query, empty values match any value
+func matches(vals, query []string) (ok bool) {
+	if len(vals) < len(query) {
+		return false
+	}
+
+	for i, q := range query {
+		if q != "" && q != vals[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hasLabels checks whether sorted labels have all sorted query labels
+func hasLabels(labels, query []string) (ok bool) {
+	i := 0
+	for _, q := range query {
+		for i < len(labels) && labels[i] < q {
+			i++
+		}
+
+		if i == len(labels) || labels[i] != q {
+			return false
+		}
+	}
+
+	return true
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
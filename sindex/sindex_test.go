@@ -0,0 +1,316 @@
+package sindex
+
+import (
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/meteorhacks/kdb"
+	"github.com/meteorhacks/kdb/mindex"
+)
+
+func TestSIndex(t *testing.T) {
+	defer os.Remove("/tmp/test-sindex-source")
+	defer os.Remove("/tmp/test-sindex")
+
+	idx, err := mindex.NewMIndex(mindex.MIndexOpts{
+		FilePath:   "/tmp/test-sindex-source",
+		IndexDepth: 3,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer idx.Close()
+
+	// random series with a few values in each level
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		vals := make([]string, 3)
+		for j := range vals {
+			vals[j] = "v" + strconv.Itoa(rnd.Intn(8))
+		}
+
+		if _, err := idx.Add(vals, int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sealed := createTestSIndex(t, idx, Options{FilePath: "/tmp/test-sindex", IndexSize: 100})
+	defer sealed.Close()
+
+	// results should be the same as results from the index
+	queries := [][]string{
+		{"", "", ""},
+		{"v1", "", ""},
+		{"v1", "v2", ""},
+		{"v1", "v2", "v3"},
+		{"", "v2", ""},
+		{"v1", "", "v3"},
+		{"", "", "v3"},
+		{"v1"},
+		{"v9", "", ""},
+		{"v1", "v9", "v3"},
+	}
+
+	for _, q := range queries {
+		exp, err := idx.Find(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := sealed.Find(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !sameElements(res, exp) {
+			t.Fatal("should return correct elements", q)
+		}
+
+		if len(q) != 3 || q[0] == "" || q[1] == "" || q[2] == "" {
+			continue
+		}
+
+		el, err := sealed.Get(q)
+		if err != nil {
+			t.Fatal(err)
+		} else if (el == nil) != (len(exp) == 0) {
+			t.Fatal("should return correct element", q)
+		} else if el != nil && (el.Position != exp[0].Position || !reflect.DeepEqual(el.Values, q)) {
+			t.Fatal("should return correct element", q)
+		}
+	}
+
+	if el, err := sealed.Get([]string{"v1", "v2"}); err != nil || el != nil {
+		t.Fatal("should not return an element")
+	}
+
+	if sealed.Count() != idx.Count() {
+		t.Fatal("should return correct number of series")
+	}
+
+	if _, err := sealed.Add([]string{"a", "b", "c"}, 1); err != ErrReadOnly {
+		t.Fatal("should return correct error")
+	}
+
+	// sealed indexes created with a different index are not used
+	if _, err := New(Options{FilePath: "/tmp/test-sindex", IndexSize: 200}); err != ErrStale {
+		t.Fatal("should return correct error")
+	}
+
+	if _, err := New(Options{FilePath: "/tmp/test-sindex", IndexSize: 100, Labels: true}); err != ErrInvalidFile {
+		t.Fatal("should return correct error")
+	}
+
+	if _, err := NewFromData(Options{IndexSize: 100}, []byte("invalid")); err != ErrInvalidFile {
+		t.Fatal("should return correct error")
+	}
+}
+
+func TestSIndexLabels(t *testing.T) {
+	defer os.Remove("/tmp/test-sindex-source")
+	defer os.Remove("/tmp/test-sindex")
+
+	idx, err := mindex.NewMIndex(mindex.MIndexOpts{
+		FilePath: "/tmp/test-sindex-source",
+		Labels:   true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer idx.Close()
+
+	// random series with a random number of labels
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		var labels []string
+		for _, name := range []string{"app", "host", "zone", "env"} {
+			if rnd.Intn(3) != 0 {
+				labels = append(labels, name+"="+strconv.Itoa(rnd.Intn(5)))
+			}
+		}
+
+		if len(labels) == 0 {
+			continue
+		}
+
+		if _, err := idx.Add(labels, int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sealed := createTestSIndex(t, idx, Options{FilePath: "/tmp/test-sindex", IndexSize: 100, Labels: true})
+	defer sealed.Close()
+
+	queries := [][]string{
+		{},
+		{"app=1"},
+		{"zone=2", "app=1"},
+		{"host=3", "", "env=0"},
+		{"app=1", "host=1", "zone=1", "env=1"},
+		{"app=9"},
+		{"region=1"},
+	}
+
+	for _, q := range queries {
+		exp, err := idx.Find(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := sealed.Find(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !sameElements(res, exp) {
+			t.Fatal("should return correct elements", q)
+		}
+
+		for _, el := range exp {
+			// labels can be given in any order
+			labels := append([]string(nil), el.Values...)
+			rnd.Shuffle(len(labels), func(i, j int) { labels[i], labels[j] = labels[j], labels[i] })
+
+			res, err := sealed.Get(labels)
+			if err != nil {
+				t.Fatal(err)
+			} else if res == nil || res.Position != el.Position {
+				t.Fatal("should return correct element", labels)
+			}
+		}
+	}
+
+	if _, err := sealed.Find([]string{"app"}); err != mindex.ErrInvalidLabel {
+		t.Fatal("should return correct error")
+	}
+}
+
+// BenchmarkSIndexOpen opens a sealed index with 10000 series
+// compare with BenchmarkSIndexOpenMIndex which loads the index file
+func BenchmarkSIndexOpen(b *testing.B) {
+	defer os.Remove("/tmp/test-sindex-source")
+	defer os.Remove("/tmp/test-sindex")
+
+	createBenchSIndex(b).Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sealed, err := New(Options{FilePath: "/tmp/test-sindex"})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		sealed.Close()
+	}
+}
+
+func BenchmarkSIndexOpenMIndex(b *testing.B) {
+	defer os.Remove("/tmp/test-sindex-source")
+	defer os.Remove("/tmp/test-sindex")
+
+	createBenchSIndex(b).Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx, err := mindex.NewMIndex(mindex.MIndexOpts{
+			FilePath:   "/tmp/test-sindex-source",
+			IndexDepth: 4,
+			ReadOnly:   true,
+		})
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		idx.Close()
+	}
+}
+
+func BenchmarkSIndexGet(b *testing.B) {
+	defer os.Remove("/tmp/test-sindex-source")
+	defer os.Remove("/tmp/test-sindex")
+
+	sealed := createBenchSIndex(b)
+	defer sealed.Close()
+
+	vals := []string{"a", "b50", "c", "d5050"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if el, err := sealed.Get(vals); err != nil || el == nil {
+			b.Fatal("should return an element")
+		}
+	}
+}
+
+// createBenchSIndex creates an index file and a sealed index with 10000
+// series, the index file is trimmed (like an index of a sealed bucket)
+func createBenchSIndex(b *testing.B) (sealed *SIndex) {
+	idx, err := mindex.NewMIndex(mindex.MIndexOpts{
+		FilePath:   "/tmp/test-sindex-source",
+		IndexDepth: 4,
+	})
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer idx.Close()
+
+	for i := 0; i < 10000; i++ {
+		vals := []string{"a", "b" + strconv.Itoa(i%100), "c", "d" + strconv.Itoa(i)}
+		if _, err := idx.Add(vals, int64(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	if err := idx.Trim(); err != nil {
+		b.Fatal(err)
+	}
+
+	return createTestSIndex(b, idx, Options{FilePath: "/tmp/test-sindex"})
+}
+
+func createTestSIndex(t testing.TB, idx *mindex.MIndex, opts Options) (sealed *SIndex) {
+	els, err := idx.Find(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Write(opts, els); err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err = New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sealed
+}
+
+// sameElements checks whether elements have the same values and positions
+func sameElements(a, b []*kdb.IndexElement) (ok bool) {
+	if len(a) != len(b) {
+		return false
+	}
+
+	sorted := func(els []*kdb.IndexElement) (res []kdb.IndexElement) {
+		for _, el := range els {
+			res = append(res, *el)
+		}
+
+		sort.Slice(res, func(i, j int) bool { return res[i].Position < res[j].Position })
+		return res
+	}
+
+	return reflect.DeepEqual(sorted(a), sorted(b))
+}